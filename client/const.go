@@ -35,6 +35,11 @@ const (
 	authCommand            = "auth"
 	statsCommand           = "stats"
 	getCoordinateCommand   = "get-coordinate"
+	sendCommand            = "send"
+	kvGetCommand           = "kv-get"
+	kvSetCommand           = "kv-set"
+	kvDeleteCommand        = "kv-delete"
+	kvListCommand          = "kv-list"
 )
 
 const (
@@ -48,6 +53,8 @@ const (
 	invalidQueryID        = "No pending queries matching ID"
 	authRequired          = "Authentication required"
 	invalidAuthToken      = "Invalid authentication token"
+	permissionDenied      = "Permission denied"
+	eventThrottled        = "User event throttled"
 )
 
 const (
@@ -91,6 +98,33 @@ type eventRequest struct {
 	Coalesce bool
 }
 
+type sendRequest struct {
+	Node    string
+	Payload []byte
+}
+
+type kvRequest struct {
+	Key string
+}
+
+type kvSetRequest struct {
+	Key   string
+	Value []byte
+}
+
+type kvResponse struct {
+	Value []byte
+	Ok    bool
+}
+
+type kvListRequest struct {
+	Prefix string
+}
+
+type kvListResponse struct {
+	Values map[string][]byte
+}
+
 type forceLeaveRequest struct {
 	Node  string
 	Prune bool
@@ -109,6 +143,7 @@ type membersFilteredRequest struct {
 	Tags   map[string]string
 	Status string
 	Name   string
+	Filter string
 }
 
 type membersResponse struct {
@@ -129,6 +164,7 @@ type keyResponse struct {
 
 type monitorRequest struct {
 	LogLevel string
+	LogJSON  bool
 }
 
 type streamRequest struct {
@@ -145,36 +181,58 @@ type tagsRequest struct {
 }
 
 type queryRequest struct {
-	FilterNodes []string
-	FilterTags  map[string]string
-	RequestAck  bool
-	RelayFactor uint8
-	Timeout     time.Duration
-	Name        string
-	Payload     []byte
+	FilterNodes   []string
+	FilterTags    map[string]string
+	FilterExpr    string
+	RequestAck    bool
+	RelayFactor   uint8
+	Timeout       time.Duration
+	SampleSize    int
+	SamplePercent float64
+	MultiResponse bool
+	Name          string
+	Payload       []byte
 }
 
 type respondRequest struct {
 	ID      uint64
 	Payload []byte
+	Partial bool
 }
 
 type queryRecord struct {
 	Type    string
 	From    string
 	Payload []byte
+	Seq     uint32
+	Partial bool
 }
 
 // NodeResponse is used to return the response of a query
 type NodeResponse struct {
 	From    string
 	Payload []byte
+
+	// Seq and Partial are set for queries that allow multiple responses.
+	// Seq numbers the responses of each node in order, and Partial is
+	// set on all but the last response of a node.
+	Seq     uint32
+	Partial bool
 }
 
 type logRecord struct {
 	Log string
 }
 
+// LogEntry is a structured log record streamed by MonitorJSON
+type LogEntry struct {
+	Timestamp time.Time `json:"timestamp"`
+	Level     string    `json:"level"`
+	Subsystem string    `json:"subsystem,omitempty"`
+	Message   string    `json:"message"`
+	Node      string    `json:"node"`
+}
+
 // Member is used to represent a single member of the
 // Serf cluster
 type Member struct {
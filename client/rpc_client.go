@@ -5,9 +5,13 @@ package client
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"log"
 	"net"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -20,10 +24,22 @@ import (
 const (
 	// This is the default IO timeout for the client
 	DefaultTimeout = 10 * time.Second
+
+	// unixSocketPrefix is used to provide a Unix domain socket path
+	// instead of a TCP address
+	unixSocketPrefix = "unix://"
 )
 
 var (
 	errClientClosed = errors.New("client closed")
+
+	// ErrPermissionDenied is returned when the token used to authenticate
+	// with the agent does not allow the command.
+	ErrPermissionDenied = errors.New(permissionDenied)
+
+	// ErrEventThrottled is returned when a user event is over the rate
+	// limits configured on the agent.
+	ErrEventThrottled = errors.New(eventThrottled)
 )
 
 type seqCallback struct {
@@ -44,7 +60,8 @@ type seqHandler interface {
 // Config is provided to ClientFromConfig to make
 // a new RPCClient from the given configuration
 type Config struct {
-	// Addr must be the RPC address to contact
+	// Addr must be the RPC address to contact. This is either a TCP
+	// host:port, or a Unix domain socket path prefixed with unix://
 	Addr string
 
 	// If provided, the client will perform key based auth
@@ -59,6 +76,10 @@ type Config struct {
 	// go-msgpack v1.1.5 by default). Decoding is not affected, as all
 	// go-msgpack v2.1.0+ decoders know how to decode both formats.
 	MsgpackUseNewTimeFormat bool
+
+	// If provided, the client will connect to the agent using TLS. If
+	// the ServerName is not set, it is derived from Addr.
+	TLSConfig *tls.Config
 }
 
 // RPCClient is used to make requests to the Agent using an RPC mechanism.
@@ -68,7 +89,7 @@ type RPCClient struct {
 	seq uint64
 
 	timeout   time.Duration
-	conn      *net.TCPConn
+	conn      net.Conn
 	reader    *bufio.Reader
 	writer    *bufio.Writer
 	dec       *codec.Decoder
@@ -144,7 +165,18 @@ func ClientFromConfig(c *Config) (*RPCClient, error) {
 	}
 
 	// Try to dial to serf
-	conn, err := net.DialTimeout("tcp", c.Addr, c.Timeout)
+	var conn net.Conn
+	var err error
+	network, addr := "tcp", c.Addr
+	if path, ok := strings.CutPrefix(c.Addr, unixSocketPrefix); ok {
+		network, addr = "unix", path
+	}
+	dialer := &net.Dialer{Timeout: c.Timeout}
+	if c.TLSConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, network, addr, c.TLSConfig)
+	} else {
+		conn, err = dialer.Dial(network, addr)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -153,7 +185,7 @@ func ClientFromConfig(c *Config) (*RPCClient, error) {
 	client := &RPCClient{
 		seq:        0,
 		timeout:    c.Timeout,
-		conn:       conn.(*net.TCPConn),
+		conn:       conn,
 		reader:     bufio.NewReader(conn),
 		writer:     bufio.NewWriter(conn),
 		dispatch:   make(map[uint64]seqHandler),
@@ -206,6 +238,12 @@ func (c *RPCClient) Close() error {
 // ForceLeave is used to ask the agent to issue a leave command for
 // a given node
 func (c *RPCClient) ForceLeave(node string) error {
+	return c.ForceLeaveContext(context.Background(), node)
+}
+
+// ForceLeaveContext is like ForceLeave, but returns once the context is done without
+// waiting for the agent to finish the request.
+func (c *RPCClient) ForceLeaveContext(ctx context.Context, node string) error {
 	header := requestHeader{
 		Command: forceLeaveCommand,
 		Seq:     c.getSeq(),
@@ -214,12 +252,18 @@ func (c *RPCClient) ForceLeave(node string) error {
 		Node:  node,
 		Prune: false,
 	}
-	return c.genericRPC(&header, &req, nil)
+	return c.genericRPCContext(ctx, &header, &req, nil)
 }
 
 // ForceLeavePrune uses ForceLeave but is used to reap the
 // node entirely
 func (c *RPCClient) ForceLeavePrune(node string) error {
+	return c.ForceLeavePruneContext(context.Background(), node)
+}
+
+// ForceLeavePruneContext is like ForceLeavePrune, but returns once the context is done without
+// waiting for the agent to finish the request.
+func (c *RPCClient) ForceLeavePruneContext(ctx context.Context, node string) error {
 	header := requestHeader{
 		Command: forceLeaveCommand,
 		Seq:     c.getSeq(),
@@ -228,11 +272,17 @@ func (c *RPCClient) ForceLeavePrune(node string) error {
 		Node:  node,
 		Prune: true,
 	}
-	return c.genericRPC(&header, &req, nil)
+	return c.genericRPCContext(ctx, &header, &req, nil)
 }
 
 // Join is used to instruct the agent to attempt a join
 func (c *RPCClient) Join(addrs []string, replay bool) (int, error) {
+	return c.JoinContext(context.Background(), addrs, replay)
+}
+
+// JoinContext is like Join, but returns once the context is done without
+// waiting for the agent to finish the request.
+func (c *RPCClient) JoinContext(ctx context.Context, addrs []string, replay bool) (int, error) {
 	header := requestHeader{
 		Command: joinCommand,
 		Seq:     c.getSeq(),
@@ -243,42 +293,85 @@ func (c *RPCClient) Join(addrs []string, replay bool) (int, error) {
 	}
 	var resp joinResponse
 
-	err := c.genericRPC(&header, &req, &resp)
+	err := c.genericRPCContext(ctx, &header, &req, &resp)
 	return int(resp.Num), err
 }
 
 // Members is used to fetch a list of known members
 func (c *RPCClient) Members() ([]Member, error) {
+	return c.MembersContext(context.Background())
+}
+
+// MembersContext is like Members, but returns once the context is done without
+// waiting for the agent to finish the request.
+func (c *RPCClient) MembersContext(ctx context.Context) ([]Member, error) {
 	header := requestHeader{
 		Command: membersCommand,
 		Seq:     c.getSeq(),
 	}
 	var resp membersResponse
 
-	err := c.genericRPC(&header, nil, &resp)
+	err := c.genericRPCContext(ctx, &header, nil, &resp)
 	return resp.Members, err
 }
 
 // MembersFiltered returns a subset of members
 func (c *RPCClient) MembersFiltered(tags map[string]string, status string,
 	name string) ([]Member, error) {
+	return c.MembersFilteredContext(context.Background(), tags, status, name)
+}
+
+// MembersFilteredContext is like MembersFiltered, but returns once the context is done without
+// waiting for the agent to finish the request.
+func (c *RPCClient) MembersFilteredContext(ctx context.Context, tags map[string]string, status string,
+	name string) ([]Member, error) {
+	return c.MembersWithFilterContext(ctx, &MembersFilter{
+		Tags:   tags,
+		Status: status,
+		Name:   name,
+	})
+}
+
+// MembersFilter is used to select the members returned by MembersWithFilter
+type MembersFilter struct {
+	Tags   map[string]string // A map of tag name to regex to filter on
+	Status string            // A regex to filter the member status on
+	Name   string            // A regex to filter the member name on
+	Expr   string            // A tag filter expression
+}
+
+// MembersWithFilter returns the members matching all the given filters
+func (c *RPCClient) MembersWithFilter(filter *MembersFilter) ([]Member, error) {
+	return c.MembersWithFilterContext(context.Background(), filter)
+}
+
+// MembersWithFilterContext is like MembersWithFilter, but returns once the context is done without
+// waiting for the agent to finish the request.
+func (c *RPCClient) MembersWithFilterContext(ctx context.Context, filter *MembersFilter) ([]Member, error) {
 	header := requestHeader{
 		Command: membersFilteredCommand,
 		Seq:     c.getSeq(),
 	}
 	req := membersFilteredRequest{
-		Tags:   tags,
-		Status: status,
-		Name:   name,
+		Tags:   filter.Tags,
+		Status: filter.Status,
+		Name:   filter.Name,
+		Filter: filter.Expr,
 	}
 	var resp membersResponse
 
-	err := c.genericRPC(&header, &req, &resp)
+	err := c.genericRPCContext(ctx, &header, &req, &resp)
 	return resp.Members, err
 }
 
 // UserEvent is used to trigger sending an event
 func (c *RPCClient) UserEvent(name string, payload []byte, coalesce bool) error {
+	return c.UserEventContext(context.Background(), name, payload, coalesce)
+}
+
+// UserEventContext is like UserEvent, but returns once the context is done without
+// waiting for the agent to finish the request.
+func (c *RPCClient) UserEventContext(ctx context.Context, name string, payload []byte, coalesce bool) error {
 	header := requestHeader{
 		Command: eventCommand,
 		Seq:     c.getSeq(),
@@ -288,20 +381,52 @@ func (c *RPCClient) UserEvent(name string, payload []byte, coalesce bool) error
 		Payload:  payload,
 		Coalesce: coalesce,
 	}
-	return c.genericRPC(&header, &req, nil)
+	return c.genericRPCContext(ctx, &header, &req, nil)
+}
+
+// SendToMember sends a payload to a single member of the cluster, which
+// receives it as a direct-message event
+func (c *RPCClient) SendToMember(node string, payload []byte) error {
+	return c.SendToMemberContext(context.Background(), node, payload)
+}
+
+// SendToMemberContext is like SendToMember, but returns once the context is
+// done without waiting for the agent to finish the request.
+func (c *RPCClient) SendToMemberContext(ctx context.Context, node string, payload []byte) error {
+	header := requestHeader{
+		Command: sendCommand,
+		Seq:     c.getSeq(),
+	}
+	req := sendRequest{
+		Node:    node,
+		Payload: payload,
+	}
+	return c.genericRPCContext(ctx, &header, &req, nil)
 }
 
 // Leave is used to trigger a graceful leave and shutdown of the agent
 func (c *RPCClient) Leave() error {
+	return c.LeaveContext(context.Background())
+}
+
+// LeaveContext is like Leave, but returns once the context is done without
+// waiting for the agent to finish the request.
+func (c *RPCClient) LeaveContext(ctx context.Context) error {
 	header := requestHeader{
 		Command: leaveCommand,
 		Seq:     c.getSeq(),
 	}
-	return c.genericRPC(&header, nil, nil)
+	return c.genericRPCContext(ctx, &header, nil, nil)
 }
 
 // UpdateTags will modify the tags on a running serf agent
 func (c *RPCClient) UpdateTags(tags map[string]string, delTags []string) error {
+	return c.UpdateTagsContext(context.Background(), tags, delTags)
+}
+
+// UpdateTagsContext is like UpdateTags, but returns once the context is done without
+// waiting for the agent to finish the request.
+func (c *RPCClient) UpdateTagsContext(ctx context.Context, tags map[string]string, delTags []string) error {
 	header := requestHeader{
 		Command: tagsCommand,
 		Seq:     c.getSeq(),
@@ -310,12 +435,18 @@ func (c *RPCClient) UpdateTags(tags map[string]string, delTags []string) error {
 		Tags:       tags,
 		DeleteTags: delTags,
 	}
-	return c.genericRPC(&header, &req, nil)
+	return c.genericRPCContext(ctx, &header, &req, nil)
 }
 
 // Respond allows a client to respond to a query event. The ID is the
 // ID of the Query to respond to, and the given payload is the response.
 func (c *RPCClient) Respond(id uint64, buf []byte) error {
+	return c.RespondContext(context.Background(), id, buf)
+}
+
+// RespondContext is like Respond, but returns once the context is done without
+// waiting for the agent to finish the request.
+func (c *RPCClient) RespondContext(ctx context.Context, id uint64, buf []byte) error {
 	header := requestHeader{
 		Command: respondCommand,
 		Seq:     c.getSeq(),
@@ -324,11 +455,38 @@ func (c *RPCClient) Respond(id uint64, buf []byte) error {
 		ID:      id,
 		Payload: buf,
 	}
-	return c.genericRPC(&header, &req, nil)
+	return c.genericRPCContext(ctx, &header, &req, nil)
+}
+
+// RespondPartial sends one of several responses to a query event that
+// allows multiple responses. The last response must be sent with Respond.
+func (c *RPCClient) RespondPartial(id uint64, buf []byte) error {
+	return c.RespondPartialContext(context.Background(), id, buf)
+}
+
+// RespondPartialContext is like RespondPartial, but returns once the context
+// is done without waiting for the agent to finish the request.
+func (c *RPCClient) RespondPartialContext(ctx context.Context, id uint64, buf []byte) error {
+	header := requestHeader{
+		Command: respondCommand,
+		Seq:     c.getSeq(),
+	}
+	req := respondRequest{
+		ID:      id,
+		Payload: buf,
+		Partial: true,
+	}
+	return c.genericRPCContext(ctx, &header, &req, nil)
 }
 
 // IntallKey installs a new encryption key onto the keyring
 func (c *RPCClient) InstallKey(key string) (map[string]string, error) {
+	return c.InstallKeyContext(context.Background(), key)
+}
+
+// InstallKeyContext is like InstallKey, but returns once the context is done without
+// waiting for the agent to finish the request.
+func (c *RPCClient) InstallKeyContext(ctx context.Context, key string) (map[string]string, error) {
 	header := requestHeader{
 		Command: installKeyCommand,
 		Seq:     c.getSeq(),
@@ -338,13 +496,19 @@ func (c *RPCClient) InstallKey(key string) (map[string]string, error) {
 	}
 
 	resp := keyResponse{}
-	err := c.genericRPC(&header, &req, &resp)
+	err := c.genericRPCContext(ctx, &header, &req, &resp)
 
 	return resp.Messages, err
 }
 
 // UseKey changes the primary encryption key on the keyring
 func (c *RPCClient) UseKey(key string) (map[string]string, error) {
+	return c.UseKeyContext(context.Background(), key)
+}
+
+// UseKeyContext is like UseKey, but returns once the context is done without
+// waiting for the agent to finish the request.
+func (c *RPCClient) UseKeyContext(ctx context.Context, key string) (map[string]string, error) {
 	header := requestHeader{
 		Command: useKeyCommand,
 		Seq:     c.getSeq(),
@@ -354,13 +518,19 @@ func (c *RPCClient) UseKey(key string) (map[string]string, error) {
 	}
 
 	resp := keyResponse{}
-	err := c.genericRPC(&header, &req, &resp)
+	err := c.genericRPCContext(ctx, &header, &req, &resp)
 
 	return resp.Messages, err
 }
 
 // RemoveKey changes the primary encryption key on the keyring
 func (c *RPCClient) RemoveKey(key string) (map[string]string, error) {
+	return c.RemoveKeyContext(context.Background(), key)
+}
+
+// RemoveKeyContext is like RemoveKey, but returns once the context is done without
+// waiting for the agent to finish the request.
+func (c *RPCClient) RemoveKeyContext(ctx context.Context, key string) (map[string]string, error) {
 	header := requestHeader{
 		Command: removeKeyCommand,
 		Seq:     c.getSeq(),
@@ -370,38 +540,56 @@ func (c *RPCClient) RemoveKey(key string) (map[string]string, error) {
 	}
 
 	resp := keyResponse{}
-	err := c.genericRPC(&header, &req, &resp)
+	err := c.genericRPCContext(ctx, &header, &req, &resp)
 
 	return resp.Messages, err
 }
 
 // ListKeys returns all of the active keys on each member of the cluster
 func (c *RPCClient) ListKeys() (map[string]int, int, map[string]string, error) {
+	return c.ListKeysContext(context.Background())
+}
+
+// ListKeysContext is like ListKeys, but returns once the context is done without
+// waiting for the agent to finish the request.
+func (c *RPCClient) ListKeysContext(ctx context.Context) (map[string]int, int, map[string]string, error) {
 	header := requestHeader{
 		Command: listKeysCommand,
 		Seq:     c.getSeq(),
 	}
 
 	resp := keyResponse{}
-	err := c.genericRPC(&header, nil, &resp)
+	err := c.genericRPCContext(ctx, &header, nil, &resp)
 
 	return resp.Keys, resp.NumNodes, resp.Messages, err
 }
 
 // Stats is used to get debugging state information
 func (c *RPCClient) Stats() (map[string]map[string]string, error) {
+	return c.StatsContext(context.Background())
+}
+
+// StatsContext is like Stats, but returns once the context is done without
+// waiting for the agent to finish the request.
+func (c *RPCClient) StatsContext(ctx context.Context) (map[string]map[string]string, error) {
 	header := requestHeader{
 		Command: statsCommand,
 		Seq:     c.getSeq(),
 	}
 	var resp map[string]map[string]string
 
-	err := c.genericRPC(&header, nil, &resp)
+	err := c.genericRPCContext(ctx, &header, nil, &resp)
 	return resp, err
 }
 
 // GetCoordinate is used to retrieve the cached coordinate of a node.
 func (c *RPCClient) GetCoordinate(node string) (*coordinate.Coordinate, error) {
+	return c.GetCoordinateContext(context.Background(), node)
+}
+
+// GetCoordinateContext is like GetCoordinate, but returns once the context is done without
+// waiting for the agent to finish the request.
+func (c *RPCClient) GetCoordinateContext(ctx context.Context, node string) (*coordinate.Coordinate, error) {
 	header := requestHeader{
 		Command: getCoordinateCommand,
 		Seq:     c.getSeq(),
@@ -411,7 +599,7 @@ func (c *RPCClient) GetCoordinate(node string) (*coordinate.Coordinate, error) {
 	}
 	var resp coordinateResponse
 
-	if err := c.genericRPC(&header, &req, &resp); err != nil {
+	if err := c.genericRPCContext(ctx, &header, &req, &resp); err != nil {
 		return nil, err
 	}
 	if resp.Ok {
@@ -420,22 +608,115 @@ func (c *RPCClient) GetCoordinate(node string) (*coordinate.Coordinate, error) {
 	return nil, nil
 }
 
+// KVGet returns the value of a key of the replicated key/value store, and
+// if the key is set.
+func (c *RPCClient) KVGet(key string) ([]byte, bool, error) {
+	return c.KVGetContext(context.Background(), key)
+}
+
+// KVGetContext is like KVGet, but returns once the context is done without
+// waiting for the agent to finish the request.
+func (c *RPCClient) KVGetContext(ctx context.Context, key string) ([]byte, bool, error) {
+	header := requestHeader{
+		Command: kvGetCommand,
+		Seq:     c.getSeq(),
+	}
+	req := kvRequest{
+		Key: key,
+	}
+	var resp kvResponse
+
+	if err := c.genericRPCContext(ctx, &header, &req, &resp); err != nil {
+		return nil, false, err
+	}
+	return resp.Value, resp.Ok, nil
+}
+
+// KVSet sets a key of the replicated key/value store
+func (c *RPCClient) KVSet(key string, value []byte) error {
+	return c.KVSetContext(context.Background(), key, value)
+}
+
+// KVSetContext is like KVSet, but returns once the context is done without
+// waiting for the agent to finish the request.
+func (c *RPCClient) KVSetContext(ctx context.Context, key string, value []byte) error {
+	header := requestHeader{
+		Command: kvSetCommand,
+		Seq:     c.getSeq(),
+	}
+	req := kvSetRequest{
+		Key:   key,
+		Value: value,
+	}
+	return c.genericRPCContext(ctx, &header, &req, nil)
+}
+
+// KVDelete deletes a key of the replicated key/value store
+func (c *RPCClient) KVDelete(key string) error {
+	return c.KVDeleteContext(context.Background(), key)
+}
+
+// KVDeleteContext is like KVDelete, but returns once the context is done
+// without waiting for the agent to finish the request.
+func (c *RPCClient) KVDeleteContext(ctx context.Context, key string) error {
+	header := requestHeader{
+		Command: kvDeleteCommand,
+		Seq:     c.getSeq(),
+	}
+	req := kvRequest{
+		Key: key,
+	}
+	return c.genericRPCContext(ctx, &header, &req, nil)
+}
+
+// KVList returns the keys of the replicated key/value store starting with
+// a prefix, along with their values.
+func (c *RPCClient) KVList(prefix string) (map[string][]byte, error) {
+	return c.KVListContext(context.Background(), prefix)
+}
+
+// KVListContext is like KVList, but returns once the context is done
+// without waiting for the agent to finish the request.
+func (c *RPCClient) KVListContext(ctx context.Context, prefix string) (map[string][]byte, error) {
+	header := requestHeader{
+		Command: kvListCommand,
+		Seq:     c.getSeq(),
+	}
+	req := kvListRequest{
+		Prefix: prefix,
+	}
+	var resp kvListResponse
+
+	if err := c.genericRPCContext(ctx, &header, &req, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Values, nil
+}
+
 type monitorHandler struct {
-	client *RPCClient
-	closed bool
-	init   bool
-	initCh chan<- error
-	logCh  chan<- string
-	seq    uint64
+	client  *RPCClient
+	closed  bool
+	init    bool
+	initCh  chan<- error
+	logCh   chan<- string
+	entryCh chan<- LogEntry
+	seq     uint64
+
+	// lock keeps Cleanup from closing the channels during a send, as
+	// Stop may be called while a log is handled
+	lock sync.Mutex
 }
 
 func (mh *monitorHandler) Handle(resp *responseHeader) {
 	// Initialize on the first response
+	mh.lock.Lock()
 	if !mh.init {
+		defer mh.lock.Unlock()
 		mh.init = true
 		mh.initCh <- strToError(resp.Error)
 		return
 	}
+	mh.lock.Unlock()
 
 	// Decode logs for all other responses
 	var rec logRecord
@@ -444,6 +725,27 @@ func (mh *monitorHandler) Handle(resp *responseHeader) {
 		mh.client.deregisterHandler(mh.seq)
 		return
 	}
+
+	mh.lock.Lock()
+	defer mh.lock.Unlock()
+	if mh.closed {
+		return
+	}
+
+	if mh.entryCh != nil {
+		// Fall back to the raw line if the agent didn't send JSON
+		var entry LogEntry
+		if err := json.Unmarshal([]byte(rec.Log), &entry); err != nil {
+			entry = LogEntry{Message: rec.Log}
+		}
+		select {
+		case mh.entryCh <- entry:
+		default:
+			log.Printf("[ERR] Dropping log! Monitor channel full")
+		}
+		return
+	}
+
 	select {
 	case mh.logCh <- rec.Log:
 	default:
@@ -452,6 +754,8 @@ func (mh *monitorHandler) Handle(resp *responseHeader) {
 }
 
 func (mh *monitorHandler) Cleanup() {
+	mh.lock.Lock()
+	defer mh.lock.Unlock()
 	if !mh.closed {
 		if !mh.init {
 			mh.init = true
@@ -460,34 +764,49 @@ func (mh *monitorHandler) Cleanup() {
 		if mh.logCh != nil {
 			close(mh.logCh)
 		}
+		if mh.entryCh != nil {
+			close(mh.entryCh)
+		}
 		mh.closed = true
 	}
 }
 
 // Monitor is used to subscribe to the logs of the agent
 func (c *RPCClient) Monitor(level logutils.LogLevel, ch chan<- string) (StreamHandle, error) {
+	req := monitorRequest{
+		LogLevel: string(level),
+	}
+	return c.monitor(&req, &monitorHandler{logCh: ch})
+}
+
+// MonitorJSON is used to subscribe to the logs of the agent as
+// structured log entries
+func (c *RPCClient) MonitorJSON(level logutils.LogLevel, ch chan<- LogEntry) (StreamHandle, error) {
+	req := monitorRequest{
+		LogLevel: string(level),
+		LogJSON:  true,
+	}
+	return c.monitor(&req, &monitorHandler{entryCh: ch})
+}
+
+// monitor starts a monitor using the given request and handler
+func (c *RPCClient) monitor(req *monitorRequest, handler *monitorHandler) (StreamHandle, error) {
 	// Setup the request
 	seq := c.getSeq()
 	header := requestHeader{
 		Command: monitorCommand,
 		Seq:     seq,
 	}
-	req := monitorRequest{
-		LogLevel: string(level),
-	}
 
-	// Create a monitor handler
+	// Setup the monitor handler
 	initCh := make(chan error, 1)
-	handler := &monitorHandler{
-		client: c,
-		initCh: initCh,
-		logCh:  ch,
-		seq:    seq,
-	}
+	handler.client = c
+	handler.initCh = initCh
+	handler.seq = seq
 	c.handleSeq(seq, handler)
 
 	// Send the request
-	if err := c.send(&header, &req); err != nil {
+	if err := c.send(&header, req); err != nil {
 		c.deregisterHandler(seq)
 		return 0, err
 	}
@@ -592,22 +911,44 @@ type queryHandler struct {
 	ackCh  chan<- string
 	respCh chan<- NodeResponse
 	seq    uint64
+
+	// lock serializes the handler with cancelling the query, which
+	// closes the channels before the query is done
+	lock       sync.Mutex
+	stopCancel func() bool
 }
 
 func (qh *queryHandler) Handle(resp *responseHeader) {
+	qh.lock.Lock()
+	done := qh.handle(resp)
+	qh.lock.Unlock()
+
+	if done {
+		qh.client.deregisterHandler(qh.seq)
+	}
+}
+
+// handle processes a response, returning if no further records are coming
+func (qh *queryHandler) handle(resp *responseHeader) bool {
 	// Initialize on the first response
 	if !qh.init {
 		qh.init = true
-		qh.initCh <- strToError(resp.Error)
-		return
+		if !qh.closed {
+			qh.initCh <- strToError(resp.Error)
+		}
+		return false
 	}
 
 	// Decode the query response
 	var rec queryRecord
 	if err := qh.client.dec.Decode(&rec); err != nil {
 		log.Printf("[ERR] Failed to decode query response: %v", err)
-		qh.client.deregisterHandler(qh.seq)
-		return
+		return true
+	}
+
+	// Records are still read after the query was cancelled, but dropped
+	if qh.closed {
+		return rec.Type == queryRecordDone
 	}
 
 	switch rec.Type {
@@ -620,24 +961,38 @@ func (qh *queryHandler) Handle(resp *responseHeader) {
 
 	case queryRecordResponse:
 		select {
-		case qh.respCh <- NodeResponse{rec.From, rec.Payload}:
+		case qh.respCh <- NodeResponse{From: rec.From, Payload: rec.Payload, Seq: rec.Seq, Partial: rec.Partial}:
 		default:
 			log.Printf("[ERR] Dropping query response, channel full")
 		}
 
 	case queryRecordDone:
 		// No further records coming
-		qh.client.deregisterHandler(qh.seq)
+		return true
 
 	default:
 		log.Printf("[ERR] Unrecognized query record type: %s", rec.Type)
 	}
+	return false
 }
 
 func (qh *queryHandler) Cleanup() {
+	qh.lock.Lock()
+	defer qh.lock.Unlock()
+	qh.cleanup()
+}
+
+// cancel closes the channels of a query that is still running. The
+// handler stays registered to read the remaining records.
+func (qh *queryHandler) cancel() {
+	qh.lock.Lock()
+	defer qh.lock.Unlock()
+	qh.cleanup()
+}
+
+func (qh *queryHandler) cleanup() {
 	if !qh.closed {
 		if !qh.init {
-			qh.init = true
 			qh.initCh <- errors.New("Stream closed")
 		}
 		if qh.ackCh != nil {
@@ -646,21 +1001,28 @@ func (qh *queryHandler) Cleanup() {
 		if qh.respCh != nil {
 			close(qh.respCh)
 		}
+		if qh.stopCancel != nil {
+			qh.stopCancel()
+		}
 		qh.closed = true
 	}
 }
 
 // QueryParam is provided to query set various settings.
 type QueryParam struct {
-	FilterNodes []string            // A list of node names to restrict query to
-	FilterTags  map[string]string   // A map of tag name to regex to filter on
-	RequestAck  bool                // Should nodes ack the query receipt
-	RelayFactor uint8               // Duplicate response count to be relayed back to sender for redundancy.
-	Timeout     time.Duration       // Maximum query duration. Optional, will be set automatically.
-	Name        string              // Opaque query name
-	Payload     []byte              // Opaque query payload
-	AckCh       chan<- string       // Channel to send Ack replies on
-	RespCh      chan<- NodeResponse // Channel to send responses on
+	FilterNodes   []string            // A list of node names to restrict query to
+	FilterTags    map[string]string   // A map of tag name to regex to filter on
+	FilterExpr    string              // A tag filter expression, requires protocol version 6
+	RequestAck    bool                // Should nodes ack the query receipt
+	RelayFactor   uint8               // Duplicate response count to be relayed back to sender for redundancy.
+	Timeout       time.Duration       // Maximum query duration. Optional, will be set automatically.
+	SampleSize    int                 // Restrict the query to a random sample of this many matching nodes
+	SamplePercent float64             // Restrict the query to a random percentage of the matching nodes
+	MultiResponse bool                // Allow nodes to send multiple responses, requires protocol version 6
+	Name          string              // Opaque query name
+	Payload       []byte              // Opaque query payload
+	AckCh         chan<- string       // Channel to send Ack replies on
+	RespCh        chan<- NodeResponse // Channel to send responses on
 }
 
 // Query initiates a new query message using the given parameters, and streams
@@ -668,6 +1030,17 @@ type QueryParam struct {
 // sends and should be buffered. At the end of the query, the channels will be
 // closed.
 func (c *RPCClient) Query(params *QueryParam) error {
+	return c.QueryContext(context.Background(), params)
+}
+
+// QueryContext is like Query, but the channels are closed early once the
+// context is done. The query keeps running on the agent until its timeout,
+// so the timeout should be set if the context has a deadline.
+func (c *RPCClient) QueryContext(ctx context.Context, params *QueryParam) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	// Setup the request
 	seq := c.getSeq()
 	header := requestHeader{
@@ -675,13 +1048,17 @@ func (c *RPCClient) Query(params *QueryParam) error {
 		Seq:     seq,
 	}
 	req := queryRequest{
-		FilterNodes: params.FilterNodes,
-		FilterTags:  params.FilterTags,
-		RequestAck:  params.RequestAck,
-		RelayFactor: params.RelayFactor,
-		Timeout:     params.Timeout,
-		Name:        params.Name,
-		Payload:     params.Payload,
+		FilterNodes:   params.FilterNodes,
+		FilterTags:    params.FilterTags,
+		FilterExpr:    params.FilterExpr,
+		RequestAck:    params.RequestAck,
+		RelayFactor:   params.RelayFactor,
+		Timeout:       params.Timeout,
+		SampleSize:    params.SampleSize,
+		SamplePercent: params.SamplePercent,
+		MultiResponse: params.MultiResponse,
+		Name:          params.Name,
+		Payload:       params.Payload,
 	}
 
 	// Create a query handler
@@ -702,13 +1079,29 @@ func (c *RPCClient) Query(params *QueryParam) error {
 	}
 
 	// Wait for a response
+	var err error
 	select {
-	case err := <-initCh:
-		return err
+	case err = <-initCh:
 	case <-c.shutdownCh:
 		c.deregisterHandler(seq)
 		return errClientClosed
+	case <-ctx.Done():
+		handler.cancel()
+		return ctx.Err()
 	}
+	if err != nil {
+		return err
+	}
+
+	// Close the channels if the context is done before the query
+	if ctx.Done() != nil {
+		handler.lock.Lock()
+		if !handler.closed {
+			handler.stopCancel = context.AfterFunc(ctx, handler.cancel)
+		}
+		handler.lock.Unlock()
+	}
+	return nil
 }
 
 // Stop is used to unsubscribe from logs or event streams
@@ -753,46 +1146,92 @@ func (c *RPCClient) auth(authKey string) error {
 // genericRPC is used to send a request and wait for an
 // errorSequenceResponse, potentially returning an error
 func (c *RPCClient) genericRPC(header *requestHeader, req any, resp any) error {
+	return c.genericRPCContext(context.Background(), header, req, resp)
+}
+
+// genericRPCContext is like genericRPC, but stops waiting for the response
+// once the context is done. The response is still read when it arrives,
+// so the connection stays usable.
+func (c *RPCClient) genericRPCContext(ctx context.Context, header *requestHeader, req any, resp any) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	// Setup a response handler
+	var lock sync.Mutex
+	abandoned := false
 	errCh := make(chan error, 1)
 	handler := func(respHeader *responseHeader) {
+		lock.Lock()
+		defer lock.Unlock()
+
 		// If we get an auth error, we should not wait for a request body
-		if respHeader.Error == authRequired {
-			goto SEND_ERR
+		hasBody := resp != nil &&
+			respHeader.Error != authRequired && respHeader.Error != permissionDenied
+
+		// Discard the body if the caller stopped waiting, since it may
+		// no longer read the response
+		if abandoned {
+			c.deregisterHandler(header.Seq)
+			if hasBody {
+				var discard any
+				c.dec.Decode(&discard)
+			}
+			return
 		}
-		if resp != nil {
-			err := c.dec.Decode(resp)
-			if err != nil {
+
+		if hasBody {
+			if err := c.dec.Decode(resp); err != nil {
 				errCh <- err
 				return
 			}
 		}
-	SEND_ERR:
 		errCh <- strToError(respHeader.Error)
 	}
 	c.handleSeq(header.Seq, &seqCallback{handler: handler})
-	defer c.deregisterHandler(header.Seq)
 
 	// Send the request
 	if err := c.send(header, req); err != nil {
+		c.deregisterHandler(header.Seq)
 		return err
 	}
 
 	// Wait for a response
 	select {
 	case err := <-errCh:
+		c.deregisterHandler(header.Seq)
 		return err
 	case <-c.shutdownCh:
+		c.deregisterHandler(header.Seq)
 		return errClientClosed
+	case <-ctx.Done():
+	}
+
+	// Use the response if it arrived in the meantime
+	lock.Lock()
+	defer lock.Unlock()
+	select {
+	case err := <-errCh:
+		c.deregisterHandler(header.Seq)
+		return err
+	default:
+		abandoned = true
+		return ctx.Err()
 	}
 }
 
 // strToError converts a string to an error if not blank
 func strToError(s string) error {
-	if s != "" {
+	switch s {
+	case "":
+		return nil
+	case permissionDenied:
+		return ErrPermissionDenied
+	case eventThrottled:
+		return ErrEventThrottled
+	default:
 		return errors.New(s)
 	}
-	return nil
 }
 
 // getSeq returns the next sequence number in a safe manner
@@ -206,6 +206,39 @@ func (a *Agent) UserEvent(name string, payload []byte, coalesce bool) error {
 	return err
 }
 
+// SendToMember sends a payload to a single member, see Serf.SendToMember.
+func (a *Agent) SendToMember(name string, payload []byte) error {
+	a.logger.Printf("[DEBUG] agent: Requesting direct message send to %s. Payload: %#v",
+		name, string(payload))
+	err := a.serf.SendToMember(name, payload)
+	if err != nil {
+		a.logger.Printf("[WARN] agent: failed to send direct message: %v", err)
+	}
+	return err
+}
+
+// KVSet sets a key of the replicated key/value store, see Serf.KVSet.
+func (a *Agent) KVSet(key string, value []byte) error {
+	a.logger.Printf("[DEBUG] agent: Requesting key/value set: %s. Value: %#v",
+		key, string(value))
+	err := a.serf.KVSet(key, value)
+	if err != nil {
+		a.logger.Printf("[WARN] agent: failed to set key: %v", err)
+	}
+	return err
+}
+
+// KVDelete deletes a key of the replicated key/value store, see
+// Serf.KVDelete.
+func (a *Agent) KVDelete(key string) error {
+	a.logger.Printf("[DEBUG] agent: Requesting key/value delete: %s", key)
+	err := a.serf.KVDelete(key)
+	if err != nil {
+		a.logger.Printf("[WARN] agent: failed to delete key: %v", err)
+	}
+	return err
+}
+
 // Query sends a Query on Serf, see Serf.Query.
 func (a *Agent) Query(name string, payload []byte, params *serf.QueryParam) (*serf.QueryResponse, error) {
 	// Prevent the use of the internal prefix
@@ -441,6 +474,14 @@ func (a *Agent) Stats() map[string]map[string]string {
 		script_filter := fmt.Sprintf("%s:%s", script.Event, script.Name)
 		event_handlers[script_filter] = script.Script
 	}
+	for _, script := range a.agentConf.PersistentEventScripts() {
+		script_filter := fmt.Sprintf("%s:%s", script.Event, script.Name)
+		event_handlers[script_filter] = script.Script
+	}
+	for _, webhook := range a.agentConf.EventWebhooks() {
+		webhook_filter := fmt.Sprintf("%s:%s", webhook.Event, webhook.Name)
+		event_handlers[webhook_filter] = webhook.URL
+	}
 
 	output := map[string]map[string]string{
 		"agent": map[string]string{
@@ -4,11 +4,13 @@
 package agent
 
 import (
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"runtime"
@@ -40,12 +42,14 @@ const (
 // ShutdownCh. If two messages are sent on the ShutdownCh it will forcibly
 // exit.
 type Command struct {
-	Ui            cli.Ui
-	ShutdownCh    <-chan struct{}
-	args          []string
-	scriptHandler *ScriptEventHandler
-	logFilter     *logutils.LevelFilter
-	logger        *log.Logger
+	Ui                cli.Ui
+	ShutdownCh        <-chan struct{}
+	args              []string
+	scriptHandler     *ScriptEventHandler
+	webhookHandler    *WebhookEventHandler
+	persistentHandler *PersistentEventHandler
+	logFilter         *logutils.LevelFilter
+	logger            *log.Logger
 }
 
 var _ cli.Command = &Command{}
@@ -72,16 +76,23 @@ func (c *Command) readConfig() *Config {
 	cmdFlags.StringVar(&cmdConfig.KeyringFile, "keyring-file", "", "path to the keyring file")
 	cmdFlags.Var((*AppendSliceValue)(&cmdConfig.EventHandlers), "event-handler",
 		"command to execute when events occur")
+	cmdFlags.StringVar(&cmdConfig.EventJournalDir, "event-journal-dir", "",
+		"directory of the event handler journals")
+	cmdFlags.Var((*AppendSliceValue)(&cmdConfig.PersistentEventHandlers), "persistent-event-handler",
+		"command to start once and stream events to")
 	cmdFlags.Var((*AppendSliceValue)(&cmdConfig.StartJoin), "join",
 		"address of agent to join on startup")
 	cmdFlags.BoolVar(&cmdConfig.ReplayOnJoin, "replay", false,
 		"replay events for startup join")
 	cmdFlags.StringVar(&cmdConfig.LogLevel, "log-level", "", "log level")
+	cmdFlags.BoolVar(&cmdConfig.LogJSON, "log-json", false, "output logs as JSON")
 	cmdFlags.StringVar(&cmdConfig.NodeName, "node", "", "node name")
 	cmdFlags.IntVar(&cmdConfig.Protocol, "protocol", -1, "protocol version")
 	cmdFlags.StringVar(&cmdConfig.Role, "role", "", "role name")
 	cmdFlags.StringVar(&cmdConfig.RPCAddr, "rpc-addr", "",
 		"address to bind RPC listener to")
+	cmdFlags.StringVar(&cmdConfig.HTTPAddr, "http-addr", "",
+		"address to bind HTTP API listener to")
 	cmdFlags.StringVar(&cmdConfig.Profile, "profile", "", "timing profile to use (lan, wan, local)")
 	cmdFlags.StringVar(&cmdConfig.SnapshotPath, "snapshot", "", "path to the snapshot file")
 	cmdFlags.Var((*AppendSliceValue)(&tags), "tag",
@@ -172,6 +183,18 @@ func (c *Command) readConfig() *Config {
 			return nil
 		}
 	}
+	for _, script := range config.PersistentEventScripts() {
+		if !script.Valid() {
+			c.Ui.Error(fmt.Sprintf("Invalid persistent event handler: %s", script.String()))
+			return nil
+		}
+	}
+	for _, webhook := range config.EventWebhooks() {
+		if err := webhook.Validate(); err != nil {
+			c.Ui.Error(err.Error())
+			return nil
+		}
+	}
 
 	// Check for a valid interface
 	if _, err := config.NetworkInterface(); err != nil {
@@ -325,6 +348,18 @@ func (c *Command) setupAgent(config *Config, logOutput io.Writer) *Agent {
 		return nil
 	}
 
+	signingKey, err := config.SigningKeyBytes()
+	if err != nil {
+		c.Ui.Error(fmt.Sprintf("Invalid signing key: %s", err))
+		return nil
+	}
+
+	trustedKeys, err := config.TrustedKeyBytes()
+	if err != nil {
+		c.Ui.Error(fmt.Sprintf("Invalid trusted key: %s", err))
+		return nil
+	}
+
 	serfConfig := serf.DefaultConfig()
 	switch config.Profile {
 	case "lan":
@@ -351,7 +386,18 @@ func (c *Command) setupAgent(config *Config, logOutput io.Writer) *Agent {
 	serfConfig.QuiescentPeriod = time.Second
 	serfConfig.QueryResponseSizeLimit = config.QueryResponseSizeLimit
 	serfConfig.QuerySizeLimit = config.QuerySizeLimit
+	serfConfig.QueryChunkedSizeLimit = config.QueryChunkedSizeLimit
 	serfConfig.UserEventSizeLimit = config.UserEventSizeLimit
+	serfConfig.LargeUserEventSizeLimit = config.LargeEventSizeLimit
+	serfConfig.ExtendedTagsSizeLimit = config.ExtendedTagsSizeLimit
+	serfConfig.UserEventRateLimit = config.EventRateLimit.RateLimit()
+	serfConfig.UserEventNodeRateLimit = config.EventNodeRateLimit.RateLimit()
+	if len(config.EventRateLimits) > 0 {
+		serfConfig.UserEventRateLimits = make(map[string]serf.RateLimit, len(config.EventRateLimits))
+		for name, limit := range config.EventRateLimits {
+			serfConfig.UserEventRateLimits[name] = limit.RateLimit()
+		}
+	}
 	serfConfig.UserCoalescePeriod = 3 * time.Second
 	serfConfig.UserQuiescentPeriod = time.Second
 	if config.ReconnectInterval != 0 {
@@ -368,6 +414,9 @@ func (c *Command) setupAgent(config *Config, logOutput io.Writer) *Agent {
 		serfConfig.KeyringFile = config.KeyringFile
 	}
 	serfConfig.RejoinAfterLeave = config.RejoinAfterLeave
+	serfConfig.SigningKey = signingKey
+	serfConfig.TrustedKeys = trustedKeys
+	serfConfig.RequireSignatures = config.RequireSignatures
 	if config.BroadcastTimeout != 0 {
 		serfConfig.BroadcastTimeout = config.BroadcastTimeout
 	}
@@ -394,6 +443,9 @@ func (c *Command) setupLoggers(config *Config) (*GatedWriter, *logWriter, io.Wri
 	c.logFilter = LevelFilter()
 	c.logFilter.MinLevel = logutils.LogLevel(strings.ToUpper(config.LogLevel))
 	c.logFilter.Writer = logGate
+	if config.LogJSON {
+		c.logFilter.Writer = &jsonLogWriter{node: config.NodeName, writer: logGate}
+	}
 	if !ValidateLevelFilter(c.logFilter.MinLevel, c.logFilter) {
 		c.Ui.Error(fmt.Sprintf(
 			"Invalid log level: %s. Valid log levels are: %v",
@@ -409,7 +461,11 @@ func (c *Command) setupLoggers(config *Config) (*GatedWriter, *logWriter, io.Wri
 			c.Ui.Error(fmt.Sprintf("Syslog setup failed: %v", err))
 			return nil, nil, nil
 		}
-		syslog = &SyslogWrapper{l, c.logFilter}
+		if config.LogJSON {
+			syslog = &jsonSyslogWrapper{l, c.logFilter, config.NodeName}
+		} else {
+			syslog = &SyslogWrapper{l, c.logFilter}
+		}
 	}
 
 	// Create a log writer, and wrap a logOutput around it
@@ -431,11 +487,34 @@ func (c *Command) startAgent(config *Config, agent *Agent,
 	logWriter *logWriter, logOutput io.Writer) *AgentIPC {
 	// Add the script event handlers
 	c.scriptHandler = &ScriptEventHandler{
+		SelfFunc:           func() serf.Member { return agent.Serf().LocalMember() },
+		Logger:             log.New(logOutput, "", log.LstdFlags),
+		Timeout:            config.EventHandlerTimeout,
+		Workers:            config.EventHandlerWorkers,
+		JournalDir:         config.EventJournalDir,
+		JournalMaxAttempts: config.EventJournalMaxAttempts,
+	}
+	c.scriptHandler.UpdateScripts(config.EventScripts())
+	agent.RegisterEventHandler(c.scriptHandler)
+
+	// Add the webhook event handlers
+	c.webhookHandler = &WebhookEventHandler{
+		SelfFunc:    func() serf.Member { return agent.Serf().LocalMember() },
+		Logger:      log.New(logOutput, "", log.LstdFlags),
+		Timeout:     config.WebhookTimeout,
+		MaxAttempts: config.WebhookMaxAttempts,
+		QueueSize:   config.WebhookQueueSize,
+	}
+	c.webhookHandler.UpdateWebhooks(config.EventWebhooks())
+	agent.RegisterEventHandler(c.webhookHandler)
+
+	// Add the persistent event handlers
+	c.persistentHandler = &PersistentEventHandler{
 		SelfFunc: func() serf.Member { return agent.Serf().LocalMember() },
-		Scripts:  config.EventScripts(),
 		Logger:   log.New(logOutput, "", log.LstdFlags),
 	}
-	agent.RegisterEventHandler(c.scriptHandler)
+	c.persistentHandler.UpdateScripts(config.PersistentEventScripts())
+	agent.RegisterEventHandler(c.persistentHandler)
 
 	// Start the agent after the handler is registered
 	if err := agent.Start(); err != nil {
@@ -472,11 +551,19 @@ func (c *Command) startAgent(config *Config, agent *Agent,
 	}
 
 	// Setup the RPC listener
-	rpcListener, err := net.Listen("tcp", config.RPCAddr)
+	rpcTLS, err := config.RPCTLSConfig()
+	if err != nil {
+		c.Ui.Error(fmt.Sprintf("Error setting up RPC TLS: %s", err))
+		return nil
+	}
+	rpcListener, err := listen(config.RPCAddr, config)
 	if err != nil {
 		c.Ui.Error(fmt.Sprintf("Error starting RPC listener: %s", err))
 		return nil
 	}
+	if rpcTLS != nil {
+		rpcListener = tls.NewListener(rpcListener, rpcTLS)
+	}
 
 	// Start the IPC layer
 	c.Ui.Output("Starting Serf agent RPC...")
@@ -493,6 +580,7 @@ func (c *Command) startAgent(config *Config, agent *Agent,
 	}
 
 	c.Ui.Info(fmt.Sprintf("                   RPC addr: '%s'", config.RPCAddr))
+	c.Ui.Info(fmt.Sprintf("                    RPC TLS: %v", rpcTLS != nil))
 	c.Ui.Info(fmt.Sprintf("                  Encrypted: %#v", agent.serf.EncryptionEnabled()))
 	c.Ui.Info(fmt.Sprintf("                   Snapshot: %v", config.SnapshotPath != ""))
 	c.Ui.Info(fmt.Sprintf("                    Profile: %s", config.Profile))
@@ -504,6 +592,52 @@ func (c *Command) startAgent(config *Config, agent *Agent,
 	return ipc
 }
 
+// startHTTP is used to start the optional HTTP API
+func (c *Command) startHTTP(config *Config, agent *Agent,
+	logWriter *logWriter, logOutput io.Writer) (*AgentHTTP, error) {
+	httpTLS, err := config.RPCTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	httpListener, err := listen(config.HTTPAddr, config)
+	if err != nil {
+		return nil, err
+	}
+	if httpTLS != nil {
+		httpListener = tls.NewListener(httpListener, httpTLS)
+	}
+
+	c.Ui.Output("Starting Serf agent HTTP API...")
+	httpAPI := NewAgentHTTP(agent, config.RPCAuthKey, httpListener, logOutput, logWriter)
+	c.Ui.Info(fmt.Sprintf("                  HTTP addr: '%s'", config.HTTPAddr))
+	return httpAPI, nil
+}
+
+// startPrometheus is used to serve the Prometheus /metrics endpoint
+func (c *Command) startPrometheus(config *Config, agent *Agent, sink *prometheusSink) (*http.Server, error) {
+	promListener, err := listen(config.PrometheusAddr, config)
+	if err != nil {
+		return nil, err
+	}
+
+	auth := &httpAuth{
+		authKey: config.RPCAuthKey,
+		tokens:  newRPCTokenIndex(config.RPCTokens),
+		logger:  c.logger,
+	}
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", &prometheusHandler{agent: agent, sink: sink, auth: auth})
+	server := &http.Server{
+		Handler:           mux,
+		ErrorLog:          c.logger,
+		ReadHeaderTimeout: httpReadHeaderTimeout,
+	}
+	go server.Serve(promListener)
+
+	c.Ui.Info(fmt.Sprintf("            Prometheus addr: '%s'", config.PrometheusAddr))
+	return server, nil
+}
+
 // startupJoin is invoked to handle any joins specified to take place at start time
 func (c *Command) startupJoin(config *Config, agent *Agent) error {
 	if len(config.StartJoin) == 0 {
@@ -604,6 +738,14 @@ func (c *Command) Run(args []string) int {
 		fanout = append(fanout, sink)
 	}
 
+	// Configure the Prometheus sink, stripping the service and host
+	// names that are prepended to the keys
+	var promSink *prometheusSink
+	if config.PrometheusAddr != "" {
+		promSink = newPrometheusSink(metricsConf.ServiceName, metricsConf.HostName)
+		fanout = append(fanout, promSink)
+	}
+
 	// Initialize the global sink
 	if len(fanout) > 0 {
 		fanout = append(fanout, inm)
@@ -626,6 +768,29 @@ func (c *Command) Run(args []string) int {
 		return 1
 	}
 	defer ipc.Shutdown()
+	defer c.scriptHandler.Shutdown()
+	defer c.webhookHandler.Shutdown()
+	defer c.persistentHandler.Shutdown()
+
+	// Start the HTTP API if enabled
+	if config.HTTPAddr != "" {
+		httpAPI, err := c.startHTTP(config, agent, logWriter, logOutput)
+		if err != nil {
+			c.Ui.Error(fmt.Sprintf("Error starting HTTP API: %s", err))
+			return 1
+		}
+		defer httpAPI.Shutdown()
+	}
+
+	// Start the Prometheus endpoint if enabled
+	if promSink != nil {
+		promServer, err := c.startPrometheus(config, agent, promSink)
+		if err != nil {
+			c.Ui.Error(fmt.Sprintf("Error starting Prometheus endpoint: %s", err))
+			return 1
+		}
+		defer promServer.Close()
+	}
 
 	// Join startup nodes if specified
 	if err := c.startupJoin(config, agent); err != nil {
@@ -733,6 +898,8 @@ func (c *Command) handleReload(config *Config, agent *Agent) *Config {
 
 	// Change the event handlers
 	c.scriptHandler.UpdateScripts(newConf.EventScripts())
+	c.webhookHandler.UpdateWebhooks(newConf.EventWebhooks())
+	c.persistentHandler.UpdateScripts(newConf.PersistentEventScripts())
 
 	// Update the tags in serf
 	if err := agent.SetTags(newConf.Tags); err != nil {
@@ -784,13 +951,26 @@ Options:
                            by Serf. As encryption keys are changed, the content of
                            this file is updated so that the same keys may be used
                            during later agent starts.
-  -event-handler=foo       Script to execute when events occur. This can
-                           be specified multiple times. See the event scripts
+  -event-handler=foo       Script to execute when events occur, or an http://
+                           or https:// URL to POST events to. This can be
+                           specified multiple times. See the event scripts
                            section below for more info.
+  -event-journal-dir=dir   Directory to journal the events for each event
+                           handler script in. Events are then retried until
+                           the script succeeds, even across agent restarts.
+  -http-addr=addr          Address to bind the HTTP/JSON API listener. The
+                           HTTP API is disabled unless this is provided.
   -join=addr               An initial agent to join with. This flag can be
                            specified multiple times.
+  -log-json                Output logs as one JSON object per line to stderr,
+                           syslog and monitors.
   -log-level=info          Log level of the agent.
   -node=hostname           Name of this node. Must be unique in the cluster
+  -persistent-event-handler=foo
+                           Command started once and kept running, which is
+                           streamed events as JSON on stdin. This can be
+                           specified multiple times, with the same syntax
+                           as -event-handler.
   -profile=[lan|wan|local] Profile is used to control the timing profiles used in Serf.
 						   The default if not provided is lan.
   -protocol=n              Serf protocol version to use. This defaults to
@@ -807,7 +987,8 @@ Options:
                            by event scripts to differentiate different types
                            of nodes that may be part of the same cluster.
                            '-role' is deprecated in favor of '-tag role=foo'.
-  -rpc-addr=127.0.0.1:7373 Address to bind the RPC listener.
+  -rpc-addr=127.0.0.1:7373 Address to bind the RPC listener. A Unix domain
+                           socket may be given as unix:///path/to/serf.sock.
   -snapshot=path/to/file   The snapshot file is used to store alive nodes and
                            event information so that Serf can rejoin a cluster
                            and avoid event replay on restart.
@@ -841,6 +1022,10 @@ Event handlers:
   - The value can be in the format of "user:EVENT=SCRIPT", such as
     "user:deploy=deploy.sh". This means that Serf will only invoke this
     script in the case of user events named "deploy".
+
+  In any of these formats the script can be replaced by an http:// or
+  https:// URL, such as "member-join=http://localhost:8080/join". Serf
+  will then POST a JSON document describing each event to the URL.
 `
 	return strings.TrimSpace(helpText)
 }
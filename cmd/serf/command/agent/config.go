@@ -4,6 +4,9 @@
 package agent
 
 import (
+	"crypto/ed25519"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -27,21 +30,27 @@ const DefaultBindPort int = 7946
 // DefaultConfig contains the defaults for configurations.
 func DefaultConfig() *Config {
 	return &Config{
-		DisableCoordinates:     false,
-		Tags:                   make(map[string]string),
-		BindAddr:               "0.0.0.0",
-		AdvertiseAddr:          "",
-		LogLevel:               "INFO",
-		RPCAddr:                "127.0.0.1:7373",
-		Protocol:               serf.ProtocolVersionMax,
-		ReplayOnJoin:           false,
-		Profile:                "lan",
-		RetryInterval:          30 * time.Second,
-		SyslogFacility:         "LOCAL0",
-		QueryResponseSizeLimit: 1024,
-		QuerySizeLimit:         1024,
-		UserEventSizeLimit:     512,
-		BroadcastTimeout:       5 * time.Second,
+		DisableCoordinates:      false,
+		Tags:                    make(map[string]string),
+		BindAddr:                "0.0.0.0",
+		AdvertiseAddr:           "",
+		LogLevel:                "INFO",
+		RPCAddr:                 "127.0.0.1:7373",
+		Protocol:                serf.ProtocolVersionMax,
+		ReplayOnJoin:            false,
+		Profile:                 "lan",
+		RetryInterval:           30 * time.Second,
+		SyslogFacility:          "LOCAL0",
+		QueryResponseSizeLimit:  1024,
+		QuerySizeLimit:          1024,
+		QueryChunkedSizeLimit:   1024 * 1024,
+		UserEventSizeLimit:      512,
+		BroadcastTimeout:        5 * time.Second,
+		EventHandlerWorkers:     1,
+		EventJournalMaxAttempts: 10,
+		WebhookTimeout:          5 * time.Second,
+		WebhookMaxAttempts:      3,
+		WebhookQueueSize:        128,
 	}
 }
 
@@ -55,6 +64,18 @@ type MDNSConfig struct {
 	DisableIPv6 bool   `mapstructure:"disable_ipv6"`
 }
 
+// RateLimitConfig limits how often user events are sent and accepted,
+// allowing Burst events at once and Rate events per second on average.
+type RateLimitConfig struct {
+	Rate  float64 `mapstructure:"rate"`
+	Burst int     `mapstructure:"burst"`
+}
+
+// RateLimit returns the limit in the form Serf expects
+func (r RateLimitConfig) RateLimit() serf.RateLimit {
+	return serf.RateLimit{Rate: r.Rate, Burst: r.Burst}
+}
+
 // Config is the configuration that can be set for an Agent. Some of these
 // configurations are exposed as command-line flags to `serf agent`, whereas
 // many of the more advanced configurations can only be set by creating
@@ -100,19 +121,72 @@ type Config struct {
 	// keyring will not be persisted to a file.
 	KeyringFile string `mapstructure:"keyring_file"`
 
+	// SigningKey is a base64 encoded Ed25519 private key, either the 32
+	// byte seed or the 64 byte key, used to sign the user events and
+	// queries sent by this agent. "serf keygen -signing" generates one.
+	SigningKey string `mapstructure:"signing_key"`
+
+	// TrustedKeys are the base64 encoded Ed25519 public keys of the nodes
+	// whose signatures on user events and queries are verified, by node
+	// name. The verified signer is passed to event handlers.
+	TrustedKeys map[string]string `mapstructure:"trusted_keys"`
+
+	// RequireSignatures drops the user events and queries that are not
+	// signed by one of the TrustedKeys, or the SigningKey of this agent.
+	RequireSignatures bool `mapstructure:"require_signatures"`
+
 	// LogLevel is the level of the logs to output.
 	// This can be updated during a reload.
 	LogLevel string `mapstructure:"log_level"`
 
+	// LogJSON formats the logs as one JSON object per line, with the
+	// timestamp, level, subsystem, message and node name. This applies
+	// to stderr, syslog and the monitor stream.
+	LogJSON bool `mapstructure:"log_json"`
+
 	// RPCAddr is the address and port to listen on for the agent's RPC
-	// interface.
+	// interface. A Unix domain socket may be used instead by providing
+	// a path prefixed with unix://, such as unix:///var/run/serf.sock.
 	RPCAddr string `mapstructure:"rpc_addr"`
 
+	// RPCSocketMode, RPCSocketUser and RPCSocketGroup control the
+	// permissions of the socket file when RPCAddr or HTTPAddr is a Unix
+	// domain socket. The mode is given in octal, such as "0600", and the
+	// user and group may be names or numeric IDs.
+	RPCSocketMode  string `mapstructure:"rpc_socket_mode"`
+	RPCSocketUser  string `mapstructure:"rpc_socket_user"`
+	RPCSocketGroup string `mapstructure:"rpc_socket_group"`
+
 	// RPCAuthKey is a key that can be set to optionally require that
 	// RPC's provide an authentication key. This is meant to be
 	// a very simple authentication control
 	RPCAuthKey string `mapstructure:"rpc_auth"`
 
+	// RPCTokens are named auth tokens that only grant access to a subset
+	// of the RPC commands. If any are set, RPC clients must authenticate
+	// even if RPCAuthKey is not set. The RPCAuthKey continues to grant
+	// access to every command.
+	RPCTokens []RPCToken `mapstructure:"rpc_tokens"`
+
+	// HTTPAddr is the address and port to listen on for the agent's
+	// HTTP API. The HTTP API is disabled if this is blank. Requests must
+	// provide the RPCAuthKey if one is set.
+	HTTPAddr string `mapstructure:"http_addr"`
+
+	// RPCTLSCertFile and RPCTLSKeyFile are the PEM encoded certificate and
+	// private key used to serve the RPC and HTTP listeners over TLS. If
+	// they are not set, the listeners use plain TCP.
+	RPCTLSCertFile string `mapstructure:"rpc_tls_cert_file"`
+	RPCTLSKeyFile  string `mapstructure:"rpc_tls_key_file"`
+
+	// RPCTLSCAFile is a PEM encoded CA bundle used to verify the
+	// certificates presented by RPC clients.
+	RPCTLSCAFile string `mapstructure:"rpc_tls_ca_file"`
+
+	// RPCTLSVerifyClient requires RPC clients to present a certificate
+	// signed by the RPCTLSCAFile, enabling mutual TLS.
+	RPCTLSVerifyClient bool `mapstructure:"rpc_tls_verify_client"`
+
 	// Protocol is the Serf protocol version to use.
 	Protocol int `mapstructure:"protocol"`
 
@@ -128,19 +202,86 @@ type Config struct {
 	QueryResponseSizeLimit int `mapstructure:"query_response_size_limit"`
 	QuerySizeLimit         int `mapstructure:"query_size_limit"`
 
+	// QueryChunkedSizeLimit limits the size of query responses
+	// that are too large for QueryResponseSizeLimit, which are sent in
+	// chunks over TCP instead.
+	QueryChunkedSizeLimit int `mapstructure:"query_chunked_size_limit"`
+
 	// UserEventSizeLimit is maximum byte size limit of user event `name` + `payload` in bytes.
 	// It's optimal to be relatively small, since it's going to be gossiped through the cluster.
 	UserEventSizeLimit int `mapstructure:"user_event_size_limit"`
 
+	// LargeEventSizeLimit allows user events over UserEventSizeLimit, up to
+	// this size. Only a hash of their payload is gossiped, and other nodes
+	// fetch the payload before delivering the event. Zero disables it.
+	LargeEventSizeLimit int `mapstructure:"large_event_size_limit"`
+
+	// ExtendedTagsSizeLimit allows tags over the memberlist meta size limit,
+	// up to this encoded size. Only a digest of such tags is gossiped, and
+	// other nodes fetch the full set. Zero disables it.
+	ExtendedTagsSizeLimit int `mapstructure:"extended_tags_size_limit"`
+
+	// EventRateLimit limits how often user events with the same name are
+	// sent and accepted, and EventRateLimits overrides it for specific event
+	// names. EventNodeRateLimit limits how often user events originating
+	// from the same node are accepted. A zero rate disables a limit.
+	EventRateLimit     RateLimitConfig            `mapstructure:"event_rate_limit"`
+	EventRateLimits    map[string]RateLimitConfig `mapstructure:"event_rate_limits"`
+	EventNodeRateLimit RateLimitConfig            `mapstructure:"event_node_rate_limit"`
+
 	// StartJoin is a list of addresses to attempt to join when the
 	// agent starts. If Serf is unable to communicate with any of these
 	// addresses, then the agent will error and exit.
 	StartJoin []string `mapstructure:"start_join"`
 
 	// EventHandlers is a list of event handlers that will be invoked.
-	// These can be updated during a reload.
+	// Handlers are scripts, or webhooks if an http:// or https:// URL
+	// is given. These can be updated during a reload.
 	EventHandlers []string `mapstructure:"event_handlers"`
 
+	// EventHandlerTimeoutRaw is the string timeout of event handler
+	// scripts. Scripts running for longer are killed, along with any
+	// processes they spawned. This defaults to no timeout.
+	EventHandlerTimeoutRaw string        `mapstructure:"event_handler_timeout"`
+	EventHandlerTimeout    time.Duration `mapstructure:"-"`
+
+	// EventHandlerWorkers is the number of event handler scripts that may
+	// run concurrently. This defaults to 1, which invokes scripts in the
+	// order of the events without blocking the agent.
+	EventHandlerWorkers int `mapstructure:"event_handler_workers"`
+
+	// EventJournalDir is the directory of the event journals. If set, the
+	// member and user events for each event handler script are journaled
+	// and retried until the script succeeds, including across restarts.
+	EventJournalDir string `mapstructure:"event_journal_dir"`
+
+	// EventJournalMaxAttempts is the number of times a journaled event is
+	// delivered to a script that fails before it is skipped, so that it
+	// doesn't hold back the later events. A negative value retries the
+	// event until the script succeeds. This defaults to 10.
+	EventJournalMaxAttempts int `mapstructure:"event_journal_max_attempts"`
+
+	// PersistentEventHandlers is a list of event handlers that are started
+	// once and kept running, receiving events as newline delimited JSON
+	// on stdin. They use the same format as EventHandlers, and can be
+	// updated during a reload.
+	PersistentEventHandlers []string `mapstructure:"persistent_event_handlers"`
+
+	// WebhookTimeoutRaw is the string timeout of each webhook delivery
+	// attempt. This defaults to 5 seconds.
+	WebhookTimeoutRaw string        `mapstructure:"webhook_timeout"`
+	WebhookTimeout    time.Duration `mapstructure:"-"`
+
+	// WebhookMaxAttempts is the number of times delivering an event to
+	// a webhook is attempted before the event is dropped. This defaults
+	// to 3.
+	WebhookMaxAttempts int `mapstructure:"webhook_max_attempts"`
+
+	// WebhookQueueSize is the number of events that may be queued for
+	// each webhook. Events are dropped when the queue is full. This
+	// defaults to 128.
+	WebhookQueueSize int `mapstructure:"webhook_queue_size"`
+
 	// Profile is used to select a timing profile for Serf. The supported choices
 	// are "wan", "lan", and "local". The default is "lan"
 	Profile string `mapstructure:"profile"`
@@ -237,6 +378,11 @@ type Config struct {
 	// metrics will be sent to that instance.
 	StatsdAddr string `mapstructure:"statsd_addr"`
 
+	// PrometheusAddr is the address to serve a Prometheus /metrics endpoint
+	// on. If provided, the telemetry emitted by Serf and memberlist is
+	// exposed along with gauges derived from the Serf stats.
+	PrometheusAddr string `mapstructure:"prometheus_addr"`
+
 	// BroadcastTimeoutRaw is the string retry interval. This interval
 	// controls the timeout for broadcast events. This defaults to
 	// 5 seconds.
@@ -284,17 +430,124 @@ func (c *Config) EncryptBytes() ([]byte, error) {
 	return base64.StdEncoding.DecodeString(c.EncryptKey)
 }
 
+// SigningKeyBytes returns the signing key configured, or nil if there
+// is none.
+func (c *Config) SigningKeyBytes() (ed25519.PrivateKey, error) {
+	if c.SigningKey == "" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(c.SigningKey)
+	if err != nil {
+		return nil, err
+	}
+	switch len(key) {
+	case ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(key), nil
+	case ed25519.PrivateKeySize:
+		return ed25519.PrivateKey(key), nil
+	default:
+		return nil, fmt.Errorf("key must be %d or %d bytes, got %d",
+			ed25519.SeedSize, ed25519.PrivateKeySize, len(key))
+	}
+}
+
+// TrustedKeyBytes returns the trusted public keys configured by node name.
+func (c *Config) TrustedKeyBytes() (map[string]ed25519.PublicKey, error) {
+	result := make(map[string]ed25519.PublicKey, len(c.TrustedKeys))
+	for name, v := range c.TrustedKeys {
+		key, err := base64.StdEncoding.DecodeString(v)
+		if err != nil {
+			return nil, fmt.Errorf("key for %q: %v", name, err)
+		}
+		if len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("key for %q must be %d bytes, got %d",
+				name, ed25519.PublicKeySize, len(key))
+		}
+		result[name] = ed25519.PublicKey(key)
+	}
+	return result, nil
+}
+
 // EventScripts returns the list of EventScripts associated with this
 // configuration and specified by the "event_handlers" configuration.
 func (c *Config) EventScripts() []EventScript {
 	result := make([]EventScript, 0, len(c.EventHandlers))
 	for _, v := range c.EventHandlers {
+		if isEventWebhook(v) {
+			continue
+		}
+		part := ParseEventScript(v)
+		result = append(result, part...)
+	}
+	return result
+}
+
+// PersistentEventScripts returns the list of EventScripts specified by
+// the "persistent_event_handlers" configuration.
+func (c *Config) PersistentEventScripts() []EventScript {
+	result := make([]EventScript, 0, len(c.PersistentEventHandlers))
+	for _, v := range c.PersistentEventHandlers {
 		part := ParseEventScript(v)
 		result = append(result, part...)
 	}
 	return result
 }
 
+// EventWebhooks returns the list of EventWebhooks specified by the
+// "event_handlers" configuration.
+func (c *Config) EventWebhooks() []EventWebhook {
+	var result []EventWebhook
+	for _, v := range c.EventHandlers {
+		if !isEventWebhook(v) {
+			continue
+		}
+		part := ParseEventWebhook(v)
+		result = append(result, part...)
+	}
+	return result
+}
+
+// RPCTLSConfig returns the TLS configuration used to serve RPC clients,
+// or nil if TLS is not configured.
+func (c *Config) RPCTLSConfig() (*tls.Config, error) {
+	if c.RPCTLSCertFile == "" && c.RPCTLSKeyFile == "" {
+		if c.RPCTLSCAFile != "" || c.RPCTLSVerifyClient {
+			return nil, fmt.Errorf("rpc_tls_cert_file and rpc_tls_key_file must be set to use RPC TLS")
+		}
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.RPCTLSCertFile, c.RPCTLSKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load RPC TLS certificate: %v", err)
+	}
+	tlsConf := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if c.RPCTLSCAFile != "" {
+		pem, err := os.ReadFile(c.RPCTLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read RPC TLS CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in RPC TLS CA file %s", c.RPCTLSCAFile)
+		}
+		tlsConf.ClientCAs = pool
+		tlsConf.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	if c.RPCTLSVerifyClient {
+		if tlsConf.ClientCAs == nil {
+			return nil, fmt.Errorf("rpc_tls_ca_file must be set to verify RPC client certificates")
+		}
+		tlsConf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConf, nil
+}
+
 // Networkinterface is used to get the associated network
 // interface from the configured value
 func (c *Config) NetworkInterface() (*net.Interface, error) {
@@ -380,6 +633,26 @@ func DecodeConfig(r io.Reader) (*Config, error) {
 		result.BroadcastTimeout = dur
 	}
 
+	if result.EventHandlerTimeoutRaw != "" {
+		dur, err := time.ParseDuration(result.EventHandlerTimeoutRaw)
+		if err != nil {
+			return nil, err
+		}
+		result.EventHandlerTimeout = dur
+	}
+
+	if result.WebhookTimeoutRaw != "" {
+		dur, err := time.ParseDuration(result.WebhookTimeoutRaw)
+		if err != nil {
+			return nil, err
+		}
+		result.WebhookTimeout = dur
+	}
+
+	if err := validateRPCTokens(result.RPCTokens); err != nil {
+		return nil, err
+	}
+
 	return &result, nil
 }
 
@@ -418,9 +691,24 @@ func MergeConfig(a, b *Config) *Config {
 	if b.EncryptKey != "" {
 		result.EncryptKey = b.EncryptKey
 	}
+	if b.SigningKey != "" {
+		result.SigningKey = b.SigningKey
+	}
+	if b.TrustedKeys != nil {
+		if result.TrustedKeys == nil {
+			result.TrustedKeys = make(map[string]string)
+		}
+		maps.Copy(result.TrustedKeys, b.TrustedKeys)
+	}
+	if b.RequireSignatures {
+		result.RequireSignatures = true
+	}
 	if b.LogLevel != "" {
 		result.LogLevel = b.LogLevel
 	}
+	if b.LogJSON {
+		result.LogJSON = true
+	}
 	if b.Protocol > 0 {
 		result.Protocol = b.Protocol
 	}
@@ -430,6 +718,30 @@ func MergeConfig(a, b *Config) *Config {
 	if b.RPCAuthKey != "" {
 		result.RPCAuthKey = b.RPCAuthKey
 	}
+	if b.RPCSocketMode != "" {
+		result.RPCSocketMode = b.RPCSocketMode
+	}
+	if b.RPCSocketUser != "" {
+		result.RPCSocketUser = b.RPCSocketUser
+	}
+	if b.RPCSocketGroup != "" {
+		result.RPCSocketGroup = b.RPCSocketGroup
+	}
+	if b.HTTPAddr != "" {
+		result.HTTPAddr = b.HTTPAddr
+	}
+	if b.RPCTLSCertFile != "" {
+		result.RPCTLSCertFile = b.RPCTLSCertFile
+	}
+	if b.RPCTLSKeyFile != "" {
+		result.RPCTLSKeyFile = b.RPCTLSKeyFile
+	}
+	if b.RPCTLSCAFile != "" {
+		result.RPCTLSCAFile = b.RPCTLSCAFile
+	}
+	if b.RPCTLSVerifyClient {
+		result.RPCTLSVerifyClient = true
+	}
 	if b.ReplayOnJoin {
 		result.ReplayOnJoin = b.ReplayOnJoin
 	}
@@ -503,18 +815,63 @@ func MergeConfig(a, b *Config) *Config {
 	if b.StatsdAddr != "" {
 		result.StatsdAddr = b.StatsdAddr
 	}
+	if b.PrometheusAddr != "" {
+		result.PrometheusAddr = b.PrometheusAddr
+	}
 	if b.QueryResponseSizeLimit != 0 {
 		result.QueryResponseSizeLimit = b.QueryResponseSizeLimit
 	}
 	if b.QuerySizeLimit != 0 {
 		result.QuerySizeLimit = b.QuerySizeLimit
 	}
+	if b.QueryChunkedSizeLimit != 0 {
+		result.QueryChunkedSizeLimit = b.QueryChunkedSizeLimit
+	}
 	if b.UserEventSizeLimit != 0 {
 		result.UserEventSizeLimit = b.UserEventSizeLimit
 	}
+	if b.LargeEventSizeLimit != 0 {
+		result.LargeEventSizeLimit = b.LargeEventSizeLimit
+	}
+	if b.ExtendedTagsSizeLimit != 0 {
+		result.ExtendedTagsSizeLimit = b.ExtendedTagsSizeLimit
+	}
+	if b.EventRateLimit.Rate != 0 {
+		result.EventRateLimit = b.EventRateLimit
+	}
+	if b.EventRateLimits != nil {
+		if result.EventRateLimits == nil {
+			result.EventRateLimits = make(map[string]RateLimitConfig)
+		}
+		maps.Copy(result.EventRateLimits, b.EventRateLimits)
+	}
+	if b.EventNodeRateLimit.Rate != 0 {
+		result.EventNodeRateLimit = b.EventNodeRateLimit
+	}
 	if b.BroadcastTimeout != 0 {
 		result.BroadcastTimeout = b.BroadcastTimeout
 	}
+	if b.EventHandlerTimeout != 0 {
+		result.EventHandlerTimeout = b.EventHandlerTimeout
+	}
+	if b.EventHandlerWorkers != 0 {
+		result.EventHandlerWorkers = b.EventHandlerWorkers
+	}
+	if b.EventJournalDir != "" {
+		result.EventJournalDir = b.EventJournalDir
+	}
+	if b.EventJournalMaxAttempts != 0 {
+		result.EventJournalMaxAttempts = b.EventJournalMaxAttempts
+	}
+	if b.WebhookTimeout != 0 {
+		result.WebhookTimeout = b.WebhookTimeout
+	}
+	if b.WebhookMaxAttempts != 0 {
+		result.WebhookMaxAttempts = b.WebhookMaxAttempts
+	}
+	if b.WebhookQueueSize != 0 {
+		result.WebhookQueueSize = b.WebhookQueueSize
+	}
 	result.EnableCompression = b.EnableCompression
 
 	// Copy the event handlers
@@ -522,11 +879,21 @@ func MergeConfig(a, b *Config) *Config {
 	result.EventHandlers = append(result.EventHandlers, a.EventHandlers...)
 	result.EventHandlers = append(result.EventHandlers, b.EventHandlers...)
 
+	// Copy the persistent event handlers
+	result.PersistentEventHandlers = make([]string, 0, len(a.PersistentEventHandlers)+len(b.PersistentEventHandlers))
+	result.PersistentEventHandlers = append(result.PersistentEventHandlers, a.PersistentEventHandlers...)
+	result.PersistentEventHandlers = append(result.PersistentEventHandlers, b.PersistentEventHandlers...)
+
 	// Copy the start join addresses
 	result.StartJoin = make([]string, 0, len(a.StartJoin)+len(b.StartJoin))
 	result.StartJoin = append(result.StartJoin, a.StartJoin...)
 	result.StartJoin = append(result.StartJoin, b.StartJoin...)
 
+	// Copy the RPC tokens
+	result.RPCTokens = make([]RPCToken, 0, len(a.RPCTokens)+len(b.RPCTokens))
+	result.RPCTokens = append(result.RPCTokens, a.RPCTokens...)
+	result.RPCTokens = append(result.RPCTokens, b.RPCTokens...)
+
 	// Copy the retry join addresses
 	result.RetryJoin = make([]string, 0, len(a.RetryJoin)+len(b.RetryJoin))
 	result.RetryJoin = append(result.RetryJoin, a.RetryJoin...)
@@ -5,6 +5,8 @@ package agent
 
 import (
 	"bytes"
+	"crypto/ed25519"
+	"crypto/tls"
 	"encoding/base64"
 	"os"
 	"path/filepath"
@@ -72,6 +74,62 @@ func TestConfigEncryptBytes(t *testing.T) {
 	}
 }
 
+func TestConfigSigningKeyBytes(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Both the seed and the full private key are accepted
+	for _, src := range [][]byte{priv.Seed(), priv} {
+		c := &Config{
+			SigningKey: base64.StdEncoding.EncodeToString(src),
+		}
+		result, err := c.SigningKeyBytes()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if !priv.Equal(result) {
+			t.Fatalf("bad: %#v", result)
+		}
+	}
+
+	// Test with a bad length
+	c := &Config{SigningKey: base64.StdEncoding.EncodeToString([]byte("abc"))}
+	if _, err := c.SigningKeyBytes(); err == nil {
+		t.Fatalf("should err")
+	}
+
+	// Test with no input
+	c = &Config{}
+	result, err := c.SigningKeyBytes()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if result != nil {
+		t.Fatalf("bad: %#v", result)
+	}
+
+	// Trusted keys
+	c = &Config{
+		TrustedKeys: map[string]string{
+			"foo": base64.StdEncoding.EncodeToString(pub),
+		},
+	}
+	keys, err := c.TrustedKeyBytes()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(keys) != 1 || !pub.Equal(keys["foo"]) {
+		t.Fatalf("bad: %#v", keys)
+	}
+
+	c.TrustedKeys["bar"] = base64.StdEncoding.EncodeToString([]byte("abc"))
+	if _, err := c.TrustedKeyBytes(); err == nil {
+		t.Fatalf("should err")
+	}
+}
+
 func TestConfigEventScripts(t *testing.T) {
 	c := &Config{
 		EventHandlers: []string{
@@ -86,10 +144,54 @@ func TestConfigEventScripts(t *testing.T) {
 	}
 
 	expected := []EventScript{
-		{EventFilter{"*", ""}, "foo.sh"},
-		{EventFilter{"bar", ""}, "blah.sh"},
+		{EventFilter{Event: "*"}, "foo.sh"},
+		{EventFilter{Event: "bar"}, "blah.sh"},
+	}
+
+	if !reflect.DeepEqual(result, expected) {
+		t.Fatalf("bad: %#v", result)
+	}
+}
+
+func TestConfigEventWebhooks(t *testing.T) {
+	c := &Config{
+		EventHandlers: []string{
+			"foo.sh",
+			"http://localhost/all",
+			"user:deploy=https://localhost/deploy",
+		},
+	}
+
+	scripts := c.EventScripts()
+	if len(scripts) != 1 || scripts[0].Script != "foo.sh" {
+		t.Fatalf("bad: %#v", scripts)
 	}
 
+	expected := []EventWebhook{
+		{EventFilter{Event: "*"}, "http://localhost/all"},
+		{EventFilter{Event: "user", Name: "deploy"}, "https://localhost/deploy"},
+	}
+
+	result := c.EventWebhooks()
+	if !reflect.DeepEqual(result, expected) {
+		t.Fatalf("bad: %#v", result)
+	}
+}
+
+func TestConfigPersistentEventScripts(t *testing.T) {
+	c := &Config{
+		PersistentEventHandlers: []string{
+			"foo.sh",
+			"user:deploy=bar.sh",
+		},
+	}
+
+	expected := []EventScript{
+		{EventFilter{Event: "*"}, "foo.sh"},
+		{EventFilter{Event: "user", Name: "deploy"}, "bar.sh"},
+	}
+
+	result := c.PersistentEventScripts()
 	if !reflect.DeepEqual(result, expected) {
 		t.Fatalf("bad: %#v", result)
 	}
@@ -251,6 +353,68 @@ func TestDecodeConfig(t *testing.T) {
 		t.Fatalf("bad: %#v", config)
 	}
 
+	// RPC tokens
+	input = `{"rpc_tokens": [{"name": "read", "token": "foo", "commands": ["members", "stats"]}]}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	expectedTokens := []RPCToken{{Name: "read", Token: "foo", Commands: []string{"members", "stats"}}}
+	if !reflect.DeepEqual(config.RPCTokens, expectedTokens) {
+		t.Fatalf("bad: %#v", config.RPCTokens)
+	}
+
+	input = `{"rpc_tokens": [{"name": "read", "token": "foo", "commands": ["bogus"]}]}`
+	if _, err = DecodeConfig(bytes.NewReader([]byte(input))); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	// HTTP addr
+	input = `{"http_addr": "127.0.0.1:7374"}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if config.HTTPAddr != "127.0.0.1:7374" {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// Prometheus addr
+	input = `{"prometheus_addr": "127.0.0.1:9100"}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if config.PrometheusAddr != "127.0.0.1:9100" {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// RPC socket options
+	input = `{"rpc_socket_mode": "0660", "rpc_socket_user": "serf", "rpc_socket_group": "ops"}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if config.RPCSocketMode != "0660" || config.RPCSocketUser != "serf" || config.RPCSocketGroup != "ops" {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// RPC TLS
+	input = `{"rpc_tls_cert_file": "cert.pem", "rpc_tls_key_file": "key.pem", "rpc_tls_ca_file": "ca.pem", "rpc_tls_verify_client": true}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if config.RPCTLSCertFile != "cert.pem" || config.RPCTLSKeyFile != "key.pem" ||
+		config.RPCTLSCAFile != "ca.pem" || !config.RPCTLSVerifyClient {
+		t.Fatalf("bad: %#v", config)
+	}
+
 	// DisableNameResolution
 	input = `{"disable_name_resolution": true}`
 	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
@@ -287,6 +451,41 @@ func TestDecodeConfig(t *testing.T) {
 		t.Fatalf("bad: %#v", config)
 	}
 
+	// Event handler limits
+	input = `{"event_handler_timeout": "30s", "event_handler_workers": 4, "event_journal_dir": "/tmp/journal", "event_journal_max_attempts": 3}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if config.EventHandlerTimeout != 30*time.Second || config.EventHandlerWorkers != 4 ||
+		config.EventJournalDir != "/tmp/journal" || config.EventJournalMaxAttempts != 3 {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// Webhooks
+	input = `{"webhook_timeout": "10s", "webhook_max_attempts": 5, "webhook_queue_size": 16}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if config.WebhookTimeout != 10*time.Second || config.WebhookMaxAttempts != 5 ||
+		config.WebhookQueueSize != 16 {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// JSON logs
+	input = `{"log_json": true}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if !config.LogJSON {
+		t.Fatalf("bad: %#v", config)
+	}
+
 	// Retry configs
 	input = `{"retry_max_attempts": 5, "retry_interval": "60s"}`
 	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
@@ -359,13 +558,62 @@ func TestDecodeConfig(t *testing.T) {
 	}
 
 	// Query sizes
-	input = `{"query_response_size_limit": 123, "query_size_limit": 456}`
+	input = `{"query_response_size_limit": 123, "query_size_limit": 456, "query_chunked_size_limit": 789}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if config.QueryResponseSizeLimit != 123 || config.QuerySizeLimit != 456 ||
+		config.QueryChunkedSizeLimit != 789 {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// Large user events
+	input = `{"large_event_size_limit": 65536}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if config.LargeEventSizeLimit != 65536 {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// Extended tags
+	input = `{"extended_tags_size_limit": 4096}`
 	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	if config.QueryResponseSizeLimit != 123 || config.QuerySizeLimit != 456 {
+	if config.ExtendedTagsSizeLimit != 4096 {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// Signing
+	input = `{"signing_key": "abc", "trusted_keys": {"foo": "def"}, "require_signatures": true}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if config.SigningKey != "abc" || config.TrustedKeys["foo"] != "def" ||
+		!config.RequireSignatures {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// Event rate limits
+	input = `{"event_rate_limit": {"rate": 0.5, "burst": 10}, "event_rate_limits": {"deploy": {"rate": 2}},
+	"event_node_rate_limit": {"rate": 5}}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if config.EventRateLimit != (RateLimitConfig{Rate: 0.5, Burst: 10}) ||
+		config.EventRateLimits["deploy"] != (RateLimitConfig{Rate: 2}) ||
+		config.EventNodeRateLimit != (RateLimitConfig{Rate: 5}) {
 		t.Fatalf("bad: %#v", config)
 	}
 }
@@ -387,6 +635,7 @@ func TestMergeConfig(t *testing.T) {
 		StartJoin:     []string{"foo"},
 		ReplayOnJoin:  true,
 		RetryJoin:     []string{"zab"},
+		TrustedKeys:   map[string]string{"foo": "abc"},
 	}
 
 	b := &Config{
@@ -403,9 +652,15 @@ func TestMergeConfig(t *testing.T) {
 		ReconnectInterval:      15 * time.Second,
 		ReconnectTimeout:       48 * time.Hour,
 		RPCAuthKey:             "foobar",
+		HTTPAddr:               "127.0.0.1:7374",
+		PrometheusAddr:         "127.0.0.1:9100",
+		RPCTLSCAFile:           "ca.pem",
+		RPCTLSVerifyClient:     true,
 		DisableNameResolution:  true,
 		TombstoneTimeout:       36 * time.Hour,
 		EnableSyslog:           true,
+		LogJSON:                true,
+		EventJournalDir:        "/tmp/journal",
 		RetryJoin:              []string{"zip"},
 		RetryMaxAttempts:       10,
 		RetryInterval:          120 * time.Second,
@@ -413,8 +668,17 @@ func TestMergeConfig(t *testing.T) {
 		StatsiteAddr:           "127.0.0.1:8125",
 		QueryResponseSizeLimit: 123,
 		QuerySizeLimit:         456,
+		QueryChunkedSizeLimit:  789,
+		LargeEventSizeLimit:    1011,
+		ExtendedTagsSizeLimit:  2022,
 		BroadcastTimeout:       20 * time.Second,
 		EnableCompression:      true,
+		SigningKey:             "sig",
+		TrustedKeys:            map[string]string{"bar": "def"},
+		RequireSignatures:      true,
+		EventRateLimit:         RateLimitConfig{Rate: 1, Burst: 5},
+		EventRateLimits:        map[string]RateLimitConfig{"deploy": {Rate: 2}},
+		EventNodeRateLimit:     RateLimitConfig{Rate: 3},
 	}
 
 	c := MergeConfig(a, b)
@@ -475,6 +739,18 @@ func TestMergeConfig(t *testing.T) {
 		t.Fatalf("bad: %#v", c)
 	}
 
+	if c.HTTPAddr != "127.0.0.1:7374" {
+		t.Fatalf("bad: %#v", c)
+	}
+
+	if c.PrometheusAddr != "127.0.0.1:9100" {
+		t.Fatalf("bad: %#v", c)
+	}
+
+	if c.RPCTLSCAFile != "ca.pem" || !c.RPCTLSVerifyClient {
+		t.Fatalf("bad: %#v", c)
+	}
+
 	if !c.DisableNameResolution {
 		t.Fatalf("bad: %#v", c)
 	}
@@ -483,6 +759,14 @@ func TestMergeConfig(t *testing.T) {
 		t.Fatalf("bad: %#v", c)
 	}
 
+	if !c.LogJSON {
+		t.Fatalf("bad: %#v", c)
+	}
+
+	if c.EventJournalDir != "/tmp/journal" {
+		t.Fatalf("bad: %#v", c)
+	}
+
 	if c.RetryMaxAttempts != 10 {
 		t.Fatalf("bad: %#v", c)
 	}
@@ -513,7 +797,9 @@ func TestMergeConfig(t *testing.T) {
 		t.Fatalf("bad: %#v", c)
 	}
 
-	if c.QueryResponseSizeLimit != 123 || c.QuerySizeLimit != 456 {
+	if c.QueryResponseSizeLimit != 123 || c.QuerySizeLimit != 456 ||
+		c.QueryChunkedSizeLimit != 789 || c.LargeEventSizeLimit != 1011 ||
+		c.ExtendedTagsSizeLimit != 2022 {
 		t.Fatalf("bad: %#v", c)
 	}
 
@@ -524,6 +810,21 @@ func TestMergeConfig(t *testing.T) {
 	if !c.EnableCompression {
 		t.Fatalf("bad: %#v", c)
 	}
+
+	if c.SigningKey != "sig" || !c.RequireSignatures {
+		t.Fatalf("bad: %#v", c)
+	}
+
+	expectedKeys := map[string]string{"foo": "abc", "bar": "def"}
+	if !reflect.DeepEqual(c.TrustedKeys, expectedKeys) {
+		t.Fatalf("bad: %#v", c.TrustedKeys)
+	}
+
+	if c.EventRateLimit != (RateLimitConfig{Rate: 1, Burst: 5}) ||
+		c.EventRateLimits["deploy"] != (RateLimitConfig{Rate: 2}) ||
+		c.EventNodeRateLimit != (RateLimitConfig{Rate: 3}) {
+		t.Fatalf("bad: %#v", c)
+	}
 }
 
 func TestReadConfigPaths_badPath(t *testing.T) {
@@ -579,3 +880,38 @@ func TestReadConfigPaths_dir(t *testing.T) {
 		t.Fatalf("bad: %#v", config)
 	}
 }
+
+func TestConfigRPCTLSConfig(t *testing.T) {
+	// No TLS by default
+	c := DefaultConfig()
+	tlsConf, err := c.RPCTLSConfig()
+	if err != nil || tlsConf != nil {
+		t.Fatalf("bad: %v %v", tlsConf, err)
+	}
+
+	// Verifying clients requires a certificate
+	c.RPCTLSVerifyClient = true
+	if _, err := c.RPCTLSConfig(); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	// Verifying clients requires a CA
+	dir := testTLSFiles(t)
+	c.RPCTLSCertFile = filepath.Join(dir, "server.pem")
+	c.RPCTLSKeyFile = filepath.Join(dir, "server-key.pem")
+	if _, err := c.RPCTLSConfig(); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	c.RPCTLSCAFile = filepath.Join(dir, "ca.pem")
+	tlsConf, err = c.RPCTLSConfig()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(tlsConf.Certificates) != 1 || tlsConf.ClientCAs == nil {
+		t.Fatalf("bad: %#v", tlsConf)
+	}
+	if tlsConf.ClientAuth != tls.RequireAndVerifyClientCert {
+		t.Fatalf("bad: %v", tlsConf.ClientAuth)
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright IBM Corp. 2013, 2026
+// SPDX-License-Identifier: MPL-2.0
+
+package agent
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// filterPatterns caches the compiled event filter patterns, since the
+// same patterns are matched against every event
+var filterPatterns sync.Map
+
+// globNamePrefix marks the event names of filters that are globs. Names
+// are otherwise matched exactly unless written as /regex/, so that names
+// containing "*" or "?" keep matching only themselves.
+const globNamePrefix = "~"
+
+// isFilterRegex returns if a filter pattern is a regular expression
+// written as /regex/ rather than a glob
+func isFilterRegex(pattern string) bool {
+	return len(pattern) >= 2 && pattern[0] == '/' && pattern[len(pattern)-1] == '/'
+}
+
+// compileFilterPattern compiles a filter pattern, which is either a
+// /regex/ or a glob where "*" matches any characters and "?" matches a
+// single character. Both must match the whole value.
+func compileFilterPattern(pattern string) (*regexp.Regexp, error) {
+	if re, ok := filterPatterns.Load(pattern); ok {
+		return re.(*regexp.Regexp), nil
+	}
+
+	var expr string
+	if isFilterRegex(pattern) {
+		expr = pattern[1 : len(pattern)-1]
+	} else {
+		expr = regexp.QuoteMeta(pattern)
+		expr = strings.ReplaceAll(expr, `\*`, ".*")
+		expr = strings.ReplaceAll(expr, `\?`, ".")
+		expr = "^" + expr + "$"
+	}
+
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	filterPatterns.Store(pattern, re)
+	return re, nil
+}
+
+// matchFilterName returns if an event name matches the name of a filter,
+// which is either exact, a glob prefixed with "~", or a /regex/
+func matchFilterName(pattern, name string) bool {
+	if glob, ok := strings.CutPrefix(pattern, globNamePrefix); ok {
+		return matchFilterPattern(glob, name)
+	}
+	if isFilterRegex(pattern) {
+		return matchFilterPattern(pattern, name)
+	}
+	return pattern == name
+}
+
+// matchFilterPattern returns if the value matches a filter pattern.
+// Invalid patterns never match.
+func matchFilterPattern(pattern, value string) bool {
+	re, err := compileFilterPattern(pattern)
+	if err != nil {
+		return false
+	}
+	return re.MatchString(value)
+}
+
+// indexFilter returns the index of the first c in v that is not inside a
+// {...} condition list or a /regex/ pattern, or -1 if there is none.
+func indexFilter(v string, c byte) int {
+	depth := 0
+	inRegex := false
+	for i := 0; i < len(v); i++ {
+		switch {
+		case inRegex:
+			if v[i] == '\\' {
+				i++
+			} else if v[i] == '/' {
+				inRegex = false
+			}
+		case v[i] == '/' && (i == 0 || strings.IndexByte(":={,", v[i-1]) >= 0):
+			inRegex = true
+		case v[i] == c && depth == 0:
+			return i
+		case v[i] == '{':
+			depth++
+		case v[i] == '}' && depth > 0:
+			depth--
+		}
+	}
+	return -1
+}
+
+// splitFilter splits v on each sep that is not inside a condition list
+// or a regex pattern
+func splitFilter(v string, sep byte) []string {
+	var parts []string
+	for {
+		idx := indexFilter(v, sep)
+		if idx < 0 {
+			return append(parts, v)
+		}
+		parts = append(parts, v[:idx])
+		v = v[idx+1:]
+	}
+}
+
+// cutFilter splits an event handler in the "type=target" format around
+// the first "=" that is not part of the filter conditions
+func cutFilter(v string) (filter, target string, ok bool) {
+	idx := indexFilter(v, '=')
+	if idx < 0 {
+		return "", v, false
+	}
+	return v[:idx], v[idx+1:], true
+}
+
+// parseFilterConditions parses the "{key=pattern,...}" conditions of a
+// filter. The "node" key matches the node name, any other key matches
+// the value of that tag.
+func parseFilterConditions(v string, filter *EventFilter) bool {
+	if !strings.HasPrefix(v, "{") || !strings.HasSuffix(v, "}") {
+		return false
+	}
+
+	for _, cond := range splitFilter(v[1:len(v)-1], ',') {
+		idx := indexFilter(cond, '=')
+		if idx <= 0 {
+			return false
+		}
+		key, pattern := cond[:idx], cond[idx+1:]
+		if key == "node" {
+			filter.Node = pattern
+			continue
+		}
+		if filter.Tags == nil {
+			filter.Tags = make(map[string]string)
+		}
+		filter.Tags[key] = pattern
+	}
+	return true
+}
@@ -7,9 +7,12 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
+	metrics "github.com/hashicorp/go-metrics/compat"
 	"github.com/hashicorp/serf/serf"
 )
 
@@ -18,22 +21,63 @@ type EventHandler interface {
 	HandleEvent(serf.Event)
 }
 
+// scriptQueueSize is the number of script invocations that may wait for
+// a worker before HandleEvent blocks
+const scriptQueueSize = 1024
+
 // ScriptEventHandler invokes scripts for the events that it receives.
 type ScriptEventHandler struct {
 	SelfFunc func() serf.Member
 	Scripts  []EventScript
 	Logger   *log.Logger
 
+	// Timeout is how long a script may run before it is killed, along
+	// with any processes it spawned. Zero disables the timeout.
+	Timeout time.Duration
+
+	// Workers is the number of scripts that may run concurrently. Events
+	// are then queued for the workers instead of being handled in the
+	// agent's event loop. If zero, scripts are run synchronously.
+	Workers int
+
+	// JournalDir enables the event journals if set. Member and user events
+	// are then written to a journal for each script before being
+	// delivered, and are retried until the script succeeds, including
+	// after the agent restarts. Each script receives its events in order,
+	// independently of the workers.
+	JournalDir string
+
+	// JournalMaxAttempts is the number of times a journaled event is
+	// delivered to a script that fails before it is skipped. Zero retries
+	// the event until the script succeeds.
+	JournalMaxAttempts int
+
 	scriptLock sync.Mutex
 	newScripts []EventScript
+
+	startWorkers sync.Once
+	invokeCh     chan *scriptInvocation
+
+	journalLock sync.Mutex
+	journals    map[string]*journalDelivery
+	shutdown    bool
+}
+
+// scriptInvocation is a script invocation queued for the workers
+type scriptInvocation struct {
+	script string
+	self   serf.Member
+	event  serf.Event
 }
 
 func (h *ScriptEventHandler) HandleEvent(e serf.Event) {
 	// Swap in the new scripts if any
 	h.scriptLock.Lock()
+	swapped := false
 	if h.newScripts != nil {
 		h.Scripts = h.newScripts
 		h.newScripts = nil
+		swapped = true
 	}
 	h.scriptLock.Unlock()
 
@@ -41,67 +85,226 @@ func (h *ScriptEventHandler) HandleEvent(e serf.Event) {
 		h.Logger = log.New(os.Stderr, "", log.LstdFlags)
 	}
 
+	journals := h.updateJournals(h.Scripts, swapped)
+
+	if h.Workers > 0 {
+		h.startWorkers.Do(func() {
+			h.invokeCh = make(chan *scriptInvocation, scriptQueueSize)
+			for i := 0; i < h.Workers; i++ {
+				go h.worker()
+			}
+		})
+	}
+
 	self := h.SelfFunc()
+	journaled := make(map[string]bool)
 	for _, script := range h.Scripts {
 		if !script.Invoke(e) {
 			continue
 		}
 
-		err := invokeEventScript(h.Logger, script.Script, self, e)
-		if err != nil {
-			h.Logger.Printf("[ERR] agent: Error invoking script '%s': %s",
+		// Events for journaled scripts are delivered from the journal,
+		// once for each script even if several of its filters match
+		if d, ok := journals[script.Script]; ok && isJournaled(e) {
+			if journaled[script.Script] {
+				continue
+			}
+			journaled[script.Script] = true
+
+			err := d.journal.Append(e)
+			if err == nil {
+				d.notify()
+				continue
+			}
+			h.Logger.Printf("[ERR] agent: Failed to journal event for script '%s': %v",
 				script.Script, err)
 		}
+
+		inv := &scriptInvocation{script: script.Script, self: self, event: e}
+		if h.invokeCh == nil {
+			h.invoke(inv)
+			continue
+		}
+
+		// Block once the queue is full, to apply back pressure
+		h.invokeCh <- inv
+		metrics.SetGauge([]string{"agent", "invoke", "queue"}, float32(len(h.invokeCh)))
+	}
+}
+
+// worker invokes the queued scripts
+func (h *ScriptEventHandler) worker() {
+	for inv := range h.invokeCh {
+		metrics.SetGauge([]string{"agent", "invoke", "queue"}, float32(len(h.invokeCh)))
+		h.invoke(inv)
+	}
+}
+
+// invoke runs a single script, logging any failure
+func (h *ScriptEventHandler) invoke(inv *scriptInvocation) {
+	err := invokeEventScript(h.Logger, inv.script, inv.self, inv.event, h.Timeout)
+	if err != nil {
+		metrics.IncrCounter([]string{"agent", "invoke", "failed"}, 1)
+		h.Logger.Printf("[ERR] agent: Error invoking script '%s': %s",
+			inv.script, err)
+	}
+}
+
+// updateJournals opens the journals for the current scripts when they
+// change, stopping the delivery for scripts that were removed. It returns
+// the journals by script.
+func (h *ScriptEventHandler) updateJournals(scripts []EventScript, changed bool) map[string]*journalDelivery {
+	h.journalLock.Lock()
+	defer h.journalLock.Unlock()
+
+	if h.JournalDir == "" || h.shutdown || (h.journals != nil && !changed) {
+		return h.journals
+	}
+
+	journals := make(map[string]*journalDelivery)
+	for _, script := range scripts {
+		if _, ok := journals[script.Script]; ok {
+			continue
+		}
+		if d, ok := h.journals[script.Script]; ok {
+			journals[script.Script] = d
+			continue
+		}
+
+		if err := os.MkdirAll(h.JournalDir, 0700); err != nil {
+			h.Logger.Printf("[ERR] agent: Failed to create journal directory: %v", err)
+			continue
+		}
+		path := journalPath(h.JournalDir, script.Script)
+		journal, err := openEventJournal(path, h.Logger)
+		if err != nil {
+			h.Logger.Printf("[ERR] agent: Failed to open journal '%s' for script '%s': %v",
+				path, script.Script, err)
+			continue
+		}
+		if n := journal.Pending(); n > 0 {
+			h.Logger.Printf("[INFO] agent: Replaying %d event(s) to script '%s'", n, script.Script)
+		}
+		journals[script.Script] = newJournalDelivery(h, script.Script, journal)
+	}
+
+	// Stop the removed scripts without waiting for them to finish
+	for script, d := range h.journals {
+		if _, ok := journals[script]; !ok {
+			go d.stop()
+		}
+	}
+	h.journals = journals
+	return journals
+}
+
+// Shutdown stops delivering the journaled events, waiting for any scripts
+// that are running. Undelivered events are kept in the journals.
+func (h *ScriptEventHandler) Shutdown() {
+	h.journalLock.Lock()
+	journals := h.journals
+	h.journals = nil
+	h.shutdown = true
+	h.journalLock.Unlock()
+
+	for _, d := range journals {
+		d.stop()
 	}
 }
 
 // UpdateScripts is used to safely update the scripts we invoke in
-// a thread safe manner
+// a thread safe manner. The journals of the new scripts are opened right
+// away, so that the events left undelivered when the agent stopped are
+// replayed without waiting for another event.
 func (h *ScriptEventHandler) UpdateScripts(scripts []EventScript) {
 	h.scriptLock.Lock()
-	defer h.scriptLock.Unlock()
 	h.newScripts = scripts
+	if h.Logger == nil {
+		h.Logger = log.New(os.Stderr, "", log.LstdFlags)
+	}
+	h.scriptLock.Unlock()
+
+	if h.JournalDir != "" {
+		h.updateJournals(scripts, true)
+	}
 }
 
 // EventFilter is used to filter which events are processed
 type EventFilter struct {
 	Event string
 	Name  string
+
+	// Node and Tags restrict the events to those of members whose name
+	// and tags match the given patterns. For member events any of the
+	// members may match, for user events, gaps, queries and direct
+	// messages the source node must match, and for key/value writes the
+	// node that made the write.
+	Node string
+	Tags map[string]string
 }
 
 // Invoke tests whether or not this event script should be invoked
 // for the given Serf event.
 func (s *EventFilter) Invoke(e serf.Event) bool {
-	if s.Event == "*" {
-		return true
-	}
-
-	if e.EventType().String() != s.Event {
+	if s.Event != "*" && e.EventType().String() != s.Event {
 		return false
 	}
 
-	if s.Event == "user" && s.Name != "" {
-		userE, ok := e.(serf.UserEvent)
-		if !ok {
+	if s.Name != "" {
+		var name string
+		switch e := e.(type) {
+		case serf.UserEvent:
+			name = e.Name
+		case *serf.Query:
+			name = e.Name
+		case serf.KVEvent:
+			name = e.Key
+		default:
 			return false
 		}
 
-		if userE.Name != s.Name {
+		if !matchFilterName(s.Name, name) {
 			return false
 		}
 	}
 
-	if s.Event == "query" && s.Name != "" {
-		query, ok := e.(*serf.Query)
-		if !ok {
-			return false
+	if s.Node == "" && len(s.Tags) == 0 {
+		return true
+	}
+
+	switch e := e.(type) {
+	case serf.MemberEvent:
+		for _, m := range e.Members {
+			if s.matchMember(m.Name, m.Tags) {
+				return true
+			}
 		}
+	case *serf.Query:
+		// The tags of the source node are not known
+		return s.matchMember(e.SourceNode(), nil)
+	case serf.UserEvent:
+		return e.Origin != "" && s.matchMember(e.Origin, nil)
+	case serf.UserEventGap:
+		return s.matchMember(e.Origin, nil)
+	case serf.DirectMessageEvent:
+		return s.matchMember(e.From, nil)
+	case serf.KVEvent:
+		return s.matchMember(e.Node, nil)
+	}
+	return false
+}
 
-		if query.Name != s.Name {
+// matchMember returns if a member's name and tags match the filter
+func (s *EventFilter) matchMember(name string, tags map[string]string) bool {
+	if s.Node != "" && !matchFilterPattern(s.Node, name) {
+		return false
+	}
+	for key, pattern := range s.Tags {
+		value, ok := tags[key]
+		if !ok || !matchFilterPattern(pattern, value) {
 			return false
 		}
 	}
-
 	return true
 }
 
@@ -115,13 +318,54 @@ func (s *EventFilter) Valid() bool {
 	case "member-reap":
 	case "user":
 	case "query":
+	case "direct-message":
+	case "user-gap":
+	case "kv":
 	case "*":
 	default:
 		return false
 	}
+
+	patterns := []string{s.Name, s.Node}
+	for key, pattern := range s.Tags {
+		if key == "" {
+			return false
+		}
+		patterns = append(patterns, pattern)
+	}
+	for _, pattern := range patterns {
+		if _, err := compileFilterPattern(pattern); err != nil {
+			return false
+		}
+	}
 	return true
 }
 
+// String returns the filter in the format it is parsed from
+func (s *EventFilter) String() string {
+	out := s.Event
+	if s.Name != "" {
+		out += ":" + s.Name
+	}
+
+	var conds []string
+	if s.Node != "" {
+		conds = append(conds, "node="+s.Node)
+	}
+	keys := make([]string, 0, len(s.Tags))
+	for key := range s.Tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		conds = append(conds, key+"="+s.Tags[key])
+	}
+	if len(conds) > 0 {
+		out += "{" + strings.Join(conds, ",") + "}"
+	}
+	return out
+}
+
 // EventScript is a single event script that will be executed in the
 // case of an event, and is configured from the command-line or from
 // a configuration file.
@@ -131,24 +375,13 @@ type EventScript struct {
 }
 
 func (s *EventScript) String() string {
-	if s.Name != "" {
-		return fmt.Sprintf("Event '%s:%s' invoking '%s'", s.Event, s.Name, s.Script)
-	}
-	return fmt.Sprintf("Event '%s' invoking '%s'", s.Event, s.Script)
+	return fmt.Sprintf("Event '%s' invoking '%s'", s.EventFilter.String(), s.Script)
 }
 
 // ParseEventScript takes a string in the format of "type=script" and
 // parses it into an EventScript struct, if it can.
 func ParseEventScript(v string) []EventScript {
-	var filter, script string
-	parts := strings.SplitN(v, "=", 2)
-	if len(parts) == 1 {
-		script = parts[0]
-	} else {
-		filter = parts[0]
-		script = parts[1]
-	}
-
+	filter, script, _ := cutFilter(v)
 	filters := ParseEventFilter(filter)
 	results := make([]EventScript, 0, len(filters))
 	for _, filt := range filters {
@@ -162,25 +395,42 @@ func ParseEventScript(v string) []EventScript {
 }
 
 // ParseEventFilter a string with the event type filters and
-// parses it into a series of EventFilters if it can.
+// parses it into a series of EventFilters if it can. Each filter is an
+// event type, optionally followed by a user event or query name, or a key,
+// and a list of conditions, such as "user:~deploy-*{role=web}". Names are exact,
+// globs prefixed with "~", or regular expressions written as /regex/, and
+// condition values are globs or regular expressions.
 func ParseEventFilter(v string) []EventFilter {
 	// No filter translates to stream all
 	if v == "" {
 		v = "*"
 	}
 
-	events := strings.Split(v, ",")
+	events := splitFilter(v, ',')
 	results := make([]EventFilter, 0, len(events))
 	for _, event := range events {
 		var result EventFilter
 		var name string
 
+		// Split off the conditions. Filters that fail to parse keep the
+		// whole string as the event so they are not valid.
+		if idx := indexFilter(event, '{'); idx >= 0 {
+			if !parseFilterConditions(event[idx:], &result) {
+				results = append(results, EventFilter{Event: event})
+				continue
+			}
+			event = event[:idx]
+		}
+
 		if strings.HasPrefix(event, "user:") {
 			name = event[len("user:"):]
 			event = "user"
 		} else if strings.HasPrefix(event, "query:") {
 			name = event[len("query:"):]
 			event = "query"
+		} else if strings.HasPrefix(event, "kv:") {
+			name = event[len("kv:"):]
+			event = "kv"
 		}
 
 		result.Event = event
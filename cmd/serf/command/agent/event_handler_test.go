@@ -7,7 +7,10 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"reflect"
+	"runtime"
 	"testing"
+	"time"
 
 	"github.com/hashicorp/serf/serf"
 )
@@ -35,6 +38,12 @@ while read line; do
 done
 `
 
+const userGapScript = `#!/bin/sh
+RESULT_FILE="%s"
+echo $SERF_EVENT $SERF_USER_ORIGIN >>${RESULT_FILE}
+echo $SERF_GAP_FIRST_SEQ $SERF_GAP_LAST_SEQ $SERF_GAP_MISSED >>${RESULT_FILE}
+`
+
 const queryScript = `#!/bin/sh
 RESULT_FILE="%s"
 echo $SERF_SELF_NAME $SERF_SELF_ROLE >>${RESULT_FILE}
@@ -162,6 +171,41 @@ func TestScriptUserEventHandler(t *testing.T) {
 	}
 }
 
+func TestScriptUserGapEventHandler(t *testing.T) {
+	script, results := testEventScript(t, userGapScript)
+
+	h := &ScriptEventHandler{
+		SelfFunc: func() serf.Member {
+			return serf.Member{Name: "ourname"}
+		},
+		Scripts: []EventScript{
+			{
+				EventFilter: EventFilter{
+					Event: "user-gap",
+				},
+				Script: script,
+			},
+		},
+	}
+
+	h.HandleEvent(serf.UserEventGap{
+		Origin:   "foo",
+		FirstSeq: 3,
+		LastSeq:  5,
+		Missed:   2,
+	})
+
+	result, err := os.ReadFile(results)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	expected := "user-gap foo\n3 5 2\n"
+	if string(result) != expected {
+		t.Fatalf("bad: %#v. Expected: %#v", string(result), expected)
+	}
+}
+
 func TestScriptQueryEventHandler(t *testing.T) {
 	script, results := testEventScript(t, queryScript)
 
@@ -201,6 +245,148 @@ func TestScriptQueryEventHandler(t *testing.T) {
 	}
 }
 
+func TestScriptEventHandler_Timeout(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.SkipNow()
+	}
+
+	// The background sleep holds the output open, so the handler only
+	// returns early if the whole process group is killed
+	h := &ScriptEventHandler{
+		SelfFunc: func() serf.Member { return serf.Member{Name: "ourname"} },
+		Scripts: []EventScript{
+			{EventFilter: EventFilter{Event: "*"}, Script: "sleep 10 & sleep 10"},
+		},
+		Timeout: 100 * time.Millisecond,
+	}
+
+	start := time.Now()
+	h.HandleEvent(serf.UserEvent{Name: "foo"})
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("script was not killed: %v", elapsed)
+	}
+}
+
+func TestScriptEventHandler_Workers(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.SkipNow()
+	}
+
+	script, results := testEventScript(t, "#!/bin/sh\nsleep 0.2\necho $SERF_USER_EVENT >>%s\n")
+	h := &ScriptEventHandler{
+		SelfFunc: func() serf.Member { return serf.Member{Name: "ourname"} },
+		Scripts: []EventScript{
+			{EventFilter: EventFilter{Event: "user"}, Script: script},
+		},
+		Workers: 2,
+	}
+
+	// Events are queued instead of blocking on the scripts
+	start := time.Now()
+	h.HandleEvent(serf.UserEvent{Name: "foo"})
+	h.HandleEvent(serf.UserEvent{Name: "bar"})
+	if elapsed := time.Since(start); elapsed > 150*time.Millisecond {
+		t.Fatalf("handler blocked: %v", elapsed)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		result, err := os.ReadFile(results)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if string(result) == "foo\nbar\n" || string(result) == "bar\nfoo\n" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("bad: %q", result)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestScriptEventHandler_OneWorker(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.SkipNow()
+	}
+
+	// The earlier events take longer, so they would finish last if the
+	// scripts ran concurrently
+	script, results := testEventScript(t, "#!/bin/sh\nsleep 0.0$SERF_USER_EVENT\necho $SERF_USER_EVENT >>%s\n")
+	h := &ScriptEventHandler{
+		SelfFunc: func() serf.Member { return serf.Member{Name: "ourname"} },
+		Scripts: []EventScript{
+			{EventFilter: EventFilter{Event: "user"}, Script: script},
+		},
+		Workers: 1,
+	}
+
+	for _, name := range []string{"5", "4", "3", "2", "1"} {
+		h.HandleEvent(serf.UserEvent{Name: name})
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		result, err := os.ReadFile(results)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if len(result) == len("5\n4\n3\n2\n1\n") {
+			if string(result) != "5\n4\n3\n2\n1\n" {
+				t.Fatalf("bad: %q", result)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("bad: %q", result)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestParseEventFilter_Conditions(t *testing.T) {
+	testCases := []struct {
+		v       string
+		results []EventFilter
+	}{
+		{
+			"member-failed{role=db}",
+			[]EventFilter{{Event: "member-failed", Tags: map[string]string{"role": "db"}}},
+		},
+		{
+			"member-join{node=web-*,role=web,dc=/east|west/},user:~deploy-*",
+			[]EventFilter{
+				{Event: "member-join", Node: "web-*", Tags: map[string]string{"role": "web", "dc": "/east|west/"}},
+				{Event: "user", Name: "~deploy-*"},
+			},
+		},
+		{
+			"query:/^(a|b),{1}$/{node=db1}",
+			[]EventFilter{{Event: "query", Name: "/^(a|b),{1}$/", Node: "db1"}},
+		},
+		{
+			"member-join{role}",
+			[]EventFilter{{Event: "member-join{role}"}},
+		},
+	}
+
+	for _, tc := range testCases {
+		results := ParseEventFilter(tc.v)
+		if !reflect.DeepEqual(results, tc.results) {
+			t.Errorf("bad: %s %#v", tc.v, results)
+		}
+	}
+
+	// The string form parses back into the same filter
+	f := EventFilter{Event: "user", Name: "deploy", Node: "web-*", Tags: map[string]string{"role": "web"}}
+	if s := f.String(); s != "user:deploy{node=web-*,role=web}" {
+		t.Fatalf("bad: %s", s)
+	}
+	if results := ParseEventFilter(f.String()); !reflect.DeepEqual(results, []EventFilter{f}) {
+		t.Fatalf("bad: %#v", results)
+	}
+}
+
 func TestEventScriptInvoke(t *testing.T) {
 	testCases := []struct {
 		script EventScript
@@ -208,55 +394,150 @@ func TestEventScriptInvoke(t *testing.T) {
 		invoke bool
 	}{
 		{
-			EventScript{EventFilter{"*", ""}, "script.sh"},
+			EventScript{EventFilter{Event: "*"}, "script.sh"},
 			serf.MemberEvent{},
 			true,
 		},
 		{
-			EventScript{EventFilter{"user", ""}, "script.sh"},
+			EventScript{EventFilter{Event: "user"}, "script.sh"},
 			serf.MemberEvent{},
 			false,
 		},
 		{
-			EventScript{EventFilter{"user", "deploy"}, "script.sh"},
+			EventScript{EventFilter{Event: "user", Name: "deploy"}, "script.sh"},
 			serf.UserEvent{Name: "deploy"},
 			true,
 		},
 		{
-			EventScript{EventFilter{"user", "deploy"}, "script.sh"},
+			EventScript{EventFilter{Event: "user", Name: "deploy"}, "script.sh"},
 			serf.UserEvent{Name: "restart"},
 			false,
 		},
 		{
-			EventScript{EventFilter{"member-join", ""}, "script.sh"},
+			EventScript{EventFilter{Event: "member-join"}, "script.sh"},
 			serf.MemberEvent{Type: serf.EventMemberJoin},
 			true,
 		},
 		{
-			EventScript{EventFilter{"member-join", ""}, "script.sh"},
+			EventScript{EventFilter{Event: "member-join"}, "script.sh"},
 			serf.MemberEvent{Type: serf.EventMemberLeave},
 			false,
 		},
 		{
-			EventScript{EventFilter{"member-reap", ""}, "script.sh"},
+			EventScript{EventFilter{Event: "member-reap"}, "script.sh"},
 			serf.MemberEvent{Type: serf.EventMemberReap},
 			true,
 		},
 		{
-			EventScript{EventFilter{"query", "deploy"}, "script.sh"},
+			EventScript{EventFilter{Event: "query", Name: "deploy"}, "script.sh"},
 			&serf.Query{Name: "deploy"},
 			true,
 		},
 		{
-			EventScript{EventFilter{"query", "uptime"}, "script.sh"},
+			EventScript{EventFilter{Event: "query", Name: "uptime"}, "script.sh"},
 			&serf.Query{Name: "deploy"},
 			false,
 		},
 		{
-			EventScript{EventFilter{"query", ""}, "script.sh"},
+			EventScript{EventFilter{Event: "query"}, "script.sh"},
 			&serf.Query{Name: "deploy"},
 			true,
 		},
+		{
+			EventScript{EventFilter{Event: "user", Name: "~deploy-*"}, "script.sh"},
+			serf.UserEvent{Name: "deploy-web"},
+			true,
+		},
+		{
+			EventScript{EventFilter{Event: "user", Name: "~deploy-?"}, "script.sh"},
+			serf.UserEvent{Name: "deploy-web"},
+			false,
+		},
+		{
+			EventScript{EventFilter{Event: "user", Name: "deploy-*"}, "script.sh"},
+			serf.UserEvent{Name: "deploy-web"},
+			false,
+		},
+		{
+			EventScript{EventFilter{Event: "user", Name: "deploy-*"}, "script.sh"},
+			serf.UserEvent{Name: "deploy-*"},
+			true,
+		},
+		{
+			EventScript{EventFilter{Event: "query", Name: "up?"}, "script.sh"},
+			&serf.Query{Name: "upx"},
+			false,
+		},
+		{
+			EventScript{EventFilter{Event: "query", Name: "/^(load|uptime)$/"}, "script.sh"},
+			&serf.Query{Name: "uptime"},
+			true,
+		},
+		{
+			EventScript{EventFilter{Event: "member-failed", Tags: map[string]string{"role": "db"}}, "script.sh"},
+			serf.MemberEvent{
+				Type: serf.EventMemberFailed,
+				Members: []serf.Member{
+					{Name: "web1", Tags: map[string]string{"role": "web"}},
+					{Name: "db1", Tags: map[string]string{"role": "db"}},
+				},
+			},
+			true,
+		},
+		{
+			EventScript{EventFilter{Event: "member-failed", Tags: map[string]string{"role": "db"}}, "script.sh"},
+			serf.MemberEvent{
+				Type:    serf.EventMemberFailed,
+				Members: []serf.Member{{Name: "web1", Tags: map[string]string{"role": "web"}}},
+			},
+			false,
+		},
+		{
+			EventScript{EventFilter{Event: "*", Node: "db*", Tags: map[string]string{"dc": "/east|west/"}}, "script.sh"},
+			serf.MemberEvent{
+				Type:    serf.EventMemberJoin,
+				Members: []serf.Member{{Name: "db1", Tags: map[string]string{"dc": "east"}}},
+			},
+			true,
+		},
+		{
+			EventScript{EventFilter{Event: "*", Node: "db*"}, "script.sh"},
+			serf.MemberEvent{
+				Type:    serf.EventMemberJoin,
+				Members: []serf.Member{{Name: "web1"}},
+			},
+			false,
+		},
+		{
+			EventScript{EventFilter{Event: "user", Node: "db*"}, "script.sh"},
+			serf.UserEvent{Name: "deploy"},
+			false,
+		},
+		{
+			EventScript{EventFilter{Event: "user", Node: "db*"}, "script.sh"},
+			serf.UserEvent{Name: "deploy", Origin: "db1"},
+			true,
+		},
+		{
+			EventScript{EventFilter{Event: "user-gap", Node: "db*"}, "script.sh"},
+			serf.UserEventGap{Origin: "db1", FirstSeq: 2, LastSeq: 3, Missed: 2},
+			true,
+		},
+		{
+			EventScript{EventFilter{Event: "user-gap", Node: "db*"}, "script.sh"},
+			serf.UserEventGap{Origin: "web1", FirstSeq: 2, LastSeq: 3, Missed: 2},
+			false,
+		},
+		{
+			EventScript{EventFilter{Event: "kv", Name: "~app/*", Node: "db*"}, "script.sh"},
+			serf.KVEvent{Key: "app/version", Node: "db1"},
+			true,
+		},
+		{
+			EventScript{EventFilter{Event: "kv", Name: "~app/*"}, "script.sh"},
+			serf.KVEvent{Key: "db/version", Node: "db1"},
+			false,
+		},
 	}
 
 	for _, tc := range testCases {
@@ -282,6 +563,9 @@ func TestEventScriptValid(t *testing.T) {
 		{"member", false},
 		{"query", true},
 		{"Query", false},
+		{"direct-message", true},
+		{"user-gap", true},
+		{"kv", true},
 		{"*", true},
 	}
 
@@ -291,6 +575,17 @@ func TestEventScriptValid(t *testing.T) {
 			t.Errorf("bad: %#v", tc)
 		}
 	}
+
+	invalid := []EventFilter{
+		{Event: "user", Name: "/(/"},
+		{Event: "*", Node: "/[/"},
+		{Event: "*", Tags: map[string]string{"": "db"}},
+	}
+	for _, f := range invalid {
+		if f.Valid() {
+			t.Errorf("should be invalid: %#v", f)
+		}
+	}
 }
 
 func TestParseEventScript(t *testing.T) {
@@ -302,51 +597,57 @@ func TestParseEventScript(t *testing.T) {
 		{
 			"script.sh",
 			false,
-			[]EventScript{{EventFilter{"*", ""}, "script.sh"}},
+			[]EventScript{{EventFilter{Event: "*"}, "script.sh"}},
 		},
 
 		{
 			"member-join=script.sh",
 			false,
-			[]EventScript{{EventFilter{"member-join", ""}, "script.sh"}},
+			[]EventScript{{EventFilter{Event: "member-join"}, "script.sh"}},
 		},
 
 		{
 			"foo,bar=script.sh",
 			false,
 			[]EventScript{
-				{EventFilter{"foo", ""}, "script.sh"},
-				{EventFilter{"bar", ""}, "script.sh"},
+				{EventFilter{Event: "foo"}, "script.sh"},
+				{EventFilter{Event: "bar"}, "script.sh"},
 			},
 		},
 
 		{
 			"user:deploy=script.sh",
 			false,
-			[]EventScript{{EventFilter{"user", "deploy"}, "script.sh"}},
+			[]EventScript{{EventFilter{Event: "user", Name: "deploy"}, "script.sh"}},
 		},
 
 		{
 			"foo,user:blah,bar,query:tubez=script.sh",
 			false,
 			[]EventScript{
-				{EventFilter{"foo", ""}, "script.sh"},
-				{EventFilter{"user", "blah"}, "script.sh"},
-				{EventFilter{"bar", ""}, "script.sh"},
-				{EventFilter{"query", "tubez"}, "script.sh"},
+				{EventFilter{Event: "foo"}, "script.sh"},
+				{EventFilter{Event: "user", Name: "blah"}, "script.sh"},
+				{EventFilter{Event: "bar"}, "script.sh"},
+				{EventFilter{Event: "query", Name: "tubez"}, "script.sh"},
 			},
 		},
 
+		{
+			"member-failed{role=db}=script.sh",
+			false,
+			[]EventScript{{EventFilter{Event: "member-failed", Tags: map[string]string{"role": "db"}}, "script.sh"}},
+		},
+
 		{
 			"query:load=script.sh",
 			false,
-			[]EventScript{{EventFilter{"query", "load"}, "script.sh"}},
+			[]EventScript{{EventFilter{Event: "query", Name: "load"}, "script.sh"}},
 		},
 
 		{
 			"query=script.sh",
 			false,
-			[]EventScript{{EventFilter{"query", ""}, "script.sh"}},
+			[]EventScript{{EventFilter{Event: "query"}, "script.sh"}},
 		},
 	}
 
@@ -387,44 +688,49 @@ func TestParseEventFilter(t *testing.T) {
 	}{
 		{
 			"",
-			[]EventFilter{EventFilter{"*", ""}},
+			[]EventFilter{EventFilter{Event: "*"}},
 		},
 
 		{
 			"member-join",
-			[]EventFilter{EventFilter{"member-join", ""}},
+			[]EventFilter{EventFilter{Event: "member-join"}},
 		},
 
 		{
 			"member-reap",
-			[]EventFilter{EventFilter{"member-reap", ""}},
+			[]EventFilter{EventFilter{Event: "member-reap"}},
 		},
 
 		{
 			"foo,bar",
 			[]EventFilter{
-				EventFilter{"foo", ""},
-				EventFilter{"bar", ""},
+				EventFilter{Event: "foo"},
+				EventFilter{Event: "bar"},
 			},
 		},
 
 		{
 			"user:deploy",
-			[]EventFilter{EventFilter{"user", "deploy"}},
+			[]EventFilter{EventFilter{Event: "user", Name: "deploy"}},
 		},
 
 		{
 			"foo,user:blah,bar",
 			[]EventFilter{
-				EventFilter{"foo", ""},
-				EventFilter{"user", "blah"},
-				EventFilter{"bar", ""},
+				EventFilter{Event: "foo"},
+				EventFilter{Event: "user", Name: "blah"},
+				EventFilter{Event: "bar"},
 			},
 		},
 
 		{
 			"query:load",
-			[]EventFilter{EventFilter{"query", "load"}},
+			[]EventFilter{EventFilter{Event: "query", Name: "load"}},
+		},
+
+		{
+			"kv:~app/*",
+			[]EventFilter{EventFilter{Event: "kv", Name: "~app/*"}},
 		},
 	}
 
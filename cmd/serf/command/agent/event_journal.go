@@ -0,0 +1,370 @@
+// Copyright IBM Corp. 2013, 2026
+// SPDX-License-Identifier: MPL-2.0
+
+package agent
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	metrics "github.com/hashicorp/go-metrics/compat"
+	"github.com/hashicorp/serf/serf"
+)
+
+const (
+	// journalMaxPending is the number of undelivered events kept for a
+	// handler. The oldest events are dropped beyond this.
+	journalMaxPending = 4096
+
+	// journalCompactRecords is the number of records written before the
+	// journal is rewritten with only the undelivered events
+	journalCompactRecords = 1024
+
+	// journalMaxRecordSize bounds the size of a single journal record
+	journalMaxRecordSize = 16 * 1024 * 1024
+
+	// journalRetryMin and journalRetryMax bound the backoff before
+	// retrying delivery of an event to a handler that failed
+	journalRetryMin = time.Second
+	journalRetryMax = time.Minute
+)
+
+// journalRecord is a single line of an event journal. Records either hold
+// an event to deliver, or acknowledge the delivery of an earlier event.
+type journalRecord struct {
+	Seq    uint64            `json:",omitempty"`
+	Ack    uint64            `json:",omitempty"`
+	Member *serf.MemberEvent `json:",omitempty"`
+	User   *serf.UserEvent   `json:",omitempty"`
+}
+
+// event returns the event held by the record
+func (r *journalRecord) event() serf.Event {
+	if r.Member != nil {
+		return *r.Member
+	}
+	return *r.User
+}
+
+// isJournaled returns if the event is persisted in the journal. Queries
+// are not, as they can't be responded to once their deadline passes.
+func isJournaled(e serf.Event) bool {
+	switch e.(type) {
+	case serf.MemberEvent, serf.UserEvent:
+		return true
+	}
+	return false
+}
+
+// journalPath returns the path of the journal for a handler script
+func journalPath(dir, script string) string {
+	sum := sha256.Sum256([]byte(script))
+	return filepath.Join(dir, hex.EncodeToString(sum[:8])+".journal")
+}
+
+// eventJournal is an append-only file of the events to deliver to a single
+// handler. Events stay in the journal until they are acknowledged, so any
+// that were not delivered before the agent stopped are delivered again
+// once it restarts.
+type eventJournal struct {
+	path    string
+	file    *os.File
+	logger  *log.Logger
+	nextSeq uint64
+	pending []*journalRecord
+	records int
+	lock    sync.Mutex
+}
+
+// openEventJournal opens the journal at the given path, creating it if it
+// does not exist and loading the events that were not acknowledged.
+func openEventJournal(path string, logger *log.Logger) (*eventJournal, error) {
+	j := &eventJournal{
+		path:    path,
+		logger:  logger,
+		nextSeq: 1,
+	}
+	if err := j.load(); err != nil {
+		return nil, err
+	}
+
+	// Rewrite the journal to drop the delivered events, along with any
+	// partial record left by a crash
+	if err := j.compact(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// load reads the records of an existing journal
+func (j *eventJournal) load() error {
+	fh, err := os.Open(j.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	scanner := bufio.NewScanner(fh)
+	scanner.Buffer(make([]byte, 0, 64*1024), journalMaxRecordSize)
+	for scanner.Scan() {
+		var rec journalRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			j.logger.Printf("[WARN] agent: Ignoring corrupt record in journal '%s': %v", j.path, err)
+			break
+		}
+
+		switch {
+		case rec.Ack != 0:
+			for len(j.pending) > 0 && j.pending[0].Seq <= rec.Ack {
+				j.pending = j.pending[1:]
+			}
+		case rec.Member != nil || rec.User != nil:
+			j.pending = append(j.pending, &rec)
+			j.nextSeq = rec.Seq + 1
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		j.logger.Printf("[WARN] agent: Failed to read journal '%s': %v", j.path, err)
+	}
+	return nil
+}
+
+// compact replaces the journal with one holding only the pending events.
+// The lock must be held, or the journal not yet shared.
+func (j *eventJournal) compact() error {
+	tmp := j.path + ".tmp"
+	fh, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	buf := bufio.NewWriter(fh)
+	enc := json.NewEncoder(buf)
+	for _, rec := range j.pending {
+		if err := enc.Encode(rec); err != nil {
+			fh.Close()
+			return err
+		}
+	}
+	if err := buf.Flush(); err != nil {
+		fh.Close()
+		return err
+	}
+	if err := fh.Sync(); err != nil {
+		fh.Close()
+		return err
+	}
+	fh.Close()
+
+	if err := os.Rename(tmp, j.path); err != nil {
+		return err
+	}
+
+	if j.file != nil {
+		j.file.Close()
+	}
+	j.file, err = os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	j.records = len(j.pending)
+	return nil
+}
+
+// write appends a record to the journal and syncs it to disk. The lock
+// must be held.
+func (j *eventJournal) write(rec *journalRecord) error {
+	buf, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := j.file.Write(append(buf, '\n')); err != nil {
+		return err
+	}
+	j.records++
+	return j.file.Sync()
+}
+
+// Append adds an event to the journal. If there are too many undelivered
+// events, the oldest one is dropped.
+func (j *eventJournal) Append(e serf.Event) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	rec := &journalRecord{Seq: j.nextSeq}
+	switch e := e.(type) {
+	case serf.MemberEvent:
+		rec.Member = &e
+	case serf.UserEvent:
+		rec.User = &e
+	default:
+		return fmt.Errorf("Unknown event type: %s", e.EventType().String())
+	}
+
+	if len(j.pending) >= journalMaxPending {
+		dropped := j.pending[0]
+		if err := j.write(&journalRecord{Ack: dropped.Seq}); err != nil {
+			return err
+		}
+		j.pending = j.pending[1:]
+		metrics.IncrCounter([]string{"agent", "journal", "dropped"}, 1)
+		j.logger.Printf("[WARN] agent: Journal '%s' is full, dropping event '%s'",
+			j.path, dropped.event().String())
+	}
+
+	if err := j.write(rec); err != nil {
+		return err
+	}
+	j.nextSeq++
+	j.pending = append(j.pending, rec)
+	return nil
+}
+
+// Next returns the oldest undelivered event, or nil if there is none
+func (j *eventJournal) Next() *journalRecord {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if len(j.pending) == 0 {
+		return nil
+	}
+	return j.pending[0]
+}
+
+// Ack records that the event with the given sequence number, and all
+// those before it, were delivered.
+func (j *eventJournal) Ack(seq uint64) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if err := j.write(&journalRecord{Ack: seq}); err != nil {
+		return err
+	}
+	for len(j.pending) > 0 && j.pending[0].Seq <= seq {
+		j.pending = j.pending[1:]
+	}
+
+	if j.records >= journalCompactRecords {
+		return j.compact()
+	}
+	return nil
+}
+
+// Pending returns the number of undelivered events
+func (j *eventJournal) Pending() int {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return len(j.pending)
+}
+
+// Close closes the journal file
+func (j *eventJournal) Close() error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return j.file.Close()
+}
+
+// journalDelivery delivers the events in a journal to a handler script in
+// order, retrying each event with a backoff until the script succeeds, or
+// until it has been attempted JournalMaxAttempts times and is skipped.
+type journalDelivery struct {
+	script   string
+	journal  *eventJournal
+	handler  *ScriptEventHandler
+	notifyCh chan struct{}
+	stopCh   chan struct{}
+	doneCh   chan struct{}
+}
+
+func newJournalDelivery(h *ScriptEventHandler, script string, journal *eventJournal) *journalDelivery {
+	d := &journalDelivery{
+		script:   script,
+		journal:  journal,
+		handler:  h,
+		notifyCh: make(chan struct{}, 1),
+		stopCh:   make(chan struct{}),
+		doneCh:   make(chan struct{}),
+	}
+	go d.run()
+	return d
+}
+
+// notify wakes up the delivery after an event was appended
+func (d *journalDelivery) notify() {
+	select {
+	case d.notifyCh <- struct{}{}:
+	default:
+	}
+}
+
+// stop stops the delivery and closes the journal, waiting for any running
+// script to finish
+func (d *journalDelivery) stop() {
+	close(d.stopCh)
+	<-d.doneCh
+	d.journal.Close()
+}
+
+func (d *journalDelivery) run() {
+	defer close(d.doneCh)
+	logger := d.handler.Logger
+
+	backoff := journalRetryMin
+	attempts := 0
+	for {
+		rec := d.journal.Next()
+		if rec == nil {
+			select {
+			case <-d.notifyCh:
+				continue
+			case <-d.stopCh:
+				return
+			}
+		}
+
+		event := rec.event()
+		err := invokeEventScript(logger, d.script, d.handler.SelfFunc(), event, d.handler.Timeout)
+		attempts++
+		if err != nil {
+			metrics.IncrCounter([]string{"agent", "invoke", "failed"}, 1)
+		}
+
+		// Skip events that keep failing, so that they don't hold back the
+		// later events forever
+		maxAttempts := d.handler.JournalMaxAttempts
+		if err != nil && maxAttempts > 0 && attempts >= maxAttempts {
+			metrics.IncrCounter([]string{"agent", "journal", "skipped"}, 1)
+			logger.Printf("[ERR] agent: Skipping event '%s' for script '%s' after %d failed attempt(s): %s",
+				event.String(), d.script, attempts, err)
+			err = nil
+		}
+
+		if err == nil {
+			backoff = journalRetryMin
+			attempts = 0
+			if err := d.journal.Ack(rec.Seq); err != nil {
+				logger.Printf("[ERR] agent: Failed to update journal for script '%s': %v", d.script, err)
+			}
+			metrics.SetGauge([]string{"agent", "journal", "pending"}, float32(d.journal.Pending()))
+			continue
+		}
+
+		logger.Printf("[ERR] agent: Error invoking script '%s' for event '%s', retrying in %v: %s",
+			d.script, event.String(), backoff, err)
+		select {
+		case <-time.After(backoff):
+			backoff = min(backoff*2, journalRetryMax)
+		case <-d.stopCh:
+			return
+		}
+	}
+}
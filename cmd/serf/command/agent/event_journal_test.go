@@ -0,0 +1,237 @@
+// Copyright IBM Corp. 2013, 2026
+// SPDX-License-Identifier: MPL-2.0
+
+package agent
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+
+	"github.com/hashicorp/serf/serf"
+)
+
+// journalScript records the user events it is invoked for, and fails
+// while a marker file next to the results exists
+const journalScript = `#!/bin/sh
+echo $SERF_USER_EVENT >>%[1]s
+[ -e %[1]s.fail ] && exit 1
+exit 0
+`
+
+func testJournalLogger() *log.Logger {
+	return log.New(os.Stderr, "", log.LstdFlags)
+}
+
+func TestEventJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.journal")
+	j, err := openEventJournal(path, testJournalLogger())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	member := serf.MemberEvent{
+		Type:    serf.EventMemberJoin,
+		Members: []serf.Member{{Name: "foo", Tags: map[string]string{"role": "web"}}},
+	}
+	user := serf.UserEvent{LTime: 3, Name: "deploy", Payload: []byte("bar")}
+	if err := j.Append(member); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := j.Append(user); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	rec := j.Next()
+	if rec == nil || rec.Seq != 1 || !reflect.DeepEqual(rec.event(), member) {
+		t.Fatalf("bad: %#v", rec)
+	}
+	if err := j.Ack(rec.Seq); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	j.Close()
+
+	// Only the unacknowledged event is loaded again
+	j, err = openEventJournal(path, testJournalLogger())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer j.Close()
+
+	if n := j.Pending(); n != 1 {
+		t.Fatalf("bad: %d", n)
+	}
+	rec = j.Next()
+	if rec.Seq != 2 || !reflect.DeepEqual(rec.event(), user) {
+		t.Fatalf("bad: %#v", rec)
+	}
+
+	// Sequence numbers keep increasing
+	if err := j.Append(user); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if n := j.nextSeq; n != 4 {
+		t.Fatalf("bad: %d", n)
+	}
+}
+
+func TestEventJournal_Corrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.journal")
+	j, err := openEventJournal(path, testJournalLogger())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := j.Append(serf.UserEvent{Name: "first"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	j.Close()
+
+	// Simulate a partial write
+	fh, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	fh.WriteString(`{"Seq":2,"User":{"Na`)
+	fh.Close()
+
+	j, err = openEventJournal(path, testJournalLogger())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer j.Close()
+
+	if n := j.Pending(); n != 1 {
+		t.Fatalf("bad: %d", n)
+	}
+	if err := j.Append(serf.UserEvent{Name: "second"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestScriptEventHandler_Journal(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.SkipNow()
+	}
+
+	script, results := testEventScript(t, journalScript)
+	if err := os.WriteFile(results+".fail", nil, 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.Remove(results + ".fail")
+
+	dir := t.TempDir()
+	newHandler := func() *ScriptEventHandler {
+		return &ScriptEventHandler{
+			SelfFunc: func() serf.Member { return serf.Member{Name: "ourname"} },
+			Scripts: []EventScript{
+				{EventFilter: EventFilter{Event: "user"}, Script: script},
+				{EventFilter: EventFilter{Event: "user", Name: "foo"}, Script: script},
+			},
+			JournalDir: dir,
+		}
+	}
+
+	// The failed event stays in the journal when the handler stops
+	h := newHandler()
+	h.HandleEvent(serf.UserEvent{Name: "foo"})
+	waitResultLines(t, results, 1)
+	h.Shutdown()
+
+	// Once restarted, the failed event is delivered before the new one
+	if err := os.Remove(results + ".fail"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	h = newHandler()
+	defer h.Shutdown()
+	h.HandleEvent(serf.UserEvent{Name: "bar"})
+
+	lines := waitResultLines(t, results, 3)
+	var names []string
+	for _, line := range lines {
+		names = append(names, string(line))
+	}
+	if !reflect.DeepEqual(names, []string{"foo", "foo", "bar"}) {
+		t.Fatalf("bad: %v", names)
+	}
+}
+
+func TestScriptEventHandler_JournalReplay(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.SkipNow()
+	}
+
+	script, results := testEventScript(t, journalScript)
+	if err := os.WriteFile(results+".fail", nil, 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.Remove(results + ".fail")
+
+	dir := t.TempDir()
+	scripts := []EventScript{
+		{EventFilter: EventFilter{Event: "user"}, Script: script},
+	}
+	h := &ScriptEventHandler{
+		SelfFunc:   func() serf.Member { return serf.Member{Name: "ourname"} },
+		JournalDir: dir,
+	}
+	h.UpdateScripts(scripts)
+	h.HandleEvent(serf.UserEvent{Name: "foo"})
+	waitResultLines(t, results, 1)
+	h.Shutdown()
+
+	// The failed event is replayed once the scripts are set, without
+	// waiting for a new event
+	if err := os.Remove(results + ".fail"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	h = &ScriptEventHandler{
+		SelfFunc:   func() serf.Member { return serf.Member{Name: "ourname"} },
+		JournalDir: dir,
+	}
+	defer h.Shutdown()
+	h.UpdateScripts(scripts)
+
+	lines := waitResultLines(t, results, 2)
+	if string(lines[1]) != "foo" {
+		t.Fatalf("bad: %s", lines)
+	}
+}
+
+func TestScriptEventHandler_JournalMaxAttempts(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.SkipNow()
+	}
+
+	script, results := testEventScript(t, journalScript)
+	if err := os.WriteFile(results+".fail", nil, 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.Remove(results + ".fail")
+
+	h := &ScriptEventHandler{
+		SelfFunc: func() serf.Member { return serf.Member{Name: "ourname"} },
+		Scripts: []EventScript{
+			{EventFilter: EventFilter{Event: "user"}, Script: script},
+		},
+		JournalDir:         t.TempDir(),
+		JournalMaxAttempts: 2,
+	}
+	defer h.Shutdown()
+
+	// The event that keeps failing is skipped after its attempts, and no
+	// longer holds back the next one
+	h.HandleEvent(serf.UserEvent{Name: "foo"})
+	h.HandleEvent(serf.UserEvent{Name: "bar"})
+
+	lines := waitResultLines(t, results, 3)
+	var names []string
+	for _, line := range lines[:3] {
+		names = append(names, string(line))
+	}
+	if !reflect.DeepEqual(names, []string{"foo", "foo", "bar"}) {
+		t.Fatalf("bad: %v", names)
+	}
+}
@@ -0,0 +1,744 @@
+// Copyright IBM Corp. 2013, 2026
+// SPDX-License-Identifier: MPL-2.0
+
+package agent
+
+/*
+ The agent can optionally expose an HTTP API alongside the msgpack IPC.
+ The HTTP API mirrors the IPC commands, using JSON encoded bodies with the
+ same field names as the IPC request and response structures. This allows
+ tooling written in any language to control Serf without a msgpack client.
+
+ Streaming commands (stream, monitor and query) hold the response open and
+ write one JSON record per line as the records become available. Clients
+ that send "Accept: text/event-stream" instead receive the records framed
+ as Server-Sent Events.
+
+ If an RPC auth key or RPC tokens are configured, every request must
+ provide one, either in the X-Serf-Auth header or the "auth" query
+ parameter. RPC tokens are restricted to the commands they allow.
+*/
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	metrics "github.com/hashicorp/go-metrics/compat"
+	"github.com/hashicorp/logutils"
+	"github.com/hashicorp/serf/coordinate"
+	"github.com/hashicorp/serf/serf"
+)
+
+const (
+	// httpAuthHeader is the header used to provide the RPC auth key
+	httpAuthHeader = "X-Serf-Auth"
+
+	// httpAuthParam is the query parameter used to provide the RPC auth
+	// key for clients that cannot set headers, such as browsers.
+	httpAuthParam = "auth"
+
+	// httpReadHeaderTimeout is how long clients have to send the headers
+	// of a request, so that slow clients can't hold connections open
+	httpReadHeaderTimeout = 10 * time.Second
+
+	// httpBodyOverhead is the room left in request bodies for the fields
+	// other than the largest payload, such as query filters
+	httpBodyOverhead = 64 * 1024
+)
+
+// httpError is returned by an HTTP handler to respond with a specific
+// status code instead of an internal server error.
+type httpError struct {
+	code int
+	msg  string
+}
+
+func (e httpError) Error() string {
+	return e.msg
+}
+
+// keyHTTPResponse is used to return the results of a key operation. The
+// per-node messages are returned even if the operation failed.
+type keyHTTPResponse struct {
+	Error string
+	keyResponse
+}
+
+// httpAuth checks the auth key or RPC token provided with HTTP requests
+type httpAuth struct {
+	authKey string
+	tokens  map[string]*RPCToken
+	logger  *log.Logger
+}
+
+// AgentHTTP exposes the agent over an HTTP/JSON API
+type AgentHTTP struct {
+	httpAuth
+	agent     *Agent
+	listener  net.Listener
+	logWriter *logWriter
+	server    *http.Server
+	stop      atomic.Uint32
+	stopCh    chan struct{}
+
+	pendingQueries map[uint64]*serf.Query
+	queryLock      sync.Mutex
+}
+
+// NewAgentHTTP is used to create a new Agent HTTP handler. The listener
+// is served until Shutdown is called. Requests may authenticate with the
+// authKey, or any of the RPC tokens in the agent configuration.
+func NewAgentHTTP(agent *Agent, authKey string, listener net.Listener,
+	logOutput io.Writer, logWriter *logWriter) *AgentHTTP {
+	if logOutput == nil {
+		logOutput = os.Stderr
+	}
+	h := &AgentHTTP{
+		httpAuth: httpAuth{
+			authKey: authKey,
+			tokens:  newRPCTokenIndex(agent.agentConf.RPCTokens),
+			logger:  log.New(logOutput, "", log.LstdFlags),
+		},
+		agent:          agent,
+		listener:       listener,
+		logWriter:      logWriter,
+		stopCh:         make(chan struct{}),
+		pendingQueries: make(map[uint64]*serf.Query),
+	}
+	h.server = &http.Server{
+		Handler:           h.handler(),
+		ErrorLog:          h.logger,
+		ReadHeaderTimeout: httpReadHeaderTimeout,
+	}
+	go h.serve()
+	return h
+}
+
+// Shutdown is used to shutdown the HTTP layer. Any open streams are closed.
+func (h *AgentHTTP) Shutdown() {
+	if !h.stop.CompareAndSwap(0, 1) {
+		return
+	}
+	close(h.stopCh)
+	h.server.Close()
+}
+
+func (h *AgentHTTP) isStopped() bool {
+	return h.stop.Load() == 1
+}
+
+// serve is a long running routine that serves the HTTP API
+func (h *AgentHTTP) serve() {
+	err := h.server.Serve(h.listener)
+	if err != nil && !h.isStopped() {
+		h.logger.Printf("[ERR] agent.http: Failed to serve HTTP API: %v", err)
+	}
+}
+
+// handler returns the request multiplexer for the HTTP API
+func (h *AgentHTTP) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/members", h.wrap(membersCommand, h.handleMembers))
+	mux.HandleFunc("PUT /v1/join", h.wrap(joinCommand, h.handleJoin))
+	mux.HandleFunc("PUT /v1/leave", h.handleLeave)
+	mux.HandleFunc("PUT /v1/force-leave", h.wrap(forceLeaveCommand, h.handleForceLeave))
+	mux.HandleFunc("PUT /v1/event", h.wrap(eventCommand, h.handleEvent))
+	mux.HandleFunc("PUT /v1/send", h.wrap(sendCommand, h.handleSend))
+	mux.HandleFunc("PUT /v1/query", h.handleQuery)
+	mux.HandleFunc("PUT /v1/respond", h.wrap(respondCommand, h.handleRespond))
+	mux.HandleFunc("PUT /v1/tags", h.wrap(tagsCommand, h.handleTags))
+	mux.HandleFunc("GET /v1/keys", h.handleListKeys)
+	mux.HandleFunc("PUT /v1/keys/install", h.handleKey(installKeyCommand, h.agent.InstallKey))
+	mux.HandleFunc("PUT /v1/keys/use", h.handleKey(useKeyCommand, h.agent.UseKey))
+	mux.HandleFunc("PUT /v1/keys/remove", h.handleKey(removeKeyCommand, h.agent.RemoveKey))
+	mux.HandleFunc("GET /v1/stats", h.wrap(statsCommand, h.handleStats))
+	mux.HandleFunc("GET /v1/coordinate/{node}", h.wrap(getCoordinateCommand, h.handleGetCoordinate))
+	mux.HandleFunc("GET /v1/kv", h.wrap(kvListCommand, h.handleKVList))
+	mux.HandleFunc("GET /v1/kv/{key...}", h.wrap(kvGetCommand, h.handleKVGet))
+	mux.HandleFunc("PUT /v1/kv/{key...}", h.wrap(kvSetCommand, h.handleKVSet))
+	mux.HandleFunc("DELETE /v1/kv/{key...}", h.wrap(kvDeleteCommand, h.handleKVDelete))
+	mux.HandleFunc("GET /v1/stream", h.handleStream)
+	mux.HandleFunc("GET /v1/monitor", h.handleMonitor)
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		req.Body = http.MaxBytesReader(resp, req.Body, h.maxBodySize())
+		mux.ServeHTTP(resp, req)
+	})
+}
+
+// maxBodySize returns the size limit of request bodies. It fits the largest
+// payload the agent may send, base64 encoded, along with the other fields.
+func (h *AgentHTTP) maxBodySize() int64 {
+	conf := h.agent.SerfConfig()
+	size := max(conf.UserEventSizeLimit, conf.LargeUserEventSizeLimit,
+		conf.QuerySizeLimit, conf.DirectMessageSizeLimit, conf.KVSizeLimit,
+		conf.ExtendedTagsSizeLimit)
+	return int64(size)*4/3 + httpBodyOverhead
+}
+
+// authorize checks the auth key or RPC token provided with the request
+// allows the command, writing an error response if not.
+func (h *httpAuth) authorize(resp http.ResponseWriter, req *http.Request, command string) bool {
+	metrics.IncrCounterWithLabels([]string{"agent", "http", "request"}, 1, nil)
+	if h.authKey == "" && len(h.tokens) == 0 {
+		return true
+	}
+
+	token := req.Header.Get(httpAuthHeader)
+	if token == "" {
+		token = req.URL.Query().Get(httpAuthParam)
+	}
+	if token == "" {
+		h.logger.Printf("[WARN] agent.http: Client sending requests without auth")
+		http.Error(resp, authRequired, http.StatusUnauthorized)
+		return false
+	}
+
+	if rpcToken, ok := h.tokens[token]; ok {
+		if !rpcToken.Allows(command) {
+			h.logger.Printf("[WARN] agent.http: RPC token '%s' denied command '%s'", rpcToken.Name, command)
+			http.Error(resp, permissionDenied, http.StatusForbidden)
+			return false
+		}
+		return true
+	}
+	if token == h.authKey {
+		return true
+	}
+	http.Error(resp, invalidAuthToken, http.StatusForbidden)
+	return false
+}
+
+// wrap is used to adapt a handler returning an object to be JSON encoded
+// into an http.HandlerFunc, applying auth and error handling.
+func (h *AgentHTTP) wrap(command string, handler func(*http.Request) (any, error)) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		if !h.authorize(resp, req, command) {
+			return
+		}
+
+		obj, err := handler(req)
+		if err != nil {
+			http.Error(resp, err.Error(), httpErrorCode(err))
+			return
+		}
+
+		if obj == nil {
+			return
+		}
+		h.writeJSON(resp, http.StatusOK, obj)
+	}
+}
+
+// httpErrorCode returns the status code to respond to an error with
+func httpErrorCode(err error) int {
+	var herr httpError
+	if errors.As(err, &herr) {
+		return herr.code
+	}
+	return http.StatusInternalServerError
+}
+
+// writeJSON encodes a response object as JSON
+func (h *AgentHTTP) writeJSON(resp http.ResponseWriter, code int, obj any) {
+	buf, err := json.Marshal(obj)
+	if err != nil {
+		h.logger.Printf("[ERR] agent.http: Failed to encode response: %v", err)
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(code)
+	resp.Write(buf)
+}
+
+// decodeBody is used to decode a JSON request body
+func decodeBody(req *http.Request, out any) error {
+	if err := json.NewDecoder(req.Body).Decode(out); err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			return httpError{http.StatusRequestEntityTooLarge,
+				fmt.Sprintf("Request body exceeds limit of %d bytes", maxErr.Limit)}
+		}
+		return httpError{http.StatusBadRequest, fmt.Sprintf("Request decode failed: %v", err)}
+	}
+	return nil
+}
+
+func (h *AgentHTTP) handleMembers(req *http.Request) (any, error) {
+	raw := h.agent.Serf().Members()
+
+	// Apply the members-filtered semantics if any filters are given
+	params := req.URL.Query()
+	if params.Has("tag") || params.Has("status") || params.Has("name") || params.Has("filter") {
+		tags := make(map[string]string)
+		for _, tag := range params["tag"] {
+			parts := strings.SplitN(tag, "=", 2)
+			if len(parts) != 2 {
+				return nil, httpError{http.StatusBadRequest, fmt.Sprintf("Invalid tag filter '%s'", tag)}
+			}
+			tags[parts[0]] = parts[1]
+		}
+
+		var err error
+		raw, err = filterMembers(raw, tags, params.Get("status"), params.Get("name"), params.Get("filter"))
+		if err != nil {
+			return nil, httpError{http.StatusBadRequest, err.Error()}
+		}
+	}
+
+	members := make([]Member, 0, len(raw))
+	for _, m := range raw {
+		members = append(members, Member{
+			Name:        m.Name,
+			Addr:        m.Addr,
+			Port:        m.Port,
+			Tags:        m.Tags,
+			Status:      m.Status.String(),
+			ProtocolMin: m.ProtocolMin,
+			ProtocolMax: m.ProtocolMax,
+			ProtocolCur: m.ProtocolCur,
+			DelegateMin: m.DelegateMin,
+			DelegateMax: m.DelegateMax,
+			DelegateCur: m.DelegateCur,
+		})
+	}
+	return &membersResponse{Members: members}, nil
+}
+
+func (h *AgentHTTP) handleJoin(req *http.Request) (any, error) {
+	var args joinRequest
+	if err := decodeBody(req, &args); err != nil {
+		return nil, err
+	}
+
+	num, err := h.agent.Join(args.Existing, args.Replay)
+	if err != nil {
+		return nil, err
+	}
+	return &joinResponse{Num: int32(num)}, nil
+}
+
+func (h *AgentHTTP) handleLeave(resp http.ResponseWriter, req *http.Request) {
+	if !h.authorize(resp, req, leaveCommand) {
+		return
+	}
+	h.logger.Printf("[INFO] agent.http: Graceful leave triggered")
+
+	// Do the leave, responding before the shutdown
+	if err := h.agent.Leave(); err != nil {
+		h.logger.Printf("[ERR] agent.http: leave failed: %v", err)
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+	} else {
+		resp.WriteHeader(http.StatusOK)
+	}
+	if f, ok := resp.(http.Flusher); ok {
+		f.Flush()
+	}
+
+	// Trigger a shutdown!
+	if err := h.agent.Shutdown(); err != nil {
+		h.logger.Printf("[ERR] agent.http: shutdown failed: %v", err)
+	}
+}
+
+func (h *AgentHTTP) handleForceLeave(req *http.Request) (any, error) {
+	var args forceLeaveRequest
+	if err := decodeBody(req, &args); err != nil {
+		return nil, err
+	}
+
+	if args.Prune {
+		return nil, h.agent.ForceLeavePrune(args.Node)
+	}
+	return nil, h.agent.ForceLeave(args.Node)
+}
+
+func (h *AgentHTTP) handleEvent(req *http.Request) (any, error) {
+	var args eventRequest
+	if err := decodeBody(req, &args); err != nil {
+		return nil, err
+	}
+	err := h.agent.UserEvent(args.Name, args.Payload, args.Coalesce)
+	if errors.Is(err, serf.UserEventThrottled) {
+		return nil, httpError{http.StatusTooManyRequests, eventThrottled}
+	}
+	return nil, err
+}
+
+func (h *AgentHTTP) handleSend(req *http.Request) (any, error) {
+	var args sendRequest
+	if err := decodeBody(req, &args); err != nil {
+		return nil, err
+	}
+	return nil, h.agent.SendToMember(args.Node, args.Payload)
+}
+
+func (h *AgentHTTP) handleTags(req *http.Request) (any, error) {
+	var args tagsRequest
+	if err := decodeBody(req, &args); err != nil {
+		return nil, err
+	}
+
+	tags := make(map[string]string)
+	for key, val := range h.agent.SerfConfig().Tags {
+		var delTag bool
+		for _, delkey := range args.DeleteTags {
+			delTag = (delTag || delkey == key)
+		}
+		if !delTag {
+			tags[key] = val
+		}
+	}
+	maps.Copy(tags, args.Tags)
+
+	return nil, h.agent.SetTags(tags)
+}
+
+func (h *AgentHTTP) handleListKeys(resp http.ResponseWriter, req *http.Request) {
+	if !h.authorize(resp, req, listKeysCommand) {
+		return
+	}
+	queryResp, err := h.agent.ListKeys()
+	h.writeKeyResponse(resp, queryResp, err)
+}
+
+// handleKey returns a handler for a key operation that takes a key
+func (h *AgentHTTP) handleKey(command string, op func(string) (*serf.KeyResponse, error)) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		if !h.authorize(resp, req, command) {
+			return
+		}
+
+		var args keyRequest
+		if err := decodeBody(req, &args); err != nil {
+			http.Error(resp, err.Error(), httpErrorCode(err))
+			return
+		}
+
+		queryResp, err := op(args.Key)
+		h.writeKeyResponse(resp, queryResp, err)
+	}
+}
+
+// writeKeyResponse is used to write the results of a key operation
+func (h *AgentHTTP) writeKeyResponse(resp http.ResponseWriter, queryResp *serf.KeyResponse, err error) {
+	out := keyHTTPResponse{
+		Error: errToString(err),
+		keyResponse: keyResponse{
+			Messages: queryResp.Messages,
+			Keys:     queryResp.Keys,
+			NumNodes: queryResp.NumNodes,
+			NumErr:   queryResp.NumErr,
+			NumResp:  queryResp.NumResp,
+		},
+	}
+
+	code := http.StatusOK
+	if err != nil {
+		code = http.StatusInternalServerError
+	}
+	h.writeJSON(resp, code, &out)
+}
+
+func (h *AgentHTTP) handleStats(req *http.Request) (any, error) {
+	return h.agent.Stats(), nil
+}
+
+func (h *AgentHTTP) handleGetCoordinate(req *http.Request) (any, error) {
+	var result coordinate.Coordinate
+	coord, ok := h.agent.Serf().GetCachedCoordinate(req.PathValue("node"))
+	if ok {
+		result = *coord
+	}
+	return &coordinateResponse{Coord: result, Ok: ok}, nil
+}
+
+func (h *AgentHTTP) handleKVGet(req *http.Request) (any, error) {
+	value, ok := h.agent.Serf().KVGet(req.PathValue("key"))
+	return &kvResponse{Value: value, Ok: ok}, nil
+}
+
+func (h *AgentHTTP) handleKVSet(req *http.Request) (any, error) {
+	var args kvSetRequest
+	if err := decodeBody(req, &args); err != nil {
+		return nil, err
+	}
+	return nil, h.agent.KVSet(req.PathValue("key"), args.Value)
+}
+
+func (h *AgentHTTP) handleKVDelete(req *http.Request) (any, error) {
+	return nil, h.agent.KVDelete(req.PathValue("key"))
+}
+
+func (h *AgentHTTP) handleKVList(req *http.Request) (any, error) {
+	values := h.agent.Serf().KVList(req.URL.Query().Get("prefix"))
+	return &kvListResponse{Values: values}, nil
+}
+
+func (h *AgentHTTP) handleRespond(req *http.Request) (any, error) {
+	var args respondRequest
+	if err := decodeBody(req, &args); err != nil {
+		return nil, err
+	}
+
+	// Lookup the query
+	h.queryLock.Lock()
+	query, ok := h.pendingQueries[args.ID]
+	h.queryLock.Unlock()
+
+	if !ok {
+		return nil, httpError{http.StatusNotFound, invalidQueryID}
+	}
+	if args.Partial {
+		return nil, query.RespondPartial(args.Payload)
+	}
+	return nil, query.Respond(args.Payload)
+}
+
+// RegisterQuery is used to register a pending query that may get a
+// response from an HTTP client. The ID of the query is returned. The IDs
+// are random, as the pending queries are shared by all the clients, so
+// that a client can't respond to the queries of another by guessing them.
+func (h *AgentHTTP) RegisterQuery(q *serf.Query) uint64 {
+	h.queryLock.Lock()
+	defer h.queryLock.Unlock()
+
+	var id uint64
+	for id == 0 || h.pendingQueries[id] != nil {
+		id = randomQueryID()
+	}
+
+	// Ensure the query deadline is in the future
+	timeout := time.Until(q.Deadline())
+	if timeout < 0 {
+		return id
+	}
+
+	// Register the query
+	h.pendingQueries[id] = q
+
+	// Setup a timer to deregister after the timeout
+	time.AfterFunc(timeout, func() {
+		h.queryLock.Lock()
+		delete(h.pendingQueries, id)
+		h.queryLock.Unlock()
+	})
+	return id
+}
+
+// randomQueryID returns a random query ID. It is limited to 53 bits, so
+// that JSON clients using floating point numbers represent it exactly.
+func randomQueryID() uint64 {
+	var buf [8]byte
+	rand.Read(buf[:])
+	return binary.BigEndian.Uint64(buf[:]) & (1<<53 - 1)
+}
+
+func (h *AgentHTTP) handleQuery(resp http.ResponseWriter, req *http.Request) {
+	if !h.authorize(resp, req, queryCommand) {
+		return
+	}
+
+	var args queryRequest
+	if err := decodeBody(req, &args); err != nil {
+		http.Error(resp, err.Error(), httpErrorCode(err))
+		return
+	}
+	if args.FilterExpr != "" {
+		if _, err := serf.ParseTagExpr(args.FilterExpr); err != nil {
+			http.Error(resp, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	params := serf.QueryParam{
+		FilterNodes:       args.FilterNodes,
+		FilterTags:        args.FilterTags,
+		FilterExpr:        args.FilterExpr,
+		RequestAck:        args.RequestAck,
+		RelayFactor:       args.RelayFactor,
+		Timeout:           args.Timeout,
+		SampleSize:        args.SampleSize,
+		SamplePercent:     args.SamplePercent,
+		MultipleResponses: args.MultiResponse,
+	}
+	queryResp, err := h.agent.Query(args.Name, args.Payload, &params)
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Stream the query responses until the query is done
+	client := h.newStreamClient(resp, req)
+	defer client.Close()
+	newQueryResponseStream(client, 0, h.logger).Stream(queryResp)
+}
+
+func (h *AgentHTTP) handleStream(resp http.ResponseWriter, req *http.Request) {
+	if !h.authorize(resp, req, streamCommand) {
+		return
+	}
+
+	// Create the event filters, defaulting to all events
+	filterType := req.URL.Query().Get("type")
+	if filterType == "" {
+		filterType = "*"
+	}
+	filters := ParseEventFilter(filterType)
+	for _, f := range filters {
+		if !f.Valid() {
+			http.Error(resp, invalidFilter, http.StatusBadRequest)
+			return
+		}
+	}
+
+	client := h.newStreamClient(resp, req)
+	defer client.Close()
+
+	es := newEventStream(client, filters, 0, h.logger)
+	h.agent.RegisterEventHandler(es)
+	defer func() {
+		h.agent.DeregisterEventHandler(es)
+		es.Stop()
+	}()
+
+	h.waitStream(req)
+}
+
+func (h *AgentHTTP) handleMonitor(resp http.ResponseWriter, req *http.Request) {
+	if !h.authorize(resp, req, monitorCommand) {
+		return
+	}
+
+	// Create a level filter, defaulting to INFO
+	level := strings.ToUpper(req.URL.Query().Get("log_level"))
+	if level == "" {
+		level = "INFO"
+	}
+	filter := LevelFilter()
+	filter.MinLevel = logutils.LogLevel(level)
+	if !ValidateLevelFilter(filter.MinLevel, filter) {
+		http.Error(resp, fmt.Sprintf("Unknown log level: %s", filter.MinLevel), http.StatusBadRequest)
+		return
+	}
+
+	var format func(string) string
+	if h.agent.agentConf.LogJSON || req.URL.Query().Get("format") == "json" {
+		format = jsonLogFormat(h.agent.SerfConfig().NodeName)
+	}
+
+	client := h.newStreamClient(resp, req)
+	defer client.Close()
+
+	ls := newLogStream(client, filter, format, 0, h.logger)
+	h.logWriter.RegisterHandler(ls)
+	defer func() {
+		h.logWriter.DeregisterHandler(ls)
+		ls.Stop()
+	}()
+
+	h.waitStream(req)
+}
+
+// waitStream blocks until the client goes away or the HTTP layer is shut down
+func (h *AgentHTTP) waitStream(req *http.Request) {
+	select {
+	case <-req.Context().Done():
+	case <-h.stopCh:
+	}
+}
+
+// httpStreamClient is a streamClient that writes records to an HTTP
+// response as newline delimited JSON or Server-Sent Events.
+type httpStreamClient struct {
+	http      *AgentHTTP
+	name      string
+	resp      http.ResponseWriter
+	flusher   http.Flusher
+	sse       bool
+	closed    bool
+	writeLock sync.Mutex
+}
+
+// newStreamClient is used to start a streaming response
+func (h *AgentHTTP) newStreamClient(resp http.ResponseWriter, req *http.Request) *httpStreamClient {
+	c := &httpStreamClient{
+		http: h,
+		name: req.RemoteAddr,
+		resp: resp,
+		sse:  strings.Contains(req.Header.Get("Accept"), "text/event-stream"),
+	}
+	c.flusher, _ = resp.(http.Flusher)
+
+	if c.sse {
+		resp.Header().Set("Content-Type", "text/event-stream")
+		resp.Header().Set("Cache-Control", "no-cache")
+	} else {
+		resp.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	resp.WriteHeader(http.StatusOK)
+	c.flush()
+	return c
+}
+
+// Send is used to write a single record. The header is unused since
+// HTTP responses are not multiplexed.
+func (c *httpStreamClient) Send(header *responseHeader, obj any) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	// The response may not be used once the handler has returned
+	if c.closed {
+		return errors.New("stream closed")
+	}
+
+	buf, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+
+	if c.sse {
+		_, err = fmt.Fprintf(c.resp, "data: %s\n\n", buf)
+	} else {
+		_, err = fmt.Fprintf(c.resp, "%s\n", buf)
+	}
+	if err != nil {
+		return err
+	}
+	c.flush()
+	return nil
+}
+
+func (c *httpStreamClient) RegisterQuery(q *serf.Query) uint64 {
+	return c.http.RegisterQuery(q)
+}
+
+// Close prevents any further writes to the response
+func (c *httpStreamClient) Close() {
+	c.writeLock.Lock()
+	c.closed = true
+	c.writeLock.Unlock()
+}
+
+func (c *httpStreamClient) flush() {
+	if c.flusher != nil {
+		c.flusher.Flush()
+	}
+}
+
+func (c *httpStreamClient) String() string {
+	return fmt.Sprintf("http.client: %v", c.name)
+}
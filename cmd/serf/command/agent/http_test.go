@@ -0,0 +1,567 @@
+// Copyright IBM Corp. 2013, 2026
+// SPDX-License-Identifier: MPL-2.0
+
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+	"github.com/hashicorp/serf/testutil"
+)
+
+// testHTTP returns an agent with an HTTP API listening on a random
+// loopback port, along with the base URL of the API.
+func testHTTP(t *testing.T, ip net.IP, authKey string) (*Agent, *AgentHTTP, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	tw := testutil.TestWriter(t)
+	lw := NewLogWriter(512)
+	mult := io.MultiWriter(tw, lw)
+
+	agent := testAgentWithConfig(t, ip, DefaultConfig(), serf.DefaultConfig(), mult)
+	h := NewAgentHTTP(agent, authKey, l, mult, lw)
+	return agent, h, "http://" + l.Addr().String()
+}
+
+func httpDo(t *testing.T, method, url string, body any) *http.Response {
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	req, err := http.NewRequest(method, url, &buf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return resp
+}
+
+func TestAgentHTTP_Members(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	a1, h, addr := testHTTP(t, ip1, "")
+	defer h.Shutdown()
+	defer a1.Shutdown()
+
+	if err := a1.Start(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	testutil.Yield()
+
+	resp := httpDo(t, "GET", addr+"/v1/members", nil)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("bad: %d", resp.StatusCode)
+	}
+
+	var out membersResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out.Members) != 1 {
+		t.Fatalf("bad: %#v", out)
+	}
+	if out.Members[0].Name != a1.conf.NodeName || out.Members[0].Status != "alive" {
+		t.Fatalf("bad: %#v", out.Members[0])
+	}
+
+	// Filter on a name that doesn't exist
+	resp2 := httpDo(t, "GET", addr+"/v1/members?name=nope", nil)
+	defer resp2.Body.Close()
+
+	out = membersResponse{}
+	if err := json.NewDecoder(resp2.Body).Decode(&out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out.Members) != 0 {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	// Invalid tag filter
+	resp3 := httpDo(t, "GET", addr+"/v1/members?tag=nope", nil)
+	defer resp3.Body.Close()
+	if resp3.StatusCode != http.StatusBadRequest {
+		t.Fatalf("bad: %d", resp3.StatusCode)
+	}
+
+	// Filter on a tag expression
+	resp4 := httpDo(t, "GET", addr+"/v1/members?filter="+url.QueryEscape(`tag1 == "foo"`), nil)
+	defer resp4.Body.Close()
+
+	out = membersResponse{}
+	if err := json.NewDecoder(resp4.Body).Decode(&out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out.Members) != 0 {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	// Invalid tag expression
+	resp5 := httpDo(t, "GET", addr+"/v1/members?filter=tag1", nil)
+	defer resp5.Body.Close()
+	if resp5.StatusCode != http.StatusOK {
+		t.Fatalf("bad: %d", resp5.StatusCode)
+	}
+	resp6 := httpDo(t, "GET", addr+"/v1/members?filter="+url.QueryEscape("tag1 =="), nil)
+	defer resp6.Body.Close()
+	if resp6.StatusCode != http.StatusBadRequest {
+		t.Fatalf("bad: %d", resp6.StatusCode)
+	}
+}
+
+func TestAgentHTTP_Auth(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	a1, h, addr := testHTTP(t, ip1, "foobar")
+	defer h.Shutdown()
+	defer a1.Shutdown()
+
+	if err := a1.Start(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	resp := httpDo(t, "GET", addr+"/v1/stats", nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("bad: %d", resp.StatusCode)
+	}
+
+	resp = httpDo(t, "GET", addr+"/v1/stats?auth=wrong", nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("bad: %d", resp.StatusCode)
+	}
+
+	req, err := http.NewRequest("GET", addr+"/v1/stats", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	req.Header.Set(httpAuthHeader, "foobar")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("bad: %d", resp.StatusCode)
+	}
+
+	var stats map[string]map[string]string
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if stats["agent"]["name"] != a1.conf.NodeName {
+		t.Fatalf("bad: %v", stats)
+	}
+}
+
+func TestAgentHTTP_Stream(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	a1, h, addr := testHTTP(t, ip1, "")
+	defer h.Shutdown()
+	defer a1.Shutdown()
+
+	if err := a1.Start(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	testutil.Yield()
+
+	resp := httpDo(t, "GET", addr+"/v1/stream?type=user:deploy", nil)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("bad: %d", resp.StatusCode)
+	}
+
+	event := eventRequest{Name: "deploy", Payload: []byte("foo")}
+	eresp := httpDo(t, "PUT", addr+"/v1/event", &event)
+	eresp.Body.Close()
+	if eresp.StatusCode != http.StatusOK {
+		t.Fatalf("bad: %d", eresp.StatusCode)
+	}
+
+	recCh := make(chan userEventRecord, 1)
+	go func() {
+		var rec userEventRecord
+		if err := json.NewDecoder(resp.Body).Decode(&rec); err == nil {
+			recCh <- rec
+		}
+	}()
+
+	select {
+	case rec := <-recCh:
+		if rec.Event != "user" || rec.Name != "deploy" || string(rec.Payload) != "foo" {
+			t.Fatalf("bad: %#v", rec)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timeout")
+	}
+}
+
+// httpQuery starts a query through the HTTP API and returns the records
+// streamed until the query is done.
+func httpQuery(t *testing.T, addr string, query *queryRequest) []queryRecord {
+	req, err := http.NewRequest("PUT", addr+"/v1/query", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	buf, _ := json.Marshal(query)
+	req.Body = io.NopCloser(bytes.NewReader(buf))
+	req.Header.Set("Accept", "text/event-stream")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("bad: %s", ct)
+	}
+
+	// Read the records until the query is done
+	var records []queryRecord
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var rec queryRecord
+		if err := json.Unmarshal([]byte(data), &rec); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		records = append(records, rec)
+	}
+	return records
+}
+
+func TestAgentHTTP_Query(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	a1, h, addr := testHTTP(t, ip1, "")
+	defer h.Shutdown()
+	defer a1.Shutdown()
+
+	handler := new(MockQueryHandler)
+	handler.Response = []byte("ok")
+	a1.RegisterEventHandler(handler)
+
+	if err := a1.Start(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	testutil.Yield()
+
+	query := queryRequest{
+		RequestAck: true,
+		Timeout:    200 * time.Millisecond,
+		Name:       "deploy",
+		Payload:    []byte("foo"),
+	}
+	records := httpQuery(t, addr, &query)
+
+	var acks, responses int
+	for _, rec := range records {
+		switch rec.Type {
+		case queryRecordAck:
+			acks++
+		case queryRecordResponse:
+			responses++
+			if string(rec.Payload) != "ok" {
+				t.Fatalf("bad: %#v", rec)
+			}
+		}
+	}
+	if acks != 1 || responses != 1 {
+		t.Fatalf("bad: %#v", records)
+	}
+	if records[len(records)-1].Type != queryRecordDone {
+		t.Fatalf("bad: %#v", records)
+	}
+}
+
+func TestAgentHTTP_QuerySample(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+	ip2, returnFn2 := testutil.TakeIP()
+	defer returnFn2()
+	ip3, returnFn3 := testutil.TakeIP()
+	defer returnFn3()
+
+	a1, h, addr := testHTTP(t, ip1, "")
+	defer h.Shutdown()
+	defer a1.Shutdown()
+	a2 := testAgent(t, ip2)
+	defer a2.Shutdown()
+	a3 := testAgent(t, ip3)
+	defer a3.Shutdown()
+
+	for _, a := range []*Agent{a1, a2, a3} {
+		handler := new(MockQueryHandler)
+		handler.Response = []byte("ok")
+		a.RegisterEventHandler(handler)
+		if err := a.Start(); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	testutil.Yield()
+
+	_, err := a1.Join([]string{
+		a2.conf.NodeName + "/" + a2.conf.MemberlistConfig.BindAddr,
+		a3.conf.NodeName + "/" + a3.conf.MemberlistConfig.BindAddr,
+	}, false)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	testutil.Yield()
+
+	query := queryRequest{
+		Timeout:    500 * time.Millisecond,
+		SampleSize: 2,
+		Name:       "deploy",
+	}
+	records := httpQuery(t, addr, &query)
+
+	from := make(map[string]struct{})
+	for _, rec := range records {
+		if rec.Type == queryRecordResponse {
+			from[rec.From] = struct{}{}
+		}
+	}
+	if len(from) != 2 {
+		t.Fatalf("bad: %#v", records)
+	}
+}
+
+func TestAgentHTTP_QueryFilterExpr(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+	ip2, returnFn2 := testutil.TakeIP()
+	defer returnFn2()
+
+	a1, h, addr := testHTTP(t, ip1, "")
+	defer h.Shutdown()
+	defer a1.Shutdown()
+	a2 := testAgent(t, ip2)
+	defer a2.Shutdown()
+
+	// Expression filters require protocol version 6
+	for role, a := range map[string]*Agent{"web": a1, "db": a2} {
+		a.SerfConfig().ProtocolVersion = 6
+		a.SerfConfig().Tags = map[string]string{"role": role}
+		handler := new(MockQueryHandler)
+		handler.Response = []byte("ok")
+		a.RegisterEventHandler(handler)
+		if err := a.Start(); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	testutil.Yield()
+
+	if _, err := a1.Join([]string{a2.conf.NodeName + "/" + a2.conf.MemberlistConfig.BindAddr}, false); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	testutil.Yield()
+
+	query := queryRequest{
+		FilterExpr: `role == db`,
+		Timeout:    500 * time.Millisecond,
+		Name:       "deploy",
+	}
+	records := httpQuery(t, addr, &query)
+
+	var from []string
+	for _, rec := range records {
+		if rec.Type == queryRecordResponse {
+			from = append(from, rec.From)
+		}
+	}
+	if len(from) != 1 || from[0] != a2.conf.NodeName {
+		t.Fatalf("bad: %#v", records)
+	}
+
+	// Expressions that don't parse are rejected
+	query.FilterExpr = `role ==`
+	resp := httpDo(t, "PUT", addr+"/v1/query", &query)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("bad: %d", resp.StatusCode)
+	}
+}
+
+func TestAgentHTTP_KV(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	a1, h, addr := testHTTP(t, ip1, "")
+	defer h.Shutdown()
+	defer a1.Shutdown()
+
+	// The key/value store requires protocol version 6
+	a1.SerfConfig().ProtocolVersion = 6
+	if err := a1.Start(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	resp := httpDo(t, "PUT", addr+"/v1/kv/app/version", &kvSetRequest{Value: []byte("1.0")})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("bad: %d", resp.StatusCode)
+	}
+
+	var out kvResponse
+	resp = httpDo(t, "GET", addr+"/v1/kv/app/version", nil)
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp.Body.Close()
+	if !out.Ok || string(out.Value) != "1.0" {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	var list kvListResponse
+	resp = httpDo(t, "GET", addr+"/v1/kv?prefix="+url.QueryEscape("app/"), nil)
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp.Body.Close()
+	if len(list.Values) != 1 || string(list.Values["app/version"]) != "1.0" {
+		t.Fatalf("bad: %#v", list)
+	}
+
+	resp = httpDo(t, "DELETE", addr+"/v1/kv/app/version", nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("bad: %d", resp.StatusCode)
+	}
+
+	out = kvResponse{}
+	resp = httpDo(t, "GET", addr+"/v1/kv/app/version", nil)
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp.Body.Close()
+	if out.Ok {
+		t.Fatalf("bad: %#v", out)
+	}
+}
+
+func TestAgentHTTP_Tokens(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	agentConf := DefaultConfig()
+	agentConf.RPCTokens = []RPCToken{
+		{Name: "read", Token: "reader", Commands: []string{statsCommand}},
+	}
+	lw := NewLogWriter(512)
+	mult := io.MultiWriter(testutil.TestWriter(t), lw)
+	a1 := testAgentWithConfig(t, ip1, agentConf, serf.DefaultConfig(), mult)
+	defer a1.Shutdown()
+	h := NewAgentHTTP(a1, "", l, mult, lw)
+	defer h.Shutdown()
+	addr := "http://" + l.Addr().String()
+
+	if err := a1.Start(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	resp := httpDo(t, "GET", addr+"/v1/stats?auth=reader", nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("bad: %d", resp.StatusCode)
+	}
+
+	resp = httpDo(t, "GET", addr+"/v1/members?auth=reader", nil)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("bad: %d", resp.StatusCode)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if strings.TrimSpace(string(body)) != permissionDenied {
+		t.Fatalf("bad: %s", body)
+	}
+}
+
+func TestAgentHTTP_BodyLimit(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	a1, h, addr := testHTTP(t, ip1, "")
+	defer h.Shutdown()
+	defer a1.Shutdown()
+
+	if err := a1.Start(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	body := eventRequest{Name: "deploy", Payload: make([]byte, h.maxBodySize())}
+	resp := httpDo(t, "PUT", addr+"/v1/event", &body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("bad: %d", resp.StatusCode)
+	}
+
+	query := queryRequest{Name: "deploy", Payload: make([]byte, h.maxBodySize())}
+	resp = httpDo(t, "PUT", addr+"/v1/query", &query)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("bad: %d", resp.StatusCode)
+	}
+}
+
+func TestAgentHTTP_RegisterQuery(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	a1, h, _ := testHTTP(t, ip1, "")
+	defer h.Shutdown()
+	defer a1.Shutdown()
+
+	if h.server.ReadHeaderTimeout == 0 {
+		t.Fatalf("should set a read header timeout")
+	}
+
+	// The query IDs are random, and can't be guessed from one another
+	q := &serf.Query{}
+	seen := make(map[uint64]bool)
+	for i := 0; i < 100; i++ {
+		id := h.RegisterQuery(q)
+		if id == 0 || id >= 1<<53 || seen[id] {
+			t.Fatalf("bad: %d", id)
+		}
+		seen[id] = true
+	}
+}
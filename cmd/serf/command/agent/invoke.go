@@ -12,6 +12,7 @@ import (
 	"regexp"
 	"runtime"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/armon/circbuf"
@@ -38,42 +39,28 @@ var sanitizeTagRegexp = regexp.MustCompile(`[^A-Z0-9_]`)
 // are a bit different. For all events, the SERF_EVENT environmental
 // variable is the type of the event. For user events, the SERF_USER_EVENT
 // environmental variable is also set, containing the name of the user
-// event that was fired.
+// event that was fired, along with its SERF_USER_ORIGIN and SERF_USER_SEQ.
+// SERF_USER_SIGNER and SERF_QUERY_SIGNER are set to the verified signer of
+// user events and queries. For direct messages, the SERF_MESSAGE_FROM
+// environmental variable is set to the name of the sending node, for user
+// event gaps the SERF_GAP_* variables describe the events missed, and for
+// key/value writes the SERF_KV_* variables describe the write.
 //
 // In all events, data is passed in via stdin to facilitate piping. See
 // the various stdin functions below for more information.
-func invokeEventScript(logger *log.Logger, script string, self serf.Member, event serf.Event) error {
+//
+// If timeout is non-zero, the script and any processes it spawned are
+// killed once the timeout is exceeded.
+func invokeEventScript(logger *log.Logger, script string, self serf.Member, event serf.Event, timeout time.Duration) error {
 	defer metrics.MeasureSinceWithLabels([]string{"agent", "invoke", script}, time.Now(), nil)
 	output, _ := circbuf.NewBuffer(maxBufSize)
 
-	// Determine the shell invocation based on OS
-	var shell, flag string
-	if runtime.GOOS == windows {
-		shell = "cmd"
-		flag = "/C"
-	} else {
-		shell = "/bin/sh"
-		flag = "-c"
-	}
-
-	cmd := exec.Command(shell, flag, script)
-	cmd.Env = append(os.Environ(),
-		"SERF_EVENT="+event.EventType().String(),
-		"SERF_SELF_NAME="+self.Name,
-		"SERF_SELF_ROLE="+self.Tags["role"],
-	)
+	cmd := scriptCommand(script, self)
+	cmd.Env = append(cmd.Env, "SERF_EVENT="+event.EventType().String())
 	cmd.Stderr = output
 	cmd.Stdout = output
-
-	// Add all the tags
-	for name, val := range self.Tags {
-		//http://stackoverflow.com/questions/2821043/allowed-characters-in-linux-environment-variable-names
-		//(http://pubs.opengroup.org/onlinepubs/000095399/basedefs/xbd_chap08.html for the long version)
-		//says that env var names must be in [A-Z0-9_] and not start with [0-9].
-		//we only care about the first part, so convert all chars not in [A-Z0-9_] to _
-		sanitizedName := sanitizeTagRegexp.ReplaceAllString(strings.ToUpper(name), "_")
-		tag_env := fmt.Sprintf("SERF_TAG_%s=%s", sanitizedName, val)
-		cmd.Env = append(cmd.Env, tag_env)
+	if timeout > 0 {
+		setProcessGroup(cmd)
 	}
 
 	stdin, err := cmd.StdinPipe()
@@ -87,10 +74,37 @@ func invokeEventScript(logger *log.Logger, script string, self serf.Member, even
 	case serf.UserEvent:
 		cmd.Env = append(cmd.Env, "SERF_USER_EVENT="+e.Name)
 		cmd.Env = append(cmd.Env, fmt.Sprintf("SERF_USER_LTIME=%d", e.LTime))
+		if e.Origin != "" {
+			cmd.Env = append(cmd.Env, "SERF_USER_ORIGIN="+e.Origin)
+			cmd.Env = append(cmd.Env, fmt.Sprintf("SERF_USER_SEQ=%d", e.Seq))
+		}
+		if e.Signer != "" {
+			cmd.Env = append(cmd.Env, "SERF_USER_SIGNER="+e.Signer)
+		}
 		go streamPayload(logger, stdin, e.Payload)
+	case serf.UserEventGap:
+		cmd.Env = append(cmd.Env, "SERF_USER_ORIGIN="+e.Origin)
+		cmd.Env = append(cmd.Env, fmt.Sprintf("SERF_GAP_FIRST_SEQ=%d", e.FirstSeq))
+		cmd.Env = append(cmd.Env, fmt.Sprintf("SERF_GAP_LAST_SEQ=%d", e.LastSeq))
+		cmd.Env = append(cmd.Env, fmt.Sprintf("SERF_GAP_MISSED=%d", e.Missed))
+		go streamPayload(logger, stdin, nil)
+	case serf.DirectMessageEvent:
+		cmd.Env = append(cmd.Env, "SERF_MESSAGE_FROM="+e.From)
+		go streamPayload(logger, stdin, e.Payload)
+	case serf.KVEvent:
+		cmd.Env = append(cmd.Env, "SERF_KV_KEY="+e.Key)
+		cmd.Env = append(cmd.Env, "SERF_KV_NODE="+e.Node)
+		cmd.Env = append(cmd.Env, fmt.Sprintf("SERF_KV_LTIME=%d", e.LTime))
+		if e.Deleted {
+			cmd.Env = append(cmd.Env, "SERF_KV_DELETED=1")
+		}
+		go streamPayload(logger, stdin, e.Value)
 	case *serf.Query:
 		cmd.Env = append(cmd.Env, "SERF_QUERY_NAME="+e.Name)
 		cmd.Env = append(cmd.Env, fmt.Sprintf("SERF_QUERY_LTIME=%d", e.LTime))
+		if e.Signer() != "" {
+			cmd.Env = append(cmd.Env, "SERF_QUERY_SIGNER="+e.Signer())
+		}
 		go streamPayload(logger, stdin, e.Payload)
 	default:
 		return fmt.Errorf("Unknown event type: %s", event.EventType().String())
@@ -106,6 +120,18 @@ func invokeEventScript(logger *log.Logger, script string, self serf.Member, even
 		return err
 	}
 
+	// Start a timer to kill hung handlers
+	var timedOut atomic.Bool
+	var killTimer *time.Timer
+	if timeout > 0 {
+		killTimer = time.AfterFunc(timeout, func() {
+			timedOut.Store(true)
+			if err := killProcessGroup(cmd); err != nil {
+				logger.Printf("[ERR] agent: Failed to kill script '%s': %v", script, err)
+			}
+		})
+	}
+
 	// Warn if buffer is overritten
 	if output.TotalWritten() > output.Size() {
 		logger.Printf("[WARN] agent: Script '%s' generated %d bytes of output, truncated to %d",
@@ -114,8 +140,15 @@ func invokeEventScript(logger *log.Logger, script string, self serf.Member, even
 
 	err = cmd.Wait()
 	slowTimer.Stop()
+	if killTimer != nil {
+		killTimer.Stop()
+	}
 	logger.Printf("[DEBUG] agent: Event '%s' script output: %s",
 		event.EventType().String(), output.String())
+	if timedOut.Load() {
+		metrics.IncrCounter([]string{"agent", "invoke", "timeout"}, 1)
+		return fmt.Errorf("Script '%s' timed out after %v", script, timeout)
+	}
 	if err != nil {
 		return err
 	}
@@ -131,6 +164,38 @@ func invokeEventScript(logger *log.Logger, script string, self serf.Member, even
 	return nil
 }
 
+// scriptCommand creates the shell invocation of a handler script, with
+// the environment describing the local member
+func scriptCommand(script string, self serf.Member) *exec.Cmd {
+	// Determine the shell invocation based on OS
+	var shell, flag string
+	if runtime.GOOS == windows {
+		shell = "cmd"
+		flag = "/C"
+	} else {
+		shell = "/bin/sh"
+		flag = "-c"
+	}
+
+	cmd := exec.Command(shell, flag, script)
+	cmd.Env = append(os.Environ(),
+		"SERF_SELF_NAME="+self.Name,
+		"SERF_SELF_ROLE="+self.Tags["role"],
+	)
+
+	// Add all the tags
+	for name, val := range self.Tags {
+		//http://stackoverflow.com/questions/2821043/allowed-characters-in-linux-environment-variable-names
+		//(http://pubs.opengroup.org/onlinepubs/000095399/basedefs/xbd_chap08.html for the long version)
+		//says that env var names must be in [A-Z0-9_] and not start with [0-9].
+		//we only care about the first part, so convert all chars not in [A-Z0-9_] to _
+		sanitizedName := sanitizeTagRegexp.ReplaceAllString(strings.ToUpper(name), "_")
+		tag_env := fmt.Sprintf("SERF_TAG_%s=%s", sanitizedName, val)
+		cmd.Env = append(cmd.Env, tag_env)
+	}
+	return cmd
+}
+
 // eventClean cleans a value to be a parameter in an event line.
 func eventClean(v string) string {
 	v = strings.ReplaceAll(v, "\t", "\\t")
@@ -72,6 +72,11 @@ const (
 	authCommand            = "auth"
 	statsCommand           = "stats"
 	getCoordinateCommand   = "get-coordinate"
+	sendCommand            = "send"
+	kvGetCommand           = "kv-get"
+	kvSetCommand           = "kv-set"
+	kvDeleteCommand        = "kv-delete"
+	kvListCommand          = "kv-list"
 )
 
 const (
@@ -85,6 +90,8 @@ const (
 	invalidQueryID        = "No pending queries matching ID"
 	authRequired          = "Authentication required"
 	invalidAuthToken      = "Invalid authentication token"
+	permissionDenied      = "Permission denied"
+	eventThrottled        = "User event throttled"
 )
 
 const (
@@ -128,6 +135,33 @@ type eventRequest struct {
 	Coalesce bool
 }
 
+type sendRequest struct {
+	Node    string
+	Payload []byte
+}
+
+type kvRequest struct {
+	Key string
+}
+
+type kvSetRequest struct {
+	Key   string
+	Value []byte
+}
+
+type kvResponse struct {
+	Value []byte
+	Ok    bool
+}
+
+type kvListRequest struct {
+	Prefix string
+}
+
+type kvListResponse struct {
+	Values map[string][]byte
+}
+
 type forceLeaveRequest struct {
 	Node  string
 	Prune bool
@@ -146,6 +180,7 @@ type membersFilteredRequest struct {
 	Tags   map[string]string
 	Status string
 	Name   string
+	Filter string
 }
 
 type membersResponse struct {
@@ -166,6 +201,7 @@ type keyResponse struct {
 
 type monitorRequest struct {
 	LogLevel string
+	LogJSON  bool
 }
 
 type streamRequest struct {
@@ -182,24 +218,31 @@ type tagsRequest struct {
 }
 
 type queryRequest struct {
-	FilterNodes []string
-	FilterTags  map[string]string
-	RequestAck  bool
-	RelayFactor uint8
-	Timeout     time.Duration
-	Name        string
-	Payload     []byte
+	FilterNodes   []string
+	FilterTags    map[string]string
+	FilterExpr    string
+	RequestAck    bool
+	RelayFactor   uint8
+	Timeout       time.Duration
+	SampleSize    int
+	SamplePercent float64
+	MultiResponse bool
+	Name          string
+	Payload       []byte
 }
 
 type respondRequest struct {
 	ID      uint64
 	Payload []byte
+	Partial bool
 }
 
 type queryRecord struct {
 	Type    string
 	From    string
 	Payload []byte
+	Seq     uint32
+	Partial bool
 }
 
 type logRecord struct {
@@ -212,16 +255,44 @@ type userEventRecord struct {
 	Name     string
 	Payload  []byte
 	Coalesce bool
+	Origin   string
+	Seq      uint64
+	Signer   string
 }
 
-type queryEventRecord struct {
+type userGapRecord struct {
+	Event    string
+	Origin   string
+	FirstSeq uint64
+	LastSeq  uint64
+	Missed   int
+}
+
+type directMessageRecord struct {
 	Event   string
-	ID      uint64 // ID is opaque to client, used to respond
-	LTime   serf.LamportTime
-	Name    string
+	From    string
 	Payload []byte
 }
 
+type kvRecord struct {
+	Event   string
+	LTime   serf.LamportTime
+	Node    string
+	Key     string
+	Value   []byte
+	Deleted bool
+}
+
+type queryEventRecord struct {
+	Event         string
+	ID            uint64 // ID is opaque to client, used to respond
+	LTime         serf.LamportTime
+	Name          string
+	Payload       []byte
+	MultiResponse bool
+	Signer        string
+}
+
 type Member struct {
 	Name        string
 	Addr        net.IP
@@ -245,6 +316,7 @@ type AgentIPC struct {
 	sync.Mutex
 	agent                   *Agent
 	authKey                 string
+	tokens                  map[string]*RPCToken
 	clients                 map[string]*IPCClient
 	listener                net.Listener
 	logger                  *log.Logger
@@ -270,7 +342,8 @@ type IPCClient struct {
 	pendingQueries map[uint64]*serf.Query
 	queryLock      sync.Mutex
 
-	didAuth bool // Did we get an auth token yet?
+	didAuth bool      // Did we get an auth token yet?
+	token   *RPCToken // Token used to auth, nil if the auth key was used
 }
 
 // send is used to send an object using the MsgPack encoding. send
@@ -331,7 +404,9 @@ func (c *IPCClient) RegisterQuery(q *serf.Query) uint64 {
 	return id
 }
 
-// NewAgentIPC is used to create a new Agent IPC handler
+// NewAgentIPC is used to create a new Agent IPC handler. Clients may
+// authenticate with the authKey, or any of the RPC tokens in the agent
+// configuration.
 func NewAgentIPC(agent *Agent, authKey string, listener net.Listener,
 	logOutput io.Writer, logWriter *logWriter, msgpackUseNewTimeFormat bool) *AgentIPC {
 	if logOutput == nil {
@@ -340,6 +415,7 @@ func NewAgentIPC(agent *Agent, authKey string, listener net.Listener,
 	ipc := &AgentIPC{
 		agent:                   agent,
 		authKey:                 authKey,
+		tokens:                  newRPCTokenIndex(agent.agentConf.RPCTokens),
 		clients:                 make(map[string]*IPCClient),
 		listener:                listener,
 		logger:                  log.New(logOutput, "", log.LstdFlags),
@@ -485,77 +561,79 @@ func (i *AgentIPC) handleRequest(client *IPCClient, reqHeader *requestHeader) er
 	metrics.IncrCounterWithLabels([]string{"agent", "ipc", "command"}, 1, nil)
 
 	// Ensure the client has authenticated after the handshake if necessary
-	if i.authKey != "" && !client.didAuth && command != authCommand && command != handshakeCommand {
+	if i.authRequired() && !client.didAuth && command != authCommand && command != handshakeCommand {
 		i.logger.Printf("[WARN] agent.ipc: Client sending commands before auth")
 		respHeader := responseHeader{Seq: seq, Error: authRequired}
 		client.Send(&respHeader, nil)
 		return nil
 	}
 
-	// Dispatch command specific handlers
-	switch command {
-	case handshakeCommand:
-		return i.handleHandshake(client, seq)
-
-	case authCommand:
-		return i.handleAuth(client, seq)
-
-	case eventCommand:
-		return i.handleEvent(client, seq)
-
-	case membersCommand, membersFilteredCommand:
-		return i.handleMembers(client, command, seq)
-
-	case streamCommand:
-		return i.handleStream(client, seq)
-
-	case monitorCommand:
-		return i.handleMonitor(client, seq)
-
-	case stopCommand:
-		return i.handleStop(client, seq)
-
-	case forceLeaveCommand:
-		return i.handleForceLeave(client, seq)
-
-	case joinCommand:
-		return i.handleJoin(client, seq)
-
-	case leaveCommand:
-		return i.handleLeave(client, seq)
-
-	case installKeyCommand:
-		return i.handleInstallKey(client, seq)
-
-	case useKeyCommand:
-		return i.handleUseKey(client, seq)
-
-	case removeKeyCommand:
-		return i.handleRemoveKey(client, seq)
-
-	case listKeysCommand:
-		return i.handleListKeys(client, seq)
-
-	case tagsCommand:
-		return i.handleTags(client, seq)
-
-	case queryCommand:
-		return i.handleQuery(client, seq)
-
-	case respondCommand:
-		return i.handleRespond(client, seq)
-
-	case statsCommand:
-		return i.handleStats(client, seq)
-
-	case getCoordinateCommand:
-		return i.handleGetCoordinate(client, seq)
-
-	default:
+	// Commands that are not recognized end the connection, as their body
+	// can't be skipped
+	cmd, ok := ipcCommands[command]
+	if !ok {
 		respHeader := responseHeader{Seq: seq, Error: unsupportedCommand}
 		client.Send(&respHeader, nil)
 		return fmt.Errorf("command '%s' not recognized", command)
 	}
+
+	// Ensure the token the client authenticated with allows the command
+	if client.token != nil && !client.token.Allows(command) {
+		i.logger.Printf("[WARN] agent.ipc: RPC token '%s' denied command '%s'", client.token.Name, command)
+		if err := i.discardRequest(client, cmd); err != nil {
+			return err
+		}
+		respHeader := responseHeader{Seq: seq, Error: permissionDenied}
+		return client.Send(&respHeader, nil)
+	}
+
+	// Dispatch command specific handlers
+	return cmd.handler(i, client, seq)
+}
+
+// ipcCommand is a command handled by the IPC layer. The handler reads the
+// body of the request, unless noBody is set for commands without one.
+type ipcCommand struct {
+	handler func(i *AgentIPC, client *IPCClient, seq uint64) error
+	noBody  bool
+}
+
+// ipcCommands are the IPC commands by name
+var ipcCommands = map[string]ipcCommand{
+	handshakeCommand:  {handler: (*AgentIPC).handleHandshake},
+	authCommand:       {handler: (*AgentIPC).handleAuth},
+	eventCommand:      {handler: (*AgentIPC).handleEvent},
+	sendCommand:       {handler: (*AgentIPC).handleSend},
+	forceLeaveCommand: {handler: (*AgentIPC).handleForceLeave},
+	joinCommand:       {handler: (*AgentIPC).handleJoin},
+	membersCommand: {
+		handler: func(i *AgentIPC, client *IPCClient, seq uint64) error {
+			return i.handleMembers(client, membersCommand, seq)
+		},
+		noBody: true,
+	},
+	membersFilteredCommand: {
+		handler: func(i *AgentIPC, client *IPCClient, seq uint64) error {
+			return i.handleMembers(client, membersFilteredCommand, seq)
+		},
+	},
+	streamCommand:        {handler: (*AgentIPC).handleStream},
+	monitorCommand:       {handler: (*AgentIPC).handleMonitor},
+	stopCommand:          {handler: (*AgentIPC).handleStop},
+	leaveCommand:         {handler: (*AgentIPC).handleLeave, noBody: true},
+	installKeyCommand:    {handler: (*AgentIPC).handleInstallKey},
+	useKeyCommand:        {handler: (*AgentIPC).handleUseKey},
+	removeKeyCommand:     {handler: (*AgentIPC).handleRemoveKey},
+	listKeysCommand:      {handler: (*AgentIPC).handleListKeys, noBody: true},
+	tagsCommand:          {handler: (*AgentIPC).handleTags},
+	queryCommand:         {handler: (*AgentIPC).handleQuery},
+	respondCommand:       {handler: (*AgentIPC).handleRespond},
+	statsCommand:         {handler: (*AgentIPC).handleStats, noBody: true},
+	getCoordinateCommand: {handler: (*AgentIPC).handleGetCoordinate},
+	kvGetCommand:         {handler: (*AgentIPC).handleKVGet},
+	kvSetCommand:         {handler: (*AgentIPC).handleKVSet},
+	kvDeleteCommand:      {handler: (*AgentIPC).handleKVDelete},
+	kvListCommand:        {handler: (*AgentIPC).handleKVList},
 }
 
 func (i *AgentIPC) handleHandshake(client *IPCClient, seq uint64) error {
@@ -591,15 +669,38 @@ func (i *AgentIPC) handleAuth(client *IPCClient, seq uint64) error {
 		Error: "",
 	}
 
-	// Check the token matches
-	if req.AuthKey == i.authKey {
+	// Check the token matches the auth key, or a named token
+	if token, ok := i.tokens[req.AuthKey]; ok && req.AuthKey != "" {
+		client.didAuth = true
+		client.token = token
+	} else if req.AuthKey == i.authKey && (i.authKey != "" || len(i.tokens) == 0) {
+		// A blank auth key only grants access if there are no tokens
 		client.didAuth = true
+		client.token = nil
 	} else {
 		resp.Error = invalidAuthToken
 	}
 	return client.Send(&resp, nil)
 }
 
+// authRequired returns if clients must authenticate before sending commands
+func (i *AgentIPC) authRequired() bool {
+	return i.authKey != "" || len(i.tokens) > 0
+}
+
+// discardRequest is used to read and discard the body of a request that
+// won't be handled, so the next request can be decoded.
+func (i *AgentIPC) discardRequest(client *IPCClient, cmd ipcCommand) error {
+	if cmd.noBody {
+		return nil
+	}
+	var body any
+	if err := client.dec.Decode(&body); err != nil {
+		return fmt.Errorf("decode failed: %v", err)
+	}
+	return nil
+}
+
 func (i *AgentIPC) handleEvent(client *IPCClient, seq uint64) error {
 	var req eventRequest
 	if err := client.dec.Decode(&req); err != nil {
@@ -608,6 +709,26 @@ func (i *AgentIPC) handleEvent(client *IPCClient, seq uint64) error {
 
 	// Attempt the send
 	err := i.agent.UserEvent(req.Name, req.Payload, req.Coalesce)
+	if errors.Is(err, serf.UserEventThrottled) {
+		err = errors.New(eventThrottled)
+	}
+
+	// Respond
+	resp := responseHeader{
+		Seq:   seq,
+		Error: errToString(err),
+	}
+	return client.Send(&resp, nil)
+}
+
+func (i *AgentIPC) handleSend(client *IPCClient, seq uint64) error {
+	var req sendRequest
+	if err := client.dec.Decode(&req); err != nil {
+		return fmt.Errorf("decode failed: %v", err)
+	}
+
+	// Attempt the send
+	err := i.agent.SendToMember(req.Node, req.Payload)
 
 	// Respond
 	resp := responseHeader{
@@ -670,9 +791,13 @@ func (i *AgentIPC) handleMembers(client *IPCClient, command string, seq uint64)
 		if err != nil {
 			return fmt.Errorf("decode failed: %v", err)
 		}
-		raw, err = i.filterMembers(raw, req.Tags, req.Status, req.Name)
+		raw, err = filterMembers(raw, req.Tags, req.Status, req.Name, req.Filter)
 		if err != nil {
-			return err
+			header := responseHeader{
+				Seq:   seq,
+				Error: err.Error(),
+			}
+			return client.Send(&header, &membersResponse{Members: members})
 		}
 	}
 
@@ -703,11 +828,22 @@ func (i *AgentIPC) handleMembers(client *IPCClient, command string, seq uint64)
 	return client.Send(&header, &resp)
 }
 
-func (i *AgentIPC) filterMembers(members []serf.Member, tags map[string]string,
-	status string, name string) ([]serf.Member, error) {
+// filterMembers returns the members matching the given tag, status and name
+// expressions. Each expression is anchored before it is compiled. The
+// members must also match the filter expression, if one is given.
+func filterMembers(members []serf.Member, tags map[string]string,
+	status string, name string, filter string) ([]serf.Member, error) {
 
 	result := make([]serf.Member, 0, len(members))
 
+	var expr *serf.TagExpr
+	if filter != "" {
+		var err error
+		if expr, err = serf.ParseTagExpr(filter); err != nil {
+			return nil, err
+		}
+	}
+
 	// Pre-compile all the regular expressions
 	tagsRe := make(map[string]*regexp.Regexp)
 	for tag, expr := range tags {
@@ -747,6 +883,11 @@ OUTER:
 			continue
 		}
 
+		// Check if the filter expression matches
+		if expr != nil && !expr.Match(m.Tags) {
+			continue
+		}
+
 		// Made it past the filters!
 		result = append(result, m)
 	}
@@ -879,6 +1020,7 @@ SEND:
 
 func (i *AgentIPC) handleMonitor(client *IPCClient, seq uint64) error {
 	var req monitorRequest
+	var format func(string) string
 	if err := client.dec.Decode(&req); err != nil {
 		return fmt.Errorf("decode failed: %v", err)
 	}
@@ -905,8 +1047,13 @@ func (i *AgentIPC) handleMonitor(client *IPCClient, seq uint64) error {
 		goto SEND
 	}
 
+	// Stream JSON logs if requested by the client or the agent config
+	if req.LogJSON || i.agent.agentConf.LogJSON {
+		format = jsonLogFormat(i.agent.SerfConfig().NodeName)
+	}
+
 	// Create a log streamer
-	client.logStreamer = newLogStream(client, filter, seq, i.logger)
+	client.logStreamer = newLogStream(client, filter, format, seq, i.logger)
 
 	// Register with the log writer. Defer so that we can respond before
 	// registration, avoids any possible race condition
@@ -995,11 +1142,15 @@ func (i *AgentIPC) handleQuery(client *IPCClient, seq uint64) error {
 
 	// Setup the query
 	params := serf.QueryParam{
-		FilterNodes: req.FilterNodes,
-		FilterTags:  req.FilterTags,
-		RequestAck:  req.RequestAck,
-		RelayFactor: req.RelayFactor,
-		Timeout:     req.Timeout,
+		FilterNodes:       req.FilterNodes,
+		FilterTags:        req.FilterTags,
+		FilterExpr:        req.FilterExpr,
+		RequestAck:        req.RequestAck,
+		RelayFactor:       req.RelayFactor,
+		Timeout:           req.Timeout,
+		SampleSize:        req.SampleSize,
+		SamplePercent:     req.SamplePercent,
+		MultipleResponses: req.MultiResponse,
 	}
 
 	// Start the query
@@ -1034,7 +1185,9 @@ func (i *AgentIPC) handleRespond(client *IPCClient, seq uint64) error {
 
 	// Respond if we have a pending query
 	var err error
-	if ok {
+	if ok && req.Partial {
+		err = query.RespondPartial(req.Payload)
+	} else if ok {
 		err = query.Respond(req.Payload)
 	} else {
 		err = errors.New(invalidQueryID)
@@ -1084,6 +1237,77 @@ func (i *AgentIPC) handleGetCoordinate(client *IPCClient, seq uint64) error {
 	return client.Send(&header, &resp)
 }
 
+func (i *AgentIPC) handleKVGet(client *IPCClient, seq uint64) error {
+	var req kvRequest
+	if err := client.dec.Decode(&req); err != nil {
+		return fmt.Errorf("decode failed: %v", err)
+	}
+
+	value, ok := i.agent.Serf().KVGet(req.Key)
+
+	// Respond
+	header := responseHeader{
+		Seq:   seq,
+		Error: errToString(nil),
+	}
+	resp := kvResponse{
+		Value: value,
+		Ok:    ok,
+	}
+	return client.Send(&header, &resp)
+}
+
+func (i *AgentIPC) handleKVSet(client *IPCClient, seq uint64) error {
+	var req kvSetRequest
+	if err := client.dec.Decode(&req); err != nil {
+		return fmt.Errorf("decode failed: %v", err)
+	}
+
+	// Attempt the write
+	err := i.agent.KVSet(req.Key, req.Value)
+
+	// Respond
+	resp := responseHeader{
+		Seq:   seq,
+		Error: errToString(err),
+	}
+	return client.Send(&resp, nil)
+}
+
+func (i *AgentIPC) handleKVDelete(client *IPCClient, seq uint64) error {
+	var req kvRequest
+	if err := client.dec.Decode(&req); err != nil {
+		return fmt.Errorf("decode failed: %v", err)
+	}
+
+	// Attempt the delete
+	err := i.agent.KVDelete(req.Key)
+
+	// Respond
+	resp := responseHeader{
+		Seq:   seq,
+		Error: errToString(err),
+	}
+	return client.Send(&resp, nil)
+}
+
+func (i *AgentIPC) handleKVList(client *IPCClient, seq uint64) error {
+	var req kvListRequest
+	if err := client.dec.Decode(&req); err != nil {
+		return fmt.Errorf("decode failed: %v", err)
+	}
+
+	// Respond
+	header := responseHeader{
+		Seq:   seq,
+		Error: errToString(nil),
+	}
+	resp := kvListResponse{
+		Values: i.agent.Serf().KVList(req.Prefix),
+	}
+	return client.Send(&header, &resp)
+}
+
 // Used to convert an error to a string representation
 func errToString(err error) string {
 	if err == nil {
@@ -68,6 +68,12 @@ func (es *eventStream) stream() {
 			err = es.sendUserEvent(e)
 		case *serf.Query:
 			err = es.sendQuery(e)
+		case serf.DirectMessageEvent:
+			err = es.sendDirectMessage(e)
+		case serf.UserEventGap:
+			err = es.sendUserGap(e)
+		case serf.KVEvent:
+			err = es.sendKV(e)
 		default:
 			err = fmt.Errorf("Unknown event type: %s", event.EventType().String())
 		}
@@ -81,6 +87,15 @@ func (es *eventStream) stream() {
 
 // sendMemberEvent is used to send a single member event
 func (es *eventStream) sendMemberEvent(me serf.MemberEvent) error {
+	header := responseHeader{
+		Seq:   es.seq,
+		Error: "",
+	}
+	return es.client.Send(&header, newMemberEventRecord(me))
+}
+
+// newMemberEventRecord converts a member event into its record
+func newMemberEventRecord(me serf.MemberEvent) *memberEventRecord {
 	members := make([]Member, 0, len(me.Members))
 	for _, m := range me.Members {
 		sm := Member{
@@ -99,15 +114,10 @@ func (es *eventStream) sendMemberEvent(me serf.MemberEvent) error {
 		members = append(members, sm)
 	}
 
-	header := responseHeader{
-		Seq:   es.seq,
-		Error: "",
-	}
-	rec := memberEventRecord{
+	return &memberEventRecord{
 		Event:   me.String(),
 		Members: members,
 	}
-	return es.client.Send(&header, &rec)
 }
 
 // sendUserEvent is used to send a single user event
@@ -116,16 +126,77 @@ func (es *eventStream) sendUserEvent(ue serf.UserEvent) error {
 		Seq:   es.seq,
 		Error: "",
 	}
-	rec := userEventRecord{
+	return es.client.Send(&header, newUserEventRecord(ue))
+}
+
+func newUserEventRecord(ue serf.UserEvent) *userEventRecord {
+	return &userEventRecord{
 		Event:    ue.EventType().String(),
 		LTime:    ue.LTime,
 		Name:     ue.Name,
 		Payload:  ue.Payload,
 		Coalesce: ue.Coalesce,
+		Origin:   ue.Origin,
+		Seq:      ue.Seq,
+		Signer:   ue.Signer,
+	}
+}
+
+// sendDirectMessage is used to send a single direct message event
+func (es *eventStream) sendDirectMessage(dm serf.DirectMessageEvent) error {
+	header := responseHeader{
+		Seq:   es.seq,
+		Error: "",
+	}
+	rec := directMessageRecord{
+		Event:   dm.EventType().String(),
+		From:    dm.From,
+		Payload: dm.Payload,
 	}
 	return es.client.Send(&header, &rec)
 }
 
+// sendUserGap is used to send a single user event gap
+func (es *eventStream) sendUserGap(g serf.UserEventGap) error {
+	header := responseHeader{
+		Seq:   es.seq,
+		Error: "",
+	}
+	return es.client.Send(&header, newUserGapRecord(g))
+}
+
+// newUserGapRecord converts a user event gap into its record
+func newUserGapRecord(g serf.UserEventGap) *userGapRecord {
+	return &userGapRecord{
+		Event:    g.EventType().String(),
+		Origin:   g.Origin,
+		FirstSeq: g.FirstSeq,
+		LastSeq:  g.LastSeq,
+		Missed:   g.Missed,
+	}
+}
+
+// sendKV is used to send a single key/value write
+func (es *eventStream) sendKV(kv serf.KVEvent) error {
+	header := responseHeader{
+		Seq:   es.seq,
+		Error: "",
+	}
+	return es.client.Send(&header, newKVRecord(kv))
+}
+
+// newKVRecord converts a key/value write into its record
+func newKVRecord(kv serf.KVEvent) *kvRecord {
+	return &kvRecord{
+		Event:   kv.EventType().String(),
+		LTime:   kv.LTime,
+		Node:    kv.Node,
+		Key:     kv.Key,
+		Value:   kv.Value,
+		Deleted: kv.Deleted,
+	}
+}
+
 // sendQuery is used to send a single query event
 func (es *eventStream) sendQuery(q *serf.Query) error {
 	id := es.client.RegisterQuery(q)
@@ -135,11 +206,13 @@ func (es *eventStream) sendQuery(q *serf.Query) error {
 		Error: "",
 	}
 	rec := queryEventRecord{
-		Event:   q.EventType().String(),
-		ID:      id,
-		LTime:   q.LTime,
-		Name:    q.Name,
-		Payload: q.Payload,
+		Event:         q.EventType().String(),
+		ID:            id,
+		LTime:         q.LTime,
+		Name:          q.Name,
+		Payload:       q.Payload,
+		MultiResponse: q.MultiResponse(),
+		Signer:        q.Signer(),
 	}
 	return es.client.Send(&header, &rec)
 }
@@ -13,16 +13,20 @@ import (
 type logStream struct {
 	client streamClient
 	filter *logutils.LevelFilter
+	format func(string) string
 	logCh  chan string
 	logger *log.Logger
 	seq    uint64
 }
 
+// newLogStream creates a log stream. If format is not nil, it is used to
+// rewrite each log line before it is sent to the client.
 func newLogStream(client streamClient, filter *logutils.LevelFilter,
-	seq uint64, logger *log.Logger) *logStream {
+	format func(string) string, seq uint64, logger *log.Logger) *logStream {
 	ls := &logStream{
 		client: client,
 		filter: filter,
+		format: format,
 		logCh:  make(chan string, 512),
 		logger: logger,
 		seq:    seq,
@@ -58,6 +62,9 @@ func (ls *logStream) stream() {
 	rec := logRecord{Log: ""}
 
 	for line := range ls.logCh {
+		if ls.format != nil {
+			line = ls.format(line)
+		}
 		rec.Log = line
 		if err := ls.client.Send(&header, &rec); err != nil {
 			ls.logger.Printf("[ERR] agent.ipc: Failed to stream log to %v: %v",
@@ -17,7 +17,7 @@ func TestIPCLogStream(t *testing.T) {
 	filter := LevelFilter()
 	filter.MinLevel = logutils.LogLevel("INFO")
 
-	ls := newLogStream(sc, filter, 42, log.New(os.Stderr, "", log.LstdFlags))
+	ls := newLogStream(sc, filter, nil, 42, log.New(os.Stderr, "", log.LstdFlags))
 	defer ls.Stop()
 
 	log := "[DEBUG] this is a test log"
@@ -42,7 +42,7 @@ func (qs *queryResponseStream) Stream(resp *serf.QueryResponse) {
 				return
 			}
 		case r := <-respCh:
-			if err := qs.sendResponse(r.From, r.Payload); err != nil {
+			if err := qs.sendResponse(r); err != nil {
 				qs.logger.Printf("[ERR] agent.ipc: Failed to stream response to %v: %v", qs.client, err)
 				return
 			}
@@ -69,15 +69,17 @@ func (qs *queryResponseStream) sendAck(from string) error {
 }
 
 // sendResponse is used to send a single response
-func (qs *queryResponseStream) sendResponse(from string, payload []byte) error {
+func (qs *queryResponseStream) sendResponse(r serf.NodeResponse) error {
 	header := responseHeader{
 		Seq:   qs.seq,
 		Error: "",
 	}
 	rec := queryRecord{
 		Type:    queryRecordResponse,
-		From:    from,
-		Payload: payload,
+		From:    r.From,
+		Payload: r.Payload,
+		Seq:     r.Seq,
+		Partial: r.Partial,
 	}
 	return qs.client.Send(&header, &rec)
 }
@@ -0,0 +1,141 @@
+// Copyright IBM Corp. 2013, 2026
+// SPDX-License-Identifier: MPL-2.0
+
+package agent
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// unixSocketPrefix is used to provide a Unix domain socket path instead
+// of a TCP address for the RPC and HTTP listeners.
+const unixSocketPrefix = "unix://"
+
+// listen is used to create a listener for the given address. The address
+// is either a TCP host:port, or a Unix domain socket path prefixed with
+// unix://, in which case the socket file permissions are applied.
+func listen(addr string, conf *Config) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, unixSocketPrefix)
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+
+	// Remove a stale socket left behind by an unclean shutdown, but never
+	// anything that isn't a socket.
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("Refusing to replace non-socket file %s", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("Failed to remove stale socket: %v", err)
+		}
+	}
+
+	// Create the socket in a private directory, so that no one can connect
+	// before its permissions are applied, and then move it in place
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".serf-")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create socket directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tmpPath := filepath.Join(dir, "sock")
+	l, err := net.Listen("unix", tmpPath)
+	if err != nil {
+		return nil, err
+	}
+	ul := l.(*net.UnixListener)
+	ul.SetUnlinkOnClose(false)
+
+	if err := setSocketPermissions(tmpPath, conf); err != nil {
+		l.Close()
+		return nil, err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("Failed to move socket in place: %v", err)
+	}
+	return &unixListener{UnixListener: ul, path: path}, nil
+}
+
+// unixListener removes its socket file when closed, which the embedded
+// listener can't do as the socket was moved after it was created
+type unixListener struct {
+	*net.UnixListener
+	path string
+}
+
+func (l *unixListener) Close() error {
+	err := l.UnixListener.Close()
+	os.Remove(l.path)
+	return err
+}
+
+// setSocketPermissions applies the configured mode and owner to a
+// Unix domain socket file.
+func setSocketPermissions(path string, conf *Config) error {
+	if conf.RPCSocketMode != "" {
+		mode, err := strconv.ParseUint(conf.RPCSocketMode, 8, 32)
+		if err != nil {
+			return fmt.Errorf("Invalid rpc_socket_mode '%s': %v", conf.RPCSocketMode, err)
+		}
+		if err := os.Chmod(path, os.FileMode(mode)); err != nil {
+			return fmt.Errorf("Failed to set socket mode: %v", err)
+		}
+	}
+
+	if conf.RPCSocketUser == "" && conf.RPCSocketGroup == "" {
+		return nil
+	}
+
+	uid, gid := -1, -1
+	if conf.RPCSocketUser != "" {
+		id, err := lookupID(conf.RPCSocketUser, func(name string) (string, error) {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return "", err
+			}
+			return u.Uid, nil
+		})
+		if err != nil {
+			return fmt.Errorf("Invalid rpc_socket_user '%s': %v", conf.RPCSocketUser, err)
+		}
+		uid = id
+	}
+	if conf.RPCSocketGroup != "" {
+		id, err := lookupID(conf.RPCSocketGroup, func(name string) (string, error) {
+			g, err := user.LookupGroup(name)
+			if err != nil {
+				return "", err
+			}
+			return g.Gid, nil
+		})
+		if err != nil {
+			return fmt.Errorf("Invalid rpc_socket_group '%s': %v", conf.RPCSocketGroup, err)
+		}
+		gid = id
+	}
+
+	if err := os.Chown(path, uid, gid); err != nil {
+		return fmt.Errorf("Failed to set socket owner: %v", err)
+	}
+	return nil
+}
+
+// lookupID resolves a numeric ID, or a name using the given lookup function
+func lookupID(nameOrID string, lookup func(string) (string, error)) (int, error) {
+	if id, err := strconv.Atoi(nameOrID); err == nil {
+		return id, nil
+	}
+	id, err := lookup(nameOrID)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(id)
+}
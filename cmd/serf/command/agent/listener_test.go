@@ -0,0 +1,138 @@
+// Copyright IBM Corp. 2013, 2026
+// SPDX-License-Identifier: MPL-2.0
+
+package agent
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+
+	"github.com/hashicorp/serf/client"
+	"github.com/hashicorp/serf/serf"
+	"github.com/hashicorp/serf/testutil"
+)
+
+func TestListen_TCP(t *testing.T) {
+	l, err := listen("127.0.0.1:0", DefaultConfig())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+
+	if l.Addr().Network() != "tcp" {
+		t.Fatalf("bad: %v", l.Addr())
+	}
+}
+
+func TestListen_Unix(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("socket permissions are not supported on windows")
+	}
+
+	path := filepath.Join(t.TempDir(), "serf.sock")
+
+	// Create a stale socket that must be replaced
+	stale, err := listen(unixSocketPrefix+path, DefaultConfig())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer stale.Close()
+
+	conf := DefaultConfig()
+	conf.RPCSocketMode = "0600"
+	conf.RPCSocketUser = strconv.Itoa(os.Getuid())
+	conf.RPCSocketGroup = strconv.Itoa(os.Getgid())
+
+	l, err := listen(unixSocketPrefix+path, conf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		t.Fatalf("bad: %v", fi.Mode())
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Fatalf("bad: %v", fi.Mode().Perm())
+	}
+
+	// The private directory the socket was created in is removed
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("bad: %v", entries)
+	}
+
+	// The socket is removed once closed
+	l.Close()
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Fatalf("should be removed: %v", err)
+	}
+}
+
+func TestListen_UnixBadOptions(t *testing.T) {
+	dir := t.TempDir()
+
+	// Must not remove regular files
+	path := filepath.Join(dir, "serf.sock")
+	if err := os.WriteFile(path, []byte("data"), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := listen(unixSocketPrefix+path, DefaultConfig()); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	// Bad mode
+	conf := DefaultConfig()
+	conf.RPCSocketMode = "rw"
+	if _, err := listen(unixSocketPrefix+filepath.Join(dir, "mode.sock"), conf); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestRPCClientUnixSocket(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	addr := unixSocketPrefix + filepath.Join(t.TempDir(), "serf.sock")
+	l, err := listen(addr, DefaultConfig())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	lw := NewLogWriter(512)
+	mult := io.MultiWriter(testutil.TestWriter(t), lw)
+	a1 := testAgentWithConfig(t, ip1, DefaultConfig(), serf.DefaultConfig(), mult)
+	defer a1.Shutdown()
+	ipc := NewAgentIPC(a1, "", l, mult, lw, false)
+	defer ipc.Shutdown()
+
+	if err := a1.Start(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testutil.Yield()
+
+	rpcClient, err := client.NewRPCClient(addr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer rpcClient.Close()
+
+	mem, err := rpcClient.Members()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(mem) != 1 {
+		t.Fatalf("bad: %#v", mem)
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright IBM Corp. 2013, 2026
+// SPDX-License-Identifier: MPL-2.0
+
+package agent
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+	"time"
+)
+
+// logTimeFormat is the timestamp format written by log.LstdFlags
+const logTimeFormat = "2006/01/02 15:04:05"
+
+// logEntry is a structured log record, used when log_json is enabled
+type logEntry struct {
+	Timestamp time.Time `json:"timestamp"`
+	Level     string    `json:"level"`
+	Subsystem string    `json:"subsystem,omitempty"`
+	Message   string    `json:"message"`
+	Node      string    `json:"node"`
+}
+
+// parseLogLine parses a log line written with log.LstdFlags using the
+// "[LEVEL] subsystem: message" convention of Serf and memberlist. Parts
+// that are missing are left empty, and the level defaults to INFO.
+func parseLogLine(line, node string) *logEntry {
+	line = strings.TrimRight(line, "\n")
+	entry := &logEntry{
+		Level:   "INFO",
+		Message: line,
+		Node:    node,
+	}
+
+	// Extract the timestamp, falling back to the current time
+	entry.Timestamp = time.Now()
+	if len(line) > len(logTimeFormat) {
+		ts, err := time.ParseInLocation(logTimeFormat, line[:len(logTimeFormat)], time.Local)
+		if err == nil {
+			entry.Timestamp = ts
+			line = strings.TrimLeft(line[len(logTimeFormat):], " ")
+		}
+	}
+
+	// Extract the level
+	if strings.HasPrefix(line, "[") {
+		if end := strings.IndexByte(line, ']'); end > 0 {
+			entry.Level = line[1:end]
+			line = strings.TrimLeft(line[end+1:], " ")
+		}
+	}
+
+	// Extract the subsystem, which is a single word such as "agent.ipc"
+	if sub, msg, ok := strings.Cut(line, ": "); ok && sub != "" && !strings.ContainsAny(sub, " \t") {
+		entry.Subsystem = sub
+		line = msg
+	}
+
+	entry.Message = line
+	return entry
+}
+
+// formatLogJSON converts a log line into a single line JSON object
+func formatLogJSON(line, node string) string {
+	buf, err := json.Marshal(parseLogLine(line, node))
+	if err != nil {
+		return line
+	}
+	return string(buf)
+}
+
+// jsonLogFormat returns a log stream format that converts log lines
+// into JSON objects for the given node
+func jsonLogFormat(node string) func(string) string {
+	return func(line string) string {
+		return formatLogJSON(line, node)
+	}
+}
+
+// jsonLogWriter is an io.Writer that rewrites each log line written to
+// it as a JSON object before passing it on.
+type jsonLogWriter struct {
+	node   string
+	writer io.Writer
+}
+
+// Write is used to implement io.Writer
+func (j *jsonLogWriter) Write(p []byte) (int, error) {
+	out := formatLogJSON(string(p), j.node) + "\n"
+	if _, err := j.writer.Write([]byte(out)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,72 @@
+// Copyright IBM Corp. 2013, 2026
+// SPDX-License-Identifier: MPL-2.0
+
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestParseLogLine(t *testing.T) {
+	entry := parseLogLine("2013/12/03 13:06:53 [WARN] agent.ipc: Dropping logs: full\n", "foo")
+	expected := &logEntry{
+		Timestamp: time.Date(2013, 12, 3, 13, 6, 53, 0, time.Local),
+		Level:     "WARN",
+		Subsystem: "agent.ipc",
+		Message:   "Dropping logs: full",
+		Node:      "foo",
+	}
+	if !entry.Timestamp.Equal(expected.Timestamp) {
+		t.Fatalf("bad: %v", entry.Timestamp)
+	}
+	entry.Timestamp = expected.Timestamp
+	if *entry != *expected {
+		t.Fatalf("bad: %#v", entry)
+	}
+
+	// Lines without a timestamp, level or subsystem
+	entry = parseLogLine("[ERR] failed to do the thing", "foo")
+	if entry.Level != "ERR" || entry.Subsystem != "" || entry.Message != "failed to do the thing" {
+		t.Fatalf("bad: %#v", entry)
+	}
+	if entry.Timestamp.IsZero() {
+		t.Fatalf("bad: %#v", entry)
+	}
+
+	entry = parseLogLine("plain", "foo")
+	if entry.Level != "INFO" || entry.Message != "plain" {
+		t.Fatalf("bad: %#v", entry)
+	}
+}
+
+func TestJSONLogWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := &jsonLogWriter{node: "foo", writer: &buf}
+
+	line := []byte("2013/12/03 13:06:53 [INFO] serf: EventMemberJoin: bar 127.0.0.1\n")
+	n, err := w.Write(line)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if n != len(line) {
+		t.Fatalf("bad: %d", n)
+	}
+	if !bytes.HasSuffix(buf.Bytes(), []byte("}\n")) {
+		t.Fatalf("bad: %q", buf.String())
+	}
+
+	var out map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out["level"] != "INFO" || out["subsystem"] != "serf" ||
+		out["message"] != "EventMemberJoin: bar 127.0.0.1" || out["node"] != "foo" {
+		t.Fatalf("bad: %v", out)
+	}
+	if _, ok := out["timestamp"]; !ok {
+		t.Fatalf("bad: %v", out)
+	}
+}
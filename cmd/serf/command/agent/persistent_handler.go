@@ -0,0 +1,392 @@
+// Copyright IBM Corp. 2013, 2026
+// SPDX-License-Identifier: MPL-2.0
+
+package agent
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	metrics "github.com/hashicorp/go-metrics/compat"
+	"github.com/hashicorp/serf/serf"
+)
+
+const (
+	// persistentRestartMin and persistentRestartMax bound the backoff
+	// before restarting a handler process that exited. The backoff is
+	// reset once a process has been running for persistentRestartMax.
+	persistentRestartMin = time.Second
+	persistentRestartMax = time.Minute
+
+	// persistentStopTimeout is how long a handler process has to exit
+	// after its stdin is closed before it is killed
+	persistentStopTimeout = 5 * time.Second
+
+	// persistentQueueSize is the number of events that may wait to be
+	// written to a handler process
+	persistentQueueSize = 512
+)
+
+// PersistentEventHandler streams the events it receives to long running
+// handler processes, instead of invoking a script for every event. One
+// process is started for each handler script. Events are written to its
+// stdin as newline delimited JSON, and it may respond to queries by
+// writing {"ID": ..., "Payload": ...} lines to stdout, setting "Partial"
+// on all but the last response to a multi-response query. Processes that
+// exit are restarted with a backoff.
+type PersistentEventHandler struct {
+	SelfFunc func() serf.Member
+	Logger   *log.Logger
+
+	lock      sync.Mutex
+	processes []*handlerProcess
+}
+
+// handlerProcess supervises the process of a single handler script
+type handlerProcess struct {
+	script  string
+	filters []EventFilter
+	handler *PersistentEventHandler
+	eventCh chan serf.Event
+	stopCh  chan struct{}
+	doneCh  chan struct{}
+
+	queryID        atomic.Uint64
+	queryLock      sync.Mutex
+	pendingQueries map[uint64]*serf.Query
+}
+
+func (h *PersistentEventHandler) HandleEvent(e serf.Event) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for _, p := range h.processes {
+		if !p.invoke(e) {
+			continue
+		}
+
+		// Do a non-blocking send
+		select {
+		case p.eventCh <- e:
+		default:
+			metrics.IncrCounter([]string{"agent", "persistent_handler", "dropped"}, 1)
+			h.Logger.Printf("[WARN] agent: Event handler '%s' queue is full, dropping event '%s'",
+				p.script, e.String())
+		}
+	}
+}
+
+// UpdateScripts replaces the handler scripts. Processes for scripts that
+// are still configured keep running with the new filters, processes for
+// removed scripts are stopped and new scripts are started.
+func (h *PersistentEventHandler) UpdateScripts(scripts []EventScript) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.Logger == nil {
+		h.Logger = log.New(os.Stderr, "", log.LstdFlags)
+	}
+
+	existing := make(map[string]*handlerProcess, len(h.processes))
+	for _, p := range h.processes {
+		existing[p.script] = p
+	}
+
+	// Group the filters by script, keeping the order of the scripts
+	var processes []*handlerProcess
+	byScript := make(map[string]*handlerProcess)
+	for _, script := range scripts {
+		if p, ok := byScript[script.Script]; ok {
+			p.filters = append(p.filters, script.EventFilter)
+			continue
+		}
+
+		p, ok := existing[script.Script]
+		if ok {
+			delete(existing, script.Script)
+		} else {
+			p = &handlerProcess{
+				script:         script.Script,
+				handler:        h,
+				eventCh:        make(chan serf.Event, persistentQueueSize),
+				stopCh:         make(chan struct{}),
+				doneCh:         make(chan struct{}),
+				pendingQueries: make(map[uint64]*serf.Query),
+			}
+			go p.run()
+		}
+		p.filters = []EventFilter{script.EventFilter}
+		byScript[script.Script] = p
+		processes = append(processes, p)
+	}
+	h.processes = processes
+
+	for _, p := range existing {
+		close(p.stopCh)
+	}
+}
+
+// Shutdown stops all the handler processes, waiting for them to exit
+func (h *PersistentEventHandler) Shutdown() {
+	h.lock.Lock()
+	processes := h.processes
+	h.processes = nil
+	h.lock.Unlock()
+
+	for _, p := range processes {
+		close(p.stopCh)
+	}
+	for _, p := range processes {
+		<-p.doneCh
+	}
+}
+
+// invoke returns if the event matches any of the handler filters
+func (p *handlerProcess) invoke(e serf.Event) bool {
+	for _, f := range p.filters {
+		if f.Invoke(e) {
+			return true
+		}
+	}
+	return false
+}
+
+// run starts the handler process, restarting it with a backoff whenever
+// it exits until the handler is stopped
+func (p *handlerProcess) run() {
+	defer close(p.doneCh)
+	logger := p.handler.Logger
+
+	// Wait for the first event before starting the process, since the
+	// agent may not have been started yet
+	var first serf.Event
+	select {
+	case first = <-p.eventCh:
+	case <-p.stopCh:
+		return
+	}
+
+	backoff := persistentRestartMin
+	for {
+		start := time.Now()
+		err := p.runOnce(first)
+		first = nil
+
+		select {
+		case <-p.stopCh:
+			return
+		default:
+		}
+
+		// Reset the backoff if the process was healthy for a while
+		if time.Since(start) > persistentRestartMax {
+			backoff = persistentRestartMin
+		}
+
+		metrics.IncrCounter([]string{"agent", "persistent_handler", "restart"}, 1)
+		logger.Printf("[ERR] agent: Event handler '%s' exited, restarting in %v: %v",
+			p.script, backoff, err)
+
+		select {
+		case <-time.After(backoff):
+		case <-p.stopCh:
+			return
+		}
+		backoff = min(backoff*2, persistentRestartMax)
+	}
+}
+
+// runOnce starts the handler process and writes events to it, starting
+// with the given event if any, until the process exits or the handler is
+// stopped
+func (p *handlerProcess) runOnce(first serf.Event) error {
+	logger := p.handler.Logger
+
+	var self serf.Member
+	if p.handler.SelfFunc != nil {
+		self = p.handler.SelfFunc()
+	}
+	cmd := scriptCommand(p.script, self)
+	cmd.Stderr = &handlerOutput{logger: logger, script: p.script}
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	logger.Printf("[INFO] agent: Started event handler '%s' (pid %d)", p.script, cmd.Process.Pid)
+
+	// Read the query responses until the process closes stdout
+	readDoneCh := make(chan struct{})
+	go func() {
+		defer close(readDoneCh)
+		p.readResponses(stdout)
+	}()
+
+	// Kill the process if it doesn't exit in time once stopped, which
+	// also unblocks any write to a process that isn't reading its stdin
+	exitCh := make(chan struct{})
+	defer close(exitCh)
+	go func() {
+		select {
+		case <-p.stopCh:
+		case <-exitCh:
+			return
+		}
+		select {
+		case <-time.After(persistentStopTimeout):
+			cmd.Process.Kill()
+		case <-exitCh:
+		}
+	}()
+
+	enc := json.NewEncoder(stdin)
+	for {
+		e := first
+		first = nil
+		if e == nil {
+			select {
+			case e = <-p.eventCh:
+			case <-readDoneCh:
+				return cmd.Wait()
+			case <-p.stopCh:
+				// Ask the process to exit by closing stdin
+				stdin.Close()
+				<-readDoneCh
+				return cmd.Wait()
+			}
+		}
+
+		if err := enc.Encode(p.record(e)); err != nil {
+			cmd.Process.Kill()
+			<-readDoneCh
+			cmd.Wait()
+			return fmt.Errorf("failed to write event: %v", err)
+		}
+	}
+}
+
+// record converts an event into the record written to the process. Queries
+// are registered so the process can respond to them by ID.
+func (p *handlerProcess) record(event serf.Event) any {
+	switch e := event.(type) {
+	case serf.MemberEvent:
+		return newMemberEventRecord(e)
+	case serf.UserEvent:
+		return newUserEventRecord(e)
+	case serf.DirectMessageEvent:
+		return &directMessageRecord{
+			Event:   e.EventType().String(),
+			From:    e.From,
+			Payload: e.Payload,
+		}
+	case serf.UserEventGap:
+		return newUserGapRecord(e)
+	case serf.KVEvent:
+		return newKVRecord(e)
+	case *serf.Query:
+		return &queryEventRecord{
+			Event:         e.EventType().String(),
+			ID:            p.registerQuery(e),
+			LTime:         e.LTime,
+			Name:          e.Name,
+			Payload:       e.Payload,
+			MultiResponse: e.MultiResponse(),
+			Signer:        e.Signer(),
+		}
+	}
+	return map[string]string{"Event": event.EventType().String()}
+}
+
+// registerQuery tracks a query until its deadline so it can be responded to
+func (p *handlerProcess) registerQuery(q *serf.Query) uint64 {
+	id := p.queryID.Add(1)
+
+	// Ensure the query deadline is in the future
+	timeout := time.Until(q.Deadline())
+	if timeout < 0 {
+		return id
+	}
+
+	p.queryLock.Lock()
+	p.pendingQueries[id] = q
+	p.queryLock.Unlock()
+
+	// Setup a timer to deregister after the timeout
+	time.AfterFunc(timeout, func() {
+		p.queryLock.Lock()
+		delete(p.pendingQueries, id)
+		p.queryLock.Unlock()
+	})
+	return id
+}
+
+// readResponses reads the query responses written by the process
+func (p *handlerProcess) readResponses(r io.Reader) {
+	logger := p.handler.Logger
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var resp respondRequest
+		if err := json.Unmarshal(scanner.Bytes(), &resp); err != nil {
+			logger.Printf("[WARN] agent: Event handler '%s' wrote an invalid response: %s",
+				p.script, scanner.Text())
+			continue
+		}
+
+		// Partial responses keep the query registered for the next ones,
+		// until the final response or the deadline
+		p.queryLock.Lock()
+		query, ok := p.pendingQueries[resp.ID]
+		if !resp.Partial {
+			delete(p.pendingQueries, resp.ID)
+		}
+		p.queryLock.Unlock()
+		if !ok {
+			logger.Printf("[WARN] agent: Event handler '%s' responded to unknown query %d",
+				p.script, resp.ID)
+			continue
+		}
+
+		var err error
+		if resp.Partial {
+			err = query.RespondPartial(resp.Payload)
+		} else {
+			err = query.Respond(resp.Payload)
+		}
+		if err != nil {
+			logger.Printf("[WARN] agent: Failed to respond to query '%s': %s",
+				query.String(), err)
+		}
+	}
+
+	// Drain the rest of the output so the process doesn't block
+	if err := scanner.Err(); err != nil {
+		logger.Printf("[ERR] agent: Failed to read from event handler '%s': %v", p.script, err)
+		io.Copy(io.Discard, r)
+	}
+}
+
+// handlerOutput logs the stderr output of a handler process
+type handlerOutput struct {
+	logger *log.Logger
+	script string
+}
+
+func (o *handlerOutput) Write(p []byte) (int, error) {
+	o.logger.Printf("[DEBUG] agent: Event handler '%s' output: %s", o.script, p)
+	return len(p), nil
+}
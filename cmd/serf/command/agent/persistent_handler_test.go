@@ -0,0 +1,268 @@
+// Copyright IBM Corp. 2013, 2026
+// SPDX-License-Identifier: MPL-2.0
+
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+	"github.com/hashicorp/serf/testutil"
+)
+
+const persistentScript = `#!/bin/sh
+RESULT_FILE="%s"
+while read line; do
+	echo "$line" >>${RESULT_FILE}
+done
+`
+
+const persistentExitScript = `#!/bin/sh
+RESULT_FILE="%s"
+read line
+echo "$line" >>${RESULT_FILE}
+exit 1
+`
+
+const persistentQueryScript = `#!/bin/sh
+RESULT_FILE="%s"
+while read line; do
+	id=$(echo "$line" | sed -n 's/.*"ID":\([0-9]*\).*/\1/p')
+	echo "{\"ID\":$id,\"Payload\":\"cG9uZw==\"}"
+done
+`
+
+const persistentMultiQueryScript = `#!/bin/sh
+RESULT_FILE="%s"
+while read line; do
+	id=$(echo "$line" | sed -n 's/.*"ID":\([0-9]*\).*/\1/p')
+	echo "{\"ID\":$id,\"Payload\":\"cGFydA==\",\"Partial\":true}"
+	echo "{\"ID\":$id,\"Payload\":\"cG9uZw==\"}"
+done
+`
+
+// waitResultLines waits for the result file to contain n lines
+func waitResultLines(t *testing.T, results string, n int) [][]byte {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		out, err := os.ReadFile(results)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		lines := bytes.Split(bytes.TrimSpace(out), []byte("\n"))
+		if len(out) > 0 && len(lines) >= n {
+			return lines
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %d lines: %s", n, out)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func testPersistentHandler(script string) *PersistentEventHandler {
+	h := &PersistentEventHandler{
+		SelfFunc: func() serf.Member {
+			return serf.Member{Name: "ourname"}
+		},
+	}
+	h.UpdateScripts(ParseEventScript(script))
+	return h
+}
+
+func TestPersistentEventHandler(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.SkipNow()
+	}
+
+	script, results := testEventScript(t, persistentScript)
+	h := testPersistentHandler("member-join,user=" + script)
+	defer h.Shutdown()
+
+	h.HandleEvent(serf.MemberEvent{
+		Type:    serf.EventMemberJoin,
+		Members: []serf.Member{{Name: "foo", Status: serf.StatusAlive}},
+	})
+	h.HandleEvent(serf.MemberEvent{Type: serf.EventMemberLeave})
+	h.HandleEvent(serf.UserEvent{LTime: 2, Name: "deploy", Payload: []byte("foo")})
+
+	lines := waitResultLines(t, results, 2)
+	if len(lines) != 2 {
+		t.Fatalf("bad: %q", lines)
+	}
+
+	var member memberEventRecord
+	if err := json.Unmarshal(lines[0], &member); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if member.Event != "member-join" || len(member.Members) != 1 || member.Members[0].Name != "foo" {
+		t.Fatalf("bad: %#v", member)
+	}
+
+	var user userEventRecord
+	if err := json.Unmarshal(lines[1], &user); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if user.Event != "user" || user.Name != "deploy" || string(user.Payload) != "foo" {
+		t.Fatalf("bad: %#v", user)
+	}
+}
+
+func TestPersistentEventHandler_Restart(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.SkipNow()
+	}
+
+	script, results := testEventScript(t, persistentExitScript)
+	h := testPersistentHandler(script)
+	defer h.Shutdown()
+
+	// The second event is written once the process is restarted
+	h.HandleEvent(serf.UserEvent{Name: "first"})
+	waitResultLines(t, results, 1)
+	h.HandleEvent(serf.UserEvent{Name: "second"})
+
+	lines := waitResultLines(t, results, 2)
+	var user userEventRecord
+	if err := json.Unmarshal(lines[1], &user); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if user.Name != "second" {
+		t.Fatalf("bad: %#v", user)
+	}
+}
+
+func TestPersistentEventHandler_Query(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.SkipNow()
+	}
+
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	a1 := testAgent(t, ip1)
+	defer a1.Shutdown()
+
+	script, _ := testEventScript(t, persistentQueryScript)
+	h := testPersistentHandler("query:ping=" + script)
+	defer h.Shutdown()
+	a1.RegisterEventHandler(h)
+
+	if err := a1.Start(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testutil.Yield()
+
+	resp, err := a1.Query("ping", nil, &serf.QueryParam{Timeout: time.Second})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	select {
+	case r := <-resp.ResponseCh():
+		if string(r.Payload) != "pong" {
+			t.Fatalf("bad: %#v", r)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+}
+
+func TestPersistentEventHandler_QueryPartial(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.SkipNow()
+	}
+
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	a1 := testAgent(t, ip1)
+	defer a1.Shutdown()
+
+	// Multiple responses require protocol version 6
+	a1.SerfConfig().ProtocolVersion = 6
+
+	script, _ := testEventScript(t, persistentMultiQueryScript)
+	h := testPersistentHandler("query:ping=" + script)
+	defer h.Shutdown()
+	a1.RegisterEventHandler(h)
+
+	if err := a1.Start(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testutil.Yield()
+
+	resp, err := a1.Query("ping", nil, &serf.QueryParam{
+		Timeout:           time.Second,
+		MultipleResponses: true,
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	var responses []serf.NodeResponse
+	for len(responses) < 2 {
+		select {
+		case r := <-resp.ResponseCh():
+			responses = append(responses, r)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timeout: %#v", responses)
+		}
+	}
+	if string(responses[0].Payload) != "part" || !responses[0].Partial {
+		t.Fatalf("bad: %#v", responses[0])
+	}
+	if string(responses[1].Payload) != "pong" || responses[1].Partial {
+		t.Fatalf("bad: %#v", responses[1])
+	}
+}
+
+func TestPersistentEventHandler_UpdateScripts(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.SkipNow()
+	}
+
+	script, results := testEventScript(t, persistentScript)
+	h := testPersistentHandler("user=" + script)
+	defer h.Shutdown()
+
+	h.HandleEvent(serf.UserEvent{Name: "first"})
+	waitResultLines(t, results, 1)
+
+	// The process keeps running with the new filters
+	h.lock.Lock()
+	p := h.processes[0]
+	h.lock.Unlock()
+	h.UpdateScripts(ParseEventScript("member-join=" + script))
+
+	h.lock.Lock()
+	if len(h.processes) != 1 || h.processes[0] != p {
+		t.Fatalf("bad: %#v", h.processes)
+	}
+	h.lock.Unlock()
+
+	h.HandleEvent(serf.UserEvent{Name: "ignored"})
+	h.HandleEvent(serf.MemberEvent{Type: serf.EventMemberJoin})
+	lines := waitResultLines(t, results, 2)
+
+	var member memberEventRecord
+	if err := json.Unmarshal(lines[1], &member); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if member.Event != "member-join" {
+		t.Fatalf("bad: %#v", member)
+	}
+
+	// Removing the script stops the process
+	h.UpdateScripts(nil)
+	select {
+	case <-p.doneCh:
+	case <-time.After(time.Second):
+		t.Fatalf("timeout")
+	}
+}
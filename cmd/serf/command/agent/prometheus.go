@@ -0,0 +1,279 @@
+// Copyright IBM Corp. 2013, 2026
+// SPDX-License-Identifier: MPL-2.0
+
+package agent
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	metrics "github.com/hashicorp/go-metrics/compat"
+)
+
+const (
+	promTypeGauge   = "gauge"
+	promTypeCounter = "counter"
+	promTypeSummary = "summary"
+
+	// promMaxSeries is the number of series retained by the sink. Some
+	// keys hold names chosen by other nodes, such as user event names, so
+	// new series over the limit are dropped and counted instead.
+	promMaxSeries = 1024
+
+	// promDroppedName is the counter of the updates to dropped series
+	promDroppedName = "agent_prometheus_dropped"
+)
+
+// promSeries is a single metric series retained by the prometheusSink
+type promSeries struct {
+	name   string
+	labels []metrics.Label
+	value  float64 // The gauge value, counter total or summary sum
+	count  uint64  // The number of summary samples
+}
+
+// prometheusSink is a go-metrics sink that retains the metrics emitted by
+// Serf and memberlist so they can be scraped in the Prometheus text format.
+// Gauges keep their last value, counters accumulate and samples are
+// exposed as summaries with a sum and count.
+type prometheusSink struct {
+	sync.Mutex
+	prefix  []string
+	series  map[string]*promSeries
+	types   map[string]string
+	dropped uint64
+}
+
+// newPrometheusSink creates a sink that strips the given leading key parts,
+// such as the service name and host name that go-metrics prepends to keys.
+func newPrometheusSink(prefix ...string) *prometheusSink {
+	return &prometheusSink{
+		prefix: prefix,
+		series: make(map[string]*promSeries),
+		types:  make(map[string]string),
+	}
+}
+
+func (p *prometheusSink) SetGauge(key []string, val float32) {
+	p.SetGaugeWithLabels(key, val, nil)
+}
+
+func (p *prometheusSink) SetGaugeWithLabels(key []string, val float32, labels []metrics.Label) {
+	p.update(promTypeGauge, key, labels, func(s *promSeries) {
+		s.value = float64(val)
+	})
+}
+
+func (p *prometheusSink) EmitKey(key []string, val float32) {
+	p.SetGaugeWithLabels(key, val, nil)
+}
+
+func (p *prometheusSink) IncrCounter(key []string, val float32) {
+	p.IncrCounterWithLabels(key, val, nil)
+}
+
+func (p *prometheusSink) IncrCounterWithLabels(key []string, val float32, labels []metrics.Label) {
+	p.update(promTypeCounter, key, labels, func(s *promSeries) {
+		s.value += float64(val)
+	})
+}
+
+func (p *prometheusSink) AddSample(key []string, val float32) {
+	p.AddSampleWithLabels(key, val, nil)
+}
+
+func (p *prometheusSink) AddSampleWithLabels(key []string, val float32, labels []metrics.Label) {
+	p.update(promTypeSummary, key, labels, func(s *promSeries) {
+		s.value += float64(val)
+		s.count++
+	})
+}
+
+// update applies a change to the series for the given key and labels
+func (p *prometheusSink) update(typ string, key []string, labels []metrics.Label, fn func(*promSeries)) {
+	name := p.flattenKey(key)
+	labels = sortedLabels(labels)
+	id := name + promLabels(labels)
+
+	p.Lock()
+	defer p.Unlock()
+
+	// A name can only have a single type, so ignore conflicting updates
+	if existing, ok := p.types[name]; ok && existing != typ {
+		return
+	}
+
+	s, ok := p.series[id]
+	if !ok {
+		if len(p.series) >= promMaxSeries {
+			p.dropped++
+			return
+		}
+		s = &promSeries{name: name, labels: labels}
+		p.series[id] = s
+	}
+	p.types[name] = typ
+	fn(s)
+}
+
+// flattenKey strips the prefix and converts a key to a metric name
+func (p *prometheusSink) flattenKey(key []string) string {
+	for _, part := range p.prefix {
+		if len(key) > 1 && part != "" && key[0] == part {
+			key = key[1:]
+		}
+	}
+	return promName(strings.Join(key, "_"))
+}
+
+// WriteTo writes every retained series in the Prometheus text format
+func (p *prometheusSink) WriteTo(w io.Writer) (int64, error) {
+	p.Lock()
+	byName := make(map[string][]promSeries)
+	for _, s := range p.series {
+		byName[s.name] = append(byName[s.name], *s)
+	}
+	types := make(map[string]string, len(p.types))
+	for name, typ := range p.types {
+		types[name] = typ
+	}
+	dropped := p.dropped
+	p.Unlock()
+
+	var buf bytes.Buffer
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		series := byName[name]
+		sort.Slice(series, func(i, j int) bool {
+			return promLabels(series[i].labels) < promLabels(series[j].labels)
+		})
+
+		typ := types[name]
+		fmt.Fprintf(&buf, "# TYPE %s %s\n", name, typ)
+		for _, s := range series {
+			labels := promLabels(s.labels)
+			if typ == promTypeSummary {
+				fmt.Fprintf(&buf, "%s_sum%s %s\n", name, labels, promValue(s.value))
+				fmt.Fprintf(&buf, "%s_count%s %d\n", name, labels, s.count)
+			} else {
+				fmt.Fprintf(&buf, "%s%s %s\n", name, labels, promValue(s.value))
+			}
+		}
+	}
+	if dropped > 0 {
+		fmt.Fprintf(&buf, "# TYPE %s counter\n", promDroppedName)
+		fmt.Fprintf(&buf, "%s %d\n", promDroppedName, dropped)
+	}
+	return buf.WriteTo(w)
+}
+
+// prometheusHandler serves the metrics retained by the sink, along with
+// gauges derived from the Serf stats at the time of the scrape. Requests
+// are authorized for the stats command, as for the HTTP API.
+type prometheusHandler struct {
+	agent *Agent
+	sink  *prometheusSink
+	auth  *httpAuth
+}
+
+func (h *prometheusHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if h.auth != nil && !h.auth.authorize(resp, req, statsCommand) {
+		return
+	}
+
+	var buf bytes.Buffer
+	if _, err := h.sink.WriteTo(&buf); err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeStatsGauges(&buf, h.agent.Serf().Stats())
+
+	resp.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	resp.Write(buf.Bytes())
+}
+
+// writeStatsGauges writes a serf_<stat> gauge for each numeric stat
+func writeStatsGauges(w io.Writer, stats map[string]string) {
+	keys := make([]string, 0, len(stats))
+	for k := range stats {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		var val float64
+		switch v := stats[k]; v {
+		case "true":
+			val = 1
+		case "false":
+			val = 0
+		default:
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+			val = f
+		}
+
+		name := promName("serf_" + k)
+		fmt.Fprintf(w, "# TYPE %s gauge\n", name)
+		fmt.Fprintf(w, "%s %s\n", name, promValue(val))
+	}
+}
+
+// sortedLabels returns a copy of the labels sorted by name
+func sortedLabels(labels []metrics.Label) []metrics.Label {
+	labels = slices.Clone(labels)
+	sort.Slice(labels, func(i, j int) bool {
+		return labels[i].Name < labels[j].Name
+	})
+	return labels
+}
+
+// promName converts a string to a valid Prometheus metric or label name
+func promName(s string) string {
+	var b strings.Builder
+	for i, r := range s {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_':
+			b.WriteRune(r)
+		case r >= '0' && r <= '9':
+			if i == 0 {
+				b.WriteRune('_')
+			}
+			b.WriteRune(r)
+		default:
+			b.WriteRune('_')
+		}
+	}
+	return b.String()
+}
+
+// promLabels formats labels as {name="value",...}
+func promLabels(labels []metrics.Label) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	parts := make([]string, 0, len(labels))
+	for _, l := range labels {
+		val := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(l.Value)
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, promName(l.Name), val))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func promValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,123 @@
+// Copyright IBM Corp. 2013, 2026
+// SPDX-License-Identifier: MPL-2.0
+
+package agent
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	metrics "github.com/hashicorp/go-metrics/compat"
+	"github.com/hashicorp/serf/serf"
+	"github.com/hashicorp/serf/testutil"
+)
+
+func TestPrometheusSink(t *testing.T) {
+	sink := newPrometheusSink("serf-agent", "host1")
+	labels := []metrics.Label{{Name: "zone", Value: "a\"b"}, {Name: "dc", Value: "east"}}
+
+	sink.SetGauge([]string{"serf-agent", "host1", "runtime", "num_goroutines"}, 10)
+	sink.SetGauge([]string{"serf-agent", "host1", "runtime", "num_goroutines"}, 12)
+	sink.IncrCounterWithLabels([]string{"serf-agent", "serf", "member", "join"}, 1, labels)
+	sink.IncrCounterWithLabels([]string{"serf-agent", "serf", "member", "join"}, 2, labels)
+	sink.AddSample([]string{"serf-agent", "memberlist", "gossip"}, 1.5)
+	sink.AddSample([]string{"serf-agent", "memberlist", "gossip"}, 0.5)
+
+	// Conflicting types are ignored
+	sink.SetGauge([]string{"serf-agent", "serf", "member", "join"}, 100)
+
+	var buf bytes.Buffer
+	if _, err := sink.WriteTo(&buf); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	expected := `# TYPE memberlist_gossip summary
+memberlist_gossip_sum 2
+memberlist_gossip_count 2
+# TYPE runtime_num_goroutines gauge
+runtime_num_goroutines 12
+# TYPE serf_member_join counter
+serf_member_join{dc="east",zone="a\"b"} 3
+`
+	if buf.String() != expected {
+		t.Fatalf("bad: %s", buf.String())
+	}
+}
+
+func TestPrometheusSink_MaxSeries(t *testing.T) {
+	sink := newPrometheusSink()
+	for i := 0; i < promMaxSeries+10; i++ {
+		sink.IncrCounter([]string{"serf", "events", fmt.Sprintf("event%d", i)}, 1)
+	}
+
+	// Updates to the series that are kept still apply
+	sink.IncrCounter([]string{"serf", "events", "event0"}, 1)
+
+	var buf bytes.Buffer
+	if _, err := sink.WriteTo(&buf); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	out := buf.String()
+	if n := strings.Count(out, "# TYPE serf_events_"); n != promMaxSeries {
+		t.Fatalf("bad: %d", n)
+	}
+	if !strings.Contains(out, "serf_events_event0 2\n") {
+		t.Fatalf("bad: %s", out)
+	}
+	if !strings.Contains(out, promDroppedName+" 10\n") {
+		t.Fatalf("bad: %s", out)
+	}
+}
+
+func TestPrometheusHandler(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	a1 := testAgentWithConfig(t, ip1, DefaultConfig(), serf.DefaultConfig(), nil)
+	defer a1.Shutdown()
+
+	if err := a1.Start(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testutil.Yield()
+
+	auth := &httpAuth{
+		tokens: newRPCTokenIndex([]RPCToken{
+			{Name: "monitor", Token: "monitor", Commands: []string{statsCommand}},
+			{Name: "read", Token: "reader", Commands: []string{membersCommand}},
+		}),
+		logger: log.New(io.Discard, "", 0),
+	}
+	h := &prometheusHandler{agent: a1, sink: newPrometheusSink(), auth: auth}
+
+	// Scrapes require a token allowing the stats command
+	for token, code := range map[string]int{"": http.StatusUnauthorized, "reader": http.StatusForbidden} {
+		resp := httptest.NewRecorder()
+		h.ServeHTTP(resp, httptest.NewRequest("GET", "/metrics?auth="+token, nil))
+		if resp.Code != code {
+			t.Fatalf("bad: %s %d", token, resp.Code)
+		}
+	}
+
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, httptest.NewRequest("GET", "/metrics?auth=monitor", nil))
+
+	body, _ := io.ReadAll(resp.Body)
+	for _, want := range []string{
+		"# TYPE serf_members gauge\n",
+		"serf_members 1\n",
+		"serf_failed 0\n",
+		"serf_encrypted 0\n",
+		"serf_health_score 0\n",
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Fatalf("missing %q: %s", want, body)
+		}
+	}
+}
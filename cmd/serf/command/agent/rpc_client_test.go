@@ -5,9 +5,15 @@ package agent
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
 	"io"
 	"net"
+	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
@@ -217,6 +223,57 @@ func TestRPCClientJoin(t *testing.T) {
 	}
 }
 
+func TestRPCClientJoinContext(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	serfConf := serf.DefaultConfig()
+	serfConf.MemberlistConfig.TCPTimeout = 500 * time.Millisecond
+	cl, a1, ipc := testRPCClientWithConfig(t, ip1, DefaultConfig(), serfConf)
+	defer ipc.Shutdown()
+	defer cl.Close()
+	defer a1.Shutdown()
+
+	if err := a1.Start(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A node that accepts connections but never answers hangs the join
+	list, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer list.Close()
+	go func() {
+		for {
+			conn, err := list.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := cl.JoinContext(ctx, []string{"hung/" + list.Addr().String()}, false); err != context.DeadlineExceeded {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The client stays usable, before and after the late response
+	if _, err := cl.Members(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	time.Sleep(time.Second)
+	mem, err := cl.Members()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(mem) != 1 {
+		t.Fatalf("bad: %#v", mem)
+	}
+}
+
 func TestRPCClientMembers(t *testing.T) {
 	ip1, returnFn1 := testutil.TakeIP()
 	defer returnFn1()
@@ -388,6 +445,65 @@ func TestRPCClientMembersFiltered(t *testing.T) {
 	}
 }
 
+func TestRPCClientMembersWithFilter(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	cl, a1, ipc := testRPCClient(t, ip1)
+	defer ipc.Shutdown()
+	defer cl.Close()
+	defer a1.Shutdown()
+
+	if err := a1.Start(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	err := cl.UpdateTags(map[string]string{
+		"tag1": "val1",
+		"tag2": "val2",
+	}, []string{})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+
+	testutil.Yield()
+
+	// Make sure that filter expressions work on member tags
+	mem, err := cl.MembersWithFilter(&client.MembersFilter{
+		Expr: `tag1 == "val1" and (tag2 =~ "^val" or tag3)`,
+	})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+
+	if len(mem) != 1 {
+		t.Fatalf("should have matched 1 member: %#v", mem)
+	}
+
+	// Expressions are combined with the other filters
+	mem, err = cl.MembersWithFilter(&client.MembersFilter{
+		Status: "alive",
+		Expr:   `tag1 == "val1" and tag3`,
+	})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+
+	if len(mem) != 0 {
+		t.Fatalf("should have matched 0 members: %#v", mem)
+	}
+
+	// Invalid expressions are returned as errors, and the client can
+	// still be used afterwards
+	if _, err := cl.MembersWithFilter(&client.MembersFilter{Expr: "tag1 =="}); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	if _, err := cl.Members(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
 func TestRPCClientUserEvent(t *testing.T) {
 	ip1, returnFn1 := testutil.TakeIP()
 	defer returnFn1()
@@ -433,6 +549,36 @@ func TestRPCClientUserEvent(t *testing.T) {
 	}
 }
 
+func TestRPCClientUserEvent_Throttled(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	serfConf := serf.DefaultConfig()
+	serfConf.UserEventRateLimit = serf.RateLimit{Rate: 0.001, Burst: 1}
+	cl, a1, ipc := testRPCClientWithConfig(t, ip1, DefaultConfig(), serfConf)
+	defer ipc.Shutdown()
+	defer cl.Close()
+	defer a1.Shutdown()
+
+	if err := a1.Start(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	testutil.Yield()
+
+	if err := cl.UserEvent("deploy", nil, false); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := cl.UserEvent("deploy", nil, false); err != client.ErrEventThrottled {
+		t.Fatalf("expected throttled, got: %v", err)
+	}
+
+	// Other event names have their own limit
+	if err := cl.UserEvent("restart", nil, false); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
 func TestRPCClientLeave(t *testing.T) {
 	ip1, returnFn1 := testutil.TakeIP()
 	defer returnFn1()
@@ -506,6 +652,41 @@ func TestRPCClientMonitor(t *testing.T) {
 	}
 }
 
+func TestRPCClientMonitorJSON(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	rpcClient, a1, ipc := testRPCClient(t, ip1)
+	defer ipc.Shutdown()
+	defer rpcClient.Close()
+	defer a1.Shutdown()
+
+	if err := a1.Start(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	entryCh := make(chan client.LogEntry, 64)
+	if handle, err := rpcClient.MonitorJSON("debug", entryCh); err != nil {
+		t.Fatalf("err: %v", err)
+	} else {
+		defer rpcClient.Stop(handle)
+	}
+
+	testutil.Yield()
+
+	select {
+	case e := <-entryCh:
+		if e.Subsystem != "agent.ipc" || !strings.Contains(e.Message, "Accepted client") {
+			t.Fatalf("bad: %#v", e)
+		}
+		if e.Level != "INFO" || e.Node != a1.SerfConfig().NodeName || e.Timestamp.IsZero() {
+			t.Fatalf("bad: %#v", e)
+		}
+	default:
+		t.Fatalf("should have backlog")
+	}
+}
+
 func TestRPCClientStream_User(t *testing.T) {
 	ip1, returnFn1 := testutil.TakeIP()
 	defer returnFn1()
@@ -557,6 +738,129 @@ func TestRPCClientStream_User(t *testing.T) {
 	}
 }
 
+func TestRPCClientStream_DirectMessage(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	serfConf := serf.DefaultConfig()
+	serfConf.ProtocolVersion = 6
+	cl, a1, ipc := testRPCClientWithConfig(t, ip1, DefaultConfig(), serfConf)
+	defer ipc.Shutdown()
+	defer cl.Close()
+	defer a1.Shutdown()
+
+	if err := a1.Start(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	eventCh := make(chan map[string]any, 64)
+	if handle, err := cl.Stream("direct-message", eventCh); err != nil {
+		t.Fatalf("err: %v", err)
+	} else {
+		defer cl.Stop(handle)
+	}
+
+	testutil.Yield()
+
+	if err := cl.SendToMember(a1.conf.NodeName, []byte("foo")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := cl.SendToMember("nope", []byte("foo")); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	select {
+	case e := <-eventCh:
+		if e["Event"].(string) != "direct-message" {
+			t.Fatalf("bad event: %#v", e)
+		}
+		if e["From"].(string) != a1.conf.NodeName {
+			t.Fatalf("bad event: %#v", e)
+		}
+		if !bytes.Equal(e["Payload"].([]byte), []byte("foo")) {
+			t.Fatalf("bad event: %#v", e)
+		}
+
+	case <-time.After(time.Second):
+		t.Fatalf("should have event")
+	}
+}
+
+func TestRPCClientKV(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	serfConf := serf.DefaultConfig()
+	serfConf.ProtocolVersion = 6
+	cl, a1, ipc := testRPCClientWithConfig(t, ip1, DefaultConfig(), serfConf)
+	defer ipc.Shutdown()
+	defer cl.Close()
+	defer a1.Shutdown()
+
+	if err := a1.Start(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	eventCh := make(chan map[string]any, 64)
+	if handle, err := cl.Stream("kv", eventCh); err != nil {
+		t.Fatalf("err: %v", err)
+	} else {
+		defer cl.Stop(handle)
+	}
+
+	testutil.Yield()
+
+	if err := cl.KVSet("app/version", []byte("1.0")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := cl.KVSet("app/name", []byte("web")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := cl.KVSet("", nil); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	value, ok, err := cl.KVGet("app/version")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !ok || string(value) != "1.0" {
+		t.Fatalf("bad: %q %v", value, ok)
+	}
+
+	if err := cl.KVDelete("app/name"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, ok, err := cl.KVGet("app/name"); err != nil || ok {
+		t.Fatalf("bad: %v %v", ok, err)
+	}
+
+	values, err := cl.KVList("app/")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expected := map[string][]byte{"app/version": []byte("1.0")}
+	if !reflect.DeepEqual(values, expected) {
+		t.Fatalf("bad: %v", values)
+	}
+
+	select {
+	case e := <-eventCh:
+		if e["Event"].(string) != "kv" {
+			t.Fatalf("bad event: %#v", e)
+		}
+		if e["Key"].(string) != "app/version" || e["Node"].(string) != a1.conf.NodeName {
+			t.Fatalf("bad event: %#v", e)
+		}
+		if !bytes.Equal(e["Value"].([]byte), []byte("1.0")) {
+			t.Fatalf("bad event: %#v", e)
+		}
+
+	case <-time.After(time.Second):
+		t.Fatalf("should have event")
+	}
+}
+
 func TestRPCClientStream_Member(t *testing.T) {
 	ip1, returnFn1 := testutil.TakeIP()
 	defer returnFn1()
@@ -696,6 +1000,54 @@ func TestRPCClientUpdateTags(t *testing.T) {
 	}
 }
 
+func TestRPCClientQueryContext(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	cl, a1, ipc := testRPCClient(t, ip1)
+	defer ipc.Shutdown()
+	defer cl.Close()
+	defer a1.Shutdown()
+
+	if err := a1.Start(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	testutil.Yield()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	respCh := make(chan client.NodeResponse, 1)
+	params := client.QueryParam{
+		Timeout: 500 * time.Millisecond,
+		Name:    "deploy",
+		RespCh:  respCh,
+	}
+	if err := cl.QueryContext(ctx, &params); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Cancelling closes the channels before the query is done
+	cancel()
+	select {
+	case _, ok := <-respCh:
+		if ok {
+			t.Fatalf("should be closed")
+		}
+	case <-time.After(100 * time.Millisecond):
+		t.Fatalf("timeout")
+	}
+
+	// The remaining records are read, so the client stays usable
+	time.Sleep(time.Second)
+	if _, err := cl.Members(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if err := cl.QueryContext(ctx, &params); err != context.Canceled {
+		t.Fatalf("err: %v", err)
+	}
+}
+
 func TestRPCClientQuery(t *testing.T) {
 	ip1, returnFn1 := testutil.TakeIP()
 	defer returnFn1()
@@ -907,6 +1259,78 @@ func TestRPCClientStream_Query_Respond(t *testing.T) {
 	}
 }
 
+func TestRPCClientStream_Query_RespondPartial(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	serfConf := serf.DefaultConfig()
+	serfConf.ProtocolVersion = 6
+	cl, a1, ipc := testRPCClientWithConfig(t, ip1, DefaultConfig(), serfConf)
+	defer ipc.Shutdown()
+	defer cl.Close()
+	defer a1.Shutdown()
+
+	if err := a1.Start(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	eventCh := make(chan map[string]any, 64)
+	if handle, err := cl.Stream("query", eventCh); err != nil {
+		t.Fatalf("err: %v", err)
+	} else {
+		defer cl.Stop(handle)
+	}
+
+	testutil.Yield()
+
+	respCh := make(chan client.NodeResponse, 4)
+	params := client.QueryParam{
+		Timeout:       500 * time.Millisecond,
+		MultiResponse: true,
+		Name:          "progress",
+		RespCh:        respCh,
+	}
+	if err := cl.Query(&params); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	select {
+	case e := <-eventCh:
+		if !e["MultiResponse"].(bool) {
+			t.Fatalf("bad query: %#v", e)
+		}
+
+		id := uint64(e["ID"].(int64))
+		if err := cl.RespondPartial(id, []byte("50%")); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := cl.Respond(id, []byte("done")); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := cl.RespondPartial(id, []byte("late")); err == nil {
+			t.Fatalf("expected error")
+		}
+
+	case <-time.After(time.Second):
+		t.Fatalf("should have query")
+	}
+
+	expected := []client.NodeResponse{
+		{From: a1.conf.NodeName, Payload: []byte("50%"), Seq: 0, Partial: true},
+		{From: a1.conf.NodeName, Payload: []byte("done"), Seq: 1},
+	}
+	for _, exp := range expected {
+		select {
+		case r := <-respCh:
+			if !reflect.DeepEqual(r, exp) {
+				t.Fatalf("bad: %#v", r)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("missing response")
+		}
+	}
+}
+
 func TestRPCClientAuth(t *testing.T) {
 	ip1, returnFn1 := testutil.TakeIP()
 	defer returnFn1()
@@ -941,6 +1365,146 @@ func TestRPCClientAuth(t *testing.T) {
 	}
 }
 
+func TestRPCClientTokens(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	agentConf := DefaultConfig()
+	agentConf.RPCTokens = []RPCToken{
+		{Name: "read", Token: "reader", Commands: []string{membersCommand}},
+		{Name: "admin", Token: "admin", Commands: []string{"*"}},
+	}
+	cl, a1, ipc := testRPCClientWithConfig(t, ip1, agentConf, serf.DefaultConfig())
+	defer ipc.Shutdown()
+	defer cl.Close()
+	defer a1.Shutdown()
+
+	if err := a1.Start(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testutil.Yield()
+
+	// Tokens require auth even without an auth key
+	if _, err := cl.Members(); err == nil || err.Error() != authRequired {
+		t.Fatalf("err: %v", err)
+	}
+
+	config := client.Config{Addr: ipc.listener.Addr().String(), AuthKey: "reader"}
+	reader, err := client.ClientFromConfig(&config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer reader.Close()
+
+	if _, err := reader.Members(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := reader.UserEvent("deploy", nil, false); err != client.ErrPermissionDenied {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := reader.Stats(); err != client.ErrPermissionDenied {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The connection should remain usable after a denial
+	if _, err := reader.Members(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	config.AuthKey = "admin"
+	admin, err := client.ClientFromConfig(&config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer admin.Close()
+
+	if err := admin.UserEvent("deploy", nil, false); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A blank key must not be accepted when only tokens are configured
+	config.AuthKey = ""
+	anon, err := client.ClientFromConfig(&config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer anon.Close()
+	if _, err := anon.Members(); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestRPCClientTLS(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	dir := testTLSFiles(t)
+	agentConf := DefaultConfig()
+	agentConf.RPCTLSCertFile = filepath.Join(dir, "server.pem")
+	agentConf.RPCTLSKeyFile = filepath.Join(dir, "server-key.pem")
+	agentConf.RPCTLSCAFile = filepath.Join(dir, "ca.pem")
+	agentConf.RPCTLSVerifyClient = true
+	serverTLS, err := agentConf.RPCTLSConfig()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	lw := NewLogWriter(512)
+	mult := io.MultiWriter(testutil.TestWriter(t), lw)
+	a1 := testAgentWithConfig(t, ip1, agentConf, serf.DefaultConfig(), mult)
+	defer a1.Shutdown()
+	ipc := NewAgentIPC(a1, "", tls.NewListener(l, serverTLS), mult, lw, false)
+	defer ipc.Shutdown()
+
+	if err := a1.Start(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testutil.Yield()
+
+	caPEM, err := os.ReadFile(filepath.Join(dir, "ca.pem"))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(caPEM)
+
+	// A plain TCP client should not be able to talk to the agent
+	config := client.Config{Addr: l.Addr().String(), Timeout: time.Second}
+	if _, err := client.ClientFromConfig(&config); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	// A TLS client without a certificate should be rejected
+	config.TLSConfig = &tls.Config{RootCAs: roots}
+	if _, err := client.ClientFromConfig(&config); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	// A TLS client with a certificate should work
+	cert, err := tls.LoadX509KeyPair(filepath.Join(dir, "client.pem"), filepath.Join(dir, "client-key.pem"))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	config.TLSConfig = &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{cert}}
+	rpcClient, err := client.ClientFromConfig(&config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer rpcClient.Close()
+
+	mem, err := rpcClient.Members()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(mem) != 1 {
+		t.Fatalf("bad: %#v", mem)
+	}
+}
+
 func TestRPCClient_Keys_EncryptionDisabledError(t *testing.T) {
 	ip1, returnFn1 := testutil.TakeIP()
 	defer returnFn1()
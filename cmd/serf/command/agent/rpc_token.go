@@ -0,0 +1,94 @@
+// Copyright IBM Corp. 2013, 2026
+// SPDX-License-Identifier: MPL-2.0
+
+package agent
+
+import (
+	"fmt"
+	"slices"
+)
+
+// rpcCommandWildcard is used in RPCToken.Commands to allow every command
+const rpcCommandWildcard = "*"
+
+// rpcTokenCommands are the IPC commands that may be granted to an RPC
+// token. The handshake, auth and stop commands are always allowed.
+var rpcTokenCommands = []string{
+	eventCommand,
+	forceLeaveCommand,
+	joinCommand,
+	membersCommand,
+	membersFilteredCommand,
+	streamCommand,
+	monitorCommand,
+	leaveCommand,
+	installKeyCommand,
+	useKeyCommand,
+	removeKeyCommand,
+	listKeysCommand,
+	tagsCommand,
+	queryCommand,
+	respondCommand,
+	statsCommand,
+	getCoordinateCommand,
+	sendCommand,
+	kvGetCommand,
+	kvSetCommand,
+	kvDeleteCommand,
+	kvListCommand,
+}
+
+// RPCToken is a named RPC auth token that only grants access to a
+// subset of the IPC commands. This allows, for example, a monitoring
+// system to list members without being able to rotate keys.
+type RPCToken struct {
+	// Name identifies the token in logs
+	Name string `mapstructure:"name"`
+
+	// Token is the secret the client provides using the auth command
+	Token string `mapstructure:"token"`
+
+	// Commands is the list of IPC commands the token may use, such as
+	// "members" or "stream". "*" allows every command.
+	Commands []string `mapstructure:"commands"`
+}
+
+// Allows returns if the token may be used for the given command
+func (t *RPCToken) Allows(command string) bool {
+	switch command {
+	case handshakeCommand, authCommand, stopCommand:
+		return true
+	}
+	return slices.Contains(t.Commands, rpcCommandWildcard) || slices.Contains(t.Commands, command)
+}
+
+// validateRPCTokens ensures the tokens are unique and only reference
+// known commands
+func validateRPCTokens(tokens []RPCToken) error {
+	seen := make(map[string]struct{})
+	for _, t := range tokens {
+		if t.Token == "" {
+			return fmt.Errorf("RPC token '%s' has an empty token", t.Name)
+		}
+		if _, ok := seen[t.Token]; ok {
+			return fmt.Errorf("RPC token '%s' is not unique", t.Name)
+		}
+		seen[t.Token] = struct{}{}
+
+		for _, c := range t.Commands {
+			if c != rpcCommandWildcard && !slices.Contains(rpcTokenCommands, c) {
+				return fmt.Errorf("RPC token '%s' has unknown command '%s'", t.Name, c)
+			}
+		}
+	}
+	return nil
+}
+
+// newRPCTokenIndex indexes the tokens by their secret
+func newRPCTokenIndex(tokens []RPCToken) map[string]*RPCToken {
+	index := make(map[string]*RPCToken, len(tokens))
+	for i := range tokens {
+		index[tokens[i].Token] = &tokens[i]
+	}
+	return index
+}
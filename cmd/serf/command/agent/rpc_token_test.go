@@ -0,0 +1,63 @@
+// Copyright IBM Corp. 2013, 2026
+// SPDX-License-Identifier: MPL-2.0
+
+package agent
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestRPCToken_Allows(t *testing.T) {
+	token := &RPCToken{Name: "read", Token: "foo", Commands: []string{membersCommand, statsCommand}}
+	for _, c := range []string{membersCommand, statsCommand, handshakeCommand, authCommand, stopCommand} {
+		if !token.Allows(c) {
+			t.Fatalf("should allow %s", c)
+		}
+	}
+	for _, c := range []string{eventCommand, forceLeaveCommand, installKeyCommand} {
+		if token.Allows(c) {
+			t.Fatalf("should not allow %s", c)
+		}
+	}
+
+	admin := &RPCToken{Name: "admin", Token: "bar", Commands: []string{"*"}}
+	if !admin.Allows(forceLeaveCommand) {
+		t.Fatalf("should allow")
+	}
+}
+
+func TestValidateRPCTokens(t *testing.T) {
+	type tcase struct {
+		tokens []RPCToken
+		err    bool
+	}
+	cases := []tcase{
+		{[]RPCToken{{Name: "a", Token: "foo", Commands: []string{"members", "*"}}}, false},
+		{[]RPCToken{{Name: "a", Token: "", Commands: []string{"members"}}}, true},
+		{[]RPCToken{{Name: "a", Token: "foo", Commands: []string{"bogus"}}}, true},
+		{[]RPCToken{{Name: "a", Token: "foo"}, {Name: "b", Token: "foo"}}, true},
+	}
+	for i, c := range cases {
+		err := validateRPCTokens(c.tokens)
+		if (err != nil) != c.err {
+			t.Fatalf("case %d: bad: %v", i, err)
+		}
+	}
+}
+
+func TestRPCTokenCommands(t *testing.T) {
+	// Every command a token may be granted is handled, so the body of a
+	// denied request can be skipped
+	for _, c := range rpcTokenCommands {
+		if _, ok := ipcCommands[c]; !ok {
+			t.Fatalf("missing command %s", c)
+		}
+	}
+	for c := range ipcCommands {
+		token := &RPCToken{}
+		if !slices.Contains(rpcTokenCommands, c) && !token.Allows(c) {
+			t.Fatalf("command %s can't be granted", c)
+		}
+	}
+}
@@ -36,17 +36,7 @@ func (s *SyslogWrapper) Write(p []byte) (int, error) {
 		return 0, nil
 	}
 
-	// Extract log level
-	var level string
-	afterLevel := p
-	x := bytes.IndexByte(p, '[')
-	if x >= 0 {
-		y := bytes.IndexByte(p[x:], ']')
-		if y >= 0 {
-			level = string(p[x+1 : x+y])
-			afterLevel = p[x+y+2:]
-		}
-	}
+	level, afterLevel := splitLogLevel(p)
 
 	// Each log level will be handled by a specific syslog priority
 	priority, ok := levelPriority[level]
@@ -58,3 +48,41 @@ func (s *SyslogWrapper) Write(p []byte) (int, error) {
 	err := s.l.WriteLevel(priority, afterLevel)
 	return len(p), err
 }
+
+// jsonSyslogWrapper is like SyslogWrapper, but writes each log line to
+// the Syslogger as a JSON object. Implements the io.Writer interface.
+type jsonSyslogWrapper struct {
+	l    gsyslog.Syslogger
+	filt *logutils.LevelFilter
+	node string
+}
+
+// Write is used to implement io.Writer
+func (s *jsonSyslogWrapper) Write(p []byte) (int, error) {
+	// Skip syslog if the log level doesn't apply
+	if !s.filt.Check(p) {
+		return 0, nil
+	}
+
+	level, _ := splitLogLevel(p)
+	priority, ok := levelPriority[level]
+	if !ok {
+		priority = gsyslog.LOG_NOTICE
+	}
+
+	err := s.l.WriteLevel(priority, []byte(formatLogJSON(string(p), s.node)))
+	return len(p), err
+}
+
+// splitLogLevel extracts the level from a log line, returning it along
+// with the remainder of the line after the level
+func splitLogLevel(p []byte) (string, []byte) {
+	x := bytes.IndexByte(p, '[')
+	if x >= 0 {
+		y := bytes.IndexByte(p[x:], ']')
+		if y >= 0 && x+y+2 <= len(p) {
+			return string(p[x+1 : x+y]), p[x+y+2:]
+		}
+	}
+	return "", p
+}
@@ -5,6 +5,7 @@ package agent
 
 import (
 	"runtime"
+	"strings"
 	"testing"
 
 	"github.com/hashicorp/go-syslog"
@@ -40,3 +41,41 @@ func TestSyslogFilter(t *testing.T) {
 		t.Fatalf("should not have logged")
 	}
 }
+
+type mockSyslogger struct {
+	priority gsyslog.Priority
+	msg      []byte
+}
+
+func (m *mockSyslogger) Write(p []byte) (int, error) { return len(p), nil }
+func (m *mockSyslogger) Close() error                { return nil }
+
+func (m *mockSyslogger) WriteLevel(p gsyslog.Priority, msg []byte) error {
+	m.priority = p
+	m.msg = msg
+	return nil
+}
+
+func TestJSONSyslogWrapper(t *testing.T) {
+	l := &mockSyslogger{}
+	filt := LevelFilter()
+	filt.MinLevel = logutils.LogLevel("INFO")
+
+	s := &jsonSyslogWrapper{l, filt, "foo"}
+	if _, err := s.Write([]byte("[DEBUG] test")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if l.msg != nil {
+		t.Fatalf("should not have logged")
+	}
+
+	if _, err := s.Write([]byte("[WARN] agent: test")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if l.priority != gsyslog.LOG_WARNING {
+		t.Fatalf("bad: %v", l.priority)
+	}
+	if !strings.Contains(string(l.msg), `"subsystem":"agent","message":"test","node":"foo"`) {
+		t.Fatalf("bad: %s", l.msg)
+	}
+}
@@ -0,0 +1,344 @@
+// Copyright IBM Corp. 2013, 2026
+// SPDX-License-Identifier: MPL-2.0
+
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	metrics "github.com/hashicorp/go-metrics/compat"
+	"github.com/hashicorp/serf/serf"
+)
+
+const (
+	// webhookRetryBase is the wait before retrying a failed webhook
+	// delivery. It doubles after each failed attempt.
+	webhookRetryBase = 500 * time.Millisecond
+
+	// webhookEventHeader and webhookSelfHeader are set on each webhook
+	// request to the event type and the name of the local node
+	webhookEventHeader = "X-Serf-Event"
+	webhookSelfHeader  = "X-Serf-Self-Name"
+)
+
+// EventWebhook is a single HTTP endpoint that receives events. It is
+// configured through event_handlers by using an http:// or https:// URL
+// in place of a script.
+type EventWebhook struct {
+	EventFilter
+	URL string
+}
+
+func (w *EventWebhook) String() string {
+	return fmt.Sprintf("Event '%s' posting to '%s'", w.EventFilter.String(), w.URL)
+}
+
+// Validate checks if the webhook has a valid filter and URL
+func (w *EventWebhook) Validate() error {
+	if !w.Valid() {
+		return fmt.Errorf("Invalid event webhook: %s", w.String())
+	}
+	if _, err := url.ParseRequestURI(w.URL); err != nil {
+		return fmt.Errorf("Invalid event webhook URL '%s': %v", w.URL, err)
+	}
+	return nil
+}
+
+// isEventWebhook returns if an event handler in the "type=script" format
+// refers to a webhook rather than a script
+func isEventWebhook(v string) bool {
+	if isWebhookURL(v) {
+		return true
+	}
+	_, script, ok := cutFilter(v)
+	return ok && isWebhookURL(script)
+}
+
+func isWebhookURL(v string) bool {
+	return strings.HasPrefix(v, "http://") || strings.HasPrefix(v, "https://")
+}
+
+// ParseEventWebhook takes a string in the format of "type=url" and parses
+// it into EventWebhook structs. A URL on its own receives every event.
+func ParseEventWebhook(v string) []EventWebhook {
+	var filter, target string
+	if isWebhookURL(v) {
+		target = v
+	} else {
+		filter, target, _ = cutFilter(v)
+	}
+
+	filters := ParseEventFilter(filter)
+	results := make([]EventWebhook, 0, len(filters))
+	for _, filt := range filters {
+		results = append(results, EventWebhook{
+			EventFilter: filt,
+			URL:         target,
+		})
+	}
+	return results
+}
+
+// webhookQueryRecord describes a query sent to a webhook. The response
+// body of the webhook is used to respond to the query.
+type webhookQueryRecord struct {
+	Event   string
+	LTime   serf.LamportTime
+	Name    string
+	Payload []byte
+	Signer  string
+}
+
+// WebhookEventHandler POSTs a JSON document describing each event it
+// receives to the matching webhooks. Each webhook has its own bounded
+// queue and delivers events in order, so a slow endpoint does not hold
+// up the agent or the other webhooks. Events are dropped if a queue is
+// full.
+type WebhookEventHandler struct {
+	SelfFunc func() serf.Member
+	Logger   *log.Logger
+
+	// Timeout bounds each delivery attempt
+	Timeout time.Duration
+
+	// MaxAttempts is the number of times a delivery is attempted before
+	// the event is dropped
+	MaxAttempts int
+
+	// QueueSize is the number of events that may wait for delivery to a
+	// single webhook
+	QueueSize int
+
+	lock    sync.Mutex
+	workers []*webhookWorker
+}
+
+// webhookWorker delivers the queued events for a single webhook URL
+type webhookWorker struct {
+	URL     string
+	filters []EventFilter
+	handler *WebhookEventHandler
+	client  *http.Client
+	eventCh chan serf.Event
+	stopCh  chan struct{}
+}
+
+func (h *WebhookEventHandler) HandleEvent(e serf.Event) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for _, w := range h.workers {
+		if !w.invoke(e) {
+			continue
+		}
+
+		// Do a non-blocking send
+		select {
+		case w.eventCh <- e:
+		default:
+			metrics.IncrCounter([]string{"agent", "webhook", "dropped"}, 1)
+			h.Logger.Printf("[WARN] agent: Webhook '%s' queue is full, dropping event '%s'",
+				w.URL, e.String())
+		}
+	}
+}
+
+// UpdateWebhooks replaces the webhooks that receive events. Webhooks with
+// the same URL share a queue, so each event is posted to a URL at most
+// once. Events still queued for the previous webhooks are discarded.
+func (h *WebhookEventHandler) UpdateWebhooks(webhooks []EventWebhook) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.Logger == nil {
+		h.Logger = log.New(os.Stderr, "", log.LstdFlags)
+	}
+
+	for _, w := range h.workers {
+		close(w.stopCh)
+	}
+	h.workers = nil
+
+	byURL := make(map[string]*webhookWorker)
+	for _, webhook := range webhooks {
+		if w, ok := byURL[webhook.URL]; ok {
+			w.filters = append(w.filters, webhook.EventFilter)
+			continue
+		}
+		w := &webhookWorker{
+			URL:     webhook.URL,
+			filters: []EventFilter{webhook.EventFilter},
+			handler: h,
+			client:  &http.Client{},
+			eventCh: make(chan serf.Event, max(h.QueueSize, 1)),
+			stopCh:  make(chan struct{}),
+		}
+		byURL[webhook.URL] = w
+		h.workers = append(h.workers, w)
+	}
+
+	for _, w := range h.workers {
+		go w.run()
+	}
+}
+
+// Shutdown stops delivering events to all webhooks
+func (h *WebhookEventHandler) Shutdown() {
+	h.UpdateWebhooks(nil)
+}
+
+// invoke returns if the event matches any of the webhook filters
+func (w *webhookWorker) invoke(e serf.Event) bool {
+	for _, f := range w.filters {
+		if f.Invoke(e) {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *webhookWorker) run() {
+	for {
+		select {
+		case e := <-w.eventCh:
+			w.deliver(e)
+		case <-w.stopCh:
+			return
+		}
+	}
+}
+
+// deliver posts the event to the webhook, retrying failed attempts with
+// a backoff. Queries are only retried until their deadline.
+func (w *webhookWorker) deliver(e serf.Event) {
+	body, err := webhookBody(e)
+	if err != nil {
+		w.handler.Logger.Printf("[ERR] agent: Failed to encode event for webhook '%s': %v",
+			w.URL, err)
+		return
+	}
+
+	query, _ := e.(*serf.Query)
+	wait := webhookRetryBase
+	for attempt := 1; ; attempt++ {
+		resp, retry, err := w.post(e, body)
+		if err == nil {
+			if query != nil && len(resp) > 0 {
+				if err := query.Respond(resp); err != nil {
+					w.handler.Logger.Printf("[WARN] agent: Failed to respond to query '%s': %s",
+						e.String(), err)
+				}
+			}
+			return
+		}
+
+		if !retry || attempt >= w.handler.MaxAttempts ||
+			(query != nil && time.Now().Add(wait).After(query.Deadline())) {
+			metrics.IncrCounter([]string{"agent", "webhook", "failed"}, 1)
+			w.handler.Logger.Printf("[ERR] agent: Webhook '%s' failed for event '%s' after %d attempt(s): %v",
+				w.URL, e.String(), attempt, err)
+			return
+		}
+
+		w.handler.Logger.Printf("[WARN] agent: Webhook '%s' failed for event '%s', retrying in %v: %v",
+			w.URL, e.String(), wait, err)
+		select {
+		case <-time.After(wait):
+			wait *= 2
+		case <-w.stopCh:
+			return
+		}
+	}
+}
+
+// post makes a single delivery attempt, returning the response body on
+// success, or if the attempt may be retried on failure
+func (w *webhookWorker) post(e serf.Event, body []byte) ([]byte, bool, error) {
+	defer metrics.MeasureSince([]string{"agent", "webhook", "deliver"}, time.Now())
+
+	ctx := context.Background()
+	if w.handler.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, w.handler.Timeout)
+		defer cancel()
+	}
+	if query, ok := e.(*serf.Query); ok {
+		var cancelQuery context.CancelFunc
+		ctx, cancelQuery = context.WithDeadline(ctx, query.Deadline())
+		defer cancelQuery()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", w.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookEventHeader, e.EventType().String())
+	if w.handler.SelfFunc != nil {
+		req.Header.Set(webhookSelfHeader, w.handler.SelfFunc().Name)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return nil, true, err
+	}
+	defer resp.Body.Close()
+
+	// Limit how much of the response we collect, as with scripts
+	out, err := io.ReadAll(io.LimitReader(resp.Body, maxBufSize))
+	if err != nil {
+		return nil, true, err
+	}
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return out, false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return nil, true, fmt.Errorf("unexpected status: %s", resp.Status)
+	default:
+		return nil, false, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+}
+
+// webhookBody encodes the JSON document describing an event
+func webhookBody(event serf.Event) ([]byte, error) {
+	var rec any
+	switch e := event.(type) {
+	case serf.MemberEvent:
+		rec = newMemberEventRecord(e)
+	case serf.UserEvent:
+		rec = newUserEventRecord(e)
+	case serf.DirectMessageEvent:
+		rec = &directMessageRecord{
+			Event:   e.EventType().String(),
+			From:    e.From,
+			Payload: e.Payload,
+		}
+	case serf.UserEventGap:
+		rec = newUserGapRecord(e)
+	case serf.KVEvent:
+		rec = newKVRecord(e)
+	case *serf.Query:
+		rec = &webhookQueryRecord{
+			Event:   e.EventType().String(),
+			LTime:   e.LTime,
+			Name:    e.Name,
+			Payload: e.Payload,
+			Signer:  e.Signer(),
+		}
+	default:
+		return nil, fmt.Errorf("Unknown event type: %s", event.EventType().String())
+	}
+	return json.Marshal(rec)
+}
@@ -0,0 +1,262 @@
+// Copyright IBM Corp. 2013, 2026
+// SPDX-License-Identifier: MPL-2.0
+
+package agent
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+	"github.com/hashicorp/serf/testutil"
+)
+
+// testWebhookServer records the requests it receives, responding with the
+// given status codes in order and then 200 OK.
+type testWebhookServer struct {
+	*httptest.Server
+
+	sync.Mutex
+	statuses []int
+	headers  []http.Header
+	bodies   [][]byte
+}
+
+func newTestWebhookServer(t *testing.T, response string, statuses ...int) *testWebhookServer {
+	s := &testWebhookServer{statuses: statuses}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		s.Lock()
+		s.headers = append(s.headers, r.Header)
+		s.bodies = append(s.bodies, body)
+		status := http.StatusOK
+		if len(s.statuses) > 0 {
+			status, s.statuses = s.statuses[0], s.statuses[1:]
+		}
+		s.Unlock()
+
+		w.WriteHeader(status)
+		w.Write([]byte(response))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *testWebhookServer) requests() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.bodies)
+}
+
+func (s *testWebhookServer) waitRequests(t *testing.T, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for s.requests() < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %d requests, got %d", n, s.requests())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func testWebhookHandler(webhooks ...EventWebhook) *WebhookEventHandler {
+	h := &WebhookEventHandler{
+		SelfFunc: func() serf.Member {
+			return serf.Member{Name: "ourname"}
+		},
+		Timeout:     time.Second,
+		MaxAttempts: 3,
+		QueueSize:   16,
+	}
+	h.UpdateWebhooks(webhooks)
+	return h
+}
+
+func TestWebhookEventHandler(t *testing.T) {
+	s := newTestWebhookServer(t, "")
+	h := testWebhookHandler(ParseEventWebhook("member-join,user:deploy=" + s.URL)...)
+	defer h.Shutdown()
+
+	h.HandleEvent(serf.MemberEvent{
+		Type: serf.EventMemberJoin,
+		Members: []serf.Member{
+			{
+				Name:   "foo",
+				Addr:   net.ParseIP("1.2.3.4"),
+				Port:   7946,
+				Tags:   map[string]string{"role": "bar"},
+				Status: serf.StatusAlive,
+			},
+		},
+	})
+	h.HandleEvent(serf.UserEvent{LTime: 1, Name: "ignored"})
+	h.HandleEvent(serf.UserEvent{LTime: 2, Name: "deploy", Payload: []byte("foo"), Coalesce: true})
+
+	s.waitRequests(t, 2)
+	s.Lock()
+	defer s.Unlock()
+
+	if s.headers[0].Get(webhookEventHeader) != "member-join" ||
+		s.headers[0].Get(webhookSelfHeader) != "ourname" ||
+		s.headers[0].Get("Content-Type") != "application/json" {
+		t.Fatalf("bad: %v", s.headers[0])
+	}
+	var member memberEventRecord
+	if err := json.Unmarshal(s.bodies[0], &member); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if member.Event != "member-join" || len(member.Members) != 1 {
+		t.Fatalf("bad: %#v", member)
+	}
+	m := member.Members[0]
+	if m.Name != "foo" || !m.Addr.Equal(net.ParseIP("1.2.3.4")) || m.Port != 7946 ||
+		m.Tags["role"] != "bar" || m.Status != "alive" {
+		t.Fatalf("bad: %#v", m)
+	}
+
+	var user userEventRecord
+	if err := json.Unmarshal(s.bodies[1], &user); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expected := userEventRecord{Event: "user", LTime: 2, Name: "deploy", Payload: []byte("foo"), Coalesce: true}
+	if !reflect.DeepEqual(user, expected) {
+		t.Fatalf("bad: %#v", user)
+	}
+}
+
+func TestWebhookEventHandler_Retry(t *testing.T) {
+	s := newTestWebhookServer(t, "", http.StatusServiceUnavailable, http.StatusBadRequest)
+	h := testWebhookHandler(ParseEventWebhook(s.URL)...)
+	defer h.Shutdown()
+
+	// The first event is retried after the 503 and dropped after the 400
+	h.HandleEvent(serf.UserEvent{Name: "first"})
+	h.HandleEvent(serf.UserEvent{Name: "second"})
+
+	s.waitRequests(t, 3)
+
+	s.Lock()
+	defer s.Unlock()
+	var names []string
+	for _, body := range s.bodies {
+		var rec userEventRecord
+		if err := json.Unmarshal(body, &rec); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		names = append(names, rec.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"first", "first", "second"}) {
+		t.Fatalf("bad: %v", names)
+	}
+}
+
+func TestWebhookEventHandler_QueueFull(t *testing.T) {
+	block := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	}))
+	defer server.Close()
+	defer close(block)
+
+	h := testWebhookHandler()
+	h.QueueSize = 1
+	h.UpdateWebhooks(ParseEventWebhook(server.URL))
+	defer h.Shutdown()
+
+	for i := 0; i < 10; i++ {
+		h.HandleEvent(serf.UserEvent{Name: "foo"})
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if n := len(h.workers[0].eventCh); n != 1 {
+		t.Fatalf("bad: %d", n)
+	}
+}
+
+func TestWebhookEventHandler_Query(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	a1 := testAgent(t, ip1)
+	defer a1.Shutdown()
+
+	s := newTestWebhookServer(t, "pong")
+	h := testWebhookHandler(ParseEventWebhook("query:ping=" + s.URL)...)
+	defer h.Shutdown()
+	a1.RegisterEventHandler(h)
+
+	if err := a1.Start(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testutil.Yield()
+
+	resp, err := a1.Query("ping", []byte("foo"), &serf.QueryParam{Timeout: time.Second})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	select {
+	case r := <-resp.ResponseCh():
+		if string(r.Payload) != "pong" {
+			t.Fatalf("bad: %#v", r)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	var rec webhookQueryRecord
+	if err := json.Unmarshal(s.bodies[0], &rec); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if rec.Event != "query" || rec.Name != "ping" || string(rec.Payload) != "foo" {
+		t.Fatalf("bad: %#v", rec)
+	}
+}
+
+func TestParseEventWebhook(t *testing.T) {
+	testCases := []struct {
+		v       string
+		results []EventWebhook
+	}{
+		{
+			"http://localhost/hook?a=b",
+			[]EventWebhook{{EventFilter{Event: "*"}, "http://localhost/hook?a=b"}},
+		},
+		{
+			"member-join,user:deploy=https://localhost/hook",
+			[]EventWebhook{
+				{EventFilter{Event: "member-join"}, "https://localhost/hook"},
+				{EventFilter{Event: "user", Name: "deploy"}, "https://localhost/hook"},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		if !isEventWebhook(tc.v) {
+			t.Fatalf("should be a webhook: %s", tc.v)
+		}
+		results := ParseEventWebhook(tc.v)
+		if !reflect.DeepEqual(results, tc.results) {
+			t.Fatalf("bad: %#v", results)
+		}
+	}
+
+	if isEventWebhook("member-join=handler.sh") || isEventWebhook("handler.sh") {
+		t.Fatalf("should not be a webhook")
+	}
+
+	bad := EventWebhook{EventFilter{Event: "nope"}, "http://localhost"}
+	if err := bad.Validate(); err == nil {
+		t.Fatalf("expected error")
+	}
+}
@@ -33,6 +33,11 @@ Options:
                             one received. Default is true.
   -rpc-addr=127.0.0.1:7373  RPC address of the Serf agent.
   -rpc-auth=""              RPC auth token of the Serf agent.
+  -rpc-tls                  Connect to the Serf agent using TLS. Implied by
+                            -rpc-tls-ca-file and -rpc-tls-cert-file.
+  -rpc-tls-ca-file=""       CA file used to verify the Serf agent.
+  -rpc-tls-cert-file=""     Client certificate presented to the Serf agent.
+  -rpc-tls-key-file=""      Client key presented to the Serf agent.
 `
 	return strings.TrimSpace(helpText)
 }
@@ -45,6 +50,7 @@ func (c *EventCommand) Run(args []string) int {
 	cmdFlags.BoolVar(&coalesce, "coalesce", true, "coalesce")
 	rpcAddr := RPCAddrFlag(cmdFlags)
 	rpcAuth := RPCAuthFlag(cmdFlags)
+	rpcTLS := RPCTLSFlags(cmdFlags)
 	if err := cmdFlags.Parse(args); err != nil {
 		return 1
 	}
@@ -68,7 +74,7 @@ func (c *EventCommand) Run(args []string) int {
 		payload = []byte(args[1])
 	}
 
-	client, err := RPCClient(*rpcAddr, *rpcAuth)
+	client, err := RPCClient(*rpcAddr, *rpcAuth, rpcTLS)
 	if err != nil {
 		c.Ui.Error(fmt.Sprintf("Error connecting to Serf agent: %s", err))
 		return 1
@@ -4,8 +4,10 @@
 package command
 
 import (
+	"crypto/ed25519"
 	"crypto/rand"
 	"encoding/base64"
+	"flag"
 	"fmt"
 	"strings"
 
@@ -20,7 +22,19 @@ type KeygenCommand struct {
 
 var _ cli.Command = &KeygenCommand{}
 
-func (c *KeygenCommand) Run(_ []string) int {
+func (c *KeygenCommand) Run(args []string) int {
+	var signing bool
+	cmdFlags := flag.NewFlagSet("keygen", flag.ContinueOnError)
+	cmdFlags.Usage = func() { c.Ui.Output(c.Help()) }
+	cmdFlags.BoolVar(&signing, "signing", false, "signing key")
+	if err := cmdFlags.Parse(args); err != nil {
+		return 1
+	}
+
+	if signing {
+		return c.signingKey()
+	}
+
 	key := make([]byte, 32)
 	n, err := rand.Reader.Read(key)
 	if err != nil {
@@ -36,17 +50,38 @@ func (c *KeygenCommand) Run(_ []string) int {
 	return 0
 }
 
+// signingKey generates an Ed25519 key pair for signing user events and
+// queries. The private key is output as its seed.
+func (c *KeygenCommand) signingKey() int {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		c.Ui.Error(fmt.Sprintf("Error generating signing key: %s", err))
+		return 1
+	}
+
+	c.Ui.Output(fmt.Sprintf("Signing key: %s", base64.StdEncoding.EncodeToString(priv.Seed())))
+	c.Ui.Output(fmt.Sprintf("Public key:  %s", base64.StdEncoding.EncodeToString(pub)))
+	return 0
+}
+
 func (c *KeygenCommand) Synopsis() string {
 	return "Generates a new encryption key"
 }
 
 func (c *KeygenCommand) Help() string {
 	helpText := `
-Usage: serf keygen
+Usage: serf keygen [options]
 
   Generates a new encryption key that can be used to configure the
   agent to encrypt traffic. The output of this command is already
   in the proper format that the agent expects.
+
+Options:
+
+  -signing                  Generate an Ed25519 key pair for signing user
+                            events and queries instead. The signing key is
+                            used as the agent signing_key, and the public
+                            key in the trusted_keys of the other agents.
 `
 	return strings.TrimSpace(helpText)
 }
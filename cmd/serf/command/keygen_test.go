@@ -4,7 +4,9 @@
 package command
 
 import (
+	"crypto/ed25519"
 	"encoding/base64"
+	"strings"
 	"testing"
 
 	"github.com/hashicorp/cli"
@@ -28,3 +30,33 @@ func TestKeygenCommand(t *testing.T) {
 		t.Fatalf("bad: %#v", result)
 	}
 }
+
+func TestKeygenCommand_Signing(t *testing.T) {
+	ui := new(cli.MockUi)
+	c := &KeygenCommand{Ui: ui}
+	code := c.Run([]string{"-signing"})
+	if code != 0 {
+		t.Fatalf("bad: %d", code)
+	}
+
+	lines := strings.Split(strings.TrimSpace(ui.OutputWriter.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("bad: %#v", lines)
+	}
+	seed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(lines[0], "Signing key: "))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	pub, err := base64.StdEncoding.DecodeString(strings.TrimSpace(strings.TrimPrefix(lines[1], "Public key:")))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if len(seed) != ed25519.SeedSize {
+		t.Fatalf("bad: %#v", seed)
+	}
+	expected := ed25519.NewKeyFromSeed(seed).Public().(ed25519.PublicKey)
+	if !expected.Equal(ed25519.PublicKey(pub)) {
+		t.Fatalf("bad: %#v", pub)
+	}
+}
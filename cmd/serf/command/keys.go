@@ -54,6 +54,11 @@ Options:
                             number of members it is installed on to the console.
   -rpc-addr=127.0.0.1:7373  RPC address of the Serf agent.
   -rpc-auth=""              RPC auth token of the Serf agent.
+  -rpc-tls                  Connect to the Serf agent using TLS. Implied by
+                            -rpc-tls-ca-file and -rpc-tls-cert-file.
+  -rpc-tls-ca-file=""       CA file used to verify the Serf agent.
+  -rpc-tls-cert-file=""     Client certificate presented to the Serf agent.
+  -rpc-tls-key-file=""      Client key presented to the Serf agent.
 `
 	return strings.TrimSpace(helpText)
 }
@@ -71,6 +76,7 @@ func (c *KeysCommand) Run(args []string) int {
 	cmdFlags.BoolVar(&listKeys, "list", false, "list cluster keys")
 	rpcAddr := RPCAddrFlag(cmdFlags)
 	rpcAuth := RPCAuthFlag(cmdFlags)
+	rpcTLS := RPCTLSFlags(cmdFlags)
 	if err := cmdFlags.Parse(args); err != nil {
 		return 1
 	}
@@ -98,7 +104,7 @@ func (c *KeysCommand) Run(args []string) int {
 		return 1
 	}
 
-	client, err := RPCClient(*rpcAddr, *rpcAuth)
+	client, err := RPCClient(*rpcAddr, *rpcAuth, rpcTLS)
 	if err != nil {
 		c.Ui.Error(fmt.Sprintf("Error connecting to Serf agent: %s", err))
 		return 1
@@ -0,0 +1,173 @@
+// Copyright IBM Corp. 2013, 2026
+// SPDX-License-Identifier: MPL-2.0
+
+package command
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/cli"
+)
+
+// KVCommand is a Command implementation that reads and writes the
+// replicated key/value store of the cluster.
+type KVCommand struct {
+	Ui cli.Ui
+}
+
+var _ cli.Command = &KVCommand{}
+
+func (c *KVCommand) Help() string {
+	helpText := `
+Usage: serf kv <subcommand> [options] [args]
+
+  Reads and writes the key/value store replicated to all the members of the
+  Serf cluster. Writes are gossiped, and the last write to a key wins.
+  Requires protocol version 6.
+
+Subcommands:
+
+  get key           Prints the value of a key.
+  set key value     Sets the value of a key.
+  delete key        Deletes a key.
+  list [prefix]     Lists the keys starting with a prefix, and their values.
+
+Options:
+
+  -format=text              Output format of list, 'json' or 'text'.
+  -rpc-addr=127.0.0.1:7373  RPC address of the Serf agent.
+  -rpc-auth=""              RPC auth token of the Serf agent.
+  -rpc-tls                  Connect to the Serf agent using TLS. Implied by
+                            -rpc-tls-ca-file and -rpc-tls-cert-file.
+  -rpc-tls-ca-file=""       CA file used to verify the Serf agent.
+  -rpc-tls-cert-file=""     Client certificate presented to the Serf agent.
+  -rpc-tls-key-file=""      Client key presented to the Serf agent.
+`
+	return strings.TrimSpace(helpText)
+}
+
+// kvArgs is the number of arguments taken by each subcommand
+var kvArgs = map[string][2]int{
+	"get":    {1, 1},
+	"set":    {2, 2},
+	"delete": {1, 1},
+	"list":   {0, 1},
+}
+
+func (c *KVCommand) Run(args []string) int {
+	if len(args) < 1 {
+		c.Ui.Error("A subcommand must be specified.")
+		c.Ui.Error("")
+		c.Ui.Error(c.Help())
+		return 1
+	}
+	sub := args[0]
+	nargs, ok := kvArgs[sub]
+	if !ok {
+		c.Ui.Error(fmt.Sprintf("Unknown subcommand '%s'.", sub))
+		c.Ui.Error("")
+		c.Ui.Error(c.Help())
+		return 1
+	}
+
+	var format string
+	cmdFlags := flag.NewFlagSet("kv", flag.ContinueOnError)
+	cmdFlags.Usage = func() { c.Ui.Output(c.Help()) }
+	cmdFlags.StringVar(&format, "format", "text", "output format")
+	rpcAddr := RPCAddrFlag(cmdFlags)
+	rpcAuth := RPCAuthFlag(cmdFlags)
+	rpcTLS := RPCTLSFlags(cmdFlags)
+	if err := cmdFlags.Parse(args[1:]); err != nil {
+		return 1
+	}
+
+	args = cmdFlags.Args()
+	if len(args) < nargs[0] || len(args) > nargs[1] {
+		c.Ui.Error(fmt.Sprintf("Wrong number of arguments for '%s'.", sub))
+		c.Ui.Error("")
+		c.Ui.Error(c.Help())
+		return 1
+	}
+
+	client, err := RPCClient(*rpcAddr, *rpcAuth, rpcTLS)
+	if err != nil {
+		c.Ui.Error(fmt.Sprintf("Error connecting to Serf agent: %s", err))
+		return 1
+	}
+	defer client.Close()
+
+	switch sub {
+	case "get":
+		value, ok, err := client.KVGet(args[0])
+		if err != nil {
+			c.Ui.Error(fmt.Sprintf("Error reading key: %s", err))
+			return 1
+		}
+		if !ok {
+			c.Ui.Error(fmt.Sprintf("Key '%s' not found", args[0]))
+			return 1
+		}
+		c.Ui.Output(string(value))
+
+	case "set":
+		if err := client.KVSet(args[0], []byte(args[1])); err != nil {
+			c.Ui.Error(fmt.Sprintf("Error setting key: %s", err))
+			return 1
+		}
+		c.Ui.Output(fmt.Sprintf("Key '%s' set", args[0]))
+
+	case "delete":
+		if err := client.KVDelete(args[0]); err != nil {
+			c.Ui.Error(fmt.Sprintf("Error deleting key: %s", err))
+			return 1
+		}
+		c.Ui.Output(fmt.Sprintf("Key '%s' deleted", args[0]))
+
+	case "list":
+		var prefix string
+		if len(args) == 1 {
+			prefix = args[0]
+		}
+		values, err := client.KVList(prefix)
+		if err != nil {
+			c.Ui.Error(fmt.Sprintf("Error listing keys: %s", err))
+			return 1
+		}
+
+		container := make(KVContainer, len(values))
+		for key, value := range values {
+			container[key] = string(value)
+		}
+		output, err := formatOutput(container, format)
+		if err != nil {
+			c.Ui.Error(fmt.Sprintf("Encoding error: %s", err))
+			return 1
+		}
+		c.Ui.Output(string(output))
+	}
+	return 0
+}
+
+func (c *KVCommand) Synopsis() string {
+	return "Read and write the replicated key/value store"
+}
+
+// KVContainer holds the keys and values listed from the key/value store
+type KVContainer map[string]string
+
+func (kv KVContainer) String() string {
+	keys := make([]string, 0, len(kv))
+	for key := range kv {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var out strings.Builder
+	for _, key := range keys {
+		fmt.Fprintf(&out, "%s=%s\n", key, kv[key])
+	}
+	return out.String()
+}
@@ -0,0 +1,89 @@
+// Copyright IBM Corp. 2013, 2026
+// SPDX-License-Identifier: MPL-2.0
+
+package command
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/cli"
+	"github.com/hashicorp/serf/cmd/serf/command/agent"
+	"github.com/hashicorp/serf/serf"
+	"github.com/hashicorp/serf/testutil"
+)
+
+func TestKVCommandRun(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	ip2, returnFn2 := testutil.TakeIP()
+	defer returnFn2()
+
+	// The key/value store requires protocol version 6
+	serfConfig := serf.DefaultConfig()
+	serfConfig.ProtocolVersion = 6
+	a1 := testAgentWithConfig(t, ip1, agent.DefaultConfig(), serfConfig)
+	defer a1.Shutdown()
+
+	rpcAddr, ipc := testIPC(t, ip2, a1)
+	defer ipc.Shutdown()
+
+	run := func(args ...string) (int, *cli.MockUi) {
+		ui := new(cli.MockUi)
+		c := &KVCommand{Ui: ui}
+		args = append(args[:1], append([]string{"-rpc-addr=" + rpcAddr}, args[1:]...)...)
+		return c.Run(args), ui
+	}
+
+	if code, ui := run("set", "app/version", "1.0"); code != 0 {
+		t.Fatalf("bad: %d. %#v", code, ui.ErrorWriter.String())
+	}
+	if code, ui := run("set", "app/name", "web"); code != 0 {
+		t.Fatalf("bad: %d. %#v", code, ui.ErrorWriter.String())
+	}
+
+	code, ui := run("get", "app/version")
+	if code != 0 {
+		t.Fatalf("bad: %d. %#v", code, ui.ErrorWriter.String())
+	}
+	if ui.OutputWriter.String() != "1.0\n" {
+		t.Fatalf("bad: %#v", ui.OutputWriter.String())
+	}
+
+	code, ui = run("list", "app/")
+	if code != 0 {
+		t.Fatalf("bad: %d. %#v", code, ui.ErrorWriter.String())
+	}
+	if ui.OutputWriter.String() != "app/name=web\napp/version=1.0\n" {
+		t.Fatalf("bad: %#v", ui.OutputWriter.String())
+	}
+
+	if code, ui := run("delete", "app/name"); code != 0 {
+		t.Fatalf("bad: %d. %#v", code, ui.ErrorWriter.String())
+	}
+	code, ui = run("get", "app/name")
+	if code != 1 {
+		t.Fatalf("bad: %d", code)
+	}
+	if !strings.Contains(ui.ErrorWriter.String(), "not found") {
+		t.Fatalf("bad: %#v", ui.ErrorWriter.String())
+	}
+}
+
+func TestKVCommandRun_badArgs(t *testing.T) {
+	cases := [][]string{
+		nil,
+		{"nope"},
+		{"get"},
+		{"set", "key"},
+		{"list", "a", "b"},
+	}
+	for _, args := range cases {
+		ui := new(cli.MockUi)
+		c := &KVCommand{Ui: ui}
+		if code := c.Run(args); code != 1 {
+			t.Fatalf("bad: %v %d", args, code)
+		}
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"strings"
 
 	"github.com/hashicorp/cli"
+	"github.com/hashicorp/serf/client"
 	"github.com/hashicorp/serf/cmd/serf/command/agent"
 	"github.com/ryanuber/columnize"
 )
@@ -66,6 +67,10 @@ Options:
   -detailed                 Additional information such as protocol verions
                             will be shown (only affects text output format).
 
+  -filter=<expr>            If provided, output is filtered to only nodes with tags
+                            matching the expression, such as:
+                            role == "web" and (dc == "east" or not canary)
+
   -format                   If provided, output is returned in the specified
                             format. Valid formats are 'json', and 'text' (default)
 
@@ -91,13 +96,18 @@ Options:
   -rpc-addr=127.0.0.1:7373  RPC address of the Serf agent.
 
   -rpc-auth=""              RPC auth token of the Serf agent.
+  -rpc-tls                  Connect to the Serf agent using TLS. Implied by
+                            -rpc-tls-ca-file and -rpc-tls-cert-file.
+  -rpc-tls-ca-file=""       CA file used to verify the Serf agent.
+  -rpc-tls-cert-file=""     Client certificate presented to the Serf agent.
+  -rpc-tls-key-file=""      Client key presented to the Serf agent.
 `
 	return strings.TrimSpace(helpText)
 }
 
 func (c *MembersCommand) Run(args []string) int {
 	var detailed bool
-	var roleFilter, statusFilter, nameFilter, format string
+	var roleFilter, statusFilter, nameFilter, exprFilter, format string
 	var tags []string
 	cmdFlags := flag.NewFlagSet("members", flag.ContinueOnError)
 	cmdFlags.Usage = func() { c.Ui.Output(c.Help()) }
@@ -107,8 +117,10 @@ func (c *MembersCommand) Run(args []string) int {
 	cmdFlags.StringVar(&format, "format", "text", "output format")
 	cmdFlags.Var((*agent.AppendSliceValue)(&tags), "tag", "tag filter")
 	cmdFlags.StringVar(&nameFilter, "name", "", "name filter")
+	cmdFlags.StringVar(&exprFilter, "filter", "", "tag filter expression")
 	rpcAddr := RPCAddrFlag(cmdFlags)
 	rpcAuth := RPCAuthFlag(cmdFlags)
+	rpcTLS := RPCTLSFlags(cmdFlags)
 	if err := cmdFlags.Parse(args); err != nil {
 		return 1
 	}
@@ -125,14 +137,19 @@ func (c *MembersCommand) Run(args []string) int {
 		return 1
 	}
 
-	client, err := RPCClient(*rpcAddr, *rpcAuth)
+	cl, err := RPCClient(*rpcAddr, *rpcAuth, rpcTLS)
 	if err != nil {
 		c.Ui.Error(fmt.Sprintf("Error connecting to Serf agent: %s", err))
 		return 1
 	}
-	defer client.Close()
-
-	members, err := client.MembersFiltered(reqtags, statusFilter, nameFilter)
+	defer cl.Close()
+
+	members, err := cl.MembersWithFilter(&client.MembersFilter{
+		Tags:   reqtags,
+		Status: statusFilter,
+		Name:   nameFilter,
+		Expr:   exprFilter,
+	})
 	if err != nil {
 		c.Ui.Error(fmt.Sprintf("Error retrieving members: %s", err))
 		return 1
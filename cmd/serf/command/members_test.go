@@ -278,3 +278,80 @@ func TestMembersCommandRun_multiTagFilter_failed(t *testing.T) {
 		t.Fatalf("bad: %#v", ui.OutputWriter.String())
 	}
 }
+
+func TestMembersCommandRun_exprFilter(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	ip2, returnFn2 := testutil.TakeIP()
+	defer returnFn2()
+
+	a1 := testAgent(t, ip1)
+	defer a1.Shutdown()
+
+	rpcAddr, ipc := testIPC(t, ip2, a1)
+	defer ipc.Shutdown()
+
+	ui := new(cli.MockUi)
+	c := &MembersCommand{Ui: ui}
+	args := []string{
+		"-rpc-addr=" + rpcAddr,
+		`-filter=tag1 == "foo" and (tag2 == "bar" or not role)`,
+	}
+
+	code := c.Run(args)
+	if code != 0 {
+		t.Fatalf("bad: %d. %#v", code, ui.ErrorWriter.String())
+	}
+
+	if !strings.Contains(ui.OutputWriter.String(), a1.SerfConfig().NodeName) {
+		t.Fatalf("bad: %#v", ui.OutputWriter.String())
+	}
+}
+
+func TestMembersCommandRun_exprFilter_failed(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	ip2, returnFn2 := testutil.TakeIP()
+	defer returnFn2()
+
+	a1 := testAgent(t, ip1)
+	defer a1.Shutdown()
+
+	rpcAddr, ipc := testIPC(t, ip2, a1)
+	defer ipc.Shutdown()
+
+	ui := new(cli.MockUi)
+	c := &MembersCommand{Ui: ui}
+	args := []string{
+		"-rpc-addr=" + rpcAddr,
+		`-filter=tag1 == "bar" or tag1 >= 5`,
+	}
+
+	code := c.Run(args)
+	if code != 0 {
+		t.Fatalf("bad: %d. %#v", code, ui.ErrorWriter.String())
+	}
+
+	if strings.Contains(ui.OutputWriter.String(), a1.SerfConfig().NodeName) {
+		t.Fatalf("bad: %#v", ui.OutputWriter.String())
+	}
+
+	// Invalid expressions are reported
+	ui = new(cli.MockUi)
+	c = &MembersCommand{Ui: ui}
+	args = []string{
+		"-rpc-addr=" + rpcAddr,
+		`-filter=tag1 ==`,
+	}
+
+	code = c.Run(args)
+	if code != 1 {
+		t.Fatalf("bad: %d", code)
+	}
+
+	if !strings.Contains(ui.ErrorWriter.String(), "Invalid filter expression") {
+		t.Fatalf("bad: %#v", ui.ErrorWriter.String())
+	}
+}
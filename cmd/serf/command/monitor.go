@@ -4,6 +4,7 @@
 package command
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"strings"
@@ -11,6 +12,7 @@ import (
 
 	"github.com/hashicorp/cli"
 	"github.com/hashicorp/logutils"
+	"github.com/hashicorp/serf/client"
 )
 
 // MonitorCommand is a Command implementation that queries a running
@@ -35,46 +37,60 @@ Usage: serf monitor [options]
 
 Options:
 
+  -log-json                 Output logs and events as one JSON object per line.
   -log-level=info          Log level of the agent.
   -rpc-addr=127.0.0.1:7373  RPC address of the Serf agent.
   -rpc-auth=""              RPC auth token of the Serf agent.
+  -rpc-tls                  Connect to the Serf agent using TLS. Implied by
+                            -rpc-tls-ca-file and -rpc-tls-cert-file.
+  -rpc-tls-ca-file=""       CA file used to verify the Serf agent.
+  -rpc-tls-cert-file=""     Client certificate presented to the Serf agent.
+  -rpc-tls-key-file=""      Client key presented to the Serf agent.
 `
 	return strings.TrimSpace(helpText)
 }
 
 func (c *MonitorCommand) Run(args []string) int {
 	var logLevel string
+	var logJSON bool
 	cmdFlags := flag.NewFlagSet("monitor", flag.ContinueOnError)
 	cmdFlags.Usage = func() { c.Ui.Output(c.Help()) }
 	cmdFlags.StringVar(&logLevel, "log-level", "INFO", "log level")
+	cmdFlags.BoolVar(&logJSON, "log-json", false, "output JSON")
 	rpcAddr := RPCAddrFlag(cmdFlags)
 	rpcAuth := RPCAuthFlag(cmdFlags)
+	rpcTLS := RPCTLSFlags(cmdFlags)
 	if err := cmdFlags.Parse(args); err != nil {
 		return 1
 	}
 
-	client, err := RPCClient(*rpcAddr, *rpcAuth)
+	cl, err := RPCClient(*rpcAddr, *rpcAuth, rpcTLS)
 	if err != nil {
 		c.Ui.Error(fmt.Sprintf("Error connecting to Serf agent: %s", err))
 		return 1
 	}
-	defer client.Close()
+	defer cl.Close()
 
 	eventCh := make(chan map[string]any, 1024)
-	streamHandle, err := client.Stream("*", eventCh)
+	streamHandle, err := cl.Stream("*", eventCh)
 	if err != nil {
 		c.Ui.Error(fmt.Sprintf("Error starting stream: %s", err))
 		return 1
 	}
-	defer client.Stop(streamHandle)
+	defer cl.Stop(streamHandle)
 
 	logCh := make(chan string, 1024)
-	monHandle, err := client.Monitor(logutils.LogLevel(logLevel), logCh)
+	var monHandle client.StreamHandle
+	if logJSON {
+		monHandle, err = cl.MonitorJSON(logutils.LogLevel(logLevel), c.jsonLogs(logCh))
+	} else {
+		monHandle, err = cl.Monitor(logutils.LogLevel(logLevel), logCh)
+	}
 	if err != nil {
 		c.Ui.Error(fmt.Sprintf("Error starting monitor: %s", err))
 		return 1
 	}
-	defer client.Stop(monHandle)
+	defer cl.Stop(monHandle)
 
 	eventDoneCh := make(chan struct{})
 	go func() {
@@ -91,6 +107,11 @@ func (c *MonitorCommand) Run(args []string) int {
 				if event == nil {
 					break OUTER
 				}
+				if logJSON {
+					buf, _ := json.Marshal(event)
+					c.Ui.Info(string(buf))
+					continue
+				}
 				c.Ui.Info("Event Info:")
 				for key, val := range event {
 					c.Ui.Info(fmt.Sprintf("\t%s: %#v", key, val))
@@ -119,6 +140,23 @@ func (c *MonitorCommand) Run(args []string) int {
 	return 0
 }
 
+// jsonLogs returns a channel for structured log entries that are
+// encoded and passed on to the given channel as JSON lines
+func (c *MonitorCommand) jsonLogs(logCh chan<- string) chan<- client.LogEntry {
+	entryCh := make(chan client.LogEntry, 1024)
+	go func() {
+		defer close(logCh)
+		for entry := range entryCh {
+			buf, err := json.Marshal(&entry)
+			if err != nil {
+				continue
+			}
+			logCh <- string(buf)
+		}
+	}()
+	return entryCh
+}
+
 func (c *MonitorCommand) Synopsis() string {
 	return "Stream logs from a Serf agent"
 }
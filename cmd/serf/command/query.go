@@ -6,6 +6,7 @@ package command
 import (
 	"flag"
 	"fmt"
+	"strconv"
 	"strings"
 	"time"
 
@@ -31,6 +32,11 @@ Usage: serf query [options] name payload
 
 Options:
 
+  -filter=<expr>            If provided, only nodes with tags matching the expression
+                            respond, such as:
+                            role == "web" and (dc == "east" or not canary)
+                            This requires protocol version 6.
+
   -format                   If provided, output is returned in the specified
                             format. Valid formats are 'json', and 'text' (default)
 
@@ -48,9 +54,18 @@ Options:
   -relay-factor             If provided, query responses will be relayed through this
                             number of extra nodes for redundancy.
 
+  -sample=N                 If provided, only a random sample of N of the nodes
+                            matching the filters is queried. A percentage of the
+                            matching nodes can be given as -sample=N%.
+
   -rpc-addr=127.0.0.1:7373  RPC address of the Serf agent.
 
   -rpc-auth=""              RPC auth token of the Serf agent.
+  -rpc-tls                  Connect to the Serf agent using TLS. Implied by
+                            -rpc-tls-ca-file and -rpc-tls-cert-file.
+  -rpc-tls-ca-file=""       CA file used to verify the Serf agent.
+  -rpc-tls-cert-file=""     Client certificate presented to the Serf agent.
+  -rpc-tls-key-file=""      Client key presented to the Serf agent.
 `
 	return strings.TrimSpace(helpText)
 }
@@ -61,17 +76,22 @@ func (c *QueryCommand) Run(args []string) int {
 	var tags []string
 	var timeout time.Duration
 	var format string
+	var filter string
 	var relayFactor int
+	var sample string
 	cmdFlags := flag.NewFlagSet("event", flag.ContinueOnError)
 	cmdFlags.Usage = func() { c.Ui.Output(c.Help()) }
 	cmdFlags.Var((*agent.AppendSliceValue)(&nodes), "node", "node filter")
 	cmdFlags.Var((*agent.AppendSliceValue)(&tags), "tag", "tag filter")
+	cmdFlags.StringVar(&filter, "filter", "", "tag filter expression")
 	cmdFlags.DurationVar(&timeout, "timeout", 0, "query timeout")
 	cmdFlags.BoolVar(&noAck, "no-ack", false, "no-ack")
 	cmdFlags.StringVar(&format, "format", "text", "output format")
 	cmdFlags.IntVar(&relayFactor, "relay-factor", 0, "response relay count")
+	cmdFlags.StringVar(&sample, "sample", "", "query a sample of nodes")
 	rpcAddr := RPCAddrFlag(cmdFlags)
 	rpcAuth := RPCAuthFlag(cmdFlags)
+	rpcTLS := RPCTLSFlags(cmdFlags)
 	if err := cmdFlags.Parse(args); err != nil {
 		return 1
 	}
@@ -101,13 +121,19 @@ func (c *QueryCommand) Run(args []string) int {
 		return 1
 	}
 
+	sampleSize, samplePercent, err := parseSample(sample)
+	if err != nil {
+		c.Ui.Error(fmt.Sprintf("Error: %s", err))
+		return 1
+	}
+
 	name := args[0]
 	var payload []byte
 	if len(args) == 2 {
 		payload = []byte(args[1])
 	}
 
-	cl, err := RPCClient(*rpcAddr, *rpcAuth)
+	cl, err := RPCClient(*rpcAddr, *rpcAuth, rpcTLS)
 	if err != nil {
 		c.Ui.Error(fmt.Sprintf("Error connecting to Serf agent: %s", err))
 		return 1
@@ -137,15 +163,18 @@ func (c *QueryCommand) Run(args []string) int {
 	respCh := make(chan client.NodeResponse, 128)
 
 	params := client.QueryParam{
-		FilterNodes: nodes,
-		FilterTags:  filterTags,
-		RequestAck:  !noAck,
-		RelayFactor: uint8(relayFactor),
-		Timeout:     timeout,
-		Name:        name,
-		Payload:     payload,
-		AckCh:       ackCh,
-		RespCh:      respCh,
+		FilterNodes:   nodes,
+		FilterTags:    filterTags,
+		FilterExpr:    filter,
+		RequestAck:    !noAck,
+		RelayFactor:   uint8(relayFactor),
+		Timeout:       timeout,
+		SampleSize:    sampleSize,
+		SamplePercent: samplePercent,
+		Name:          name,
+		Payload:       payload,
+		AckCh:         ackCh,
+		RespCh:        respCh,
 	}
 	if err := cl.Query(&params); err != nil {
 		c.Ui.Error(fmt.Sprintf("Error sending query: %s", err))
@@ -179,6 +208,26 @@ OUTER:
 	return 0
 }
 
+// parseSample parses the -sample flag, which is either a number of nodes
+// or a percentage of the matching nodes
+func parseSample(v string) (int, float64, error) {
+	if v == "" {
+		return 0, 0, nil
+	}
+	if pct, ok := strings.CutSuffix(v, "%"); ok {
+		n, err := strconv.ParseFloat(pct, 64)
+		if err != nil || n <= 0 || n > 100 {
+			return 0, 0, fmt.Errorf("Sample percentage must be between 0 and 100: %s", v)
+		}
+		return 0, n, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		return 0, 0, fmt.Errorf("Sample size must be a positive number: %s", v)
+	}
+	return n, 0, nil
+}
+
 func (c *QueryCommand) Synopsis() string {
 	return "Send a query to the Serf cluster"
 }
@@ -9,6 +9,8 @@ import (
 	"testing"
 
 	"github.com/hashicorp/cli"
+	"github.com/hashicorp/serf/cmd/serf/command/agent"
+	"github.com/hashicorp/serf/serf"
 	"github.com/hashicorp/serf/testutil"
 )
 
@@ -100,6 +102,98 @@ func TestQueryCommandRun_tagFilter(t *testing.T) {
 	}
 }
 
+func TestQueryCommandRun_sample(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	ip2, returnFn2 := testutil.TakeIP()
+	defer returnFn2()
+
+	a1 := testAgent(t, ip1)
+	defer a1.Shutdown()
+
+	rpcAddr, ipc := testIPC(t, ip2, a1)
+	defer ipc.Shutdown()
+
+	ui := new(cli.MockUi)
+	c := &QueryCommand{Ui: ui}
+	args := []string{
+		"-rpc-addr=" + rpcAddr,
+		"-sample=50%",
+		"-timeout=500ms",
+		"foo",
+	}
+
+	code := c.Run(args)
+	if code != 0 {
+		t.Fatalf("bad: %d. %#v", code, ui.ErrorWriter.String())
+	}
+
+	if !strings.Contains(ui.OutputWriter.String(), a1.SerfConfig().NodeName) {
+		t.Fatalf("bad: %#v", ui.OutputWriter.String())
+	}
+}
+
+func TestQueryCommandRun_badSample(t *testing.T) {
+	for _, sample := range []string{"0", "-1", "abc", "0%", "101%"} {
+		ui := new(cli.MockUi)
+		c := &QueryCommand{Ui: ui}
+		args := []string{"-rpc-addr=foo", "-sample=" + sample, "foo"}
+
+		code := c.Run(args)
+		if code != 1 {
+			t.Fatalf("bad: %s %d", sample, code)
+		}
+
+		if !strings.Contains(ui.ErrorWriter.String(), "Sample") {
+			t.Fatalf("bad: %#v", ui.ErrorWriter.String())
+		}
+	}
+}
+
+func TestQueryCommandRun_exprFilter(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	ip2, returnFn2 := testutil.TakeIP()
+	defer returnFn2()
+
+	// Expression filters require protocol version 6
+	serfConfig := serf.DefaultConfig()
+	serfConfig.ProtocolVersion = 6
+	a1 := testAgentWithConfig(t, ip1, agent.DefaultConfig(), serfConfig)
+	defer a1.Shutdown()
+
+	rpcAddr, ipc := testIPC(t, ip2, a1)
+	defer ipc.Shutdown()
+
+	for _, tc := range []struct {
+		filter string
+		match  bool
+	}{
+		{`tag1 == "foo" and not canary`, true},
+		{`tag1 == "foo" and canary`, false},
+	} {
+		ui := new(cli.MockUi)
+		c := &QueryCommand{Ui: ui}
+		args := []string{
+			"-rpc-addr=" + rpcAddr,
+			"-filter=" + tc.filter,
+			"-timeout=500ms",
+			"foo",
+		}
+
+		code := c.Run(args)
+		if code != 0 {
+			t.Fatalf("bad: %d. %#v", code, ui.ErrorWriter.String())
+		}
+
+		if strings.Contains(ui.OutputWriter.String(), a1.SerfConfig().NodeName) != tc.match {
+			t.Fatalf("bad: %s %#v", tc.filter, ui.OutputWriter.String())
+		}
+	}
+}
+
 func TestQueryCommandRun_tagFilter_failed(t *testing.T) {
 	ip1, returnFn1 := testutil.TakeIP()
 	defer returnFn1()
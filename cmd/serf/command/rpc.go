@@ -4,12 +4,30 @@
 package command
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"flag"
+	"fmt"
 	"os"
 
 	"github.com/hashicorp/serf/client"
 )
 
+// RPCTLS holds the TLS settings used to connect to the Serf agent.
+type RPCTLS struct {
+	// Enable connects using TLS even if no files are given, verifying
+	// the agent against the system roots.
+	Enable bool
+
+	// CAFile is used to verify the agent's certificate
+	CAFile string
+
+	// CertFile and KeyFile are presented to the agent if it
+	// verifies client certificates.
+	CertFile string
+	KeyFile  string
+}
+
 // RPCAddrFlag returns a pointer to a string that will be populated
 // when the given flagset is parsed with the RPC address of the Serf.
 func RPCAddrFlag(f *flag.FlagSet) *string {
@@ -30,8 +48,60 @@ func RPCAuthFlag(f *flag.FlagSet) *string {
 		"RPC auth token of the Serf agent")
 }
 
+// RPCTLSFlags returns a pointer to the RPC TLS settings that will be
+// populated when the given flagset is parsed.
+func RPCTLSFlags(f *flag.FlagSet) *RPCTLS {
+	rpcTLS := &RPCTLS{
+		Enable:   os.Getenv("SERF_RPC_TLS") != "",
+		CAFile:   os.Getenv("SERF_RPC_TLS_CA_FILE"),
+		CertFile: os.Getenv("SERF_RPC_TLS_CERT_FILE"),
+		KeyFile:  os.Getenv("SERF_RPC_TLS_KEY_FILE"),
+	}
+	f.BoolVar(&rpcTLS.Enable, "rpc-tls", rpcTLS.Enable,
+		"connect to the Serf agent using TLS")
+	f.StringVar(&rpcTLS.CAFile, "rpc-tls-ca-file", rpcTLS.CAFile,
+		"CA file used to verify the Serf agent")
+	f.StringVar(&rpcTLS.CertFile, "rpc-tls-cert-file", rpcTLS.CertFile,
+		"client certificate presented to the Serf agent")
+	f.StringVar(&rpcTLS.KeyFile, "rpc-tls-key-file", rpcTLS.KeyFile,
+		"client key presented to the Serf agent")
+	return rpcTLS
+}
+
+// TLSConfig returns the client TLS configuration, or nil if TLS is
+// not enabled.
+func (r *RPCTLS) TLSConfig() (*tls.Config, error) {
+	if r == nil || (!r.Enable && r.CAFile == "" && r.CertFile == "") {
+		return nil, nil
+	}
+
+	tlsConf := &tls.Config{MinVersion: tls.VersionTLS12}
+	if r.CAFile != "" {
+		pem, err := os.ReadFile(r.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read RPC TLS CA file: %v", err)
+		}
+		tlsConf.RootCAs = x509.NewCertPool()
+		if !tlsConf.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in RPC TLS CA file %s", r.CAFile)
+		}
+	}
+	if r.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(r.CertFile, r.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load RPC TLS certificate: %v", err)
+		}
+		tlsConf.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConf, nil
+}
+
 // RPCClient returns a new Serf RPC client with the given address.
-func RPCClient(addr, auth string) (*client.RPCClient, error) {
-	config := client.Config{Addr: addr, AuthKey: auth}
+func RPCClient(addr, auth string, rpcTLS *RPCTLS) (*client.RPCClient, error) {
+	tlsConf, err := rpcTLS.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	config := client.Config{Addr: addr, AuthKey: auth, TLSConfig: tlsConf}
 	return client.ClientFromConfig(&config)
 }
@@ -0,0 +1,90 @@
+// Copyright IBM Corp. 2013, 2026
+// SPDX-License-Identifier: MPL-2.0
+
+package command
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/cli"
+)
+
+// SendCommand is a Command implementation that sends a payload to a
+// single member of the cluster.
+type SendCommand struct {
+	Ui cli.Ui
+}
+
+var _ cli.Command = &SendCommand{}
+
+func (c *SendCommand) Help() string {
+	helpText := `
+Usage: serf send [options] node payload
+
+  Sends a payload directly to a single member of the Serf cluster over a
+  reliable connection. The member receives it as a direct-message event.
+  Requires protocol version 6 on both nodes.
+
+Options:
+
+  -rpc-addr=127.0.0.1:7373  RPC address of the Serf agent.
+  -rpc-auth=""              RPC auth token of the Serf agent.
+  -rpc-tls                  Connect to the Serf agent using TLS. Implied by
+                            -rpc-tls-ca-file and -rpc-tls-cert-file.
+  -rpc-tls-ca-file=""       CA file used to verify the Serf agent.
+  -rpc-tls-cert-file=""     Client certificate presented to the Serf agent.
+  -rpc-tls-key-file=""      Client key presented to the Serf agent.
+`
+	return strings.TrimSpace(helpText)
+}
+
+func (c *SendCommand) Run(args []string) int {
+	cmdFlags := flag.NewFlagSet("send", flag.ContinueOnError)
+	cmdFlags.Usage = func() { c.Ui.Output(c.Help()) }
+	rpcAddr := RPCAddrFlag(cmdFlags)
+	rpcAuth := RPCAuthFlag(cmdFlags)
+	rpcTLS := RPCTLSFlags(cmdFlags)
+	if err := cmdFlags.Parse(args); err != nil {
+		return 1
+	}
+
+	args = cmdFlags.Args()
+	if len(args) < 1 {
+		c.Ui.Error("A node name must be specified.")
+		c.Ui.Error("")
+		c.Ui.Error(c.Help())
+		return 1
+	} else if len(args) > 2 {
+		c.Ui.Error("Too many command line arguments. Only a node and payload must be specified.")
+		c.Ui.Error("")
+		c.Ui.Error(c.Help())
+		return 1
+	}
+
+	node := args[0]
+	var payload []byte
+	if len(args) == 2 {
+		payload = []byte(args[1])
+	}
+
+	client, err := RPCClient(*rpcAddr, *rpcAuth, rpcTLS)
+	if err != nil {
+		c.Ui.Error(fmt.Sprintf("Error connecting to Serf agent: %s", err))
+		return 1
+	}
+	defer client.Close()
+
+	if err := client.SendToMember(node, payload); err != nil {
+		c.Ui.Error(fmt.Sprintf("Error sending message: %s", err))
+		return 1
+	}
+
+	c.Ui.Output(fmt.Sprintf("Message sent to '%s'", node))
+	return 0
+}
+
+func (c *SendCommand) Synopsis() string {
+	return "Send a payload directly to a single member"
+}
@@ -0,0 +1,130 @@
+// Copyright IBM Corp. 2013, 2026
+// SPDX-License-Identifier: MPL-2.0
+
+package command
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/cli"
+	"github.com/hashicorp/serf/cmd/serf/command/agent"
+	"github.com/hashicorp/serf/serf"
+	"github.com/hashicorp/serf/testutil"
+)
+
+func TestSendCommandRun(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	ip2, returnFn2 := testutil.TakeIP()
+	defer returnFn2()
+
+	// Direct messages require protocol version 6
+	serfConfig := serf.DefaultConfig()
+	serfConfig.ProtocolVersion = 6
+	a1 := testAgentWithConfig(t, ip1, agent.DefaultConfig(), serfConfig)
+	defer a1.Shutdown()
+
+	handler := new(agent.MockEventHandler)
+	a1.RegisterEventHandler(handler)
+
+	rpcAddr, ipc := testIPC(t, ip2, a1)
+	defer ipc.Shutdown()
+
+	ui := new(cli.MockUi)
+	c := &SendCommand{Ui: ui}
+	args := []string{"-rpc-addr=" + rpcAddr, serfConfig.NodeName, "hello"}
+
+	code := c.Run(args)
+	if code != 0 {
+		t.Fatalf("bad: %d. %#v", code, ui.ErrorWriter.String())
+	}
+
+	if !strings.Contains(ui.OutputWriter.String(), "Message sent") {
+		t.Fatalf("bad: %#v", ui.OutputWriter.String())
+	}
+
+	expected := serf.DirectMessageEvent{From: serfConfig.NodeName, Payload: []byte("hello")}
+	testutil.Yield()
+	deadline := time.Now().Add(time.Second)
+	for {
+		handler.Lock()
+		var got []serf.Event
+		for _, e := range handler.Events {
+			if e.EventType() == serf.EventDirectMessage {
+				got = append(got, e)
+			}
+		}
+		handler.Unlock()
+
+		if len(got) == 1 && reflect.DeepEqual(got[0], expected) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("bad: %#v", got)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSendCommandRun_unknownNode(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	ip2, returnFn2 := testutil.TakeIP()
+	defer returnFn2()
+
+	serfConfig := serf.DefaultConfig()
+	serfConfig.ProtocolVersion = 6
+	a1 := testAgentWithConfig(t, ip1, agent.DefaultConfig(), serfConfig)
+	defer a1.Shutdown()
+
+	rpcAddr, ipc := testIPC(t, ip2, a1)
+	defer ipc.Shutdown()
+
+	ui := new(cli.MockUi)
+	c := &SendCommand{Ui: ui}
+	args := []string{"-rpc-addr=" + rpcAddr, "nope", "hello"}
+
+	code := c.Run(args)
+	if code != 1 {
+		t.Fatalf("bad: %d", code)
+	}
+
+	if !strings.Contains(ui.ErrorWriter.String(), "unknown member") {
+		t.Fatalf("bad: %#v", ui.ErrorWriter.String())
+	}
+}
+
+func TestSendCommandRun_noNode(t *testing.T) {
+	ui := new(cli.MockUi)
+	c := &SendCommand{Ui: ui}
+	args := []string{"-rpc-addr=foo"}
+
+	code := c.Run(args)
+	if code != 1 {
+		t.Fatalf("bad: %d", code)
+	}
+
+	if !strings.Contains(ui.ErrorWriter.String(), "node name") {
+		t.Fatalf("bad: %#v", ui.ErrorWriter.String())
+	}
+}
+
+func TestSendCommandRun_tooMany(t *testing.T) {
+	ui := new(cli.MockUi)
+	c := &SendCommand{Ui: ui}
+	args := []string{"-rpc-addr=foo", "foo", "bar", "baz"}
+
+	code := c.Run(args)
+	if code != 1 {
+		t.Fatalf("bad: %d", code)
+	}
+
+	if !strings.Contains(ui.ErrorWriter.String(), "Too many") {
+		t.Fatalf("bad: %#v", ui.ErrorWriter.String())
+	}
+}
@@ -64,6 +64,12 @@ func init() {
 			}, nil
 		},
 
+		"kv": func() (cli.Command, error) {
+			return &command.KVCommand{
+				Ui: ui,
+			}, nil
+		},
+
 		"leave": func() (cli.Command, error) {
 			return &command.LeaveCommand{
 				Ui: ui,
@@ -83,6 +89,12 @@ func init() {
 			}, nil
 		},
 
+		"send": func() (cli.Command, error) {
+			return &command.SendCommand{
+				Ui: ui,
+			}, nil
+		},
+
 		"tags": func() (cli.Command, error) {
 			return &command.TagsCommand{
 				Ui: ui,
@@ -4,6 +4,7 @@
 package serf
 
 import (
+	"crypto/ed25519"
 	"io"
 	"log"
 	"os"
@@ -20,6 +21,7 @@ var ProtocolVersionMap map[uint8]uint8
 
 func init() {
 	ProtocolVersionMap = map[uint8]uint8{
+		6: 2,
 		5: 2,
 		4: 2,
 		3: 2,
@@ -40,6 +42,13 @@ type Config struct {
 	// map.
 	Tags map[string]string
 
+	// ExtendedTagsSizeLimit allows tags over the memberlist meta size
+	// limit, up to this encoded size, which is disabled when zero. The meta
+	// of a node then holds a digest of its tags along with as many of them
+	// as fit, and other nodes fetch the full set from the node or get it
+	// during a push/pull. This requires protocol version 6.
+	ExtendedTagsSizeLimit int
+
 	// EventCh is a channel that receives all the Serf events. The events
 	// are sent on this channel in proper ordering. Care must be taken that
 	// this channel doesn't block, either by processing the events quick
@@ -187,6 +196,13 @@ type Config struct {
 	QueryResponseSizeLimit int
 	QuerySizeLimit         int
 
+	// QueryChunkedSizeLimit limits the size of query responses
+	// that are too large for QueryResponseSizeLimit, which are sent in
+	// chunks over TCP instead. This applies to both inbound and outbound
+	// responses, and requires the query originator to support protocol
+	// version 6.
+	QueryChunkedSizeLimit int
+
 	// MemberlistConfig is the memberlist configuration that Serf will
 	// use to do the underlying membership management and gossip. Some
 	// fields in the MemberlistConfig will be overwritten by Serf no
@@ -251,6 +267,62 @@ type Config struct {
 	// It's optimal to be relatively small, since it's going to be gossiped through the cluster.
 	UserEventSizeLimit int
 
+	// LargeUserEventSizeLimit allows user events over UserEventSizeLimit,
+	// up to this size, which is disabled when zero. Only a hash of the
+	// payload of such events is gossiped, and nodes fetch the payload from
+	// the sender, or other nodes that have it, before delivering the event.
+	// This requires protocol version 6 on all the alive members.
+	LargeUserEventSizeLimit int
+
+	// DirectMessageSizeLimit is the maximum byte size of the payload of a
+	// direct message sent with SendToMember. This applies to both inbound
+	// and outbound messages.
+	DirectMessageSizeLimit int
+
+	// KVSizeLimit is the maximum byte size of a key and its value in the
+	// replicated key/value store, which are gossiped like user events.
+	// KVMaxKeys is the maximum number of keys in the store, including the
+	// deleted keys that are still remembered. Writes to new keys are
+	// rejected once it is full. The whole store is sent during push/pull,
+	// so KVMaxKeys times KVSizeLimit must be at most 4MB.
+	// KVTombstoneTimeout is how long deleted keys are remembered, so that
+	// older writes that arrive later don't bring them back.
+	KVSizeLimit        int
+	KVMaxKeys          int
+	KVTombstoneTimeout time.Duration
+
+	// UserEventRateLimit limits how often user events with the same name
+	// are sent and accepted by this node, and UserEventRateLimits overrides
+	// it for specific event names. UserEventNodeRateLimit limits how often
+	// user events originating from the same node are accepted, including
+	// those sent by this node. It applies to the signer of signed events,
+	// and events without an origin, sent by older versions of Serf, share
+	// a single limit. Events over a limit are dropped without
+	// being rebroadcast, and UserEvent returns UserEventThrottled.
+	UserEventRateLimit     RateLimit
+	UserEventRateLimits    map[string]RateLimit
+	UserEventNodeRateLimit RateLimit
+
+	// UserEventGapTimeout is how long to wait for the user events a node
+	// skipped, as they may be gossiped out of order, before they are
+	// reported as missed with a UserEventGap.
+	UserEventGapTimeout time.Duration
+
+	// SigningKey is used to sign the user events and queries sent by this
+	// node with Ed25519, if set. Nodes trusting the matching public key
+	// can then verify that they were sent by this node.
+	SigningKey ed25519.PrivateKey
+
+	// TrustedKeys are the public keys of the nodes whose signatures on
+	// user events and queries are verified, by node name. Messages with a
+	// signature that doesn't verify are dropped, while unsigned messages
+	// and those signed by other nodes are delivered without a signer.
+	TrustedKeys map[string]ed25519.PublicKey
+
+	// RequireSignatures drops the user events and queries that are not
+	// signed by a trusted key, including internal queries.
+	RequireSignatures bool
+
 	// messageDropper is a callback used for selectively ignoring inbound
 	// gossip messages. This should only be used in unit tests needing careful
 	// control over sequencing of gossip arrival
@@ -318,9 +390,15 @@ func DefaultConfig() *Config {
 		QueryTimeoutMult:             16,
 		QueryResponseSizeLimit:       1024,
 		QuerySizeLimit:               1024,
+		QueryChunkedSizeLimit:        1024 * 1024,
 		EnableNameConflictResolution: true,
 		DisableCoordinates:           false,
 		ValidateNodeNames:            false,
 		UserEventSizeLimit:           512,
+		DirectMessageSizeLimit:       1024 * 1024,
+		KVSizeLimit:                  512,
+		KVMaxKeys:                    1024,
+		KVTombstoneTimeout:           24 * time.Hour,
+		UserEventGapTimeout:          time.Minute,
 	}
 }
@@ -20,8 +20,8 @@ type delegate struct {
 var _ memberlist.Delegate = &delegate{}
 
 func (d *delegate) NodeMeta(limit int) []byte {
-	roleBytes := d.serf.encodeTags(d.serf.config.Tags)
-	if len(roleBytes) > limit {
+	roleBytes, err := d.serf.encodeMetaTags(d.serf.config.Tags)
+	if err != nil || len(roleBytes) > limit {
 		panic(fmt.Errorf("Node tags '%v' exceeds length limit of %d bytes", d.serf.config.Tags, limit))
 	}
 
@@ -86,6 +86,17 @@ func (d *delegate) NotifyMsg(buf []byte) {
 		rebroadcast = d.serf.handleQuery(&query)
 		rebroadcastQueue = d.serf.queryBroadcasts
 
+	case messageKVType:
+		var kv messageKV
+		if err := decodeMessage(buf[1:], &kv); err != nil {
+			d.serf.logger.Printf("[ERR] serf: Error decoding key/value message: %s", err)
+			break
+		}
+
+		d.serf.logger.Printf("[DEBUG] serf: messageKVType: %s", kv.Key)
+		rebroadcast = d.serf.handleKV(&kv)
+		rebroadcastQueue = d.serf.kvBroadcasts
+
 	case messageQueryResponseType:
 		var resp messageQueryResponse
 		if err := decodeMessage(buf[1:], &resp); err != nil {
@@ -96,6 +107,56 @@ func (d *delegate) NotifyMsg(buf []byte) {
 		d.serf.logger.Printf("[DEBUG] serf: messageQueryResponseType: %v", resp.From)
 		d.serf.handleQueryResponse(&resp)
 
+	case messageDirectType:
+		var msg messageDirect
+		if err := decodeMessage(buf[1:], &msg); err != nil {
+			d.serf.logger.Printf("[ERR] serf: Error decoding direct message: %s", err)
+			break
+		}
+
+		d.serf.logger.Printf("[DEBUG] serf: messageDirectType: %s", msg.From)
+		d.serf.handleDirectMessage(&msg)
+
+	case messagePayloadRequestType:
+		var req messagePayloadRequest
+		if err := decodeMessage(buf[1:], &req); err != nil {
+			d.serf.logger.Printf("[ERR] serf: Error decoding payload request: %s", err)
+			break
+		}
+
+		d.serf.logger.Printf("[DEBUG] serf: messagePayloadRequestType: %s", req.From)
+		d.serf.handlePayloadRequest(&req)
+
+	case messagePayloadResponseType:
+		var resp messagePayloadResponse
+		if err := decodeMessage(buf[1:], &resp); err != nil {
+			d.serf.logger.Printf("[ERR] serf: Error decoding payload response: %s", err)
+			break
+		}
+
+		d.serf.logger.Printf("[DEBUG] serf: messagePayloadResponseType")
+		d.serf.handlePayloadResponse(&resp)
+
+	case messageTagsRequestType:
+		var req messageTagsRequest
+		if err := decodeMessage(buf[1:], &req); err != nil {
+			d.serf.logger.Printf("[ERR] serf: Error decoding tags request: %s", err)
+			break
+		}
+
+		d.serf.logger.Printf("[DEBUG] serf: messageTagsRequestType: %s", req.From)
+		d.serf.handleTagsRequest(&req)
+
+	case messageTagsType:
+		var msg messageTags
+		if err := decodeMessage(buf[1:], &msg); err != nil {
+			d.serf.logger.Printf("[ERR] serf: Error decoding tags: %s", err)
+			break
+		}
+
+		d.serf.logger.Printf("[DEBUG] serf: messageTagsType: %s", msg.Node)
+		d.serf.handleTags(&msg)
+
 	case messageRelayType:
 		var header relayHeader
 		var handle codec.MsgpackHandle
@@ -170,6 +231,17 @@ func (d *delegate) GetBroadcasts(overhead, limit int) [][]byte {
 		msgs = append(msgs, eventMsgs...)
 	}
 
+	// Get any additional key/value broadcasts
+	kvMsgs := d.serf.kvBroadcasts.GetBroadcasts(overhead, limit-bytesUsed)
+	if kvMsgs != nil {
+		for _, m := range kvMsgs {
+			lm := len(m)
+			bytesUsed += lm + overhead
+			metrics.AddSampleWithLabels([]string{"serf", "msgs", "sent"}, float32(lm), d.serf.metricLabels)
+		}
+		msgs = append(msgs, kvMsgs...)
+	}
+
 	return msgs
 }
 
@@ -187,6 +259,9 @@ func (d *delegate) LocalState(join bool) []byte {
 		EventLTime:   d.serf.eventClock.Time(),
 		Events:       d.serf.eventBuffer,
 		QueryLTime:   d.serf.queryClock.Time(),
+		KVLTime:      d.serf.kvClock.Time(),
+		KV:           d.serf.kvEntries(),
+		Tags:         d.serf.extendedTagsState(),
 	}
 
 	// Add all the join LTimes
@@ -243,6 +318,9 @@ func (d *delegate) MergeRemoteState(buf []byte, isJoin bool) {
 	if pp.QueryLTime > 0 {
 		d.serf.queryClock.Witness(pp.QueryLTime - 1)
 	}
+	if pp.KVLTime > 0 {
+		d.serf.kvClock.Witness(pp.KVLTime - 1)
+	}
 
 	// Process the left nodes first to avoid the LTimes from incrementing
 	// in the wrong order. Note that we don't have the actual Lamport time
@@ -294,7 +372,33 @@ func (d *delegate) MergeRemoteState(buf []byte, isJoin bool) {
 		for _, e := range events.Events {
 			userEvent.Name = e.Name
 			userEvent.Payload = e.Payload
+			userEvent.Hash = e.Hash
+			userEvent.Origin = e.Origin
+			userEvent.Seq = e.Seq
+			userEvent.Signer = e.Signer
+			userEvent.Signature = e.Signature
 			d.serf.handleUserEvent(&userEvent)
 		}
 	}
+
+	// Merge the key/value store, keeping the last writes. Only as many keys
+	// as fit in the store are looked at.
+	kvs := pp.KV
+	if len(kvs) > d.serf.config.KVMaxKeys {
+		d.serf.logger.Printf("[WARN] serf: Ignoring %d keys over the limit of %d in push/pull",
+			len(kvs)-d.serf.config.KVMaxKeys, d.serf.config.KVMaxKeys)
+		kvs = kvs[:d.serf.config.KVMaxKeys]
+	}
+	for _, kv := range kvs {
+		if kv != nil {
+			d.serf.handleKV(kv)
+		}
+	}
+
+	// Take the tags of the nodes too large for their meta
+	for _, tags := range pp.Tags {
+		if tags != nil {
+			d.serf.handleTags(tags)
+		}
+	}
 }
@@ -24,6 +24,9 @@ const (
 	EventMemberReap
 	EventUser
 	EventQuery
+	EventDirectMessage
+	EventUserGap
+	EventKV
 )
 
 func (t EventType) String() string {
@@ -42,6 +45,12 @@ func (t EventType) String() string {
 		return "user"
 	case EventQuery:
 		return "query"
+	case EventDirectMessage:
+		return "direct-message"
+	case EventUserGap:
+		return "user-gap"
+	case EventKV:
+		return "kv"
 	default:
 		panic(fmt.Sprintf("unknown event type: %d", t))
 	}
@@ -90,6 +99,20 @@ type UserEvent struct {
 	Name     string
 	Payload  []byte
 	Coalesce bool
+
+	// Origin is the node that sent the event, and Seq its sequence number
+	// among the events sent by that node since it started, which can be
+	// used to order them. They are empty for events from older nodes.
+	Origin string
+	Seq    uint64
+
+	// Signer is the name of the node whose trusted key signed the event,
+	// or empty if the event isn't signed by a trusted key
+	Signer string
+
+	// Replay is set for events fetched from other nodes by
+	// ReplayEventsSince, which arrive after newer events were delivered
+	Replay bool
 }
 
 func (u UserEvent) EventType() EventType {
@@ -100,6 +123,62 @@ func (u UserEvent) String() string {
 	return fmt.Sprintf("user-event: %s", u.Name)
 }
 
+// DirectMessageEvent is the struct used for payloads sent to this node
+// by another member with SendToMember
+type DirectMessageEvent struct {
+	From    string
+	Payload []byte
+}
+
+func (d DirectMessageEvent) EventType() EventType {
+	return EventDirectMessage
+}
+
+func (d DirectMessageEvent) String() string {
+	return fmt.Sprintf("direct-message: %s", d.From)
+}
+
+// UserEventGap is sent when user events from a node were missed, such as
+// after a partition that lasted longer than the EventBuffer. Consumers that
+// rely on every event from the node should resync with it.
+type UserEventGap struct {
+	Origin string
+
+	// FirstSeq and LastSeq are the first and last sequence numbers of the
+	// events missed, and Missed the number of events missed between them
+	FirstSeq uint64
+	LastSeq  uint64
+	Missed   int
+}
+
+func (g UserEventGap) EventType() EventType {
+	return EventUserGap
+}
+
+func (g UserEventGap) String() string {
+	return fmt.Sprintf("user-gap: %s %d-%d", g.Origin, g.FirstSeq, g.LastSeq)
+}
+
+// KVEvent is sent when a key of the replicated key/value store is set or
+// deleted, by this node or another one
+type KVEvent struct {
+	Key     string
+	Value   []byte
+	Deleted bool
+
+	// LTime is the time of the write, and Node the node that made it
+	LTime LamportTime
+	Node  string
+}
+
+func (e KVEvent) EventType() EventType {
+	return EventKV
+}
+
+func (e KVEvent) String() string {
+	return fmt.Sprintf("kv: %s", e.Key)
+}
+
 // Query is the struct used by EventQuery type events
 type Query struct {
 	LTime   LamportTime
@@ -113,6 +192,9 @@ type Query struct {
 	sourceNode  string    // Node name to respond to
 	deadline    time.Time // Must respond by this deadline
 	relayFactor uint8     // Number of duplicate responses to relay back to sender
+	multi       bool      // Multiple responses may be sent
+	respSeq     uint32    // Sequence number of the next response
+	signer      string    // Node whose trusted key signed the query
 	respLock    sync.Mutex
 }
 
@@ -134,6 +216,19 @@ func (q *Query) Deadline() time.Time {
 	return q.deadline
 }
 
+// Signer returns the name of the node whose trusted key signed the query,
+// or an empty string if the query isn't signed by a trusted key
+func (q *Query) Signer() string {
+	return q.signer
+}
+
+// MultiResponse returns if the originator accepts multiple responses to
+// the query, sent with RespondPartial before the last one is sent with
+// Respond
+func (q *Query) MultiResponse() bool {
+	return q.multi
+}
+
 func (q *Query) createResponse(buf []byte) messageQueryResponse {
 	// Create response
 	return messageQueryResponse{
@@ -193,8 +288,77 @@ func (q *Query) respondWithMessageAndResponse(raw []byte, resp messageQueryRespo
 	return nil
 }
 
-// Respond is used to send a response to the user query
+// respondReliable sends a response directly to the originator over TCP.
+// Responses larger than a single message are split into fragments that
+// are reassembled into a single response by the originator. Responses
+// sent this way are not relayed.
+func (q *Query) respondReliable(buf []byte, final bool) error {
+	if len(buf) > q.serf.config.QueryChunkedSizeLimit {
+		return fmt.Errorf("response exceeds limit of %d bytes", q.serf.config.QueryChunkedSizeLimit)
+	}
+
+	q.respLock.Lock()
+	defer q.respLock.Unlock()
+
+	// Check if we've already responded
+	if q.deadline.IsZero() {
+		return fmt.Errorf("response already sent")
+	}
+
+	node := &memberlist.Node{Name: q.sourceNode, Addr: q.addr, Port: q.port}
+	chunks := max((len(buf)+queryResponseChunkSize-1)/queryResponseChunkSize, 1)
+	for i := 0; i < chunks; i++ {
+		// Ensure we aren't past our response deadline
+		if time.Now().After(q.deadline) {
+			return fmt.Errorf("response is past the deadline")
+		}
+
+		start := i * queryResponseChunkSize
+		resp := q.createResponse(buf[start:min(start+queryResponseChunkSize, len(buf))])
+		if chunks > 1 {
+			resp.Chunk = uint32(i)
+			resp.Chunks = uint32(chunks)
+		}
+		if q.multi {
+			resp.Seq = q.respSeq
+			if final {
+				resp.Flags |= queryFlagDone
+			}
+		}
+
+		raw, err := encodeMessage(messageQueryResponseType, resp, q.serf.msgpackUseNewTimeFormat)
+		if err != nil {
+			return fmt.Errorf("failed to format response: %v", err)
+		}
+		if err := q.serf.memberlist.SendReliable(node, raw); err != nil {
+			return err
+		}
+	}
+
+	// Clear the deadline once the last response is sent
+	if final {
+		q.deadline = time.Time{}
+	} else {
+		q.respSeq++
+	}
+
+	return nil
+}
+
+// Respond is used to send a response to the user query. Responses that
+// exceed QueryResponseSizeLimit are sent in chunks over TCP if the query
+// originator supports it. For multi-response queries, this sends the last
+// response.
 func (q *Query) Respond(buf []byte) error {
+	// Responses to multi-response queries are all sent over TCP, so they
+	// are not lost or held up behind a lost response
+	if q.multi {
+		if err := q.respondReliable(buf, true); err != nil {
+			return fmt.Errorf("failed to respond to query: %v", err)
+		}
+		return nil
+	}
+
 	// Create response
 	resp := q.createResponse(buf)
 
@@ -204,9 +368,30 @@ func (q *Query) Respond(buf []byte) error {
 		return fmt.Errorf("failed to format response: %v", err)
 	}
 
+	// Fall back to a chunked response if this is too large
+	if len(raw) > q.serf.config.QueryResponseSizeLimit && q.serf.supportsChunkedResponses(q.sourceNode) {
+		if err := q.respondReliable(buf, true); err != nil {
+			return fmt.Errorf("failed to respond to key query: %v", err)
+		}
+		return nil
+	}
+
 	if err := q.respondWithMessageAndResponse(raw, resp); err != nil {
 		return fmt.Errorf("failed to respond to key query: %v", err)
 	}
 
 	return nil
 }
+
+// RespondPartial is used to send a response to a multi-response query,
+// which may be followed by more responses. The last response must be sent
+// with Respond.
+func (q *Query) RespondPartial(buf []byte) error {
+	if !q.multi {
+		return fmt.Errorf("query does not accept multiple responses")
+	}
+	if err := q.respondReliable(buf, false); err != nil {
+		return fmt.Errorf("failed to respond to query: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,289 @@
+// Copyright IBM Corp. 2013, 2026
+// SPDX-License-Identifier: MPL-2.0
+
+package serf
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"math/rand"
+	"slices"
+	"time"
+
+	metrics "github.com/hashicorp/go-metrics/compat"
+	"github.com/hashicorp/memberlist"
+)
+
+const (
+	// largeUserEventProtocol is the protocol version required to send
+	// user events whose payload is fetched on demand
+	largeUserEventProtocol = 6
+
+	// eventPayloadFetchAttempts is the number of nodes a payload is
+	// requested from before the event is dropped, starting with the origin
+	eventPayloadFetchAttempts = 3
+
+	// eventPayloadFetchTimeout is how long to wait for a node to send a
+	// payload before asking the next one
+	eventPayloadFetchTimeout = 5 * time.Second
+
+	// eventPayloadFetchWorkers is the number of payloads fetched at once,
+	// and eventPayloadFetchQueue the number of events that may wait for
+	// a worker before they are dropped
+	eventPayloadFetchWorkers = 8
+	eventPayloadFetchQueue   = 256
+)
+
+// eventPayload is the payload of a large user event, kept so it can be
+// sent to the nodes that fetch it
+type eventPayload struct {
+	LTime   LamportTime
+	Payload []byte
+}
+
+// eventPayloadFetch is a large user event waiting for its payload to be
+// fetched
+type eventPayloadFetch struct {
+	eventMsg messageUserEvent
+	signer   string
+}
+
+// hashEventPayload returns the hash gossiped in place of a large payload
+func hashEventPayload(payload []byte) []byte {
+	sum := sha256.Sum256(payload)
+	return sum[:]
+}
+
+// storeEventPayload keeps a verified payload for as long as its event is
+// in the event buffer, removing the payloads of older events
+func (s *Serf) storeEventPayload(ltime LamportTime, hash, payload []byte) {
+	s.eventPayloadLock.Lock()
+	defer s.eventPayloadLock.Unlock()
+
+	curTime := s.eventClock.Time()
+	window := LamportTime(len(s.eventBuffer))
+	for key, p := range s.eventPayloads {
+		if curTime > window && p.LTime < curTime-window {
+			delete(s.eventPayloads, key)
+		}
+	}
+	s.eventPayloads[string(hash)] = &eventPayload{LTime: ltime, Payload: payload}
+}
+
+// getEventPayload returns a stored payload by its hash
+func (s *Serf) getEventPayload(hash []byte) ([]byte, bool) {
+	s.eventPayloadLock.Lock()
+	defer s.eventPayloadLock.Unlock()
+	p, ok := s.eventPayloads[string(hash)]
+	if !ok {
+		return nil, false
+	}
+	return p.Payload, true
+}
+
+// deliverUserEvent sends a user event to the event channel
+func (s *Serf) deliverUserEvent(eventMsg *messageUserEvent, signer string, payload []byte) {
+	if s.config.EventCh != nil {
+		s.config.EventCh <- UserEvent{
+			LTime:    eventMsg.LTime,
+			Name:     eventMsg.Name,
+			Payload:  payload,
+			Coalesce: eventMsg.CC,
+			Origin:   eventMsg.Origin,
+			Seq:      eventMsg.Seq,
+			Signer:   signer,
+			Replay:   eventMsg.replay,
+		}
+	}
+}
+
+// largeUserEventsSupported returns if all the alive members can fetch the
+// payload of a large user event. Older nodes would deliver the event with
+// an empty payload.
+func (s *Serf) largeUserEventsSupported() bool {
+	s.memberLock.RLock()
+	defer s.memberLock.RUnlock()
+	for _, m := range s.members {
+		if m.Status == StatusAlive && m.DelegateMax < largeUserEventProtocol {
+			return false
+		}
+	}
+	return true
+}
+
+// queueEventPayloadFetch queues a large user event until a worker fetches
+// its payload. The event is dropped if too many are waiting.
+func (s *Serf) queueEventPayloadFetch(eventMsg messageUserEvent, signer string) {
+	select {
+	case s.eventPayloadFetchCh <- &eventPayloadFetch{eventMsg: eventMsg, signer: signer}:
+	default:
+		s.logger.Printf("[ERR] serf: Dropping event %s, too many payloads waiting to be fetched",
+			eventMsg.Name)
+		s.emitDroppedEvent(&eventMsg)
+	}
+}
+
+// fetchEventPayloads is a long running routine that fetches the payloads
+// of the queued large user events
+func (s *Serf) fetchEventPayloads() {
+	for {
+		select {
+		case f := <-s.eventPayloadFetchCh:
+			s.fetchEventPayload(f.eventMsg, f.signer)
+		case <-s.shutdownCh:
+			return
+		}
+	}
+}
+
+// emitDroppedEvent sends a gap for a large user event that was dropped
+// without its payload, so it can be replayed
+func (s *Serf) emitDroppedEvent(eventMsg *messageUserEvent) {
+	if eventMsg.Seq != 0 {
+		s.emitEventGap(UserEventGap{
+			Origin:   eventMsg.Origin,
+			FirstSeq: eventMsg.Seq,
+			LastSeq:  eventMsg.Seq,
+			Missed:   1,
+		})
+	}
+}
+
+// fetchEventPayload retrieves the payload of a large user event, first from
+// its origin and then from other nodes that may have fetched it, and
+// delivers the event once the payload is verified
+func (s *Serf) fetchEventPayload(eventMsg messageUserEvent, signer string) {
+	key := string(eventMsg.Hash)
+	ch := make(chan []byte, 1)
+
+	s.eventPayloadLock.Lock()
+	s.eventPayloadWaits[key] = append(s.eventPayloadWaits[key], ch)
+	s.eventPayloadLock.Unlock()
+
+	defer func() {
+		s.eventPayloadLock.Lock()
+		defer s.eventPayloadLock.Unlock()
+		waits := slices.DeleteFunc(s.eventPayloadWaits[key], func(c chan []byte) bool {
+			return c == ch
+		})
+		if len(waits) == 0 {
+			delete(s.eventPayloadWaits, key)
+		} else {
+			s.eventPayloadWaits[key] = waits
+		}
+	}()
+
+	req := messagePayloadRequest{
+		Hash: eventMsg.Hash,
+		From: s.config.NodeName,
+	}
+	raw, err := encodeMessage(messagePayloadRequestType, &req, s.msgpackUseNewTimeFormat)
+	if err != nil {
+		s.logger.Printf("[ERR] serf: Failed to encode payload request: %v", err)
+		return
+	}
+
+	for _, node := range s.eventPayloadSources(eventMsg.Origin) {
+		if err := s.memberlist.SendReliable(node, raw); err != nil {
+			s.logger.Printf("[WARN] serf: Failed to request payload of event %s from %s: %v",
+				eventMsg.Name, node.Name, err)
+			continue
+		}
+
+		select {
+		case payload := <-ch:
+			metrics.IncrCounterWithLabels([]string{"serf", "events", "fetched"}, 1, s.metricLabels)
+			s.storeEventPayload(eventMsg.LTime, eventMsg.Hash, payload)
+			s.deliverUserEvent(&eventMsg, signer, payload)
+			return
+		case <-time.After(eventPayloadFetchTimeout):
+		case <-s.shutdownCh:
+			return
+		}
+	}
+	s.logger.Printf("[ERR] serf: Dropping event %s, failed to fetch its payload", eventMsg.Name)
+	s.emitDroppedEvent(&eventMsg)
+}
+
+// eventPayloadSources returns the nodes to request a payload from, which is
+// the origin followed by random other nodes
+func (s *Serf) eventPayloadSources(origin string) []*memberlist.Node {
+	s.memberLock.RLock()
+	defer s.memberLock.RUnlock()
+
+	var first, others []*memberlist.Node
+	for _, m := range s.members {
+		if m.Name == s.config.NodeName || m.Status != StatusAlive ||
+			m.DelegateMax < largeUserEventProtocol {
+			continue
+		}
+		node := &memberlist.Node{Name: m.Name, Addr: m.Addr, Port: m.Port}
+		if m.Name == origin {
+			first = append(first, node)
+		} else {
+			others = append(others, node)
+		}
+	}
+	rand.Shuffle(len(others), func(i, j int) {
+		others[i], others[j] = others[j], others[i]
+	})
+
+	nodes := append(first, others...)
+	if len(nodes) > eventPayloadFetchAttempts {
+		nodes = nodes[:eventPayloadFetchAttempts]
+	}
+	return nodes
+}
+
+// handlePayloadRequest sends a stored payload to the node requesting it.
+// Requests for payloads we don't have are ignored, and the node will ask
+// another one.
+func (s *Serf) handlePayloadRequest(req *messagePayloadRequest) {
+	payload, ok := s.getEventPayload(req.Hash)
+	if !ok {
+		return
+	}
+
+	s.memberLock.RLock()
+	m, ok := s.members[req.From]
+	var node *memberlist.Node
+	if ok {
+		node = &memberlist.Node{Name: m.Name, Addr: m.Addr, Port: m.Port}
+	}
+	s.memberLock.RUnlock()
+	if !ok {
+		s.logger.Printf("[WARN] serf: Payload requested by unknown node %s", req.From)
+		return
+	}
+
+	resp := messagePayloadResponse{
+		Hash:    req.Hash,
+		Payload: payload,
+	}
+	raw, err := encodeMessage(messagePayloadResponseType, &resp, s.msgpackUseNewTimeFormat)
+	if err != nil {
+		s.logger.Printf("[ERR] serf: Failed to encode payload response: %v", err)
+		return
+	}
+	if err := s.memberlist.SendReliable(node, raw); err != nil {
+		s.logger.Printf("[ERR] serf: Failed to send payload to %s: %v", req.From, err)
+	}
+}
+
+// handlePayloadResponse passes a payload that was fetched for a large user
+// event to the pending fetches, once it matches the gossiped hash
+func (s *Serf) handlePayloadResponse(resp *messagePayloadResponse) {
+	if !bytes.Equal(hashEventPayload(resp.Payload), resp.Hash) {
+		s.logger.Printf("[WARN] serf: Discarding event payload not matching its hash")
+		return
+	}
+
+	s.eventPayloadLock.Lock()
+	defer s.eventPayloadLock.Unlock()
+	for _, ch := range s.eventPayloadWaits[string(resp.Hash)] {
+		select {
+		case ch <- resp.Payload:
+		default:
+		}
+	}
+}
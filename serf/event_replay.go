@@ -0,0 +1,124 @@
+// Copyright IBM Corp. 2013, 2026
+// SPDX-License-Identifier: MPL-2.0
+
+package serf
+
+import (
+	"slices"
+	"sort"
+
+	metrics "github.com/hashicorp/go-metrics/compat"
+)
+
+const (
+	// replayEventsProtocol is the protocol version required to replay
+	// user events from other nodes
+	replayEventsProtocol = 6
+
+	// replayEventsNodes is the number of nodes the events to replay are
+	// requested from
+	replayEventsNodes = 3
+)
+
+// ReplayEventsSince fetches the user events since the given time from the
+// event buffers of a few other nodes, and delivers the ones we haven't seen
+// with the Replay flag set. It can be used to catch up on the events missed
+// while partitioned, or after a UserEventGap. Events are not rebroadcast.
+//
+// Only the events still in the event buffers can be replayed, and events
+// from before the time a snapshot was restored or a join ignored them are
+// still dropped. The number of events delivered is returned.
+func (s *Serf) ReplayEventsSince(ltime LamportTime) (int, error) {
+	if s.ProtocolVersion() < replayEventsProtocol {
+		return 0, FeatureNotSupported
+	}
+
+	nodes := kRandomMembers(replayEventsNodes, s.Members(), func(m Member) bool {
+		return m.Name == s.config.NodeName || m.Status != StatusAlive ||
+			m.DelegateMax < replayEventsProtocol
+	})
+	if len(nodes) == 0 {
+		return 0, nil
+	}
+
+	req, err := encodeMessage(messageReplayRequestType, &messageReplayRequest{LTime: ltime},
+		s.msgpackUseNewTimeFormat)
+	if err != nil {
+		return 0, err
+	}
+	params := s.DefaultQueryParams()
+	for _, m := range nodes {
+		params.FilterNodes = append(params.FilterNodes, m.Name)
+	}
+	resp, err := s.Query(internalQueryName(replayEventsQuery), req, params)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Close()
+
+	// Gather the events of all the nodes before delivering them in order,
+	// the events already seen from another node are then dropped
+	var events []*userEvents
+	responses := 0
+	for r := range resp.ResponseCh() {
+		var replay messageReplayResponse
+		if len(r.Payload) == 0 || messageType(r.Payload[0]) != messageReplayResponseType {
+			s.logger.Printf("[ERR] serf: Invalid replay response from %s", r.From)
+		} else if err := decodeMessage(r.Payload[1:], &replay); err != nil {
+			s.logger.Printf("[ERR] serf: Failed to decode replay response from %s: %v", r.From, err)
+		} else {
+			events = append(events, replay.Events...)
+		}
+
+		if responses++; responses == len(nodes) {
+			break
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].LTime < events[j].LTime
+	})
+
+	replayed := 0
+	for _, e := range events {
+		for _, ue := range e.Events {
+			msg := messageUserEvent{
+				LTime:     e.LTime,
+				Name:      ue.Name,
+				Payload:   ue.Payload,
+				Hash:      ue.Hash,
+				Origin:    ue.Origin,
+				Seq:       ue.Seq,
+				Signer:    ue.Signer,
+				Signature: ue.Signature,
+				replay:    true,
+			}
+			if s.handleUserEvent(&msg) {
+				replayed++
+			}
+		}
+	}
+	metrics.IncrCounterWithLabels([]string{"serf", "events", "replayed"}, float32(replayed), s.metricLabels)
+	return replayed, nil
+}
+
+// bufferedEventsSince returns a copy of the user events in the event buffer
+// since the given time, ordered by time
+func (s *Serf) bufferedEventsSince(ltime LamportTime) []*userEvents {
+	s.eventLock.RLock()
+	defer s.eventLock.RUnlock()
+
+	var events []*userEvents
+	for _, e := range s.eventBuffer {
+		if e == nil || e.LTime < ltime || len(e.Events) == 0 {
+			continue
+		}
+		events = append(events, &userEvents{
+			LTime:  e.LTime,
+			Events: slices.Clone(e.Events),
+		})
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].LTime < events[j].LTime
+	})
+	return events
+}
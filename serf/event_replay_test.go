@@ -0,0 +1,121 @@
+// Copyright IBM Corp. 2013, 2026
+// SPDX-License-Identifier: MPL-2.0
+
+package serf
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/serf/testutil"
+	"github.com/hashicorp/serf/testutil/retry"
+)
+
+func TestSerf_ReplayEventsSince(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	ip2, returnFn2 := testutil.TakeIP()
+	defer returnFn2()
+
+	eventCh := make(chan Event, 64)
+	s1Config := testConfig(t, ip1)
+	s2Config := testConfig(t, ip2)
+	s2Config.EventCh = eventCh
+	s1Config.ProtocolVersion = replayEventsProtocol
+	s2Config.ProtocolVersion = replayEventsProtocol
+
+	// Replayed events don't count against the rate limits
+	s2Config.UserEventNodeRateLimit = RateLimit{Rate: 0.001, Burst: 1}
+
+	// The second node misses the events gossiped, and those sent during a
+	// push/pull
+	s2Config.messageDropper = func(typ messageType) bool {
+		return typ == messageUserEventType || typ == messagePushPullType
+	}
+
+	s1, err := Create(s1Config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s1.Shutdown()
+
+	s2, err := Create(s2Config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s2.Shutdown()
+
+	if _, err := s1.Join([]string{s2Config.NodeName + "/" + s2Config.MemberlistConfig.BindAddr}, false); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	waitUntilNumNodes(t, 2, s1, s2)
+
+	for i := 0; i < 3; i++ {
+		if err := s1.UserEvent("deploy", []byte{byte(i)}, false); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// The query can time out on a loaded machine, in which case nothing is
+	// delivered and it can be tried again
+	retry.Run(t, func(r *retry.R) {
+		n, err := s2.ReplayEventsSince(0)
+		if err != nil {
+			r.Fatalf("err: %v", err)
+		}
+		if n != 3 {
+			r.Fatalf("bad: %d", n)
+		}
+	})
+
+	// The events are delivered in order, flagged as replayed
+	var payloads [][]byte
+	for len(payloads) < 3 {
+		select {
+		case e := <-eventCh:
+			u, ok := e.(UserEvent)
+			if !ok {
+				continue
+			}
+			if !u.Replay || u.Origin != s1Config.NodeName {
+				t.Fatalf("bad: %#v", u)
+			}
+			payloads = append(payloads, u.Payload)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout: %v", payloads)
+		}
+	}
+	expected := [][]byte{{0}, {1}, {2}}
+	if !reflect.DeepEqual(payloads, expected) {
+		t.Fatalf("bad: %v", payloads)
+	}
+
+	// Events already seen are not replayed again
+	n, err := s2.ReplayEventsSince(0)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if n != 0 {
+		t.Fatalf("bad: %d", n)
+	}
+}
+
+func TestSerf_bufferedEventsSince(t *testing.T) {
+	s := &Serf{eventBuffer: make([]*userEvents, 4)}
+	s.eventBuffer[1] = &userEvents{LTime: 5, Events: []userEvent{{Name: "b"}}}
+	s.eventBuffer[2] = &userEvents{LTime: 2, Events: []userEvent{{Name: "old"}}}
+	s.eventBuffer[3] = &userEvents{LTime: 3, Events: []userEvent{{Name: "a"}}}
+
+	events := s.bufferedEventsSince(3)
+	if len(events) != 2 || events[0].LTime != 3 || events[1].LTime != 5 {
+		t.Fatalf("bad: %#v", events)
+	}
+
+	// The events returned are a copy
+	events[0].Events[0].Name = "changed"
+	if s.eventBuffer[3].Events[0].Name != "a" {
+		t.Fatalf("bad: %#v", s.eventBuffer[3])
+	}
+}
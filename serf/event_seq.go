@@ -0,0 +1,121 @@
+// Copyright IBM Corp. 2013, 2026
+// SPDX-License-Identifier: MPL-2.0
+
+package serf
+
+import (
+	"time"
+
+	metrics "github.com/hashicorp/go-metrics/compat"
+)
+
+// originSeqs tracks the sequence numbers of the user events received from a
+// node. Events are gossiped out of order, so the sequence numbers skipped
+// are kept as missing until their events arrive or the gap is reported.
+type originSeqs struct {
+	highest uint64
+	ltime   LamportTime
+	missing map[uint64]struct{}
+}
+
+func newOriginSeqs(seq uint64, ltime LamportTime) *originSeqs {
+	return &originSeqs{
+		highest: seq,
+		ltime:   ltime,
+		missing: make(map[uint64]struct{}),
+	}
+}
+
+// trackEventSeq records the sequence number of a user event received from
+// another node, reporting a gap for the sequence numbers it skips if their
+// events don't arrive within the UserEventGapTimeout.
+func (s *Serf) trackEventSeq(eventMsg *messageUserEvent) {
+	origin, seq := eventMsg.Origin, eventMsg.Seq
+	if origin == "" || seq == 0 || origin == s.config.NodeName {
+		return
+	}
+
+	var gap UserEventGap
+	s.originSeqLock.Lock()
+	o, ok := s.originSeqs[origin]
+	switch {
+	case !ok:
+		// The events before the first one seen from a node are unknown
+		s.originSeqs[origin] = newOriginSeqs(seq, eventMsg.LTime)
+
+	case seq > o.highest:
+		if first, last := o.highest+1, seq-1; first <= last {
+			// Events too far behind are already outside the event buffer of
+			// the other nodes, so they are reported without waiting
+			window := uint64(len(s.eventBuffer))
+			if last-first >= window {
+				gap = UserEventGap{
+					Origin:   origin,
+					FirstSeq: first,
+					LastSeq:  last - window,
+					Missed:   int(last - window - first + 1),
+				}
+				first = last - window + 1
+			}
+			for i := first; i <= last; i++ {
+				o.missing[i] = struct{}{}
+			}
+			time.AfterFunc(s.config.UserEventGapTimeout, func() {
+				s.reportEventGap(origin, o, first, last)
+			})
+		}
+		o.highest = seq
+		o.ltime = eventMsg.LTime
+
+	case eventMsg.LTime > o.ltime:
+		// A lower sequence number with a newer clock means the node
+		// restarted, and its sequence numbers with it
+		s.originSeqs[origin] = newOriginSeqs(seq, eventMsg.LTime)
+
+	default:
+		delete(o.missing, seq)
+	}
+	s.originSeqLock.Unlock()
+
+	if gap.Missed > 0 {
+		s.emitEventGap(gap)
+	}
+}
+
+// reportEventGap sends a gap for the sequence numbers between first and
+// last whose events are still missing
+func (s *Serf) reportEventGap(origin string, o *originSeqs, first, last uint64) {
+	if s.State() == SerfShutdown {
+		return
+	}
+
+	gap := UserEventGap{Origin: origin}
+	s.originSeqLock.Lock()
+	for seq := first; seq <= last; seq++ {
+		if _, ok := o.missing[seq]; !ok {
+			continue
+		}
+		delete(o.missing, seq)
+		if gap.Missed == 0 {
+			gap.FirstSeq = seq
+		}
+		gap.LastSeq = seq
+		gap.Missed++
+	}
+	s.originSeqLock.Unlock()
+
+	if gap.Missed > 0 {
+		s.emitEventGap(gap)
+	}
+}
+
+// emitEventGap sends a gap to the event channel
+func (s *Serf) emitEventGap(gap UserEventGap) {
+	s.logger.Printf("[WARN] serf: Missed %d events from %s between sequence numbers %d and %d",
+		gap.Missed, gap.Origin, gap.FirstSeq, gap.LastSeq)
+	metrics.IncrCounterWithLabels([]string{"serf", "events", "missed"}, float32(gap.Missed), s.metricLabels)
+
+	if s.config.EventCh != nil {
+		s.config.EventCh <- gap
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright IBM Corp. 2013, 2026
+// SPDX-License-Identifier: MPL-2.0
+
+package serf
+
+import (
+	"log"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSerf_trackEventSeq(t *testing.T) {
+	eventCh := make(chan Event, 8)
+	s := &Serf{
+		config: &Config{
+			NodeName:            "self",
+			EventCh:             eventCh,
+			UserEventGapTimeout: 50 * time.Millisecond,
+		},
+		logger:      log.New(os.Stderr, "", log.LstdFlags),
+		eventBuffer: make([]*userEvents, 4),
+		originSeqs:  make(map[string]*originSeqs),
+	}
+
+	track := func(origin string, seq uint64, ltime LamportTime) {
+		s.trackEventSeq(&messageUserEvent{Origin: origin, Seq: seq, LTime: ltime})
+	}
+	expectGap := func(expected UserEventGap) {
+		t.Helper()
+		select {
+		case e := <-eventCh:
+			if gap, ok := e.(UserEventGap); !ok || gap != expected {
+				t.Fatalf("bad: %#v", e)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timeout")
+		}
+	}
+	expectNone := func() {
+		t.Helper()
+		select {
+		case e := <-eventCh:
+			t.Fatalf("bad: %#v", e)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	// Events arriving out of order within the timeout are not missed
+	track("foo", 1, 1)
+	track("foo", 4, 10)
+	track("foo", 2, 5)
+	expectGap(UserEventGap{Origin: "foo", FirstSeq: 3, LastSeq: 3, Missed: 1})
+
+	// Events missed beyond the event buffer are reported right away
+	track("foo", 10, 20)
+	expectGap(UserEventGap{Origin: "foo", FirstSeq: 5, LastSeq: 5, Missed: 1})
+	expectGap(UserEventGap{Origin: "foo", FirstSeq: 6, LastSeq: 9, Missed: 4})
+
+	// A late event that was already reported is ignored
+	track("foo", 7, 15)
+	expectNone()
+
+	// A restart of the origin resets its sequence
+	track("foo", 1, 30)
+	track("foo", 2, 31)
+	expectNone()
+
+	// Our own events and those without a sequence are not tracked
+	track("self", 1, 40)
+	track("self", 5, 41)
+	track("bar", 0, 42)
+	expectNone()
+}
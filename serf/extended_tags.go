@@ -0,0 +1,267 @@
+// Copyright IBM Corp. 2013, 2026
+// SPDX-License-Identifier: MPL-2.0
+
+package serf
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+const (
+	// extendedTagsProtocol is the protocol version required to use tags
+	// over the meta size limit
+	extendedTagsProtocol = 6
+
+	// tagsDigestTag is the tag set in the meta of a node whose tags are
+	// too large for it, holding the digest of the full tag set
+	tagsDigestTag = "_serf_tags_digest"
+
+	// extendedTagsFetchDelay is how long to wait before fetching the tags
+	// of a node from it, as they often arrive during a push/pull first
+	extendedTagsFetchDelay = 500 * time.Millisecond
+
+	// extendedTagsFetchAttempts is the number of times the tags of a node
+	// are requested from it, after which they are left to the push/pulls
+	extendedTagsFetchAttempts = 3
+
+	// extendedTagsFetchTimeout is how long to wait for a node to send its
+	// tags before asking again
+	extendedTagsFetchTimeout = 5 * time.Second
+)
+
+// extendedTags tracks the tags of a node that are too large for its meta.
+// The want digest is the one in the meta of the node, and tags the last
+// full tag set received, which is used while its digest matches it.
+type extendedTags struct {
+	want   string
+	digest string
+	tags   map[string]string
+}
+
+// tagsDigest returns the digest of a tag set, which doesn't depend on the
+// order of the tags
+func tagsDigest(tags map[string]string) string {
+	d := newSignedData("tags")
+	for _, name := range slices.Sorted(maps.Keys(tags)) {
+		d.string(name)
+		d.string(tags[name])
+	}
+	sum := sha256.Sum256(*d)
+	return hex.EncodeToString(sum[:])
+}
+
+// encodeMetaTags encodes tags for the meta of the local node. Tags that
+// don't fit are replaced by their digest, and as many of the tags as fit
+// in sorted order, if extended tags are allowed.
+func (s *Serf) encodeMetaTags(tags map[string]string) ([]byte, error) {
+	if _, ok := tags[tagsDigestTag]; ok {
+		return nil, fmt.Errorf("Tag %q is reserved", tagsDigestTag)
+	}
+
+	buf := s.encodeTags(tags)
+	if len(buf) <= memberlist.MetaMaxSize {
+		return buf, nil
+	}
+	if s.ProtocolVersion() < extendedTagsProtocol || s.config.ExtendedTagsSizeLimit <= 0 {
+		return nil, fmt.Errorf("Encoded length of tags exceeds limit of %d bytes",
+			memberlist.MetaMaxSize)
+	}
+	if len(buf) > s.config.ExtendedTagsSizeLimit {
+		return nil, fmt.Errorf("Encoded length of tags exceeds limit of %d bytes",
+			s.config.ExtendedTagsSizeLimit)
+	}
+
+	meta := map[string]string{tagsDigestTag: tagsDigest(tags)}
+	buf = s.encodeTags(meta)
+	for _, name := range slices.Sorted(maps.Keys(tags)) {
+		meta[name] = tags[name]
+		if b := s.encodeTags(meta); len(b) <= memberlist.MetaMaxSize {
+			buf = b
+		} else {
+			delete(meta, name)
+		}
+	}
+	return buf, nil
+}
+
+// decodeMetaTags decodes the tags in the meta of a node, returning the
+// digest of its full tag set separately if they didn't all fit
+func (s *Serf) decodeMetaTags(meta []byte) (map[string]string, string) {
+	tags := s.decodeTags(meta)
+	digest := tags[tagsDigestTag]
+	delete(tags, tagsDigestTag)
+	return tags, digest
+}
+
+// memberTags returns the tags of a node from its meta. When the meta only
+// holds a digest, the full tag set is returned if it was received, and is
+// otherwise fetched from the node while the tags in the meta are returned,
+// along with false.
+func (s *Serf) memberTags(name string, meta []byte) (map[string]string, bool) {
+	tags, digest := s.decodeMetaTags(meta)
+	if digest != "" && name == s.config.NodeName {
+		return maps.Clone(s.config.Tags), true
+	}
+
+	s.extendedTagsLock.Lock()
+	defer s.extendedTagsLock.Unlock()
+
+	if digest == "" {
+		delete(s.extendedTags, name)
+		return tags, true
+	}
+
+	e, ok := s.extendedTags[name]
+	if !ok {
+		e = &extendedTags{}
+		s.extendedTags[name] = e
+	}
+	e.want = digest
+	if e.digest == digest {
+		return maps.Clone(e.tags), true
+	}
+
+	time.AfterFunc(extendedTagsFetchDelay, func() {
+		s.fetchTags(name, digest, 1)
+	})
+	return tags, false
+}
+
+// fetchTags requests the tags of a node from it, while they are missing,
+// asking again if they don't arrive in time
+func (s *Serf) fetchTags(name, digest string, attempt int) {
+	if s.State() == SerfShutdown {
+		return
+	}
+
+	s.extendedTagsLock.Lock()
+	e, ok := s.extendedTags[name]
+	pending := ok && e.want == digest && e.digest != digest
+	s.extendedTagsLock.Unlock()
+	if !pending {
+		return
+	}
+
+	s.memberLock.RLock()
+	m, ok := s.members[name]
+	var node *memberlist.Node
+	if ok && m.Status == StatusAlive {
+		node = &memberlist.Node{Name: m.Name, Addr: m.Addr, Port: m.Port}
+	}
+	s.memberLock.RUnlock()
+	if node == nil {
+		return
+	}
+
+	req := messageTagsRequest{From: s.config.NodeName}
+	raw, err := encodeMessage(messageTagsRequestType, &req, s.msgpackUseNewTimeFormat)
+	if err != nil {
+		s.logger.Printf("[ERR] serf: Failed to encode tags request: %v", err)
+		return
+	}
+	if err := s.memberlist.SendReliable(node, raw); err != nil {
+		s.logger.Printf("[WARN] serf: Failed to request tags from %s: %v", name, err)
+	}
+
+	if attempt < extendedTagsFetchAttempts {
+		time.AfterFunc(extendedTagsFetchTimeout, func() {
+			s.fetchTags(name, digest, attempt+1)
+		})
+	}
+}
+
+// handleTagsRequest sends the tags of the local node to the node
+// requesting them
+func (s *Serf) handleTagsRequest(req *messageTagsRequest) {
+	s.memberLock.RLock()
+	m, ok := s.members[req.From]
+	var node *memberlist.Node
+	if ok {
+		node = &memberlist.Node{Name: m.Name, Addr: m.Addr, Port: m.Port}
+	}
+	s.memberLock.RUnlock()
+	if !ok {
+		s.logger.Printf("[WARN] serf: Tags requested by unknown node %s", req.From)
+		return
+	}
+
+	resp := messageTags{
+		Node: s.config.NodeName,
+		Tags: s.config.Tags,
+	}
+	raw, err := encodeMessage(messageTagsType, &resp, s.msgpackUseNewTimeFormat)
+	if err != nil {
+		s.logger.Printf("[ERR] serf: Failed to encode tags: %v", err)
+		return
+	}
+	if err := s.memberlist.SendReliable(node, raw); err != nil {
+		s.logger.Printf("[ERR] serf: Failed to send tags to %s: %v", req.From, err)
+	}
+}
+
+// handleTags keeps the full tag set of a node whose meta only holds its
+// digest. Once it matches the digest in the meta, the tags of the member
+// are updated and an update event is sent.
+func (s *Serf) handleTags(msg *messageTags) {
+	if msg.Node == s.config.NodeName {
+		return
+	}
+	digest := tagsDigest(msg.Tags)
+
+	s.memberLock.Lock()
+	defer s.memberLock.Unlock()
+
+	// Tag sets are only kept for the nodes known to need them
+	s.extendedTagsLock.Lock()
+	e, ok := s.extendedTags[msg.Node]
+	if !ok || e.want != digest || e.digest == digest {
+		s.extendedTagsLock.Unlock()
+		return
+	}
+	e.digest = digest
+	e.tags = msg.Tags
+	s.extendedTagsLock.Unlock()
+
+	member, ok := s.members[msg.Node]
+	if !ok {
+		return
+	}
+	member.Tags = maps.Clone(msg.Tags)
+
+	s.logger.Printf("[INFO] serf: EventMemberUpdate: %s", member.Name)
+	if s.config.EventCh != nil {
+		s.config.EventCh <- MemberEvent{
+			Type:    EventMemberUpdate,
+			Members: []Member{member.Member},
+		}
+	}
+}
+
+// extendedTagsState returns the tag sets too large for the meta of their
+// node that match its digest, including those of the local node, to be
+// sent during a push/pull
+func (s *Serf) extendedTagsState() []*messageTags {
+	var state []*messageTags
+	if len(s.encodeTags(s.config.Tags)) > memberlist.MetaMaxSize {
+		state = append(state, &messageTags{
+			Node: s.config.NodeName,
+			Tags: s.config.Tags,
+		})
+	}
+
+	s.extendedTagsLock.Lock()
+	defer s.extendedTagsLock.Unlock()
+	for name, e := range s.extendedTags {
+		if e.digest == e.want {
+			state = append(state, &messageTags{Node: name, Tags: e.tags})
+		}
+	}
+	return state
+}
@@ -0,0 +1,183 @@
+// Copyright IBM Corp. 2013, 2026
+// SPDX-License-Identifier: MPL-2.0
+
+package serf
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/hashicorp/serf/testutil"
+	"github.com/hashicorp/serf/testutil/retry"
+)
+
+// testLargeTags returns tags too large for the memberlist meta
+func testLargeTags(version string) map[string]string {
+	tags := map[string]string{
+		"role":    "web",
+		"version": version,
+	}
+	for i := 0; i < 20; i++ {
+		tags[fmt.Sprintf("cap%02d", i)] = strings.Repeat("x", 40)
+	}
+	return tags
+}
+
+func TestSerf_encodeMetaTags(t *testing.T) {
+	s := &Serf{
+		config: &Config{ProtocolVersion: extendedTagsProtocol},
+		logger: log.New(os.Stderr, "", log.LstdFlags),
+	}
+	tags := testLargeTags("1")
+
+	// Extended tags are disabled by default
+	if _, err := s.encodeMetaTags(tags); err == nil {
+		t.Fatalf("expected error")
+	}
+	s.config.ExtendedTagsSizeLimit = 512 * 2
+	if _, err := s.encodeMetaTags(tags); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	s.config.ExtendedTagsSizeLimit = 64 * 1024
+
+	// Small tag sets are encoded as they are
+	buf, err := s.encodeMetaTags(map[string]string{"role": "web"})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if meta, digest := s.decodeMetaTags(buf); digest != "" || meta["role"] != "web" {
+		t.Fatalf("bad: %v %q", meta, digest)
+	}
+
+	// Large ones are replaced by their digest and the tags that fit
+	buf, err = s.encodeMetaTags(tags)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(buf) > memberlist.MetaMaxSize {
+		t.Fatalf("bad: %d", len(buf))
+	}
+	meta, digest := s.decodeMetaTags(buf)
+	if digest != tagsDigest(tags) {
+		t.Fatalf("bad: %q", digest)
+	}
+	if len(meta) == 0 || len(meta) == len(tags) {
+		t.Fatalf("bad: %v", meta)
+	}
+	for name, value := range meta {
+		if tags[name] != value {
+			t.Fatalf("bad: %s=%s", name, value)
+		}
+	}
+
+	// The digest tag is reserved
+	if _, err := s.encodeMetaTags(map[string]string{tagsDigestTag: "x"}); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	// Older protocols keep the meta size limit
+	s.config.ProtocolVersion = extendedTagsProtocol - 1
+	if _, err := s.encodeMetaTags(tags); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestSerf_tagsDigest(t *testing.T) {
+	a := tagsDigest(map[string]string{"a": "bc", "d": ""})
+	if b := tagsDigest(map[string]string{"d": "", "a": "bc"}); a != b {
+		t.Fatalf("bad: %s %s", a, b)
+	}
+	if b := tagsDigest(map[string]string{"ab": "c", "d": ""}); a == b {
+		t.Fatalf("should differ")
+	}
+}
+
+func TestSerf_ExtendedTags(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+	ip2, returnFn2 := testutil.TakeIP()
+	defer returnFn2()
+
+	tags := testLargeTags("1")
+
+	eventCh := make(chan Event, 16)
+	s1Config := testConfig(t, ip1)
+	s1Config.ProtocolVersion = extendedTagsProtocol
+	s1Config.EventCh = eventCh
+	s2Config := testConfig(t, ip2)
+	s2Config.ProtocolVersion = extendedTagsProtocol
+	s2Config.ExtendedTagsSizeLimit = 64 * 1024
+	s2Config.Tags = tags
+
+	s1, err := Create(s1Config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s1.Shutdown()
+
+	s2, err := Create(s2Config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s2.Shutdown()
+
+	if out := s2.LocalMember().Tags; !reflect.DeepEqual(out, tags) {
+		t.Fatalf("bad: %v", out)
+	}
+
+	// The tags are sent during the push/pull of the join
+	if _, err := s1.Join([]string{s2Config.NodeName + "/" + s2Config.MemberlistConfig.BindAddr}, false); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	waitUntilNumNodes(t, 2, s1, s2)
+
+	memberTags := func(s *Serf, name string) map[string]string {
+		for _, m := range s.Members() {
+			if m.Name == name {
+				return m.Tags
+			}
+		}
+		return nil
+	}
+	retry.Run(t, func(r *retry.R) {
+		if out := memberTags(s1, s2Config.NodeName); !reflect.DeepEqual(out, tags) {
+			r.Fatalf("bad: %v", out)
+		}
+	})
+
+	// Updated tags are fetched from the node
+	tags = testLargeTags("2")
+	if err := s2.SetTags(tags); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	retry.Run(t, func(r *retry.R) {
+		if out := memberTags(s1, s2Config.NodeName); !reflect.DeepEqual(out, tags) {
+			r.Fatalf("bad: %v", out)
+		}
+	})
+
+	// The update event carries the full tag set
+	retry.Run(t, func(r *retry.R) {
+		for {
+			select {
+			case e := <-eventCh:
+				me, ok := e.(MemberEvent)
+				if ok && me.Type == EventMemberUpdate && reflect.DeepEqual(me.Members[0].Tags, tags) {
+					return
+				}
+			default:
+				r.Fatalf("no update event")
+			}
+		}
+	})
+
+	// Nodes that don't allow extended tags still refuse them
+	if err := s1.SetTags(tags); err == nil {
+		t.Fatalf("expected error")
+	}
+}
@@ -33,6 +33,9 @@ const (
 	// listKeysQuery is used to list all known keys in the cluster
 	listKeysQuery = "list-keys"
 
+	// replayEventsQuery is used to fetch the recent user events of a node
+	replayEventsQuery = "replay-events"
+
 	// minEncodedKeyLength is used to compute the max number of keys in a list key
 	// response. eg 1024/25 = 40. a message with max size of 1024 bytes cannot
 	// contain more than 40 keys. There is a test
@@ -124,6 +127,8 @@ func (s *serfQueries) handleQuery(q *Query) {
 		s.handleRemoveKey(q)
 	case listKeysQuery:
 		s.handleListKeys(q)
+	case replayEventsQuery:
+		s.handleReplayEvents(q)
 	default:
 		s.logger.Printf("[WARN] serf: Unhandled internal query '%s'", queryName)
 	}
@@ -381,3 +386,36 @@ func (s *serfQueries) handleListKeys(q *Query) {
 SEND:
 	s.sendKeyResponse(q, &response)
 }
+
+// handleReplayEvents is invoked when a node asks for the user events in our
+// event buffer, to catch up on the events it missed. The oldest events are
+// left out if they don't fit in a response.
+func (s *serfQueries) handleReplayEvents(q *Query) {
+	if len(q.Payload) < 1 {
+		s.logger.Printf("[ERR] serf: Invalid replay request")
+		return
+	}
+	var req messageReplayRequest
+	if err := decodeMessage(q.Payload[1:], &req); err != nil {
+		s.logger.Printf("[ERR] serf: Failed to decode replay request: %v", err)
+		return
+	}
+
+	resp := messageReplayResponse{Events: s.serf.bufferedEventsSince(req.LTime)}
+	for {
+		buf, err := encodeMessage(messageReplayResponseType, &resp, s.serf.msgpackUseNewTimeFormat)
+		if err != nil {
+			s.logger.Printf("[ERR] serf: Failed to encode replay response: %v", err)
+			return
+		}
+		if len(buf) > s.serf.config.QueryChunkedSizeLimit && len(resp.Events) > 1 {
+			resp.Events = resp.Events[len(resp.Events)/2:]
+			continue
+		}
+
+		if err := q.Respond(buf); err != nil {
+			s.logger.Printf("[ERR] serf: Failed to respond to replay query: %v", err)
+		}
+		return
+	}
+}
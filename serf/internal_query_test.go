@@ -70,6 +70,13 @@ func TestSerfQueries_Ping(t *testing.T) {
 	}
 }
 
+func TestSerfQueries_ReplayEvents_invalid(t *testing.T) {
+	s := &serfQueries{logger: log.New(os.Stderr, "", log.LstdFlags)}
+
+	// An empty payload is ignored
+	s.handleReplayEvents(&Query{LTime: 42, Name: internalQueryName(replayEventsQuery)})
+}
+
 func TestSerfQueries_Conflict_SameName(t *testing.T) {
 	serf := &Serf{config: &Config{NodeName: "foo"}}
 	logger := log.New(os.Stderr, "", log.LstdFlags)
@@ -4,6 +4,7 @@
 package serf
 
 import (
+	"context"
 	"encoding/base64"
 	"fmt"
 	"sync"
@@ -100,7 +101,7 @@ func (k *KeyManager) streamKeyResp(resp *KeyResponse, ch <-chan NodeResponse) {
 // handleKeyRequest performs query broadcasting to all members for any type of
 // key operation and manages gathering responses and packing them up into a
 // KeyResponse for uniform response handling.
-func (k *KeyManager) handleKeyRequest(key, query string, opts *KeyRequestOptions) (*KeyResponse, error) {
+func (k *KeyManager) handleKeyRequest(ctx context.Context, key, query string, opts *KeyRequestOptions) (*KeyResponse, error) {
 	resp := &KeyResponse{
 		Messages:    make(map[string]string),
 		Keys:        make(map[string]int),
@@ -124,14 +125,18 @@ func (k *KeyManager) handleKeyRequest(key, query string, opts *KeyRequestOptions
 	if opts != nil {
 		qParam.RelayFactor = opts.RelayFactor
 	}
-	queryResp, err := k.serf.Query(qName, req, qParam)
+	queryResp, err := k.serf.QueryContext(ctx, qName, req, qParam)
 	if err != nil {
 		return resp, err
 	}
 
-	// Handle the response stream and populate the KeyResponse
+	// Handle the response stream and populate the KeyResponse. The stream
+	// is closed early if the context is done.
 	resp.NumNodes = k.serf.memberlist.NumMembers()
 	k.streamKeyResp(resp, queryResp.respCh)
+	if err := ctx.Err(); err != nil {
+		return resp, err
+	}
 
 	// Check the response for any reported failure conditions
 	if resp.NumErr != 0 {
@@ -152,10 +157,16 @@ func (k *KeyManager) InstallKey(key string) (*KeyResponse, error) {
 }
 
 func (k *KeyManager) InstallKeyWithOptions(key string, opts *KeyRequestOptions) (*KeyResponse, error) {
+	return k.InstallKeyContext(context.Background(), key, opts)
+}
+
+// InstallKeyContext is like InstallKeyWithOptions, but stops waiting for responses
+// once the context is done and returns the context error.
+func (k *KeyManager) InstallKeyContext(ctx context.Context, key string, opts *KeyRequestOptions) (*KeyResponse, error) {
 	k.l.Lock()
 	defer k.l.Unlock()
 
-	return k.handleKeyRequest(key, installKeyQuery, opts)
+	return k.handleKeyRequest(ctx, key, installKeyQuery, opts)
 }
 
 // UseKey handles broadcasting a primary key change to all members in the
@@ -166,10 +177,16 @@ func (k *KeyManager) UseKey(key string) (*KeyResponse, error) {
 }
 
 func (k *KeyManager) UseKeyWithOptions(key string, opts *KeyRequestOptions) (*KeyResponse, error) {
+	return k.UseKeyContext(context.Background(), key, opts)
+}
+
+// UseKeyContext is like UseKeyWithOptions, but stops waiting for responses
+// once the context is done and returns the context error.
+func (k *KeyManager) UseKeyContext(ctx context.Context, key string, opts *KeyRequestOptions) (*KeyResponse, error) {
 	k.l.Lock()
 	defer k.l.Unlock()
 
-	return k.handleKeyRequest(key, useKeyQuery, opts)
+	return k.handleKeyRequest(ctx, key, useKeyQuery, opts)
 }
 
 // RemoveKey handles broadcasting a key to the cluster for removal. Each member
@@ -180,10 +197,16 @@ func (k *KeyManager) RemoveKey(key string) (*KeyResponse, error) {
 }
 
 func (k *KeyManager) RemoveKeyWithOptions(key string, opts *KeyRequestOptions) (*KeyResponse, error) {
+	return k.RemoveKeyContext(context.Background(), key, opts)
+}
+
+// RemoveKeyContext is like RemoveKeyWithOptions, but stops waiting for responses
+// once the context is done and returns the context error.
+func (k *KeyManager) RemoveKeyContext(ctx context.Context, key string, opts *KeyRequestOptions) (*KeyResponse, error) {
 	k.l.Lock()
 	defer k.l.Unlock()
 
-	return k.handleKeyRequest(key, removeKeyQuery, opts)
+	return k.handleKeyRequest(ctx, key, removeKeyQuery, opts)
 }
 
 // ListKeys is used to collect installed keys from members in a Serf cluster
@@ -196,8 +219,14 @@ func (k *KeyManager) ListKeys() (*KeyResponse, error) {
 }
 
 func (k *KeyManager) ListKeysWithOptions(opts *KeyRequestOptions) (*KeyResponse, error) {
+	return k.ListKeysContext(context.Background(), opts)
+}
+
+// ListKeysContext is like ListKeysWithOptions, but stops waiting for
+// responses once the context is done and returns the context error.
+func (k *KeyManager) ListKeysContext(ctx context.Context, opts *KeyRequestOptions) (*KeyResponse, error) {
 	k.l.RLock()
 	defer k.l.RUnlock()
 
-	return k.handleKeyRequest("", listKeysQuery, opts)
+	return k.handleKeyRequest(ctx, "", listKeysQuery, opts)
 }
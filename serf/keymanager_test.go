@@ -5,6 +5,7 @@ package serf
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"net"
 	"testing"
@@ -320,3 +321,29 @@ func TestSerf_ListKeys(t *testing.T) {
 		}
 	}
 }
+
+func TestSerf_ListKeysContext(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	s1, err := testKeyringSerf(t, ip1)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s1.Shutdown()
+
+	manager := s1.KeyManager()
+	resp, err := manager.ListKeysContext(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if resp.NumResp != 1 {
+		t.Fatalf("bad: %#v", resp)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := manager.ListKeysContext(ctx, nil); err != context.Canceled {
+		t.Fatalf("err: %v", err)
+	}
+}
@@ -0,0 +1,190 @@
+// Copyright IBM Corp. 2013, 2026
+// SPDX-License-Identifier: MPL-2.0
+
+package serf
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	metrics "github.com/hashicorp/go-metrics/compat"
+)
+
+// kvProtocol is the protocol version required to write to the replicated
+// key/value store
+const kvProtocol = 6
+
+// kvEntry is a key of the replicated key/value store, with the last write
+// to it. Deleted keys are kept until they are reaped, so that older writes
+// can't bring them back.
+type kvEntry struct {
+	messageKV
+	deleteTime time.Time
+}
+
+// newer returns if a write wins over the current one, which is the case
+// when it is later, or made at the same time by a node with a greater name
+func (m *messageKV) newer(other *messageKV) bool {
+	if m.LTime != other.LTime {
+		return m.LTime > other.LTime
+	}
+	return m.Node > other.Node
+}
+
+// KVSet sets a key of the replicated key/value store, which is gossiped to
+// the other nodes and merged during push/pull. Concurrent writes to a key
+// are resolved by keeping the last one, by Lamport time. This requires
+// protocol version 6 to be in use.
+func (s *Serf) KVSet(key string, value []byte) error {
+	return s.kvWrite(key, value, false)
+}
+
+// KVDelete deletes a key of the replicated key/value store.
+func (s *Serf) KVDelete(key string) error {
+	return s.kvWrite(key, nil, true)
+}
+
+// KVGet returns the value of a key of the replicated key/value store, and
+// if the key is set.
+func (s *Serf) KVGet(key string) ([]byte, bool) {
+	s.kvLock.RLock()
+	defer s.kvLock.RUnlock()
+	e, ok := s.kv[key]
+	if !ok || e.Deleted {
+		return nil, false
+	}
+	return e.Value, true
+}
+
+// KVList returns the keys of the replicated key/value store starting with
+// a prefix, along with their values.
+func (s *Serf) KVList(prefix string) map[string][]byte {
+	s.kvLock.RLock()
+	defer s.kvLock.RUnlock()
+	out := make(map[string][]byte)
+	for key, e := range s.kv {
+		if !e.Deleted && strings.HasPrefix(key, prefix) {
+			out[key] = e.Value
+		}
+	}
+	return out
+}
+
+func (s *Serf) kvWrite(key string, value []byte, deleted bool) error {
+	if s.ProtocolVersion() < kvProtocol {
+		return FeatureNotSupported
+	}
+	if key == "" {
+		return fmt.Errorf("key must not be empty")
+	}
+	if size := len(key) + len(value); size > s.config.KVSizeLimit {
+		return fmt.Errorf("key and value exceed limit of %d bytes", s.config.KVSizeLimit)
+	}
+	s.kvLock.RLock()
+	full := !s.kvHasRoom(key)
+	s.kvLock.RUnlock()
+	if full {
+		return fmt.Errorf("key/value store is full with %d keys", s.config.KVMaxKeys)
+	}
+
+	msg := messageKV{
+		LTime:   s.kvClock.Time(),
+		Node:    s.config.NodeName,
+		Key:     key,
+		Value:   value,
+		Deleted: deleted,
+	}
+	s.kvClock.Increment()
+
+	// Process update locally, then gossip it
+	s.handleKV(&msg)
+	raw, err := encodeMessage(messageKVType, &msg, s.msgpackUseNewTimeFormat)
+	if err != nil {
+		return err
+	}
+	s.kvBroadcasts.QueueBroadcast(&broadcast{msg: raw})
+	return nil
+}
+
+// handleKV is called when a write to the key/value store is received,
+// either gossiped or during a push/pull. Returns if the write is newer
+// than the one we have, and should be rebroadcast. The event is sent once
+// the lock is released, so a slow consumer doesn't block the store, and
+// concurrent writes may be delivered out of their LTime order.
+func (s *Serf) handleKV(msg *messageKV) bool {
+	if len(msg.Key)+len(msg.Value) > s.config.KVSizeLimit {
+		s.logger.Printf("[WARN] serf: Dropping write to key %q exceeding limit of %d bytes",
+			msg.Key, s.config.KVSizeLimit)
+		return false
+	}
+
+	// Witness a potentially newer time
+	s.kvClock.Witness(msg.LTime)
+
+	s.kvLock.Lock()
+	if e, ok := s.kv[msg.Key]; ok && !msg.newer(&e.messageKV) {
+		s.kvLock.Unlock()
+		return false
+	}
+	if !s.kvHasRoom(msg.Key) {
+		s.kvLock.Unlock()
+		metrics.IncrCounterWithLabels([]string{"serf", "kv", "dropped"}, 1, s.metricLabels)
+		s.logger.Printf("[WARN] serf: Dropping write to key %q, store is full with %d keys",
+			msg.Key, s.config.KVMaxKeys)
+		return false
+	}
+	e := &kvEntry{messageKV: *msg}
+	if msg.Deleted {
+		e.Value = nil
+		e.deleteTime = time.Now()
+	}
+	s.kv[msg.Key] = e
+	event := KVEvent{
+		Key:     e.Key,
+		Value:   e.Value,
+		Deleted: e.Deleted,
+		LTime:   e.LTime,
+		Node:    e.Node,
+	}
+	s.kvLock.Unlock()
+
+	metrics.IncrCounterWithLabels([]string{"serf", "kv", "writes"}, 1, s.metricLabels)
+	if s.config.EventCh != nil {
+		s.config.EventCh <- event
+	}
+	return true
+}
+
+// kvHasRoom returns if a key can be written, which is the case if it is
+// already in the store or the store isn't full. The lock must be held.
+func (s *Serf) kvHasRoom(key string) bool {
+	if _, ok := s.kv[key]; ok {
+		return true
+	}
+	return len(s.kv) < s.config.KVMaxKeys
+}
+
+// kvEntries returns a copy of the writes to the key/value store, to send
+// during a push/pull. There are at most KVMaxKeys of them.
+func (s *Serf) kvEntries() []*messageKV {
+	s.kvLock.RLock()
+	defer s.kvLock.RUnlock()
+	out := make([]*messageKV, 0, len(s.kv))
+	for _, e := range s.kv {
+		msg := e.messageKV
+		out = append(out, &msg)
+	}
+	return out
+}
+
+// reapKV removes the deleted keys that are older than the tombstone timeout
+func (s *Serf) reapKV(now time.Time) {
+	s.kvLock.Lock()
+	defer s.kvLock.Unlock()
+	for key, e := range s.kv {
+		if e.Deleted && now.Sub(e.deleteTime) > s.config.KVTombstoneTimeout {
+			delete(s.kv, key)
+		}
+	}
+}
@@ -0,0 +1,269 @@
+// Copyright IBM Corp. 2013, 2026
+// SPDX-License-Identifier: MPL-2.0
+
+package serf
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/serf/testutil"
+	"github.com/hashicorp/serf/testutil/retry"
+)
+
+func testKVSerf() *Serf {
+	return &Serf{
+		config: &Config{
+			NodeName:           "self",
+			KVSizeLimit:        64,
+			KVMaxKeys:          8,
+			KVTombstoneTimeout: time.Hour,
+		},
+		logger: log.New(os.Stderr, "", log.LstdFlags),
+		kv:     make(map[string]*kvEntry),
+	}
+}
+
+func TestSerf_handleKV(t *testing.T) {
+	s := testKVSerf()
+
+	cases := []struct {
+		msg     messageKV
+		applied bool
+		value   string
+		ok      bool
+	}{
+		{messageKV{LTime: 5, Node: "b", Key: "k", Value: []byte("1")}, true, "1", true},
+		{messageKV{LTime: 5, Node: "b", Key: "k", Value: []byte("1")}, false, "1", true},
+		{messageKV{LTime: 4, Node: "z", Key: "k", Value: []byte("2")}, false, "1", true},
+		{messageKV{LTime: 5, Node: "a", Key: "k", Value: []byte("3")}, false, "1", true},
+		{messageKV{LTime: 5, Node: "c", Key: "k", Value: []byte("4")}, true, "4", true},
+		{messageKV{LTime: 6, Node: "a", Key: "k", Deleted: true}, true, "", false},
+		{messageKV{LTime: 5, Node: "z", Key: "k", Value: []byte("5")}, false, "", false},
+		{messageKV{LTime: 7, Node: "a", Key: "k", Value: make([]byte, 64)}, false, "", false},
+	}
+	for i, c := range cases {
+		if applied := s.handleKV(&c.msg); applied != c.applied {
+			t.Fatalf("case %d: bad: %v", i, applied)
+		}
+		value, ok := s.KVGet("k")
+		if string(value) != c.value || ok != c.ok {
+			t.Fatalf("case %d: bad: %q %v", i, value, ok)
+		}
+	}
+
+	// The clock moves past the writes received
+	if s.kvClock.Time() != 7 {
+		t.Fatalf("bad: %d", s.kvClock.Time())
+	}
+
+	// Deleted keys are kept until reaped
+	if len(s.kvEntries()) != 1 {
+		t.Fatalf("bad: %v", s.kvEntries())
+	}
+	s.reapKV(time.Now())
+	if len(s.kvEntries()) != 1 {
+		t.Fatalf("bad: %v", s.kvEntries())
+	}
+	s.reapKV(time.Now().Add(2 * time.Hour))
+	if len(s.kvEntries()) != 0 {
+		t.Fatalf("bad: %v", s.kvEntries())
+	}
+}
+
+func TestSerf_handleKV_MaxKeys(t *testing.T) {
+	s := testKVSerf()
+	for i := 0; i < s.config.KVMaxKeys-1; i++ {
+		s.handleKV(&messageKV{LTime: 1, Key: fmt.Sprintf("k%d", i), Value: []byte("1")})
+	}
+	if !s.handleKV(&messageKV{LTime: 1, Key: "deleted", Deleted: true}) {
+		t.Fatalf("should apply")
+	}
+
+	// Deleted keys take room until they are reaped, and the keys in the
+	// store can still be written once it is full
+	if s.handleKV(&messageKV{LTime: 2, Key: "new", Value: []byte("1")}) {
+		t.Fatalf("should drop")
+	}
+	if !s.handleKV(&messageKV{LTime: 2, Key: "k0", Value: []byte("2")}) {
+		t.Fatalf("should apply")
+	}
+	if !s.handleKV(&messageKV{LTime: 2, Key: "k1", Deleted: true}) {
+		t.Fatalf("should apply")
+	}
+	s.reapKV(time.Now().Add(2 * time.Hour))
+	if !s.handleKV(&messageKV{LTime: 3, Key: "new", Value: []byte("1")}) {
+		t.Fatalf("should apply")
+	}
+	if n := len(s.kvEntries()); n != s.config.KVMaxKeys-1 {
+		t.Fatalf("bad: %d", n)
+	}
+}
+
+func TestSerf_handleKV_SlowConsumer(t *testing.T) {
+	s := testKVSerf()
+	eventCh := make(chan Event)
+	s.config.EventCh = eventCh
+
+	doneCh := make(chan struct{})
+	go func() {
+		defer close(doneCh)
+		s.handleKV(&messageKV{LTime: 1, Key: "k", Value: []byte("1")})
+	}()
+
+	// The store can be read while the event waits for the consumer
+	retry.Run(t, func(r *retry.R) {
+		if value, ok := s.KVGet("k"); !ok || string(value) != "1" {
+			r.Fatalf("bad: %q %v", value, ok)
+		}
+	})
+
+	e := <-eventCh
+	if kv, ok := e.(KVEvent); !ok || kv.Key != "k" {
+		t.Fatalf("bad: %#v", e)
+	}
+	<-doneCh
+}
+
+func TestSerf_KVList(t *testing.T) {
+	s := testKVSerf()
+	s.handleKV(&messageKV{LTime: 1, Key: "app/a", Value: []byte("1")})
+	s.handleKV(&messageKV{LTime: 1, Key: "app/b", Value: []byte("2")})
+	s.handleKV(&messageKV{LTime: 1, Key: "app/c", Deleted: true})
+	s.handleKV(&messageKV{LTime: 1, Key: "db", Value: []byte("3")})
+
+	expected := map[string][]byte{
+		"app/a": []byte("1"),
+		"app/b": []byte("2"),
+	}
+	if out := s.KVList("app/"); !reflect.DeepEqual(out, expected) {
+		t.Fatalf("bad: %v", out)
+	}
+	if out := s.KVList(""); len(out) != 3 {
+		t.Fatalf("bad: %v", out)
+	}
+}
+
+func TestSerf_KV(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	ip2, returnFn2 := testutil.TakeIP()
+	defer returnFn2()
+
+	eventCh := make(chan Event, 16)
+	s1Config := testConfig(t, ip1)
+	s1Config.ProtocolVersion = kvProtocol
+	s1Config.KVMaxKeys = 3
+	s2Config := testConfig(t, ip2)
+	s2Config.ProtocolVersion = kvProtocol
+	s2Config.EventCh = eventCh
+
+	s1, err := Create(s1Config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s1.Shutdown()
+
+	s2, err := Create(s2Config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s2.Shutdown()
+
+	// Keys set before joining are merged during the push/pull
+	if err := s1.KVSet("before", []byte("join")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Writes are queued apart from the intents
+	if n := s1.kvBroadcasts.NumQueued(); n != 1 {
+		t.Fatalf("bad: %d", n)
+	}
+
+	if _, err := s1.Join([]string{s2Config.NodeName + "/" + s2Config.MemberlistConfig.BindAddr}, false); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	waitUntilNumNodes(t, 2, s1, s2)
+
+	if err := s1.KVSet("after", []byte("join")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	retry.Run(t, func(r *retry.R) {
+		expected := map[string][]byte{
+			"before": []byte("join"),
+			"after":  []byte("join"),
+		}
+		if out := s2.KVList(""); !reflect.DeepEqual(out, expected) {
+			r.Fatalf("bad: %v", out)
+		}
+	})
+
+	// Deletes are gossiped back
+	if err := s2.KVDelete("before"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	retry.Run(t, func(r *retry.R) {
+		if _, ok := s1.KVGet("before"); ok {
+			r.Fatalf("should be deleted")
+		}
+	})
+
+	// The writes are sent to the event channel
+	var events []KVEvent
+	for len(events) < 3 {
+		select {
+		case e := <-eventCh:
+			if kv, ok := e.(KVEvent); ok {
+				events = append(events, kv)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout: %v", events)
+		}
+	}
+	deleted := events[2]
+	if deleted.Key != "before" || !deleted.Deleted || deleted.Node != s2Config.NodeName {
+		t.Fatalf("bad: %#v", deleted)
+	}
+
+	if err := s1.KVSet("", nil); err == nil {
+		t.Fatalf("expected error")
+	}
+	if err := s1.KVSet("big", make([]byte, 1024)); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	// Only so many keys fit in the store, including the deleted ones
+	if err := s1.KVSet("third", nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := s1.KVSet("fourth", nil); err == nil {
+		t.Fatalf("expected error")
+	}
+	if err := s1.KVSet("before", nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Older protocols can't write to the store
+	s1.config.ProtocolVersion = 5
+	if err := s1.KVSet("old", nil); err != FeatureNotSupported {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestSerf_KV_StoreSizeLimit(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	// The whole store must fit in a push/pull
+	c := testConfig(t, ip1)
+	c.KVMaxKeys = kvStoreSizeLimit/c.KVSizeLimit + 1
+	if _, err := Create(c); err == nil {
+		t.Fatalf("expected error")
+	}
+}
@@ -46,11 +46,14 @@ func (m *mergeDelegate) nodeToMember(n *memberlist.Node) (*Member, error) {
 	if err := m.validateMemberInfo(n); err != nil {
 		return nil, err
 	}
+
+	// Only the tags that fit in the meta are known before the merge
+	tags, _ := m.serf.decodeMetaTags(n.Meta)
 	return &Member{
 		Name:        n.Name,
 		Addr:        net.IP(n.Addr),
 		Port:        n.Port,
-		Tags:        m.serf.decodeTags(n.Meta),
+		Tags:        tags,
 		Status:      status,
 		ProtocolMin: n.PMin,
 		ProtocolMax: n.PMax,
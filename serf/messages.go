@@ -26,6 +26,14 @@ const (
 	messageKeyRequestType
 	messageKeyResponseType
 	messageRelayType
+	messageDirectType
+	messagePayloadRequestType
+	messagePayloadResponseType
+	messageReplayRequestType
+	messageReplayResponseType
+	messageKVType
+	messageTagsRequestType
+	messageTagsType
 )
 
 const (
@@ -35,6 +43,13 @@ const (
 	// NoBroadcast is used to prevent re-broadcast of a query.
 	// this can be used to selectively send queries to individual members
 	queryFlagNoBroadcast
+
+	// MultiResponse allows each node to send multiple ordered responses
+	// to a query, the last of which has the Done flag set
+	queryFlagMultiResponse
+
+	// Done marks the last response of a node to a multi-response query
+	queryFlagDone
 )
 
 // filterType is used with a queryFilter to specify the type of
@@ -44,6 +59,7 @@ type filterType uint8
 const (
 	filterNodeType filterType = iota
 	filterTagType
+	filterExprType
 )
 
 // messageJoin is the message broadcasted after we join to
@@ -70,6 +86,15 @@ type messagePushPull struct {
 	EventLTime   LamportTime            // Lamport time for event clock
 	Events       []*userEvents          // Recent events
 	QueryLTime   LamportTime            // Lamport time for query clock
+
+	// KVLTime is the Lamport time of the key/value store, and KV all of
+	// its keys, including the deleted ones
+	KVLTime LamportTime  `codec:",omitempty"`
+	KV      []*messageKV `codec:",omitempty"`
+
+	// Tags holds the tag sets known to be too large for the meta of their
+	// node, which only holds their digest
+	Tags []*messageTags `codec:",omitempty"`
 }
 
 // messageUserEvent is used for user-generated events
@@ -78,6 +103,79 @@ type messageUserEvent struct {
 	Name    string
 	Payload []byte
 	CC      bool // "Can Coalesce". Zero value is compatible with Serf 0.1
+
+	// Hash is set in place of the payload for events over the size limit,
+	// which nodes fetch from the Origin node, or others that have it. The
+	// Origin is also used to rate limit events by node.
+	Hash   []byte `codec:",omitempty"`
+	Origin string `codec:",omitempty"`
+
+	// Seq is the sequence number of the event among those sent by the
+	// Origin, used to detect missed events
+	Seq uint64 `codec:",omitempty"`
+
+	// Signer is the node that signed the event, if any
+	Signer    string `codec:",omitempty"`
+	Signature []byte `codec:",omitempty"`
+
+	// replay is set for events received from ReplayEventsSince, and local
+	// for the events sent by this node. They are not sent over the wire.
+	replay bool
+	local  bool
+}
+
+// messagePayloadRequest is used to fetch the payload of a user event
+// by its hash
+type messagePayloadRequest struct {
+	Hash []byte
+	From string
+}
+
+// messagePayloadResponse is used to send the payload of a user event
+type messagePayloadResponse struct {
+	Hash    []byte
+	Payload []byte
+}
+
+// messageReplayRequest is used to ask a node for the user events in its
+// event buffer since a given time
+type messageReplayRequest struct {
+	LTime LamportTime
+}
+
+// messageReplayResponse is used to send the buffered user events, ordered
+// by time
+type messageReplayResponse struct {
+	Events []*userEvents
+}
+
+// messageKV is used to set or delete a key in the replicated key/value
+// store. Writes are ordered by their Lamport time, then by the name of the
+// node that made them, and the last one wins.
+type messageKV struct {
+	LTime   LamportTime
+	Node    string
+	Key     string
+	Value   []byte
+	Deleted bool
+}
+
+// messageTagsRequest is used to ask a node for its tags, when they are
+// too large for its meta
+type messageTagsRequest struct {
+	From string
+}
+
+// messageTags is used to send the full tag set of a node
+type messageTags struct {
+	Node string
+	Tags map[string]string
+}
+
+// messageDirect is used to send a payload to a single member
+type messageDirect struct {
+	From    string
+	Payload []byte
 }
 
 // messageQuery is used for query events
@@ -93,6 +191,10 @@ type messageQuery struct {
 	Timeout     time.Duration // Maximum time between delivery and response
 	Name        string        // Query name
 	Payload     []byte        // Query payload
+
+	// Signer is the node that signed the query, if any
+	Signer    string `codec:",omitempty"`
+	Signature []byte `codec:",omitempty"`
 }
 
 // Ack checks if the ack flag is set
@@ -105,6 +207,11 @@ func (m *messageQuery) NoBroadcast() bool {
 	return (m.Flags & queryFlagNoBroadcast) != 0
 }
 
+// MultiResponse checks if the multi response flag is set
+func (m *messageQuery) MultiResponse() bool {
+	return (m.Flags & queryFlagMultiResponse) != 0
+}
+
 // filterNode is used with the filterNodeType, and is a list
 // of node names
 type filterNode []string
@@ -116,6 +223,10 @@ type filterTag struct {
 	Expr string
 }
 
+// filterExpr is used with the filterExprType, and is a tag filter
+// expression parsed by ParseTagExpr
+type filterExpr string
+
 // messageQueryResponse is used to respond to a query
 type messageQueryResponse struct {
 	LTime   LamportTime // Event lamport time
@@ -123,6 +234,16 @@ type messageQueryResponse struct {
 	From    string      // Node name
 	Flags   uint32      // Used to provide various flags
 	Payload []byte      // Optional response payload
+
+	// Chunk and Chunks are set on the fragments of a chunked response,
+	// which is split into Chunks fragments with Chunk as the index of
+	// this one. They are omitted otherwise, so regular responses keep
+	// the same size.
+	Chunk  uint32 `codec:",omitempty"`
+	Chunks uint32 `codec:",omitempty"`
+
+	// Seq orders the responses of a node to a multi-response query
+	Seq uint32 `codec:",omitempty"`
 }
 
 // Ack checks if the ack flag is set
@@ -130,6 +251,16 @@ func (m *messageQueryResponse) Ack() bool {
 	return (m.Flags & queryFlagAck) != 0
 }
 
+// Done checks if the done flag is set
+func (m *messageQueryResponse) Done() bool {
+	return (m.Flags & queryFlagDone) != 0
+}
+
+// Chunked checks if this is a fragment of a chunked response
+func (m *messageQueryResponse) Chunked() bool {
+	return m.Chunks > 0
+}
+
 func decodeMessage(buf []byte, out any) error {
 	handle := codec.MsgpackHandle{}
 	return codec.NewDecoder(bytes.NewReader(buf), &handle).Decode(out)
@@ -4,6 +4,7 @@
 package serf
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"math"
@@ -17,6 +18,33 @@ import (
 	"github.com/hashicorp/memberlist"
 )
 
+const (
+	// queryResponseChunkSize is the payload size of each fragment of a
+	// chunked query response
+	queryResponseChunkSize = 64 * 1024
+
+	// chunkedResponseProtocol is the first protocol version that can
+	// receive chunked query responses
+	chunkedResponseProtocol = 6
+
+	// multiResponseBuffer is the number of responses buffered for each
+	// member for multi-response queries
+	multiResponseBuffer = 16
+
+	// maxPendingResponses is the number of out of order responses that
+	// are held back for each node of a multi-response query
+	maxPendingResponses = 128
+
+	// maxChunkedPerNode is the number of chunked responses that can be
+	// partially received from each node at once
+	maxChunkedPerNode = 4
+
+	// maxChunkedBufferFactor bounds the bytes of partially received chunked
+	// responses buffered for a query, as a multiple of the size limit of a
+	// single chunked response
+	maxChunkedBufferFactor = 16
+)
+
 // QueryParam is provided to Query() to configure the parameters of the
 // query. If not provided, sane defaults will be used.
 type QueryParam struct {
@@ -28,6 +56,11 @@ type QueryParam struct {
 	// to restrict the nodes that should respond
 	FilterTags map[string]string
 
+	// FilterExpr is a tag filter expression, as parsed by ParseTagExpr,
+	// that restricts the nodes that should respond. This requires
+	// protocol version 6.
+	FilterExpr string
+
 	// If true, we are requesting an delivery acknowledgement from
 	// every node that meets the filter requirement. This means nodes
 	// the receive the message but do not pass the filters, will not
@@ -38,9 +71,24 @@ type QueryParam struct {
 	// back to the sender through other nodes for redundancy.
 	RelayFactor uint8
 
+	// MultipleResponses allows each node to send multiple responses,
+	// which are delivered in order until the node sends its last one.
+	// These responses are sent over TCP and are not relayed. This
+	// requires protocol version 6.
+	MultipleResponses bool
+
 	// The timeout limits how long the query is left open. If not provided,
 	// then a default timeout is used based on the configuration of Serf
 	Timeout time.Duration
+
+	// SampleSize restricts the nodes that should respond to a random
+	// sample of at most this many of the nodes that pass the filters
+	SampleSize int
+
+	// SamplePercent restricts the nodes that should respond to a random
+	// sample of this percentage of the nodes that pass the filters. If
+	// SampleSize is also set, the smaller of the two samples is used.
+	SamplePercent float64
 }
 
 // DefaultQueryTimeout returns the default timeout value for a query
@@ -86,6 +134,15 @@ func (q *QueryParam) encodeFilters() ([][]byte, error) {
 		}
 	}
 
+	// Add the expression filter
+	if q.FilterExpr != "" {
+		if buf, err := encodeFilter(filterExprType, filterExpr(q.FilterExpr)); err != nil {
+			return nil, err
+		} else {
+			filters = append(filters, buf)
+		}
+	}
+
 	return filters, nil
 }
 
@@ -104,6 +161,13 @@ type QueryResponse struct {
 	// Stores the LTime of the query
 	lTime LamportTime
 
+	// start is when the query was sent
+	start time.Time
+
+	// expected are the nodes that matched the query filters when it was
+	// sent. This is nil if the query has no filters.
+	expected []string
+
 	// respCh is used to send a response from a node
 	respCh chan NodeResponse
 
@@ -111,19 +175,40 @@ type QueryResponse struct {
 	acks      map[string]struct{}
 	responses map[string]struct{}
 
+	// chunks holds the fragments received so far of chunked responses
+	chunks map[responseChunkKey]*responseChunks
+
+	// chunkSets counts the partial chunked responses of each node, and
+	// chunkBytes their total size, so a node can't pin unbounded memory
+	chunkSets  map[string]int
+	chunkBytes int
+
+	// multi is set if nodes may send multiple responses, in which case
+	// streams holds the next expected response of each node along with
+	// those that arrived out of order
+	multi   bool
+	streams map[string]*responseStream
+
 	closed    bool
 	closeLock sync.Mutex
 }
 
 // newQueryResponse is used to construct a new query response
 func newQueryResponse(n int, q *messageQuery) *QueryResponse {
+	now := time.Now()
 	resp := &QueryResponse{
-		deadline:  time.Now().Add(q.Timeout),
+		start:     now,
+		deadline:  now.Add(q.Timeout),
 		id:        q.ID,
 		lTime:     q.LTime,
 		respCh:    make(chan NodeResponse, n),
 		responses: make(map[string]struct{}),
 	}
+	if q.MultiResponse() {
+		resp.respCh = make(chan NodeResponse, n*multiResponseBuffer)
+		resp.multi = true
+		resp.streams = make(map[string]*responseStream)
+	}
 	if q.Ack() {
 		resp.ackCh = make(chan string, n)
 		resp.acks = make(map[string]struct{})
@@ -189,6 +274,155 @@ func (r *QueryResponse) sendResponse(nr NodeResponse) error {
 	return nil
 }
 
+// responseChunkKey identifies a chunked response, since nodes can send
+// multiple responses to multi-response queries
+type responseChunkKey struct {
+	from string
+	seq  uint32
+}
+
+// responseChunks holds the fragments received so far of a chunked response
+type responseChunks struct {
+	count uint32
+	parts map[uint32][]byte
+	size  int
+}
+
+// hasResponse returns if a response was already delivered for a node
+func (r *QueryResponse) hasResponse(from string) bool {
+	r.closeLock.Lock()
+	defer r.closeLock.Unlock()
+	_, ok := r.responses[from]
+	return ok
+}
+
+// addChunk stores a fragment of a chunked response. Once all the fragments
+// of the response were received, the reassembled payload is returned.
+func (r *QueryResponse) addChunk(resp *messageQueryResponse, limit int) ([]byte, bool, error) {
+	r.closeLock.Lock()
+	defer r.closeLock.Unlock()
+	if r.closed {
+		return nil, false, nil
+	}
+	if _, ok := r.responses[resp.From]; ok {
+		return nil, false, nil
+	}
+
+	if r.chunks == nil {
+		r.chunks = make(map[responseChunkKey]*responseChunks)
+		r.chunkSets = make(map[string]int)
+	}
+	key := responseChunkKey{resp.From, resp.Seq}
+	c, ok := r.chunks[key]
+	if !ok {
+		if r.chunkSets[resp.From] >= maxChunkedPerNode {
+			return nil, false, fmt.Errorf("serf: Too many partial chunked responses from %s",
+				resp.From)
+		}
+		c = &responseChunks{count: resp.Chunks, parts: make(map[uint32][]byte)}
+		r.chunks[key] = c
+		r.chunkSets[resp.From]++
+	}
+	if resp.Chunks != c.count || resp.Chunk >= c.count {
+		r.removeChunks(key, c)
+		return nil, false, fmt.Errorf("serf: Invalid response chunk %d of %d from %s",
+			resp.Chunk, resp.Chunks, resp.From)
+	}
+	if _, ok := c.parts[resp.Chunk]; ok {
+		return nil, false, nil
+	}
+
+	if c.size+len(resp.Payload) > limit {
+		r.removeChunks(key, c)
+		return nil, false, fmt.Errorf("serf: Chunked response from %s exceeds limit of %d bytes",
+			resp.From, limit)
+	}
+	if r.chunkBytes+len(resp.Payload) > limit*maxChunkedBufferFactor {
+		r.removeChunks(key, c)
+		return nil, false, fmt.Errorf("serf: Dropping chunked response from %s, query buffer is full",
+			resp.From)
+	}
+	c.size += len(resp.Payload)
+	r.chunkBytes += len(resp.Payload)
+	c.parts[resp.Chunk] = resp.Payload
+	if uint32(len(c.parts)) < c.count {
+		return nil, false, nil
+	}
+
+	r.removeChunks(key, c)
+	payload := make([]byte, 0, c.size)
+	for i := uint32(0); i < c.count; i++ {
+		payload = append(payload, c.parts[i]...)
+	}
+	return payload, true, nil
+}
+
+// removeChunks forgets a partial chunked response. closeLock must be held.
+func (r *QueryResponse) removeChunks(key responseChunkKey, c *responseChunks) {
+	delete(r.chunks, key)
+	r.chunkBytes -= c.size
+	if r.chunkSets[key.from]--; r.chunkSets[key.from] <= 0 {
+		delete(r.chunkSets, key.from)
+	}
+}
+
+// responseStream tracks the responses of a node to a multi-response query
+type responseStream struct {
+	next    uint32
+	pending map[uint32]NodeResponse
+}
+
+// sendOrderedResponse delivers a response to a multi-response query once
+// all the earlier responses of the node were delivered
+func (r *QueryResponse) sendOrderedResponse(resp *messageQueryResponse, payload []byte) error {
+	r.closeLock.Lock()
+	defer r.closeLock.Unlock()
+	if r.closed {
+		return nil
+	}
+	if _, ok := r.responses[resp.From]; ok {
+		return nil
+	}
+
+	st, ok := r.streams[resp.From]
+	if !ok {
+		st = &responseStream{pending: make(map[uint32]NodeResponse)}
+		r.streams[resp.From] = st
+	}
+	if resp.Seq < st.next {
+		return nil
+	}
+	if len(st.pending) >= maxPendingResponses {
+		return fmt.Errorf("serf: Too many out of order responses from %s, dropping", resp.From)
+	}
+	st.pending[resp.Seq] = NodeResponse{
+		From:    resp.From,
+		Payload: payload,
+		Seq:     resp.Seq,
+		Partial: !resp.Done(),
+	}
+
+	for {
+		nr, ok := st.pending[st.next]
+		if !ok {
+			return nil
+		}
+		delete(st.pending, st.next)
+		select {
+		case r.respCh <- nr:
+		default:
+			return errors.New("serf: Failed to deliver query response, dropping")
+		}
+		st.next++
+
+		if !nr.Partial {
+			r.responses[nr.From] = struct{}{}
+			delete(r.streams, nr.From)
+			return nil
+		}
+	}
+}
+
 // sendResponse sends a response on the response channel ensuring the channel is not closed.
 func (r *QueryResponse) sendAck(nr *messageQueryResponse) error {
 	r.closeLock.Lock()
@@ -205,10 +439,213 @@ func (r *QueryResponse) sendAck(nr *messageQueryResponse) error {
 	return nil
 }
 
+// QueryResult is the outcome of a query gathered by Collect
+type QueryResult struct {
+	// Responses maps the name of each node that responded to its payload.
+	// For multi-response queries, this is the payloads of all the
+	// responses of the node joined in order.
+	Responses map[string][]byte
+
+	// Acks are the nodes that acknowledged the query, in the order the
+	// acks arrived. This is empty unless RequestAck was set.
+	Acks []string
+
+	// Expected are the alive nodes that matched the query filters when it
+	// was sent. This is nil if the query has no filters, in which case
+	// any node may respond.
+	Expected []string
+
+	// NoAck are the expected nodes that did not acknowledge the query.
+	// This is empty unless RequestAck was set.
+	NoAck []string
+
+	// NoResponse are the expected nodes that did not respond, or did not
+	// send their last response to a multi-response query
+	NoResponse []string
+
+	// Duration is how long the query ran before the results were
+	// collected
+	Duration time.Duration
+}
+
+// Collect blocks until the query finishes, every expected node has
+// responded, or the context is done, and returns what was gathered. If
+// the context is done first, the partial result is returned along with
+// the context's error. Collect reads from AckCh and ResponseCh, so it
+// should not be combined with other readers of those channels.
+func (r *QueryResponse) Collect(ctx context.Context) (*QueryResult, error) {
+	result := &QueryResult{
+		Responses: make(map[string][]byte),
+		Expected:  r.expected,
+	}
+	acked := make(map[string]struct{})
+	partial := make(map[string]struct{})
+	addAck := func(from string) {
+		if _, ok := acked[from]; !ok {
+			acked[from] = struct{}{}
+			result.Acks = append(result.Acks, from)
+		}
+	}
+
+	var err error
+	ackCh, respCh := r.ackCh, r.respCh
+COLLECT:
+	for (ackCh != nil || respCh != nil) && !r.expectedResponded(result, partial) {
+		select {
+		case from, ok := <-ackCh:
+			if !ok {
+				ackCh = nil
+				continue
+			}
+			addAck(from)
+
+		case resp, ok := <-respCh:
+			if !ok {
+				respCh = nil
+				continue
+			}
+			if resp.Partial {
+				partial[resp.From] = struct{}{}
+			} else {
+				delete(partial, resp.From)
+			}
+			if r.multi {
+				result.Responses[resp.From] = append(result.Responses[resp.From], resp.Payload...)
+			} else {
+				result.Responses[resp.From] = resp.Payload
+			}
+
+		case <-ctx.Done():
+			err = ctx.Err()
+			break COLLECT
+		}
+	}
+
+	// Pick up the acks that arrived along with the last responses
+DRAIN:
+	for ackCh != nil {
+		select {
+		case from, ok := <-ackCh:
+			if !ok {
+				break DRAIN
+			}
+			addAck(from)
+		default:
+			break DRAIN
+		}
+	}
+	result.Duration = time.Since(r.start)
+
+	for _, node := range r.expected {
+		if _, ok := acked[node]; r.ackCh != nil && !ok {
+			result.NoAck = append(result.NoAck, node)
+		}
+		_, ok := result.Responses[node]
+		if _, incomplete := partial[node]; !ok || incomplete {
+			result.NoResponse = append(result.NoResponse, node)
+		}
+	}
+	return result, err
+}
+
+// sample returns a copy of the query parameters with the node filter
+// restricted to a random sample of the alive members that pass the filters.
+// The sample is sent as a node filter, so the other nodes don't respond.
+func (q *QueryParam) sample(members []Member) (*QueryParam, error) {
+	if q.SampleSize < 0 {
+		return nil, fmt.Errorf("Sample size must not be negative")
+	}
+	if q.SamplePercent < 0 || q.SamplePercent > 100 {
+		return nil, fmt.Errorf("Sample percentage must be between 0 and 100")
+	}
+
+	nodes, err := q.expectedNodes(members)
+	if err != nil {
+		return nil, err
+	}
+	k := len(nodes)
+	if q.SampleSize > 0 {
+		k = min(k, q.SampleSize)
+	}
+	if q.SamplePercent > 0 {
+		k = min(k, int(math.Ceil(float64(len(nodes))*q.SamplePercent/100)))
+	}
+	if k == 0 {
+		return nil, fmt.Errorf("No members match the query filters")
+	}
+
+	rand.Shuffle(len(nodes), func(i, j int) {
+		nodes[i], nodes[j] = nodes[j], nodes[i]
+	})
+	p := *q
+	p.FilterNodes = nodes[:k]
+	return &p, nil
+}
+
+// expectedResponded returns if the query has filters and all the nodes
+// expected to respond have sent their last response
+func (r *QueryResponse) expectedResponded(result *QueryResult, partial map[string]struct{}) bool {
+	if r.expected == nil {
+		return false
+	}
+	for _, node := range r.expected {
+		if _, ok := result.Responses[node]; !ok {
+			return false
+		}
+		if _, ok := partial[node]; ok {
+			return false
+		}
+	}
+	return true
+}
+
+// expectedNodes returns the names of the alive members that match the
+// query filters, using the same rules as shouldProcessQuery. An error is
+// returned if the filter expression doesn't parse.
+func (q *QueryParam) expectedNodes(members []Member) ([]string, error) {
+	var expr *TagExpr
+	if q.FilterExpr != "" {
+		var err error
+		if expr, err = ParseTagExpr(q.FilterExpr); err != nil {
+			return nil, err
+		}
+	}
+
+	expected := make([]string, 0)
+	for _, m := range members {
+		if m.Status != StatusAlive {
+			continue
+		}
+		if len(q.FilterNodes) > 0 && !slices.Contains(q.FilterNodes, m.Name) {
+			continue
+		}
+
+		matched := true
+		for tag, expr := range q.FilterTags {
+			if ok, err := regexp.MatchString(expr, m.Tags[tag]); err != nil || !ok {
+				matched = false
+				break
+			}
+		}
+		if matched && expr != nil {
+			matched = expr.Match(m.Tags)
+		}
+		if matched {
+			expected = append(expected, m.Name)
+		}
+	}
+	return expected, nil
+}
+
 // NodeResponse is used to represent a single response from a node
 type NodeResponse struct {
 	From    string
 	Payload []byte
+
+	// Seq orders the responses of a node to a multi-response query, and
+	// Partial is set on all but the last of them
+	Seq     uint32
+	Partial bool
 }
 
 // shouldProcessQuery checks if a query should be proceeded given
@@ -249,6 +686,24 @@ func (s *Serf) shouldProcessQuery(filters [][]byte) bool {
 				return false
 			}
 
+		case filterExprType:
+			// Decode the filter
+			var filt filterExpr
+			if err := decodeMessage(filter[1:], &filt); err != nil {
+				s.logger.Printf("[WARN] serf: failed to decode filterExprType: %v", err)
+				return false
+			}
+
+			// Check if our tags satisfy the expression
+			expr, err := ParseTagExpr(string(filt))
+			if err != nil {
+				s.logger.Printf("[WARN] serf: failed to parse filter expression (%s): %v", filt, err)
+				return false
+			}
+			if !expr.Match(s.config.Tags) {
+				return false
+			}
+
 		default:
 			s.logger.Printf("[WARN] serf: query has unrecognized filter type: %d", filter[0])
 			return false
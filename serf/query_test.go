@@ -4,8 +4,10 @@
 package serf
 
 import (
+	"context"
 	"fmt"
 	"reflect"
+	"slices"
 	"testing"
 	"time"
 
@@ -148,6 +150,33 @@ func TestSerf_ShouldProcess(t *testing.T) {
 	if s1.shouldProcessQuery(filters) {
 		t.Fatalf("expected false")
 	}
+
+	// Matching expression
+	q = &QueryParam{
+		FilterExpr: `role == "webserver" and (datacenter =~ "^east" or canary)`,
+	}
+	filters, err = q.encodeFilters()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if filterType(filters[0][0]) != filterExprType {
+		t.Fatalf("bad: %v", filters)
+	}
+	if !s1.shouldProcessQuery(filters) {
+		t.Fatalf("expected true")
+	}
+
+	// Expression that doesn't match
+	q = &QueryParam{
+		FilterExpr: `role == "webserver" and not datacenter`,
+	}
+	filters, err = q.encodeFilters()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if s1.shouldProcessQuery(filters) {
+		t.Fatalf("expected false")
+	}
 }
 
 func Test_kRandomMembers(t *testing.T) {
@@ -204,3 +233,323 @@ func Test_kRandomMembers(t *testing.T) {
 		}
 	}
 }
+
+func TestQueryParams_ExpectedNodes(t *testing.T) {
+	members := []Member{
+		{Name: "foo", Status: StatusAlive, Tags: map[string]string{"role": "webserver"}},
+		{Name: "bar", Status: StatusAlive, Tags: map[string]string{"role": "db"}},
+		{Name: "baz", Status: StatusFailed, Tags: map[string]string{"role": "webserver"}},
+	}
+
+	cases := []struct {
+		params *QueryParam
+		nodes  []string
+	}{
+		{&QueryParam{FilterTags: map[string]string{"role": "^web"}}, []string{"foo"}},
+		{&QueryParam{FilterNodes: []string{"bar", "baz", "zip"}}, []string{"bar"}},
+		{&QueryParam{FilterExpr: `not role =~ "^web"`}, []string{"bar"}},
+		{&QueryParam{FilterNodes: []string{"foo"}, FilterTags: map[string]string{"role": "db"}}, []string{}},
+	}
+	for _, tc := range cases {
+		nodes, err := tc.params.expectedNodes(members)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if !reflect.DeepEqual(nodes, tc.nodes) {
+			t.Fatalf("bad: %v %v", tc.params, nodes)
+		}
+	}
+
+	// Filter expressions that don't parse are an error
+	params := &QueryParam{FilterExpr: `role ==`}
+	if _, err := params.expectedNodes(members); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestQueryParams_Sample(t *testing.T) {
+	var members []Member
+	for i := 0; i < 10; i++ {
+		role := "web"
+		if i%2 == 1 {
+			role = "db"
+		}
+		members = append(members, Member{
+			Name:   fmt.Sprintf("node%d", i),
+			Status: StatusAlive,
+			Tags:   map[string]string{"role": role},
+		})
+	}
+
+	cases := []struct {
+		params *QueryParam
+		size   int
+	}{
+		{&QueryParam{SampleSize: 3}, 3},
+		{&QueryParam{SampleSize: 20}, 10},
+		{&QueryParam{SamplePercent: 25}, 3},
+		{&QueryParam{SamplePercent: 100}, 10},
+		{&QueryParam{SampleSize: 2, SamplePercent: 50}, 2},
+		{&QueryParam{SampleSize: 4, FilterTags: map[string]string{"role": "db"}}, 4},
+		{&QueryParam{SamplePercent: 50, FilterNodes: []string{"node1", "node2"}}, 1},
+	}
+	for _, tc := range cases {
+		p, err := tc.params.sample(members)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if len(p.FilterNodes) != tc.size {
+			t.Fatalf("bad: %v %v", tc.params, p.FilterNodes)
+		}
+		if tc.params.FilterNodes != nil && len(tc.params.FilterNodes) != 2 {
+			t.Fatalf("params modified: %v", tc.params.FilterNodes)
+		}
+
+		// The sample only holds distinct members that pass the filters
+		matching, err := tc.params.expectedNodes(members)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		seen := make(map[string]struct{})
+		for _, node := range p.FilterNodes {
+			if !slices.Contains(matching, node) {
+				t.Fatalf("bad: %v %v", tc.params, p.FilterNodes)
+			}
+			if _, ok := seen[node]; ok {
+				t.Fatalf("duplicate: %v", p.FilterNodes)
+			}
+			seen[node] = struct{}{}
+		}
+	}
+
+	bad := []*QueryParam{
+		{SampleSize: -1},
+		{SamplePercent: 101},
+		{SampleSize: 1, FilterNodes: []string{"nope"}},
+	}
+	for _, params := range bad {
+		if _, err := params.sample(members); err == nil {
+			t.Fatalf("expected error: %v", params)
+		}
+	}
+}
+
+func TestQueryResponse_AddChunk(t *testing.T) {
+	resp := newQueryResponse(2, &messageQuery{Timeout: time.Minute})
+	chunk := func(from string, i, n uint32, payload string) *messageQueryResponse {
+		return &messageQueryResponse{From: from, Chunk: i, Chunks: n, Payload: []byte(payload)}
+	}
+
+	// Fragments are reassembled in order, ignoring duplicates
+	for _, c := range []*messageQueryResponse{
+		chunk("foo", 2, 3, "baz"),
+		chunk("foo", 0, 3, "foo"),
+		chunk("foo", 0, 3, "foo"),
+	} {
+		if _, done, err := resp.addChunk(c, 1024); err != nil || done {
+			t.Fatalf("bad: %v %v", done, err)
+		}
+	}
+	payload, done, err := resp.addChunk(chunk("foo", 1, 3, "bar"), 1024)
+	if err != nil || !done || string(payload) != "foobarbaz" {
+		t.Fatalf("bad: %q %v %v", payload, done, err)
+	}
+
+	// Fragments must agree on the number of fragments
+	if _, _, err := resp.addChunk(chunk("bar", 0, 2, "foo"), 1024); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, _, err := resp.addChunk(chunk("bar", 1, 3, "bar"), 1024); err == nil {
+		t.Fatalf("expected error")
+	}
+	if _, _, err := resp.addChunk(chunk("bar", 5, 5, "bar"), 1024); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	// The size of the whole response is limited
+	if _, _, err := resp.addChunk(chunk("baz", 0, 2, "foo"), 4); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, _, err := resp.addChunk(chunk("baz", 1, 2, "bar"), 4); err == nil {
+		t.Fatalf("expected error")
+	}
+	if len(resp.chunks) != 0 || len(resp.chunkSets) != 0 || resp.chunkBytes != 0 {
+		t.Fatalf("bad: %v %v %d", resp.chunks, resp.chunkSets, resp.chunkBytes)
+	}
+
+	// Each node can only have a few partial responses at once
+	for i := 0; i < maxChunkedPerNode; i++ {
+		c := chunk("zap", 0, 2, "ab")
+		c.Seq = uint32(i)
+		if _, _, err := resp.addChunk(c, 4); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	c := chunk("zap", 0, 2, "ab")
+	c.Seq = maxChunkedPerNode
+	if _, _, err := resp.addChunk(c, 4); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	// The partial responses buffered for the query are limited
+	for i := 0; ; i++ {
+		_, _, err := resp.addChunk(chunk(fmt.Sprintf("node%d", i), 0, 2, "ab"), 4)
+		if err == nil {
+			continue
+		}
+		if i != (4*maxChunkedBufferFactor-2*maxChunkedPerNode)/2 {
+			t.Fatalf("bad: %d %v", i, err)
+		}
+		break
+	}
+	if resp.chunkBytes != 4*maxChunkedBufferFactor {
+		t.Fatalf("bad: %d", resp.chunkBytes)
+	}
+
+	// Nothing is delivered once the query is closed
+	resp.Close()
+	if _, done, err := resp.addChunk(chunk("zip", 0, 1, "foo"), 1024); err != nil || done {
+		t.Fatalf("bad: %v %v", done, err)
+	}
+}
+
+func TestQueryResponse_SendOrderedResponse(t *testing.T) {
+	q := &messageQuery{ID: 1, Timeout: time.Second, Flags: queryFlagMultiResponse}
+	resp := newQueryResponse(1, q)
+	send := func(from string, seq uint32, done bool) {
+		m := &messageQueryResponse{From: from, Seq: seq}
+		if done {
+			m.Flags |= queryFlagDone
+		}
+		if err := resp.sendOrderedResponse(m, []byte(fmt.Sprintf("%s%d", from, seq))); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Responses are delivered in order, ignoring duplicates, and nothing
+	// is delivered after the last response
+	send("foo", 1, false)
+	send("foo", 3, true)
+	send("foo", 0, false)
+	send("foo", 0, false)
+	send("foo", 2, false)
+	send("foo", 4, false)
+	send("foo", 0, true)
+
+	var got []string
+	for len(resp.respCh) > 0 {
+		nr := <-resp.respCh
+		got = append(got, fmt.Sprintf("%s:%d:%v", nr.Payload, nr.Seq, nr.Partial))
+	}
+	expected := []string{"foo0:0:true", "foo1:1:true", "foo2:2:true", "foo3:3:false"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("bad: %v", got)
+	}
+	if !resp.hasResponse("foo") || len(resp.streams) != 0 {
+		t.Fatalf("bad: %v", resp.streams)
+	}
+
+	// The number of held back responses is limited
+	for i := 1; i <= maxPendingResponses; i++ {
+		send("bar", uint32(i), false)
+	}
+	m := &messageQueryResponse{From: "bar", Seq: maxPendingResponses + 1}
+	if err := resp.sendOrderedResponse(m, nil); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestQueryResponse_Collect_MultiResponse(t *testing.T) {
+	q := &messageQuery{ID: 1, Timeout: time.Second, Flags: queryFlagMultiResponse}
+	resp := newQueryResponse(2, q)
+	resp.expected = []string{"foo", "bar"}
+
+	resp.sendOrderedResponse(&messageQueryResponse{From: "foo", Seq: 0}, []byte("1"))
+	resp.sendOrderedResponse(&messageQueryResponse{From: "foo", Seq: 1, Flags: queryFlagDone}, []byte("2"))
+	resp.sendOrderedResponse(&messageQueryResponse{From: "bar", Seq: 0}, []byte("3"))
+
+	// bar never sends its last response
+	time.AfterFunc(50*time.Millisecond, resp.Close)
+	result, err := resp.Collect(context.Background())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	expected := map[string][]byte{"foo": []byte("12"), "bar": []byte("3")}
+	if !reflect.DeepEqual(result.Responses, expected) {
+		t.Fatalf("bad: %v", result.Responses)
+	}
+	if !reflect.DeepEqual(result.NoResponse, []string{"bar"}) {
+		t.Fatalf("bad: %v", result.NoResponse)
+	}
+}
+
+func TestQueryResponse_Collect(t *testing.T) {
+	q := &messageQuery{ID: 1, Timeout: time.Second, Flags: queryFlagAck}
+	resp := newQueryResponse(4, q)
+	resp.expected = []string{"foo", "bar", "baz"}
+
+	resp.sendAck(&messageQueryResponse{From: "foo"})
+	resp.sendAck(&messageQueryResponse{From: "bar"})
+	resp.sendResponse(NodeResponse{From: "foo", Payload: []byte("1")})
+	resp.sendResponse(NodeResponse{From: "zip", Payload: []byte("2")})
+
+	// The query runs until it is closed since baz never responds
+	time.AfterFunc(50*time.Millisecond, resp.Close)
+	result, err := resp.Collect(context.Background())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	expected := &QueryResult{
+		Responses:  map[string][]byte{"foo": []byte("1"), "zip": []byte("2")},
+		Acks:       []string{"foo", "bar"},
+		Expected:   []string{"foo", "bar", "baz"},
+		NoAck:      []string{"baz"},
+		NoResponse: []string{"bar", "baz"},
+		Duration:   result.Duration,
+	}
+	if !reflect.DeepEqual(result, expected) {
+		t.Fatalf("bad: %#v", result)
+	}
+	if result.Duration < 50*time.Millisecond {
+		t.Fatalf("bad: %v", result.Duration)
+	}
+}
+
+func TestQueryResponse_Collect_Complete(t *testing.T) {
+	q := &messageQuery{ID: 1, Timeout: time.Minute}
+	resp := newQueryResponse(4, q)
+	resp.expected = []string{"foo", "bar"}
+	defer resp.Close()
+
+	resp.sendResponse(NodeResponse{From: "foo", Payload: []byte("1")})
+	resp.sendResponse(NodeResponse{From: "bar", Payload: []byte("2")})
+
+	// Returns as soon as every expected node responded
+	result, err := resp.Collect(context.Background())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(result.Responses) != 2 || len(result.NoResponse) != 0 || len(result.NoAck) != 0 {
+		t.Fatalf("bad: %#v", result)
+	}
+}
+
+func TestQueryResponse_Collect_Context(t *testing.T) {
+	q := &messageQuery{ID: 1, Timeout: time.Minute}
+	resp := newQueryResponse(4, q)
+	defer resp.Close()
+
+	resp.sendResponse(NodeResponse{From: "foo", Payload: []byte("1")})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	result, err := resp.Collect(ctx)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("err: %v", err)
+	}
+	if string(result.Responses["foo"]) != "1" || result.Expected != nil {
+		t.Fatalf("bad: %#v", result)
+	}
+}
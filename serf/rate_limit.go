@@ -0,0 +1,162 @@
+// Copyright IBM Corp. 2013, 2026
+// SPDX-License-Identifier: MPL-2.0
+
+package serf
+
+import (
+	"sync"
+	"time"
+
+	metrics "github.com/hashicorp/go-metrics/compat"
+)
+
+// maxRateBuckets is the number of token buckets a rateLimiter keeps. Once
+// there are as many, the buckets that have refilled are removed, or the least
+// recently used one if none have.
+const maxRateBuckets = 1024
+
+// RateLimit limits how often something may happen with a token bucket,
+// which holds up to Burst tokens and is refilled at Rate tokens per second.
+type RateLimit struct {
+	// Rate is the average number allowed per second. A zero Rate disables
+	// the limit.
+	Rate float64
+
+	// Burst is the number allowed at once, defaulting to 1.
+	Burst int
+}
+
+func (l RateLimit) burst() float64 {
+	if l.Burst < 1 {
+		return 1
+	}
+	return float64(l.Burst)
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// refill adds the tokens earned since the bucket was last used
+func (b *tokenBucket) refill(limit RateLimit, now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * limit.Rate
+		b.last = now
+	}
+	if burst := limit.burst(); b.tokens > burst {
+		b.tokens = burst
+	}
+}
+
+// rateLimiter keeps a token bucket for each key, such as an event name,
+// with a default limit that can be overridden for specific keys
+type rateLimiter struct {
+	limit     RateLimit
+	overrides map[string]RateLimit
+
+	lock    sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+func newRateLimiter(limit RateLimit, overrides map[string]RateLimit) *rateLimiter {
+	return &rateLimiter{
+		limit:     limit,
+		overrides: overrides,
+		buckets:   make(map[string]*tokenBucket),
+	}
+}
+
+func (r *rateLimiter) limitFor(key string) RateLimit {
+	if limit, ok := r.overrides[key]; ok {
+		return limit
+	}
+	return r.limit
+}
+
+// allow takes a token from the bucket of a key, returning false if there
+// are none left
+func (r *rateLimiter) allow(key string, now time.Time) bool {
+	limit := r.limitFor(key)
+	if limit.Rate <= 0 {
+		return true
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	b, ok := r.buckets[key]
+	if !ok {
+		if len(r.buckets) >= maxRateBuckets {
+			r.prune(now)
+		}
+		if len(r.buckets) >= maxRateBuckets {
+			r.evictOldest()
+		}
+		b = &tokenBucket{tokens: limit.burst(), last: now}
+		r.buckets[key] = b
+	}
+
+	b.refill(limit, now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// refund returns a token taken by allow to the bucket of a key, for when
+// the action it allowed was rejected by another limit
+func (r *rateLimiter) refund(key string) {
+	limit := r.limitFor(key)
+	if limit.Rate <= 0 {
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if b, ok := r.buckets[key]; ok {
+		b.tokens = min(b.tokens+1, limit.burst())
+	}
+}
+
+// prune removes the buckets that have refilled, as they behave the same as
+// a new bucket. The lock must be held.
+func (r *rateLimiter) prune(now time.Time) {
+	for key, b := range r.buckets {
+		limit := r.limitFor(key)
+		if b.tokens+now.Sub(b.last).Seconds()*limit.Rate >= limit.burst() {
+			delete(r.buckets, key)
+		}
+	}
+}
+
+// evictOldest removes the least recently used bucket. The lock must be held.
+func (r *rateLimiter) evictOldest() {
+	var oldest string
+	var last time.Time
+	for key, b := range r.buckets {
+		if last.IsZero() || b.last.Before(last) {
+			oldest, last = key, b.last
+		}
+	}
+	delete(r.buckets, oldest)
+}
+
+// userEventAllowed checks a user event against the rate limits of its name
+// and of the node it originates from. Events rejected by the limit of their
+// node don't count against the limit of their name, so a noisy node can't
+// throttle a name for everyone. Events without an origin share the limit of
+// an empty node name.
+func (s *Serf) userEventAllowed(name, origin string) bool {
+	now := time.Now()
+	allowed := s.eventNameLimiter.allow(name, now)
+	if allowed && !s.eventNodeLimiter.allow(origin, now) {
+		s.eventNameLimiter.refund(name)
+		allowed = false
+	}
+	if !allowed {
+		metrics.IncrCounterWithLabels([]string{"serf", "events", "throttled"}, 1, s.metricLabels)
+	}
+	return allowed
+}
@@ -0,0 +1,199 @@
+// Copyright IBM Corp. 2013, 2026
+// SPDX-License-Identifier: MPL-2.0
+
+package serf
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/serf/testutil"
+)
+
+func TestRateLimiter(t *testing.T) {
+	r := newRateLimiter(RateLimit{Rate: 1, Burst: 2}, map[string]RateLimit{
+		"slow": {Rate: 0.1},
+		"free": {},
+	})
+	now := time.Now()
+
+	// The burst is allowed at once
+	for i := 0; i < 2; i++ {
+		if !r.allow("foo", now) {
+			t.Fatalf("should allow %d", i)
+		}
+	}
+	if r.allow("foo", now) {
+		t.Fatalf("should throttle")
+	}
+
+	// Other keys have their own bucket
+	if !r.allow("bar", now) {
+		t.Fatalf("should allow")
+	}
+
+	// Tokens are refilled over time, up to the burst
+	if !r.allow("foo", now.Add(time.Second)) {
+		t.Fatalf("should allow")
+	}
+	if r.allow("foo", now.Add(time.Second)) {
+		t.Fatalf("should throttle")
+	}
+	later := now.Add(time.Hour)
+	for i := 0; i < 2; i++ {
+		if !r.allow("foo", later) {
+			t.Fatalf("should allow %d", i)
+		}
+	}
+	if r.allow("foo", later) {
+		t.Fatalf("should throttle")
+	}
+
+	// Overrides replace the default limit, with a burst of 1
+	if !r.allow("slow", now) || r.allow("slow", now.Add(time.Second)) {
+		t.Fatalf("bad slow limit")
+	}
+	for i := 0; i < 10; i++ {
+		if !r.allow("free", now) {
+			t.Fatalf("should allow %d", i)
+		}
+	}
+}
+
+func TestRateLimiter_refund(t *testing.T) {
+	r := newRateLimiter(RateLimit{Rate: 1, Burst: 2}, nil)
+	now := time.Now()
+
+	if !r.allow("foo", now) || !r.allow("foo", now) || r.allow("foo", now) {
+		t.Fatalf("bad burst")
+	}
+	r.refund("foo")
+	if !r.allow("foo", now) || r.allow("foo", now) {
+		t.Fatalf("should allow once")
+	}
+
+	// Refunds don't go over the burst
+	later := now.Add(time.Hour)
+	r.allow("foo", later)
+	r.refund("foo")
+	r.refund("foo")
+	for i := 0; i < 2; i++ {
+		if !r.allow("foo", later) {
+			t.Fatalf("should allow %d", i)
+		}
+	}
+	if r.allow("foo", later) {
+		t.Fatalf("should throttle")
+	}
+}
+
+func TestSerf_userEventAllowed(t *testing.T) {
+	s := &Serf{
+		eventNameLimiter: newRateLimiter(RateLimit{Rate: 0.001, Burst: 2}, nil),
+		eventNodeLimiter: newRateLimiter(RateLimit{Rate: 0.001, Burst: 1}, nil),
+	}
+
+	if !s.userEventAllowed("deploy", "noisy") {
+		t.Fatalf("should allow")
+	}
+
+	// Events throttled by the limit of their node leave the name budget
+	// to the other nodes
+	for i := 0; i < 5; i++ {
+		if s.userEventAllowed("deploy", "noisy") {
+			t.Fatalf("should throttle %d", i)
+		}
+	}
+	if !s.userEventAllowed("deploy", "quiet") {
+		t.Fatalf("should allow")
+	}
+	if s.userEventAllowed("deploy", "other") {
+		t.Fatalf("should throttle")
+	}
+}
+
+func TestSerf_userEvent_nodeLimit(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	pub, priv := testSigningKey(t)
+	c := testConfig(t, ip1)
+	c.UserEventNodeRateLimit = RateLimit{Rate: 0.001, Burst: 1}
+	c.TrustedKeys = map[string]ed25519.PublicKey{"signer": pub}
+	s, err := Create(c)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s.Shutdown()
+
+	// Remote events can't skip the node limit by claiming to come from
+	// this node or from no node at all, and signed events are limited by
+	// their signer whatever their origin
+	ltime := LamportTime(0)
+	send := func(origin, signer string) bool {
+		ltime++
+		msg := messageUserEvent{LTime: ltime, Name: "deploy", Origin: origin, Signer: signer}
+		if signer != "" {
+			msg.Signature = ed25519.Sign(priv, msg.signedData())
+		}
+		return s.handleUserEvent(&msg)
+	}
+	for _, origin := range []string{c.NodeName, "", "signer"} {
+		signer := ""
+		if origin == "signer" {
+			signer = "signer"
+		}
+		if !send(origin, signer) {
+			t.Fatalf("should allow %q", origin)
+		}
+		if send(origin, signer) {
+			t.Fatalf("should throttle %q", origin)
+		}
+	}
+	if send("", "signer") {
+		t.Fatalf("should throttle the signer")
+	}
+}
+
+func TestRateLimiter_prune(t *testing.T) {
+	r := newRateLimiter(RateLimit{Rate: 1}, nil)
+	now := time.Now()
+
+	for i := 0; i < maxRateBuckets; i++ {
+		r.allow(fmt.Sprintf("key%d", i), now)
+	}
+	if len(r.buckets) != maxRateBuckets {
+		t.Fatalf("bad: %d", len(r.buckets))
+	}
+
+	// The refilled buckets are removed to make room
+	if !r.allow("key0", now.Add(time.Second)) {
+		t.Fatalf("should allow")
+	}
+	r.allow("new", now.Add(2*time.Second))
+	if len(r.buckets) != 1 {
+		t.Fatalf("bad: %d", len(r.buckets))
+	}
+
+	// Once full of buckets that haven't refilled, the least recently used
+	// one is removed
+	r = newRateLimiter(RateLimit{Rate: 0.001}, nil)
+	for i := 0; i < maxRateBuckets; i++ {
+		r.allow(fmt.Sprintf("key%d", i), now.Add(time.Duration(i)*time.Millisecond))
+	}
+	r.allow("key0", now.Add(time.Second))
+	r.allow("new", now.Add(time.Second))
+	if len(r.buckets) != maxRateBuckets {
+		t.Fatalf("bad: %d", len(r.buckets))
+	}
+	if _, ok := r.buckets["key1"]; ok {
+		t.Fatalf("key1 should be evicted")
+	}
+	for _, key := range []string{"key0", "key2", "new"} {
+		if _, ok := r.buckets[key]; !ok {
+			t.Fatalf("%s should be kept", key)
+		}
+	}
+}
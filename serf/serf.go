@@ -5,8 +5,11 @@ package serf
 
 import (
 	"bytes"
+	"context"
+	"crypto/ed25519"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"math/rand"
@@ -30,7 +33,7 @@ import (
 // version to memberlist below.
 const (
 	ProtocolVersionMin uint8 = 2
-	ProtocolVersionMax       = 5
+	ProtocolVersionMax       = 6
 )
 
 const (
@@ -45,6 +48,10 @@ var (
 	// FeatureNotSupported is returned if a feature cannot be used
 	// due to an older protocol version being used.
 	FeatureNotSupported = fmt.Errorf("Feature not supported") //nolint:staticcheck
+
+	// UserEventThrottled is returned if a user event is over the rate
+	// limit of its name or of this node.
+	UserEventThrottled = fmt.Errorf("User event rate limit exceeded") //nolint:staticcheck
 )
 
 // ReconnectTimeoutOverrider is an interface that can be implemented to allow overriding
@@ -64,6 +71,7 @@ type Serf struct {
 	clock      LamportClock
 	eventClock LamportClock
 	queryClock LamportClock
+	kvClock    LamportClock
 
 	broadcasts    *memberlist.TransmitLimitedQueue
 	config        *Config
@@ -85,6 +93,40 @@ type Serf struct {
 	eventMinTime    LamportTime
 	eventLock       sync.RWMutex
 
+	// eventPayloads holds the payloads of large user events by their
+	// hash, and eventPayloadWaits the fetches waiting for them
+	eventPayloads     map[string]*eventPayload
+	eventPayloadWaits map[string][]chan []byte
+	eventPayloadLock  sync.Mutex
+
+	// eventPayloadFetchCh queues the large user events whose payload
+	// is fetched by the workers
+	eventPayloadFetchCh chan *eventPayloadFetch
+
+	// eventSeq is the sequence number of the last user event sent, and
+	// originSeqs tracks those of the events received from each node
+	eventSeq      uint64
+	eventSeqLock  sync.Mutex
+	originSeqs    map[string]*originSeqs
+	originSeqLock sync.Mutex
+
+	// eventNameLimiter and eventNodeLimiter enforce the rate limits of
+	// user events by name and by originating node
+	eventNameLimiter *rateLimiter
+	eventNodeLimiter *rateLimiter
+
+	// kv is the replicated key/value store, including the deleted keys
+	// until they are reaped. Writes are gossiped with their own queue, so
+	// they can't delay the intents.
+	kv           map[string]*kvEntry
+	kvLock       sync.RWMutex
+	kvBroadcasts *memberlist.TransmitLimitedQueue
+
+	// extendedTags holds the tags of the nodes that are too large for
+	// their meta, by node name
+	extendedTags     map[string]*extendedTags
+	extendedTagsLock sync.Mutex
+
 	queryBroadcasts *memberlist.TransmitLimitedQueue
 	queryBuffer     []*queries
 	queryMinTime    LamportTime
@@ -208,13 +250,21 @@ type nodeIntent struct {
 type userEvent struct {
 	Name    string
 	Payload []byte
+	Hash    []byte `codec:",omitempty"`
+	Origin  string `codec:",omitempty"`
+	Seq     uint64 `codec:",omitempty"`
+
+	Signer    string `codec:",omitempty"`
+	Signature []byte `codec:",omitempty"`
 }
 
+// Equals compares the contents of events, ignoring the signature, as older
+// nodes that replay an event during a push/pull don't keep it.
 func (ue *userEvent) Equals(other *userEvent) bool {
 	if ue.Name != other.Name {
 		return false
 	}
-	return bytes.Equal(ue.Payload, other.Payload)
+	return bytes.Equal(ue.Payload, other.Payload) && bytes.Equal(ue.Hash, other.Hash)
 }
 
 // userEvents stores all the user events at a specific time
@@ -232,6 +282,7 @@ type queries struct {
 const (
 	snapshotSizeLimit  = 128 * 1024 // Maximum 128 KB snapshot
 	UserEventSizeLimit = 9 * 1024   // Maximum 9KB for event name and payload
+	kvStoreSizeLimit   = 4 << 20    // Maximum 4MB for the key/value store
 )
 
 // Create creates a new Serf instance, starting all the background tasks
@@ -252,6 +303,12 @@ func Create(conf *Config) (*Serf, error) {
 	if conf.UserEventSizeLimit > UserEventSizeLimit {
 		return nil, fmt.Errorf("user event size limit exceeds limit of %d bytes", UserEventSizeLimit)
 	}
+	if conf.KVSizeLimit > UserEventSizeLimit {
+		return nil, fmt.Errorf("key/value size limit exceeds limit of %d bytes", UserEventSizeLimit)
+	}
+	if conf.KVMaxKeys*conf.KVSizeLimit > kvStoreSizeLimit {
+		return nil, fmt.Errorf("key/value store size exceeds limit of %d bytes", kvStoreSizeLimit)
+	}
 
 	logger := conf.Logger
 	if logger == nil {
@@ -275,8 +332,8 @@ func Create(conf *Config) (*Serf, error) {
 	serf.eventJoinIgnore.Store(false)
 
 	// Check that the meta data length is okay
-	if len(serf.encodeTags(conf.Tags)) > memberlist.MetaMaxSize {
-		return nil, fmt.Errorf("Encoded length of tags exceeds limit of %d bytes", memberlist.MetaMaxSize)
+	if _, err := serf.encodeMetaTags(conf.Tags); err != nil {
+		return nil, err
 	}
 	if err := serf.ValidateNodeNames(); err != nil {
 		return nil, err
@@ -369,6 +426,10 @@ func Create(conf *Config) (*Serf, error) {
 		NumNodes:       serf.NumNodes,
 		RetransmitMult: conf.MemberlistConfig.RetransmitMult,
 	}
+	serf.kvBroadcasts = &memberlist.TransmitLimitedQueue{
+		NumNodes:       serf.NumNodes,
+		RetransmitMult: conf.MemberlistConfig.RetransmitMult,
+	}
 
 	// Create the buffer for recent intents
 	serf.recentIntents = make(map[string]nodeIntent)
@@ -376,12 +437,21 @@ func Create(conf *Config) (*Serf, error) {
 	// Create a buffer for events and queries
 	serf.eventBuffer = make([]*userEvents, conf.EventBuffer)
 	serf.queryBuffer = make([]*queries, conf.QueryBuffer)
+	serf.eventPayloads = make(map[string]*eventPayload)
+	serf.eventPayloadWaits = make(map[string][]chan []byte)
+	serf.eventPayloadFetchCh = make(chan *eventPayloadFetch, eventPayloadFetchQueue)
+	serf.originSeqs = make(map[string]*originSeqs)
+	serf.eventNameLimiter = newRateLimiter(conf.UserEventRateLimit, conf.UserEventRateLimits)
+	serf.eventNodeLimiter = newRateLimiter(conf.UserEventNodeRateLimit, nil)
+	serf.kv = make(map[string]*kvEntry)
+	serf.extendedTags = make(map[string]*extendedTags)
 
 	// Ensure our lamport clock is at least 1, so that the default
 	// join LTime of 0 does not cause issues
 	serf.clock.Increment()
 	serf.eventClock.Increment()
 	serf.queryClock.Increment()
+	serf.kvClock.Increment()
 
 	// Restore the clock from snap if we have one
 	serf.clock.Witness(oldClock)
@@ -429,6 +499,10 @@ func Create(conf *Config) (*Serf, error) {
 	go serf.checkQueueDepth("Intent", serf.broadcasts)
 	go serf.checkQueueDepth("Event", serf.eventBroadcasts)
 	go serf.checkQueueDepth("Query", serf.queryBroadcasts)
+	go serf.checkQueueDepth("KV", serf.kvBroadcasts)
+	for range eventPayloadFetchWorkers {
+		go serf.fetchEventPayloads()
+	}
 
 	// Attempt to re-join the cluster if we have known nodes
 	if len(prev) != 0 {
@@ -461,9 +535,22 @@ func (s *Serf) KeyManager() *KeyManager {
 // name and payload. If the configured size limit is exceeded and error will be returned.
 // If coalesce is enabled, nodes are allowed to coalesce this event.
 // Coalescing is only available starting in v0.2
+//
+// Events over the size limit, but within LargeUserEventSizeLimit, gossip a
+// hash of the payload in its place, and nodes fetch the payload from us.
+// This requires all the alive members to support it.
 func (s *Serf) UserEvent(name string, payload []byte, coalesce bool) error {
 	payloadSizeBeforeEncoding := len(name) + len(payload)
 
+	var hash []byte
+	if payloadSizeBeforeEncoding > s.config.UserEventSizeLimit &&
+		payloadSizeBeforeEncoding <= s.config.LargeUserEventSizeLimit &&
+		s.ProtocolVersion() >= largeUserEventProtocol &&
+		s.largeUserEventsSupported() {
+		hash = hashEventPayload(payload)
+		payloadSizeBeforeEncoding = len(name) + len(hash)
+	}
+
 	// Check size before encoding to prevent needless encoding and return early if it's over the specified limit.
 	if payloadSizeBeforeEncoding > s.config.UserEventSizeLimit {
 		return fmt.Errorf(
@@ -479,12 +566,27 @@ func (s *Serf) UserEvent(name string, payload []byte, coalesce bool) error {
 		)
 	}
 
+	// Events take the next sequence number once they are sure to be sent,
+	// so the other nodes can detect the events they missed
+	s.eventSeqLock.Lock()
+	defer s.eventSeqLock.Unlock()
+
 	// Create a message
 	msg := messageUserEvent{
 		LTime:   s.eventClock.Time(),
 		Name:    name,
 		Payload: payload,
 		CC:      coalesce,
+		Origin:  s.config.NodeName,
+		Seq:     s.eventSeq + 1,
+	}
+	if hash != nil {
+		msg.Payload = nil
+		msg.Hash = hash
+	}
+	if s.config.SigningKey != nil {
+		msg.Signer = s.config.NodeName
+		msg.Signature = ed25519.Sign(s.config.SigningKey, msg.signedData())
 	}
 
 	// Start broadcasting the event
@@ -494,24 +596,41 @@ func (s *Serf) UserEvent(name string, payload []byte, coalesce bool) error {
 	}
 
 	// Check the size after encoding to be sure again that
-	// we're not attempting to send over the specified size limit.
-	if len(raw) > s.config.UserEventSizeLimit {
+	// we're not attempting to send over the specified size limit. The
+	// fields identifying the origin of the event and its signature don't
+	// count against the limits, so they don't shrink what can be sent.
+	metadata, err := s.userEventMetadataSize(&msg)
+	if err != nil {
+		return err
+	}
+	if len(raw)-metadata > s.config.UserEventSizeLimit {
 		return fmt.Errorf(
 			"encoded user event exceeds configured limit of %d bytes after encoding",
 			s.config.UserEventSizeLimit,
 		)
 	}
 
-	if len(raw) > UserEventSizeLimit {
+	if len(raw)-metadata > UserEventSizeLimit {
 		return fmt.Errorf(
 			"encoded user event exceeds reasonable limit of %d bytes after encoding",
 			UserEventSizeLimit,
 		)
 	}
 
+	if !s.userEventAllowed(name, s.config.NodeName) {
+		return UserEventThrottled
+	}
+
+	s.eventSeq = msg.Seq
 	s.eventClock.Increment()
 
+	// Keep the payload for the nodes fetching it
+	if hash != nil {
+		s.storeEventPayload(msg.LTime, hash, payload)
+	}
+
 	// Process update locally
+	msg.local = true
 	s.handleUserEvent(&msg)
 
 	s.eventBroadcasts.QueueBroadcast(&broadcast{
@@ -520,11 +639,93 @@ func (s *Serf) UserEvent(name string, payload []byte, coalesce bool) error {
 	return nil
 }
 
+// userEventMetadataSize returns the encoded size of the fields of a user event
+// that identify its origin and hold its signature
+func (s *Serf) userEventMetadataSize(msg *messageUserEvent) (int, error) {
+	metadata := messageUserEvent{
+		Origin:    msg.Origin,
+		Seq:       msg.Seq,
+		Signer:    msg.Signer,
+		Signature: msg.Signature,
+	}
+	withMetadata, err := encodeMessage(messageUserEventType, &metadata, s.msgpackUseNewTimeFormat)
+	if err != nil {
+		return 0, err
+	}
+	without, err := encodeMessage(messageUserEventType, &messageUserEvent{}, s.msgpackUseNewTimeFormat)
+	if err != nil {
+		return 0, err
+	}
+	return len(withMetadata) - len(without), nil
+}
+
+// directMessageProtocol is the protocol version required to send and
+// receive direct messages
+const directMessageProtocol = 6
+
+// SendToMember sends a payload to a single member over a reliable
+// connection, which is encrypted like gossip when a keyring is in use. The
+// member receives it as a DirectMessageEvent. This requires protocol version
+// 6 to be in use by both nodes.
+func (s *Serf) SendToMember(name string, payload []byte) error {
+	if s.ProtocolVersion() < directMessageProtocol {
+		return FeatureNotSupported
+	}
+	if len(payload) > s.config.DirectMessageSizeLimit {
+		return fmt.Errorf("direct message exceeds limit of %d bytes", s.config.DirectMessageSizeLimit)
+	}
+
+	msg := messageDirect{
+		From:    s.config.NodeName,
+		Payload: payload,
+	}
+	if name == s.config.NodeName {
+		s.handleDirectMessage(&msg)
+		return nil
+	}
+
+	s.memberLock.RLock()
+	m, ok := s.members[name]
+	var node *memberlist.Node
+	if ok {
+		node = &memberlist.Node{Name: m.Name, Addr: m.Addr, Port: m.Port}
+	}
+	s.memberLock.RUnlock()
+	switch {
+	case !ok:
+		return fmt.Errorf("unknown member %q", name)
+	case m.Status != StatusAlive:
+		return fmt.Errorf("member %q is %s", name, m.Status)
+	case m.DelegateMax < directMessageProtocol:
+		return fmt.Errorf("member %q does not support direct messages", name)
+	}
+
+	raw, err := encodeMessage(messageDirectType, &msg, s.msgpackUseNewTimeFormat)
+	if err != nil {
+		return err
+	}
+	if err := s.memberlist.SendReliable(node, raw); err != nil {
+		return fmt.Errorf("failed to send direct message: %v", err)
+	}
+	metrics.IncrCounterWithLabels([]string{"serf", "direct", "sent"}, 1, s.metricLabels)
+	return nil
+}
+
 // Query is used to broadcast a new query. The query must be fairly small,
 // and an error will be returned if the size limit is exceeded. This is only
 // available with protocol version 4 and newer. Query parameters are optional,
 // and if not provided, a sane set of defaults will be used.
 func (s *Serf) Query(name string, payload []byte, params *QueryParam) (*QueryResponse, error) {
+	return s.QueryContext(context.Background(), name, payload, params)
+}
+
+// QueryContext is like Query, but the query is closed once the context is
+// done, and its timeout is capped by the context deadline.
+func (s *Serf) QueryContext(ctx context.Context, name string, payload []byte, params *QueryParam) (*QueryResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	// Check that the latest protocol is in use
 	if s.ProtocolVersion() < 4 {
 		return nil, FeatureNotSupported
@@ -537,6 +738,39 @@ func (s *Serf) Query(name string, payload []byte, params *QueryParam) (*QueryRes
 		params.Timeout = s.DefaultQueryTimeout()
 	}
 
+	// Don't leave the query open past the context deadline
+	if deadline, ok := ctx.Deadline(); ok {
+		if timeout := time.Until(deadline); timeout < params.Timeout {
+			p := *params
+			p.Timeout = max(timeout, time.Millisecond)
+			params = &p
+		}
+	}
+
+	// Multiple responses are not understood by older nodes
+	if params.MultipleResponses && s.ProtocolVersion() < 6 {
+		return nil, FeatureNotSupported
+	}
+
+	// Expression filters are not understood by older nodes
+	if params.FilterExpr != "" {
+		if s.ProtocolVersion() < 6 {
+			return nil, FeatureNotSupported
+		}
+		if _, err := ParseTagExpr(params.FilterExpr); err != nil {
+			return nil, err
+		}
+	}
+
+	// Restrict the query to a sample of the matching nodes
+	if params.SampleSize != 0 || params.SamplePercent != 0 {
+		sampled, err := params.sample(s.Members())
+		if err != nil {
+			return nil, err
+		}
+		params = sampled
+	}
+
 	// Get the local node
 	local := s.memberlist.LocalNode()
 
@@ -551,6 +785,9 @@ func (s *Serf) Query(name string, payload []byte, params *QueryParam) (*QueryRes
 	if params.RequestAck {
 		flags |= queryFlagAck
 	}
+	if params.MultipleResponses {
+		flags |= queryFlagMultiResponse
+	}
 
 	// Create a message
 	q := messageQuery{
@@ -566,6 +803,10 @@ func (s *Serf) Query(name string, payload []byte, params *QueryParam) (*QueryRes
 		Name:        name,
 		Payload:     payload,
 	}
+	if s.config.SigningKey != nil {
+		q.Signer = s.config.NodeName
+		q.Signature = ed25519.Sign(s.config.SigningKey, q.signedData())
+	}
 
 	// Encode the query
 	raw, err := encodeMessage(messageQueryType, &q, s.msgpackUseNewTimeFormat)
@@ -580,8 +821,19 @@ func (s *Serf) Query(name string, payload []byte, params *QueryParam) (*QueryRes
 
 	// Register QueryResponse to track acks and responses
 	resp := newQueryResponse(s.memberlist.NumMembers(), &q)
+	if len(filters) > 0 {
+		if resp.expected, err = params.expectedNodes(s.Members()); err != nil {
+			return nil, err
+		}
+	}
 	s.registerQueryResponse(params.Timeout, resp)
 
+	// Close the query early if the context is done first
+	if ctx.Done() != nil {
+		stop := context.AfterFunc(ctx, resp.Close)
+		time.AfterFunc(params.Timeout, func() { stop() })
+	}
+
 	// Process query locally
 	s.handleQuery(&q)
 
@@ -614,11 +866,13 @@ func (s *Serf) registerQueryResponse(timeout time.Duration, resp *QueryResponse)
 // SetTags is used to dynamically update the tags associated with
 // the local node. This will propagate the change to the rest of
 // the cluster. Blocks until a the message is broadcast out.
+//
+// Tags over the memberlist meta size limit are allowed up to the
+// ExtendedTagsSizeLimit, in which case other nodes get them separately.
 func (s *Serf) SetTags(tags map[string]string) error {
 	// Check that the meta data length is okay
-	if len(s.encodeTags(tags)) > memberlist.MetaMaxSize {
-		return fmt.Errorf("Encoded length of tags exceeds limit of %d bytes",
-			memberlist.MetaMaxSize)
+	if _, err := s.encodeMetaTags(tags); err != nil {
+		return err
 	}
 
 	// Update the config
@@ -633,11 +887,49 @@ func (s *Serf) SetTags(tags map[string]string) error {
 // case that no nodes could be contacted. If ignoreOld is true, then any
 // user messages sent prior to the join will be ignored.
 func (s *Serf) Join(existing []string, ignoreOld bool) (int, error) {
+	return s.JoinContext(context.Background(), existing, ignoreOld)
+}
+
+// JoinContext is like Join, but stops contacting nodes once the context is
+// done. It then returns the number of nodes contacted so far along with the
+// context error. An attempt to contact a node that is already in progress
+// keeps running in the background, and joins the cluster if it succeeds.
+func (s *Serf) JoinContext(ctx context.Context, existing []string, ignoreOld bool) (int, error) {
 	// Do a quick state check
 	if s.State() != SerfAlive {
 		return 0, fmt.Errorf("Serf can't Join after Leave or Shutdown")
 	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
 
+	// Without a context that can be done, join in the foreground
+	if ctx.Done() == nil {
+		return s.join(ctx, existing, ignoreOld, nil)
+	}
+
+	type joinResult struct {
+		num int
+		err error
+	}
+	var joined atomic.Int32
+	resultCh := make(chan joinResult, 1)
+	go func() {
+		num, err := s.join(ctx, existing, ignoreOld, &joined)
+		resultCh <- joinResult{num, err}
+	}()
+
+	select {
+	case r := <-resultCh:
+		return r.num, r.err
+	case <-ctx.Done():
+		return int(joined.Load()), ctx.Err()
+	}
+}
+
+// join contacts the existing nodes, checking the context before each one
+// and counting the nodes contacted in joined if given.
+func (s *Serf) join(ctx context.Context, existing []string, ignoreOld bool, joined *atomic.Int32) (int, error) {
 	// Hold the joinLock, this is to make eventJoinIgnore safe
 	s.joinLock.Lock()
 	defer s.joinLock.Unlock()
@@ -651,8 +943,30 @@ func (s *Serf) Join(existing []string, ignoreOld bool) (int, error) {
 		}()
 	}
 
-	// Have memberlist attempt to join
-	num, err := s.memberlist.Join(existing)
+	// Have memberlist attempt to join. If the context can be done, the
+	// nodes are contacted one at a time so the join can stop in between.
+	var num int
+	var err error
+	if ctx.Done() == nil {
+		num, err = s.memberlist.Join(existing)
+	} else {
+		var errs []error
+		for _, addr := range existing {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				errs = []error{ctxErr}
+				break
+			}
+			n, joinErr := s.memberlist.Join([]string{addr})
+			num += n
+			joined.Add(int32(n))
+			if joinErr != nil {
+				errs = append(errs, joinErr)
+			}
+		}
+		if num == 0 || ctx.Err() != nil {
+			err = errors.Join(errs...)
+		}
+	}
 
 	// If we joined any nodes, broadcast the join message
 	if num > 0 {
@@ -692,6 +1006,14 @@ func (s *Serf) broadcastJoin(ltime LamportTime) error {
 // times.
 // If the Leave broadcast timeout, Leave() will try to finish the sequence as best effort.
 func (s *Serf) Leave() error {
+	return s.LeaveContext(context.Background())
+}
+
+// LeaveContext is like Leave, but stops waiting for the leave to propagate
+// once the context is done, and caps the broadcast timeout by the context
+// deadline. The node is still marked as left, and the context error is
+// returned.
+func (s *Serf) LeaveContext(ctx context.Context) error {
 	// Check the current state
 	s.stateLock.Lock()
 
@@ -737,11 +1059,18 @@ func (s *Serf) Leave() error {
 		case <-notifyCh:
 		case <-time.After(s.config.BroadcastTimeout):
 			s.logger.Printf("[WARN] serf: timeout while waiting for graceful leave")
+		case <-ctx.Done():
+			s.logger.Printf("[WARN] serf: leave cancelled while waiting for graceful leave")
 		}
 	}
 
-	// Attempt the memberlist leave
-	err := s.memberlist.Leave(s.config.BroadcastTimeout)
+	// Attempt the memberlist leave, without waiting past the deadline.
+	// A zero timeout waits forever, so keep it positive.
+	timeout := s.config.BroadcastTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = max(min(timeout, time.Until(deadline)), time.Millisecond)
+	}
+	err := s.memberlist.Leave(timeout)
 	if err != nil {
 		s.logger.Printf("[WARN] serf: timeout waiting for leave broadcast: %s", err.Error())
 	}
@@ -751,7 +1080,10 @@ func (s *Serf) Leave() error {
 	// queue, but this wait is for that message to propagate through the
 	// cluster. In particular, we want to stay up long enough to service
 	// any probes from other nodes before they learn about us leaving.
-	time.Sleep(s.config.LeavePropagateDelay)
+	select {
+	case <-time.After(s.config.LeavePropagateDelay):
+	case <-ctx.Done():
+	}
 
 	// Transition to Left only if we not already shutdown
 	s.stateLock.Lock()
@@ -759,7 +1091,7 @@ func (s *Serf) Leave() error {
 		s.state = SerfLeft
 	}
 	s.stateLock.Unlock()
-	return nil
+	return ctx.Err()
 }
 
 // hasAliveMembers is called to check for any alive members other than
@@ -932,6 +1264,10 @@ func (s *Serf) handleNodeJoin(n *memberlist.Node) {
 		return
 	}
 
+	// Extended tags that are missing are sent in an update event once
+	// they arrive
+	tags, _ := s.memberTags(n.Name, n.Meta)
+
 	var oldStatus MemberStatus
 	member, ok := s.members[n.Name]
 	if !ok {
@@ -941,7 +1277,7 @@ func (s *Serf) handleNodeJoin(n *memberlist.Node) {
 				Name:   n.Name,
 				Addr:   n.Addr,
 				Port:   n.Port,
-				Tags:   s.decodeTags(n.Meta),
+				Tags:   tags,
 				Status: StatusAlive,
 			},
 		}
@@ -969,7 +1305,7 @@ func (s *Serf) handleNodeJoin(n *memberlist.Node) {
 		member.leaveTime = time.Time{}
 		member.Addr = n.Addr
 		member.Port = n.Port
-		member.Tags = s.decodeTags(n.Meta)
+		member.Tags = tags
 	}
 
 	// Update the protocol versions every time we get an event
@@ -1064,10 +1400,15 @@ func (s *Serf) handleNodeUpdate(n *memberlist.Node) {
 		return
 	}
 
-	// Update the member attributes
+	// Update the member attributes. When the tags are too large for the
+	// meta and the new ones are missing, the old ones are kept and the
+	// event is sent once the new ones arrive.
 	member.Addr = n.Addr
 	member.Port = n.Port
-	member.Tags = s.decodeTags(n.Meta)
+	tags, haveTags := s.memberTags(n.Name, n.Meta)
+	if haveTags {
+		member.Tags = tags
+	}
 
 	// Snag the latest versions. NOTE - the current memberlist code will NOT
 	// fire an update event if the metadata (for Serf, tags) stays the same
@@ -1086,6 +1427,9 @@ func (s *Serf) handleNodeUpdate(n *memberlist.Node) {
 	metrics.IncrCounterWithLabels([]string{"serf", "member", "update"}, 1, s.metricLabels)
 
 	// Send an event along
+	if !haveTags {
+		return
+	}
 	s.logger.Printf("[INFO] serf: EventMemberUpdate: %s", member.Name)
 	if s.config.EventCh != nil {
 		s.config.EventCh <- MemberEvent{
@@ -1239,9 +1583,6 @@ func (s *Serf) handleNodeJoinIntent(joinMsg *messageJoin) bool {
 // handleUserEvent is called when a user event broadcast is
 // received. Returns if the message should be rebroadcast.
 func (s *Serf) handleUserEvent(eventMsg *messageUserEvent) bool {
-	// Witness a potentially newer time
-	s.eventClock.Witness(eventMsg.LTime)
-
 	s.eventLock.Lock()
 	defer s.eventLock.Unlock()
 
@@ -1251,7 +1592,7 @@ func (s *Serf) handleUserEvent(eventMsg *messageUserEvent) bool {
 	}
 
 	// Check if this message is too old
-	curTime := s.eventClock.Time()
+	curTime := max(s.eventClock.Time(), eventMsg.LTime)
 	if curTime > LamportTime(len(s.eventBuffer)) &&
 		eventMsg.LTime < curTime-LamportTime(len(s.eventBuffer)) {
 		s.logger.Printf(
@@ -1265,14 +1606,38 @@ func (s *Serf) handleUserEvent(eventMsg *messageUserEvent) bool {
 	// Check if we've already seen this
 	idx := eventMsg.LTime % LamportTime(len(s.eventBuffer))
 	seen := s.eventBuffer[idx]
-	userEvent := userEvent{Name: eventMsg.Name, Payload: eventMsg.Payload}
+	userEvent := userEvent{
+		Name:    eventMsg.Name,
+		Payload: eventMsg.Payload,
+		Hash:    eventMsg.Hash,
+		Origin:  eventMsg.Origin,
+		Seq:     eventMsg.Seq,
+
+		Signer:    eventMsg.Signer,
+		Signature: eventMsg.Signature,
+	}
 	if seen != nil && seen.LTime == eventMsg.LTime {
 		for _, previous := range seen.Events {
 			if previous.Equals(&userEvent) {
 				return false
 			}
 		}
-	} else {
+	}
+
+	// Only new events are verified, since each event is received several
+	// times through gossip
+	signer, ok := s.verifySignature(eventMsg.Origin, eventMsg.Signer, eventMsg.Signature,
+		eventMsg.signedData)
+	if !ok {
+		s.logger.Printf("[WARN] serf: Dropping event %s with untrusted signature from %q",
+			eventMsg.Name, eventMsg.Signer)
+		return false
+	}
+
+	// Witness a potentially newer time
+	s.eventClock.Witness(eventMsg.LTime)
+
+	if seen == nil || seen.LTime != eventMsg.LTime {
 		seen = &userEvents{LTime: eventMsg.LTime}
 		s.eventBuffer[idx] = seen
 	}
@@ -1280,24 +1645,68 @@ func (s *Serf) handleUserEvent(eventMsg *messageUserEvent) bool {
 	// Add to recent events
 	seen.Events = append(seen.Events, userEvent)
 
+	// Events from other nodes count against the rate limits once, when
+	// they are first seen. Our own events are counted as they are sent, and
+	// replayed events were missed rather than sent recently.
+	// The node limit applies to the verified signer when there is one,
+	// since anyone can claim to be the origin of an unsigned event.
+	node := eventMsg.Origin
+	if signer != "" {
+		node = signer
+	}
+	if !eventMsg.local && !eventMsg.replay && !s.userEventAllowed(eventMsg.Name, node) {
+		s.logger.Printf("[WARN] serf: Dropping event %s from %q over the rate limit",
+			eventMsg.Name, node)
+		return false
+	}
+	s.trackEventSeq(eventMsg)
+
 	// Update some metrics
 	metrics.IncrCounterWithLabels([]string{"serf", "events"}, 1, s.metricLabels)
 	metrics.IncrCounterWithLabels([]string{"serf", "events", eventMsg.Name}, 1, s.metricLabels)
 
-	if s.config.EventCh != nil {
-		s.config.EventCh <- UserEvent{
-			LTime:    eventMsg.LTime,
-			Name:     eventMsg.Name,
-			Payload:  eventMsg.Payload,
-			Coalesce: eventMsg.CC,
+	// Events with a hash are delivered once the payload is fetched
+	payload := eventMsg.Payload
+	if eventMsg.Hash != nil {
+		var ok bool
+		if payload, ok = s.getEventPayload(eventMsg.Hash); !ok {
+			s.queueEventPayloadFetch(*eventMsg, signer)
+			return true
 		}
 	}
+	s.deliverUserEvent(eventMsg, signer, payload)
 	return true
 }
 
+// handleDirectMessage is called when a message sent to this node with
+// SendToMember is received
+func (s *Serf) handleDirectMessage(msg *messageDirect) {
+	if len(msg.Payload) > s.config.DirectMessageSizeLimit {
+		s.logger.Printf("[WARN] serf: Dropping direct message from %s exceeding limit of %d bytes",
+			msg.From, s.config.DirectMessageSizeLimit)
+		return
+	}
+	metrics.IncrCounterWithLabels([]string{"serf", "direct", "received"}, 1, s.metricLabels)
+
+	if s.config.EventCh != nil {
+		s.config.EventCh <- DirectMessageEvent{
+			From:    msg.From,
+			Payload: msg.Payload,
+		}
+	}
+}
+
 // handleQuery is called when a query broadcast is
 // received. Returns if the message should be rebroadcast.
 func (s *Serf) handleQuery(query *messageQuery) bool {
+	signer, ok := s.verifySignature(query.SourceNode, query.Signer, query.Signature,
+		query.signedData)
+	if !ok {
+		s.logger.Printf("[WARN] serf: Dropping query %s with untrusted signature from %q",
+			query.Name, query.Signer)
+		return false
+	}
+
 	// Witness a potentially newer time
 	s.queryClock.Witness(query.LTime)
 
@@ -1389,6 +1798,8 @@ func (s *Serf) handleQuery(query *messageQuery) bool {
 			sourceNode:  query.SourceNode,
 			deadline:    time.Now().Add(query.Timeout),
 			relayFactor: query.RelayFactor,
+			multi:       query.MultiResponse(),
+			signer:      signer,
 		}
 	}
 	return rebroadcast
@@ -1434,19 +1845,49 @@ func (s *Serf) handleQueryResponse(resp *messageQueryResponse) {
 		}
 	} else {
 		// Exit early if this is a duplicate response
-		if _, ok := query.responses[resp.From]; ok {
+		if query.hasResponse(resp.From) {
 			metrics.IncrCounterWithLabels([]string{"serf", "query_duplicate_responses"}, 1, s.metricLabels)
 			return
 		}
 
+		// Wait for the remaining fragments of a chunked response
+		payload := resp.Payload
+		if resp.Chunked() {
+			var done bool
+			var err error
+			payload, done, err = query.addChunk(resp, s.config.QueryChunkedSizeLimit)
+			if err != nil {
+				metrics.IncrCounterWithLabels([]string{"serf", "query_chunks_dropped"}, 1, s.metricLabels)
+				s.logger.Printf("[WARN] %v", err)
+				return
+			}
+			if !done {
+				return
+			}
+		}
+
 		metrics.IncrCounterWithLabels([]string{"serf", "query_responses"}, 1, s.metricLabels)
-		err := query.sendResponse(NodeResponse{From: resp.From, Payload: resp.Payload})
+		var err error
+		if query.multi {
+			err = query.sendOrderedResponse(resp, payload)
+		} else {
+			err = query.sendResponse(NodeResponse{From: resp.From, Payload: payload})
+		}
 		if err != nil {
 			s.logger.Printf("[WARN] %v", err)
 		}
 	}
 }
 
+// supportsChunkedResponses returns if the given member can receive
+// chunked query responses
+func (s *Serf) supportsChunkedResponses(name string) bool {
+	s.memberLock.RLock()
+	defer s.memberLock.RUnlock()
+	m, ok := s.members[name]
+	return ok && m.DelegateMax >= chunkedResponseProtocol
+}
+
 // handleNodeConflict is invoked when a join detects a conflict over a name.
 // This means two different nodes (IP/Port) are claiming the same name. Memberlist
 // will reject the "new" node mapping, but we can still be notified.
@@ -1528,6 +1969,14 @@ func (s *Serf) eraseNode(m *memberState) {
 	// Delete from members
 	delete(s.members, m.Name)
 
+	s.originSeqLock.Lock()
+	delete(s.originSeqs, m.Name)
+	s.originSeqLock.Unlock()
+
+	s.extendedTagsLock.Lock()
+	delete(s.extendedTags, m.Name)
+	s.extendedTagsLock.Unlock()
+
 	// Tell the coordinate client the node has gone away and delete
 	// its cached coordinates.
 	if !s.config.DisableCoordinates {
@@ -1559,6 +2008,7 @@ func (s *Serf) handleReap() {
 			s.leftMembers = s.reap(s.leftMembers, now, s.config.TombstoneTimeout)
 			reapIntents(s.recentIntents, now, s.config.RecentIntentTimeout)
 			s.memberLock.Unlock()
+			s.reapKV(now)
 		case <-s.shutdownCh:
 			return
 		}
@@ -1834,6 +2284,7 @@ func (s *Serf) Stats() map[string]string {
 		"intent_queue": toString(uint64(s.broadcasts.NumQueued())),
 		"event_queue":  toString(uint64(s.eventBroadcasts.NumQueued())),
 		"query_queue":  toString(uint64(s.queryBroadcasts.NumQueued())),
+		"kv_queue":     toString(uint64(s.kvBroadcasts.NumQueued())),
 		"encrypted":    fmt.Sprintf("%v", s.EncryptionEnabled()),
 	}
 	if !s.config.DisableCoordinates {
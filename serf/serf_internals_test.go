@@ -4,6 +4,11 @@
 package serf
 
 import (
+	"bytes"
+	"crypto/ed25519"
+	"log"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -412,6 +417,70 @@ func TestSerf_userEvent_sameClock(t *testing.T) {
 		[][]byte{[]byte("test"), []byte("newpayload"), []byte("other")})
 }
 
+// lockedBuffer collects log output written from several goroutines
+type lockedBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
+}
+
+func TestSerf_userEvent_verifyOnce(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	pub, priv := testSigningKey(t)
+	var logs lockedBuffer
+	eventCh := make(chan Event, 4)
+	c := testConfig(t, ip1)
+	c.EventCh = eventCh
+	c.Logger = log.New(&logs, "", 0)
+	c.TrustedKeys = map[string]ed25519.PublicKey{"signer": pub}
+	s, err := Create(c)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s.Shutdown()
+
+	msg := messageUserEvent{LTime: 1, Name: "first", Payload: []byte("test"), Signer: "signer"}
+	msg.Signature = ed25519.Sign(priv, msg.signedData())
+	if !s.handleUserEvent(&msg) {
+		t.Fatalf("should rebroadcast")
+	}
+
+	// Copies of an event that was already seen aren't verified again, so
+	// they are dropped quietly even once the signer is no longer trusted
+	s.config.RequireSignatures = true
+	s.config.TrustedKeys = nil
+	if s.handleUserEvent(&msg) {
+		t.Fatalf("should not rebroadcast")
+	}
+	if strings.Contains(logs.String(), "untrusted signature") {
+		t.Fatalf("duplicate was verified: %s", logs.String())
+	}
+
+	msg.LTime = 2
+	msg.Signature = ed25519.Sign(priv, msg.signedData())
+	if s.handleUserEvent(&msg) {
+		t.Fatalf("should not rebroadcast")
+	}
+	if !strings.Contains(logs.String(), "untrusted signature") {
+		t.Fatalf("new event was not verified: %s", logs.String())
+	}
+
+	testUserEvents(t, eventCh, []string{"first"}, [][]byte{[]byte("test")})
+}
+
 func TestSerf_query_oldMessage(t *testing.T) {
 	ip1, returnFn1 := testutil.TakeIP()
 	defer returnFn1()
@@ -5,6 +5,9 @@ package serf
 
 import (
 	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
 	"encoding/base64"
 	"fmt"
 	"log"
@@ -12,6 +15,7 @@ import (
 	"os"
 	"path/filepath"
 	"reflect"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -557,6 +561,453 @@ func TestSerf_eventsUser_sizeLimit(t *testing.T) {
 	}
 }
 
+func TestSerf_eventsUser_sizeLimitMetadata(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	_, priv := testSigningKey(t)
+	s1Config := testConfig(t, ip1)
+	s1Config.NodeName = strings.Repeat("n", 128)
+	s1Config.SigningKey = priv
+	s1, err := Create(s1Config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s1.Shutdown()
+
+	waitUntilNumNodes(t, 1, s1)
+
+	// Find the largest event that fit before events carried their origin
+	// and signature, which must still be accepted
+	name := "deploy"
+	var payload []byte
+	for {
+		msg := messageUserEvent{LTime: s1.eventClock.Time(), Name: name, Payload: append(payload, 0)}
+		raw, err := encodeMessage(messageUserEventType, &msg, s1.msgpackUseNewTimeFormat)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if len(raw) > s1Config.UserEventSizeLimit {
+			break
+		}
+		payload = msg.Payload
+	}
+	if err := s1.UserEvent(name, payload, false); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := s1.UserEvent(name, append(payload, 0), false); err == nil {
+		t.Fatalf("expect error")
+	}
+}
+
+func TestSerf_eventsUser_large(t *testing.T) {
+	var eventChs []chan Event
+	var servers []*Serf
+	for i := range 3 {
+		ip, returnFn := testutil.TakeIP()
+		defer returnFn()
+
+		eventCh := make(chan Event, 64)
+		conf := testConfig(t, ip)
+		conf.ProtocolVersion = 6
+		conf.EventCh = eventCh
+		if i == 0 {
+			conf.LargeUserEventSizeLimit = 16 * 1024
+		}
+		s, err := Create(conf)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer s.Shutdown()
+
+		if i > 0 {
+			addr := servers[0].config.NodeName + "/" + servers[0].config.MemberlistConfig.BindAddr
+			if _, err := s.Join([]string{addr}, false); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+		}
+		eventChs = append(eventChs, eventCh)
+		servers = append(servers, s)
+	}
+	waitUntilNumNodes(t, 3, servers...)
+
+	payload := make([]byte, 8*1024)
+	rand.Read(payload)
+	if err := servers[0].UserEvent("large", payload, false); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Every node gets the event with the whole payload
+	timeout := time.After(5 * time.Second)
+	for _, eventCh := range eventChs {
+	WAIT:
+		for {
+			select {
+			case e := <-eventCh:
+				u, ok := e.(UserEvent)
+				if !ok {
+					continue
+				}
+				if u.Name != "large" || !bytes.Equal(u.Payload, payload) {
+					t.Fatalf("bad: %v", e)
+				}
+				break WAIT
+			case <-timeout:
+				t.Fatalf("timeout")
+			}
+		}
+	}
+
+	// Only the hash was gossiped, and nodes that fetched the payload can
+	// send it on
+	for _, s := range servers {
+		if _, ok := s.getEventPayload(hashEventPayload(payload)); !ok {
+			t.Fatalf("missing payload on %s", s.config.NodeName)
+		}
+	}
+
+	if err := servers[0].UserEvent("larger", make([]byte, 32*1024), false); err == nil {
+		t.Fatalf("expected error")
+	}
+	if err := servers[1].UserEvent("large", payload, false); err == nil {
+		t.Fatalf("expected error")
+	}
+	servers[0].config.ProtocolVersion = 5
+	if err := servers[0].UserEvent("large", payload, false); err == nil {
+		t.Fatalf("expected error")
+	}
+	servers[0].config.ProtocolVersion = 6
+
+	// Large events aren't sent while an older node is alive
+	servers[0].memberLock.Lock()
+	servers[0].members[servers[2].config.NodeName].DelegateMax = 5
+	servers[0].memberLock.Unlock()
+	if err := servers[0].UserEvent("large", payload, false); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestSerf_handlePayloadResponse(t *testing.T) {
+	s := &Serf{
+		logger:            log.New(os.Stderr, "", log.LstdFlags),
+		eventPayloadWaits: make(map[string][]chan []byte),
+	}
+
+	payload := []byte("payload")
+	hash := hashEventPayload(payload)
+	ch := make(chan []byte, 1)
+	s.eventPayloadWaits[string(hash)] = []chan []byte{ch}
+
+	// Payloads that don't match the hash are discarded
+	s.handlePayloadResponse(&messagePayloadResponse{Hash: hash, Payload: []byte("bad")})
+	select {
+	case p := <-ch:
+		t.Fatalf("bad: %s", p)
+	default:
+	}
+
+	s.handlePayloadResponse(&messagePayloadResponse{Hash: hash, Payload: payload})
+	select {
+	case p := <-ch:
+		if !bytes.Equal(p, payload) {
+			t.Fatalf("bad: %s", p)
+		}
+	default:
+		t.Fatalf("missing payload")
+	}
+}
+
+func TestSerf_eventPayloadSources(t *testing.T) {
+	s := &Serf{
+		config:  &Config{NodeName: "self"},
+		members: make(map[string]*memberState),
+	}
+	add := func(name string, status MemberStatus, delegateMax uint8) {
+		s.members[name] = &memberState{
+			Member: Member{Name: name, Status: status, DelegateMax: delegateMax},
+		}
+	}
+	add("self", StatusAlive, 6)
+	add("origin", StatusAlive, 6)
+	add("old", StatusAlive, 5)
+	add("failed", StatusFailed, 6)
+	for i := range 5 {
+		add(fmt.Sprintf("node%d", i), StatusAlive, 6)
+	}
+
+	nodes := s.eventPayloadSources("origin")
+	if len(nodes) != eventPayloadFetchAttempts || nodes[0].Name != "origin" {
+		t.Fatalf("bad: %v", nodes)
+	}
+	for _, n := range nodes[1:] {
+		if !strings.HasPrefix(n.Name, "node") {
+			t.Fatalf("bad: %v", n.Name)
+		}
+	}
+}
+
+func TestSerf_largeUserEventsSupported(t *testing.T) {
+	s := &Serf{
+		members: make(map[string]*memberState),
+	}
+	add := func(name string, status MemberStatus, delegateMax uint8) {
+		s.members[name] = &memberState{
+			Member: Member{Name: name, Status: status, DelegateMax: delegateMax},
+		}
+	}
+	add("self", StatusAlive, 6)
+	add("failed", StatusFailed, 5)
+	if !s.largeUserEventsSupported() {
+		t.Fatalf("should be supported")
+	}
+
+	// A single alive older node prevents large events
+	add("old", StatusAlive, 5)
+	if s.largeUserEventsSupported() {
+		t.Fatalf("should not be supported")
+	}
+}
+
+func TestSerf_queueEventPayloadFetch(t *testing.T) {
+	eventCh := make(chan Event, 4)
+	s := &Serf{
+		config:              &Config{EventCh: eventCh},
+		logger:              log.New(os.Stderr, "", log.LstdFlags),
+		eventPayloadFetchCh: make(chan *eventPayloadFetch, 1),
+	}
+
+	msg := messageUserEvent{Name: "large", Origin: "origin", Seq: 3, Hash: []byte("hash")}
+	s.queueEventPayloadFetch(msg, "")
+	if len(s.eventPayloadFetchCh) != 1 {
+		t.Fatalf("should be queued")
+	}
+
+	// Events over the queue size are dropped, leaving a gap
+	msg.Seq = 4
+	s.queueEventPayloadFetch(msg, "")
+	select {
+	case e := <-eventCh:
+		gap, ok := e.(UserEventGap)
+		if !ok || gap.Origin != "origin" || gap.FirstSeq != 4 || gap.LastSeq != 4 {
+			t.Fatalf("bad: %#v", e)
+		}
+	default:
+		t.Fatalf("missing gap")
+	}
+}
+
+func TestSerf_SignedEvents(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	ip2, returnFn2 := testutil.TakeIP()
+	defer returnFn2()
+
+	pub1, priv1 := testSigningKey(t)
+	_, priv2 := testSigningKey(t)
+
+	// s1 only accepts its own signatures, while s2 trusts s1
+	eventCh1 := make(chan Event, 64)
+	s1Config := testConfig(t, ip1)
+	s1Config.EventCh = eventCh1
+	s1Config.SigningKey = priv1
+	s1Config.RequireSignatures = true
+
+	eventCh2 := make(chan Event, 64)
+	s2Config := testConfig(t, ip2)
+	s2Config.EventCh = eventCh2
+	s2Config.SigningKey = priv2
+	s2Config.TrustedKeys = map[string]ed25519.PublicKey{s1Config.NodeName: pub1}
+
+	s1, err := Create(s1Config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s1.Shutdown()
+
+	s2, err := Create(s2Config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s2.Shutdown()
+
+	if _, err := s1.Join([]string{s2Config.NodeName + "/" + s2Config.MemberlistConfig.BindAddr}, false); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	waitUntilNumNodes(t, 2, s1, s2)
+
+	if err := s1.UserEvent("first", nil, false); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := s2.UserEvent("second", nil, false); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	params := s1.DefaultQueryParams()
+	params.FilterNodes = []string{s2Config.NodeName}
+	if _, err := s1.Query("load", nil, params); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// waitSigners returns the signers of the user events and queries
+	// received until the channel is idle
+	waitSigners := func(ch chan Event) map[string]string {
+		signers := make(map[string]string)
+		for {
+			select {
+			case e := <-ch:
+				switch e := e.(type) {
+				case UserEvent:
+					signers[e.Name] = e.Signer
+				case *Query:
+					signers[e.Name] = e.Signer()
+				}
+			case <-time.After(500 * time.Millisecond):
+				return signers
+			}
+		}
+	}
+
+	// s1 drops the event from s2, as it doesn't trust its key
+	expected := map[string]string{"first": s1Config.NodeName}
+	if got := waitSigners(eventCh1); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("bad: %v", got)
+	}
+
+	// s2 only verifies the signature of s1
+	expected = map[string]string{
+		"first":  s1Config.NodeName,
+		"second": s2Config.NodeName,
+		"load":   s1Config.NodeName,
+	}
+	if got := waitSigners(eventCh2); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("bad: %v", got)
+	}
+}
+
+func TestSerf_UserEventRateLimit(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	ip2, returnFn2 := testutil.TakeIP()
+	defer returnFn2()
+
+	// s1 limits its events by name, and s2 the events from each node
+	s1Config := testConfig(t, ip1)
+	s1Config.UserEventRateLimit = RateLimit{Rate: 0.001, Burst: 2}
+	s1Config.UserEventRateLimits = map[string]RateLimit{"free": {}}
+
+	eventCh := make(chan Event, 64)
+	s2Config := testConfig(t, ip2)
+	s2Config.EventCh = eventCh
+	s2Config.UserEventNodeRateLimit = RateLimit{Rate: 0.001, Burst: 3}
+
+	s1, err := Create(s1Config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s1.Shutdown()
+
+	s2, err := Create(s2Config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s2.Shutdown()
+
+	if _, err := s1.Join([]string{s2Config.NodeName + "/" + s2Config.MemberlistConfig.BindAddr}, false); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	waitUntilNumNodes(t, 2, s1, s2)
+
+	for i := 0; i < 2; i++ {
+		if err := s1.UserEvent("deploy", []byte{byte(i)}, false); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	if err := s1.UserEvent("deploy", []byte{2}, false); err != UserEventThrottled {
+		t.Fatalf("expected throttled, got: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := s1.UserEvent("free", []byte{byte(i)}, false); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// s2 only accepts the first 3 events from s1
+	received := 0
+	for {
+		select {
+		case e := <-eventCh:
+			if _, ok := e.(UserEvent); ok {
+				received++
+			}
+			continue
+		case <-time.After(500 * time.Millisecond):
+		}
+		break
+	}
+	if received != 3 {
+		t.Fatalf("bad: %d", received)
+	}
+}
+
+func TestSerf_eventsUser_seq(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	ip2, returnFn2 := testutil.TakeIP()
+	defer returnFn2()
+
+	eventCh := make(chan Event, 64)
+	s1Config := testConfig(t, ip1)
+	s2Config := testConfig(t, ip2)
+	s2Config.EventCh = eventCh
+
+	s1, err := Create(s1Config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s1.Shutdown()
+
+	s2, err := Create(s2Config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s2.Shutdown()
+
+	if _, err := s1.Join([]string{s2Config.NodeName + "/" + s2Config.MemberlistConfig.BindAddr}, false); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	waitUntilNumNodes(t, 2, s1, s2)
+
+	for i := 0; i < 3; i++ {
+		if err := s1.UserEvent("deploy", []byte{byte(i)}, false); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// The events carry their origin and sequence number
+	seqs := make(map[uint64][]byte)
+	for len(seqs) < 3 {
+		select {
+		case e := <-eventCh:
+			u, ok := e.(UserEvent)
+			if !ok {
+				continue
+			}
+			if u.Origin != s1Config.NodeName {
+				t.Fatalf("bad: %#v", u)
+			}
+			seqs[u.Seq] = u.Payload
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout: %v", seqs)
+		}
+	}
+	expected := map[uint64][]byte{1: {0}, 2: {1}, 3: {2}}
+	if !reflect.DeepEqual(seqs, expected) {
+		t.Fatalf("bad: %v", seqs)
+	}
+}
+
 func TestSerf_getQueueMax(t *testing.T) {
 	s := &Serf{
 		config: DefaultConfig(),
@@ -2226,18 +2677,550 @@ func TestSerf_Query_Filter(t *testing.T) {
 	}
 }
 
-func TestSerf_Query_Deduplicate(t *testing.T) {
-	s := &Serf{}
+func TestSerf_Query_FilterExpr(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
 
-	// Set up a dummy query and response
-	mq := &messageQuery{
-		LTime:   123,
-		ID:      123,
-		Timeout: time.Second,
-		Flags:   queryFlagAck,
+	ip2, returnFn2 := testutil.TakeIP()
+	defer returnFn2()
+
+	s1Config := testConfig(t, ip1)
+	s1Config.ProtocolVersion = 6
+	s1, err := Create(s1Config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
 	}
-	query := newQueryResponse(3, mq)
-	response := &messageQueryResponse{
+	defer s1.Shutdown()
+
+	// Older protocols can't send expression filters
+	s2Config := testConfig(t, ip2)
+	s2Config.ProtocolVersion = 5
+	s2, err := Create(s2Config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s2.Shutdown()
+
+	params := &QueryParam{FilterExpr: `role == "web"`, Timeout: time.Second}
+	if _, err := s2.Query("load", nil, params); err != FeatureNotSupported {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Invalid expressions are rejected
+	params.FilterExpr = `role ==`
+	if _, err := s1.Query("load", nil, params); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	// Only the local node matches
+	if err := s1.SetTags(map[string]string{"role": "web"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := s1.Join([]string{s2Config.NodeName + "/" + s2Config.MemberlistConfig.BindAddr}, false); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	waitUntilNumNodes(t, 2, s1, s2)
+
+	params.FilterExpr = `role == "web" or role == "db"`
+	resp, err := s1.Query("load", nil, params)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !reflect.DeepEqual(resp.expected, []string{s1Config.NodeName}) {
+		t.Fatalf("bad: %v", resp.expected)
+	}
+	resp.Close()
+}
+
+func TestSerf_Query_ChunkedResponse(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	ip2, returnFn2 := testutil.TakeIP()
+	defer returnFn2()
+
+	// The response is large enough to need a few chunks
+	payload := bytes.Repeat([]byte("0123456789"), queryResponseChunkSize/4)
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	eventCh := make(chan Event, 4)
+	s1Config := testConfig(t, ip1)
+	s1Config.EventCh = eventCh
+	s1, err := Create(s1Config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s1.Shutdown()
+
+	wg.Go(func() {
+		for {
+			select {
+			case e := <-eventCh:
+				q, ok := e.(*Query)
+				if !ok {
+					continue
+				}
+				if err := q.Respond(payload); err != nil {
+					t.Errorf("err: %v", err)
+				}
+				return
+			case <-time.After(5 * time.Second):
+				t.Errorf("timeout")
+				return
+			}
+		}
+	})
+
+	s2Config := testConfig(t, ip2)
+	s2, err := Create(s2Config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s2.Shutdown()
+
+	if _, err := s1.Join([]string{s2Config.NodeName + "/" + s2Config.MemberlistConfig.BindAddr}, false); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	waitUntilNumNodes(t, 2, s1, s2)
+
+	params := s2.DefaultQueryParams()
+	params.FilterNodes = []string{s1Config.NodeName}
+	params.Timeout = 5 * time.Second
+	resp, err := s2.Query("dump", nil, params)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The fragments are delivered as a single response
+	var responses []NodeResponse
+	for r := range resp.ResponseCh() {
+		responses = append(responses, r)
+		resp.Close()
+	}
+	if len(responses) != 1 {
+		t.Fatalf("bad: %d", len(responses))
+	}
+	if responses[0].From != s1Config.NodeName || !bytes.Equal(responses[0].Payload, payload) {
+		t.Fatalf("bad: %s %d", responses[0].From, len(responses[0].Payload))
+	}
+}
+
+func TestSerf_Query_ChunkedResponse_Limit(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	eventCh := make(chan Event, 4)
+	s1Config := testConfig(t, ip1)
+	s1Config.EventCh = eventCh
+	s1Config.QueryChunkedSizeLimit = 4096
+	s1, err := Create(s1Config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s1.Shutdown()
+
+	params := s1.DefaultQueryParams()
+	params.Timeout = time.Second
+	resp, err := s1.Query("dump", nil, params)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer resp.Close()
+
+	var q *Query
+	for q == nil {
+		select {
+		case e := <-eventCh:
+			q, _ = e.(*Query)
+		case <-time.After(time.Second):
+			t.Fatalf("timeout")
+		}
+	}
+
+	// Responses beyond the chunked limit are rejected
+	if err := q.Respond(make([]byte, 8192)); err == nil || !strings.Contains(err.Error(), "exceeds limit") {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Smaller responses are still chunked
+	if err := q.Respond(make([]byte, 2048)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	select {
+	case r := <-resp.ResponseCh():
+		if len(r.Payload) != 2048 {
+			t.Fatalf("bad: %d", len(r.Payload))
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timeout")
+	}
+}
+
+func TestSerf_SendToMember(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	ip2, returnFn2 := testutil.TakeIP()
+	defer returnFn2()
+
+	eventCh := make(chan Event, 4)
+	s1Config := testConfig(t, ip1)
+	s1Config.ProtocolVersion = 6
+	s1Config.EventCh = eventCh
+	s1Config.DirectMessageSizeLimit = 1024
+	s1, err := Create(s1Config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s1.Shutdown()
+
+	s2Config := testConfig(t, ip2)
+	s2Config.ProtocolVersion = 6
+	s2, err := Create(s2Config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s2.Shutdown()
+
+	if _, err := s1.Join([]string{s2Config.NodeName + "/" + s2Config.MemberlistConfig.BindAddr}, false); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	waitUntilNumNodes(t, 2, s1, s2)
+
+	if err := s2.SendToMember(s1Config.NodeName, []byte("hello")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Messages over the receiver's limit are dropped
+	if err := s2.SendToMember(s1Config.NodeName, make([]byte, 2048)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Messages to ourselves are delivered directly
+	if err := s1.SendToMember(s1Config.NodeName, []byte("self")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	got := make(map[string]string)
+	timeout := time.After(5 * time.Second)
+	for len(got) < 2 {
+		select {
+		case e := <-eventCh:
+			if dm, ok := e.(DirectMessageEvent); ok {
+				got[dm.From] = string(dm.Payload)
+			}
+		case <-timeout:
+			t.Fatalf("timeout: %v", got)
+		}
+	}
+	expected := map[string]string{
+		s1Config.NodeName: "self",
+		s2Config.NodeName: "hello",
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("bad: %v", got)
+	}
+	select {
+	case e := <-eventCh:
+		if _, ok := e.(DirectMessageEvent); ok {
+			t.Fatalf("unexpected message: %v", e)
+		}
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if err := s1.SendToMember("nope", nil); err == nil {
+		t.Fatalf("expected error")
+	}
+	if err := s1.SendToMember(s2Config.NodeName, make([]byte, 2048)); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	// Older protocols can't send direct messages
+	s1.config.ProtocolVersion = 5
+	if err := s1.SendToMember(s2Config.NodeName, nil); err != FeatureNotSupported {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestSerf_Query_MultipleResponses(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	ip2, returnFn2 := testutil.TakeIP()
+	defer returnFn2()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	eventCh := make(chan Event, 4)
+	s1Config := testConfig(t, ip1)
+	s1Config.ProtocolVersion = 6
+	s1Config.EventCh = eventCh
+	s1, err := Create(s1Config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s1.Shutdown()
+
+	// Send progress followed by a large final response
+	final := bytes.Repeat([]byte("x"), queryResponseChunkSize+1)
+	wg.Go(func() {
+		for {
+			select {
+			case e := <-eventCh:
+				q, ok := e.(*Query)
+				if !ok {
+					continue
+				}
+				if !q.MultiResponse() {
+					t.Errorf("expected multi response query")
+				}
+				for i := 0; i < 3; i++ {
+					if err := q.RespondPartial([]byte(strconv.Itoa(i))); err != nil {
+						t.Errorf("err: %v", err)
+					}
+				}
+				if err := q.Respond(final); err != nil {
+					t.Errorf("err: %v", err)
+				}
+				if err := q.RespondPartial([]byte("late")); err == nil {
+					t.Errorf("expected error")
+				}
+				return
+			case <-time.After(5 * time.Second):
+				t.Errorf("timeout")
+				return
+			}
+		}
+	})
+
+	s2Config := testConfig(t, ip2)
+	s2Config.ProtocolVersion = 6
+	s2, err := Create(s2Config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s2.Shutdown()
+
+	if _, err := s1.Join([]string{s2Config.NodeName + "/" + s2Config.MemberlistConfig.BindAddr}, false); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	waitUntilNumNodes(t, 2, s1, s2)
+
+	params := s2.DefaultQueryParams()
+	params.FilterNodes = []string{s1Config.NodeName}
+	params.MultipleResponses = true
+	params.Timeout = 5 * time.Second
+	resp, err := s2.Query("progress", nil, params)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	result, err := resp.Collect(ctx)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expected := append([]byte("012"), final...)
+	if !bytes.Equal(result.Responses[s1Config.NodeName], expected) {
+		t.Fatalf("bad: %d", len(result.Responses[s1Config.NodeName]))
+	}
+	resp.Close()
+
+	// Responses to other queries can't be partial
+	params.MultipleResponses = false
+	resp, err = s2.Query("progress", nil, params)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer resp.Close()
+	q := &Query{serf: s1, deadline: time.Now().Add(time.Second)}
+	if err := q.RespondPartial(nil); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	// Older protocols can't send multi-response queries
+	s1.config.ProtocolVersion = 5
+	params.MultipleResponses = true
+	if _, err := s1.Query("progress", nil, params); err != FeatureNotSupported {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestSerf_Query_Sample(t *testing.T) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Every node responds to every query
+	var servers []*Serf
+	for i := 0; i < 3; i++ {
+		ip, returnFn := testutil.TakeIP()
+		defer returnFn()
+
+		eventCh := make(chan Event, 4)
+		conf := testConfig(t, ip)
+		conf.EventCh = eventCh
+		s, err := Create(conf)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer s.Shutdown()
+		servers = append(servers, s)
+
+		wg.Go(func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case e := <-eventCh:
+					if q, ok := e.(*Query); ok {
+						q.Respond([]byte("test"))
+					}
+				}
+			}
+		})
+	}
+
+	s1 := servers[0]
+	for _, s := range servers[1:] {
+		local := s.LocalMember()
+		if _, err := s1.Join([]string{local.Name + "/" + local.Addr.String()}, false); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	waitUntilNumNodes(t, 3, servers...)
+
+	params := s1.DefaultQueryParams()
+	params.SampleSize = 2
+	params.RequestAck = true
+	params.Timeout = time.Second
+
+	resp, err := s1.Query("load", nil, params)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if params.FilterNodes != nil {
+		t.Fatalf("params modified: %v", params.FilterNodes)
+	}
+	if len(resp.expected) != 2 {
+		t.Fatalf("bad: %v", resp.expected)
+	}
+
+	// Only the sampled nodes respond
+	var responses []string
+	for r := range resp.ResponseCh() {
+		responses = append(responses, r.From)
+	}
+	slices.Sort(responses)
+	expected := slices.Sorted(slices.Values(resp.expected))
+	if !reflect.DeepEqual(responses, expected) {
+		t.Fatalf("bad: %v %v", responses, expected)
+	}
+}
+
+func TestSerf_Query_Collect(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	ip2, returnFn2 := testutil.TakeIP()
+	defer returnFn2()
+
+	eventCh := make(chan Event, 4)
+	s1Config := testConfig(t, ip1)
+	s1Config.EventCh = eventCh
+	s1, err := Create(s1Config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s1.Shutdown()
+
+	// Listen for the query
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	ctx := t.Context()
+
+	wg.Go(func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case e := <-eventCh:
+				if e.EventType() != EventQuery {
+					continue
+				}
+				q := e.(*Query)
+				if err := q.Respond([]byte("test")); err != nil {
+					t.Errorf("err: %v", err)
+				}
+				return
+			case <-time.After(time.Second):
+				t.Errorf("timeout")
+				return
+			}
+		}
+	})
+
+	s2Config := testConfig(t, ip2)
+	s2, err := Create(s2Config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s2.Shutdown()
+
+	waitUntilNumNodes(t, 1, s1, s2)
+
+	_, err = s1.Join([]string{s2Config.NodeName + "/" + s2Config.MemberlistConfig.BindAddr}, false)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	waitUntilNumNodes(t, 2, s1, s2)
+
+	// Filter to only s1, with a timeout well beyond the test
+	params := s2.DefaultQueryParams()
+	params.FilterNodes = []string{s1Config.NodeName}
+	params.RequestAck = true
+	params.Timeout = time.Minute
+
+	resp, err := s2.Query("load", []byte("sup girl"), params)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Collect returns once s1 responded
+	collectCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	result, err := resp.Collect(collectCtx)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if !reflect.DeepEqual(result.Expected, []string{s1Config.NodeName}) {
+		t.Fatalf("bad: %#v", result)
+	}
+	if string(result.Responses[s1Config.NodeName]) != "test" || len(result.NoResponse) != 0 {
+		t.Fatalf("bad: %#v", result)
+	}
+}
+
+func TestSerf_Query_Deduplicate(t *testing.T) {
+	s := &Serf{}
+
+	// Set up a dummy query and response
+	mq := &messageQuery{
+		LTime:   123,
+		ID:      123,
+		Timeout: time.Second,
+		Flags:   queryFlagAck,
+	}
+	query := newQueryResponse(3, mq)
+	response := &messageQueryResponse{
 		LTime: mq.LTime,
 		ID:    mq.ID,
 		From:  "node1",
@@ -2554,6 +3537,7 @@ func TestSerfStats(t *testing.T) {
 		"member_time":  "1",
 		"members":      "1",
 		"query_queue":  "0",
+		"kv_queue":     "0",
 		"query_time":   "1",
 		"encrypted":    "false",
 	}
@@ -3071,3 +4055,142 @@ func TestSerf_perNodeReconnectTimeout(t *testing.T) {
 		t.Fatalf("The reconnect override was not used")
 	}
 }
+
+func TestSerf_JoinContext(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	ip2, returnFn2 := testutil.TakeIP()
+	defer returnFn2()
+
+	s1Config := testConfig(t, ip1)
+	s1Config.MemberlistConfig.TCPTimeout = 2 * time.Second
+	s1, err := Create(s1Config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s1.Shutdown()
+
+	s2Config := testConfig(t, ip2)
+	s2, err := Create(s2Config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s2.Shutdown()
+
+	waitUntilNumNodes(t, 1, s1, s2)
+
+	// A done context doesn't contact any nodes
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	addr := s2Config.NodeName + "/" + s2Config.MemberlistConfig.BindAddr
+	if _, err := s1.JoinContext(ctx, []string{addr}, false); err != context.Canceled {
+		t.Fatalf("err: %v", err)
+	}
+	waitUntilNumNodes(t, 1, s1)
+
+	// A node that accepts connections but never answers hangs the join
+	// until the context deadline
+	list, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer list.Close()
+	go func() {
+		for {
+			conn, err := list.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	num, err := s1.JoinContext(ctx, []string{"hung/" + list.Addr().String(), addr}, false)
+	if err != context.DeadlineExceeded || num != 0 {
+		t.Fatalf("bad: %d %v", num, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("join was not cancelled: %v", elapsed)
+	}
+
+	// A context that isn't done joins as usual
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	num, err = s1.JoinContext(ctx, []string{addr}, false)
+	if err != nil || num != 1 {
+		t.Fatalf("bad: %d %v", num, err)
+	}
+	waitUntilNumNodes(t, 2, s1, s2)
+}
+
+func TestSerf_QueryContext(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	s1, err := Create(testConfig(t, ip1))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s1.Shutdown()
+
+	// The context deadline caps the query timeout
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	params := &QueryParam{Timeout: time.Minute}
+	resp, err := s1.QueryContext(ctx, "load", nil, params)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if resp.Deadline().After(time.Now().Add(time.Second)) || params.Timeout != time.Minute {
+		t.Fatalf("bad: %v %v", resp.Deadline(), params.Timeout)
+	}
+
+	// Cancelling the context closes the query
+	cancel()
+	select {
+	case _, ok := <-resp.ResponseCh():
+		if ok {
+			t.Fatalf("should be closed")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timeout")
+	}
+	if !resp.Finished() {
+		t.Fatalf("should be finished")
+	}
+
+	if _, err := s1.QueryContext(ctx, "load", nil, nil); err != context.Canceled {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestSerf_LeaveContext(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	s1Config := testConfig(t, ip1)
+	s1Config.LeavePropagateDelay = time.Minute
+	s1, err := Create(s1Config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s1.Shutdown()
+
+	// The propagation delay is cut short by the context
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := s1.LeaveContext(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("err: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("leave was not cancelled: %v", elapsed)
+	}
+	if s1.State() != SerfLeft {
+		t.Fatalf("bad state: %v", s1.State())
+	}
+}
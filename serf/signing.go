@@ -0,0 +1,109 @@
+// Copyright IBM Corp. 2013, 2026
+// SPDX-License-Identifier: MPL-2.0
+
+package serf
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+
+	metrics "github.com/hashicorp/go-metrics/compat"
+)
+
+// signedData builds the bytes covered by the signature of a message. Each
+// field is length prefixed, so that the fields can't be shifted into one
+// another, and a kind is prepended so a signature for one kind of message
+// can't be replayed as another.
+type signedData []byte
+
+func newSignedData(kind string) *signedData {
+	d := new(signedData)
+	d.string(kind)
+	return d
+}
+
+func (d *signedData) bytes(b []byte) {
+	*d = binary.BigEndian.AppendUint32(*d, uint32(len(b)))
+	*d = append(*d, b...)
+}
+
+func (d *signedData) string(s string) {
+	d.bytes([]byte(s))
+}
+
+func (d *signedData) uint64(v uint64) {
+	*d = binary.BigEndian.AppendUint64(*d, v)
+}
+
+// signedData returns the bytes covered by the signature of a user event.
+// The coalesce flag is not covered, as it isn't kept when events are
+// replayed during a push/pull.
+func (m *messageUserEvent) signedData() []byte {
+	d := newSignedData("user-event")
+	d.uint64(uint64(m.LTime))
+	d.string(m.Name)
+	d.bytes(m.Payload)
+	d.bytes(m.Hash)
+	d.string(m.Origin)
+	d.uint64(m.Seq)
+	d.string(m.Signer)
+	return *d
+}
+
+// signedData returns the bytes covered by the signature of a query
+func (m *messageQuery) signedData() []byte {
+	d := newSignedData("query")
+	d.uint64(uint64(m.LTime))
+	d.uint64(uint64(m.ID))
+	d.bytes(m.Addr)
+	d.uint64(uint64(m.Port))
+	d.string(m.SourceNode)
+	d.uint64(uint64(len(m.Filters)))
+	for _, f := range m.Filters {
+		d.bytes(f)
+	}
+	d.uint64(uint64(m.Flags))
+	d.uint64(uint64(m.RelayFactor))
+	d.uint64(uint64(m.Timeout))
+	d.string(m.Name)
+	d.bytes(m.Payload)
+	d.string(m.Signer)
+	return *d
+}
+
+// trustedKey returns the public key trusted for a signer. A node always
+// trusts its own key.
+func (s *Serf) trustedKey(signer string) (ed25519.PublicKey, bool) {
+	if signer == s.config.NodeName && s.config.SigningKey != nil {
+		return s.config.SigningKey.Public().(ed25519.PublicKey), true
+	}
+	key, ok := s.config.TrustedKeys[signer]
+	return key, ok
+}
+
+// verifySignature checks the signature of a message, returning the name of
+// the verified signer, or an empty name if the message isn't signed by a
+// trusted key. Messages are rejected if their signature doesn't verify, if
+// signatures are required and the signer isn't trusted, or if they are signed
+// by another node than the one they claim to come from.
+func (s *Serf) verifySignature(origin, signer string, sig []byte, data func() []byte) (string, bool) {
+	if signer != "" && origin != "" && signer != origin {
+		metrics.IncrCounterWithLabels([]string{"serf", "signature", "invalid"}, 1, s.metricLabels)
+		return "", false
+	}
+
+	key, ok := s.trustedKey(signer)
+	if signer == "" || !ok {
+		if s.config.RequireSignatures {
+			metrics.IncrCounterWithLabels([]string{"serf", "signature", "untrusted"}, 1, s.metricLabels)
+			return "", false
+		}
+		return "", true
+	}
+
+	if len(key) != ed25519.PublicKeySize || !ed25519.Verify(key, data(), sig) {
+		metrics.IncrCounterWithLabels([]string{"serf", "signature", "invalid"}, 1, s.metricLabels)
+		return "", false
+	}
+	return signer, true
+}
@@ -0,0 +1,104 @@
+// Copyright IBM Corp. 2013, 2026
+// SPDX-License-Identifier: MPL-2.0
+
+package serf
+
+import (
+	"crypto/ed25519"
+	"testing"
+)
+
+func testSigningKey(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return pub, priv
+}
+
+func TestSerf_verifySignature(t *testing.T) {
+	pub1, priv1 := testSigningKey(t)
+	_, priv2 := testSigningKey(t)
+	_, priv3 := testSigningKey(t)
+
+	s := &Serf{config: &Config{
+		NodeName:    "node2",
+		SigningKey:  priv2,
+		TrustedKeys: map[string]ed25519.PublicKey{"node1": pub1},
+	}}
+
+	sign := func(signer string, key ed25519.PrivateKey) *messageUserEvent {
+		msg := &messageUserEvent{LTime: 3, Name: "deploy", Payload: []byte("foo"), Signer: signer}
+		if key != nil {
+			msg.Signature = ed25519.Sign(key, msg.signedData())
+		}
+		return msg
+	}
+	verify := func(msg *messageUserEvent) (string, bool) {
+		return s.verifySignature(msg.Origin, msg.Signer, msg.Signature, msg.signedData)
+	}
+
+	// Trusted and own keys
+	if signer, ok := verify(sign("node1", priv1)); !ok || signer != "node1" {
+		t.Fatalf("bad: %v %v", signer, ok)
+	}
+	if signer, ok := verify(sign("node2", priv2)); !ok || signer != "node2" {
+		t.Fatalf("bad: %v %v", signer, ok)
+	}
+
+	// Tampered messages and impersonation are rejected
+	msg := sign("node1", priv1)
+	msg.Payload = []byte("bar")
+	if _, ok := verify(msg); ok {
+		t.Fatalf("expected rejection")
+	}
+	msg = sign("node1", priv1)
+	msg.CC = true
+	if _, ok := verify(msg); !ok {
+		t.Fatalf("coalesce flag should not be signed")
+	}
+	if _, ok := verify(sign("node1", priv3)); ok {
+		t.Fatalf("expected rejection")
+	}
+
+	// Unsigned messages and unknown signers are delivered without a signer,
+	// unless signatures are required
+	for _, msg := range []*messageUserEvent{sign("", nil), sign("node3", priv3)} {
+		if signer, ok := verify(msg); !ok || signer != "" {
+			t.Fatalf("bad: %v %v", signer, ok)
+		}
+	}
+	s.config.RequireSignatures = true
+	for _, msg := range []*messageUserEvent{sign("", nil), sign("node3", priv3)} {
+		if _, ok := verify(msg); ok {
+			t.Fatalf("expected rejection")
+		}
+	}
+	if signer, ok := verify(sign("node1", priv1)); !ok || signer != "node1" {
+		t.Fatalf("bad: %v %v", signer, ok)
+	}
+
+	// Signatures can't be moved between kinds of messages
+	q := &messageQuery{LTime: 3, Name: "deploy", Payload: []byte("foo"), Signer: "node1"}
+	q.Signature = sign("node1", priv1).Signature
+	if _, ok := s.verifySignature(q.SourceNode, q.Signer, q.Signature, q.signedData); ok {
+		t.Fatalf("expected rejection")
+	}
+
+	// Trusted keys can't sign messages claiming to come from other nodes
+	msg = &messageUserEvent{LTime: 3, Name: "deploy", Origin: "node3", Signer: "node1"}
+	msg.Signature = ed25519.Sign(priv1, msg.signedData())
+	if _, ok := verify(msg); ok {
+		t.Fatalf("expected rejection")
+	}
+	msg.Origin = "node1"
+	msg.Signature = ed25519.Sign(priv1, msg.signedData())
+	if signer, ok := verify(msg); !ok || signer != "node1" {
+		t.Fatalf("bad: %v %v", signer, ok)
+	}
+	q = &messageQuery{LTime: 3, Name: "deploy", SourceNode: "node3", Signer: "node1"}
+	q.Signature = ed25519.Sign(priv1, q.signedData())
+	if _, ok := s.verifySignature(q.SourceNode, q.Signer, q.Signature, q.signedData); ok {
+		t.Fatalf("expected rejection")
+	}
+}
@@ -262,6 +262,9 @@ func (s *Snapshotter) stream() {
 			s.processUserEvent(typed)
 		case *Query:
 			s.processQuery(typed)
+		case DirectMessageEvent, UserEventGap, KVEvent:
+			// Direct messages and gaps don't carry a clock, and the
+			// key/value store is recovered from the other nodes
 		default:
 			s.logger.Printf("[ERR] serf: Unknown event to snapshot: %#v", e)
 		}
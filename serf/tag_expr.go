@@ -0,0 +1,348 @@
+// Copyright IBM Corp. 2013, 2026
+// SPDX-License-Identifier: MPL-2.0
+
+package serf
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// TagExpr is a boolean expression over the tags of a member, such as
+//
+//	role == "web" and (dc == "east" or not canary)
+//
+// A tag name on its own checks that the tag exists. Tags can be compared
+// with ==, != and the regular expression operators =~ and !~, where tags
+// that don't exist have an empty value. The <, <=, > and >= operators
+// compare numbers, and never match tags that don't hold a number. Terms
+// are combined with "and", "or", "not" and parentheses.
+type TagExpr struct {
+	src  string
+	root tagExprNode
+}
+
+// ParseTagExpr parses a tag filter expression
+func ParseTagExpr(src string) (*TagExpr, error) {
+	p := &tagExprParser{src: src}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tagTokEOF {
+		return nil, p.errorf("unexpected %q", p.tok.val)
+	}
+	return &TagExpr{src: src, root: root}, nil
+}
+
+// Match returns if the tags satisfy the expression
+func (e *TagExpr) Match(tags map[string]string) bool {
+	return e.root.eval(tags)
+}
+
+// String returns the expression as it was parsed
+func (e *TagExpr) String() string {
+	return e.src
+}
+
+// tagExprNode is a node of a parsed tag expression
+type tagExprNode interface {
+	eval(tags map[string]string) bool
+}
+
+type tagExprAnd struct {
+	left, right tagExprNode
+}
+
+func (n *tagExprAnd) eval(tags map[string]string) bool {
+	return n.left.eval(tags) && n.right.eval(tags)
+}
+
+type tagExprOr struct {
+	left, right tagExprNode
+}
+
+func (n *tagExprOr) eval(tags map[string]string) bool {
+	return n.left.eval(tags) || n.right.eval(tags)
+}
+
+type tagExprNot struct {
+	expr tagExprNode
+}
+
+func (n *tagExprNot) eval(tags map[string]string) bool {
+	return !n.expr.eval(tags)
+}
+
+type tagExprExists struct {
+	tag string
+}
+
+func (n *tagExprExists) eval(tags map[string]string) bool {
+	_, ok := tags[n.tag]
+	return ok
+}
+
+type tagExprCompare struct {
+	tag   string
+	op    string
+	value string
+	num   float64
+	re    *regexp.Regexp
+}
+
+func (n *tagExprCompare) eval(tags map[string]string) bool {
+	v := tags[n.tag]
+	switch n.op {
+	case "==":
+		return v == n.value
+	case "!=":
+		return v != n.value
+	case "=~":
+		return n.re.MatchString(v)
+	case "!~":
+		return !n.re.MatchString(v)
+	}
+
+	num, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return false
+	}
+	switch n.op {
+	case "<":
+		return num < n.num
+	case "<=":
+		return num <= n.num
+	case ">":
+		return num > n.num
+	case ">=":
+		return num >= n.num
+	}
+	return false
+}
+
+// maxTagExprDepth bounds the nesting of an expression, since expressions
+// are parsed from queries sent by other nodes
+const maxTagExprDepth = 64
+
+type tagTokKind int
+
+const (
+	tagTokEOF tagTokKind = iota
+	tagTokWord
+	tagTokString
+	tagTokOp
+	tagTokLParen
+	tagTokRParen
+)
+
+type tagTok struct {
+	kind tagTokKind
+	val  string
+	pos  int
+}
+
+// tagExprParser is a recursive descent parser for tag expressions
+type tagExprParser struct {
+	src   string
+	pos   int
+	tok   tagTok
+	depth int
+}
+
+func (p *tagExprParser) errorf(format string, args ...any) error {
+	return fmt.Errorf("Invalid filter expression at offset %d: %s",
+		p.tok.pos, fmt.Sprintf(format, args...))
+}
+
+// isTagWordChar returns if c can be part of a bare tag name or value
+func isTagWordChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		strings.IndexByte("_-.:/", c) >= 0
+}
+
+// next reads the next token
+func (p *tagExprParser) next() error {
+	for p.pos < len(p.src) && strings.IndexByte(" \t\r\n", p.src[p.pos]) >= 0 {
+		p.pos++
+	}
+	start := p.pos
+	p.tok = tagTok{pos: start}
+	if p.pos >= len(p.src) {
+		p.tok.kind = tagTokEOF
+		return nil
+	}
+
+	c := p.src[p.pos]
+	switch {
+	case c == '(':
+		p.pos++
+		p.tok.kind, p.tok.val = tagTokLParen, "("
+	case c == ')':
+		p.pos++
+		p.tok.kind, p.tok.val = tagTokRParen, ")"
+	case c == '"':
+		end := p.pos + 1
+		for ; end < len(p.src) && p.src[end] != '"'; end++ {
+			if p.src[end] == '\\' {
+				end++
+			}
+		}
+		if end >= len(p.src) {
+			return p.errorf("unterminated string")
+		}
+		val, err := strconv.Unquote(p.src[p.pos : end+1])
+		if err != nil {
+			return p.errorf("invalid string %s", p.src[p.pos:end+1])
+		}
+		p.pos = end + 1
+		p.tok.kind, p.tok.val = tagTokString, val
+	case strings.IndexByte("=!<>", c) >= 0:
+		op := p.src[p.pos : p.pos+1]
+		if p.pos+1 < len(p.src) && strings.IndexByte("=~", p.src[p.pos+1]) >= 0 {
+			op = p.src[p.pos : p.pos+2]
+		}
+		switch op {
+		case "==", "!=", "=~", "!~", "<", "<=", ">", ">=":
+		default:
+			return p.errorf("unknown operator %q", op)
+		}
+		p.pos += len(op)
+		p.tok.kind, p.tok.val = tagTokOp, op
+	case isTagWordChar(c):
+		for p.pos < len(p.src) && isTagWordChar(p.src[p.pos]) {
+			p.pos++
+		}
+		p.tok.kind, p.tok.val = tagTokWord, p.src[start:p.pos]
+	default:
+		return p.errorf("unexpected %q", c)
+	}
+	return nil
+}
+
+// isKeyword returns if the current token is the given keyword
+func (p *tagExprParser) isKeyword(word string) bool {
+	return p.tok.kind == tagTokWord && p.tok.val == word
+}
+
+func (p *tagExprParser) parseOr() (tagExprNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.isKeyword("or") {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &tagExprOr{left, right}
+	}
+	return left, nil
+}
+
+func (p *tagExprParser) parseAnd() (tagExprNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.isKeyword("and") {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &tagExprAnd{left, right}
+	}
+	return left, nil
+}
+
+func (p *tagExprParser) parseUnary() (tagExprNode, error) {
+	p.depth++
+	defer func() { p.depth-- }()
+	if p.depth > maxTagExprDepth {
+		return nil, p.errorf("expression is nested too deeply")
+	}
+
+	if p.isKeyword("not") {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		expr, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &tagExprNot{expr}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *tagExprParser) parsePrimary() (tagExprNode, error) {
+	switch {
+	case p.tok.kind == tagTokLParen:
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.tok.kind != tagTokRParen {
+			return nil, p.errorf("expected \")\"")
+		}
+		return expr, p.next()
+
+	case p.tok.kind == tagTokWord && !p.isKeyword("and") && !p.isKeyword("or"),
+		p.tok.kind == tagTokString:
+		tag := p.tok.val
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		if p.tok.kind != tagTokOp {
+			return &tagExprExists{tag}, nil
+		}
+		return p.parseCompare(tag)
+
+	case p.tok.kind == tagTokEOF:
+		return nil, p.errorf("unexpected end of expression")
+
+	default:
+		return nil, p.errorf("unexpected %q", p.tok.val)
+	}
+}
+
+func (p *tagExprParser) parseCompare(tag string) (tagExprNode, error) {
+	op := p.tok.val
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tagTokWord && p.tok.kind != tagTokString {
+		return nil, p.errorf("expected a value after %q", op)
+	}
+
+	n := &tagExprCompare{tag: tag, op: op, value: p.tok.val}
+	switch op {
+	case "=~", "!~":
+		re, err := regexp.Compile(n.value)
+		if err != nil {
+			return nil, p.errorf("invalid regular expression: %v", err)
+		}
+		n.re = re
+	case "<", "<=", ">", ">=":
+		num, err := strconv.ParseFloat(n.value, 64)
+		if err != nil {
+			return nil, p.errorf("expected a number after %q", op)
+		}
+		n.num = num
+	}
+	return n, p.next()
+}
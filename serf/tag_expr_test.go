@@ -0,0 +1,95 @@
+// Copyright IBM Corp. 2013, 2026
+// SPDX-License-Identifier: MPL-2.0
+
+package serf
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseTagExpr(t *testing.T) {
+	tags := map[string]string{
+		"role":    "web",
+		"dc":      "east",
+		"weight":  "10",
+		"version": "1.2.3",
+		"empty":   "",
+		"not":     "keyword",
+	}
+
+	cases := []struct {
+		expr  string
+		match bool
+	}{
+		{`role == "web"`, true},
+		{`role == web`, true},
+		{`role != "web"`, false},
+		{`role == "db"`, false},
+		{`canary`, false},
+		{`empty`, true},
+		{`not canary`, true},
+		{`not not role`, true},
+		{`missing == ""`, true},
+		{`missing != "x"`, true},
+		{`role =~ "^w"`, true},
+		{`role !~ "^w"`, false},
+		{`version =~ "^1\\.2"`, true},
+		{`weight > 5`, true},
+		{`weight >= 10`, true},
+		{`weight < 10`, false},
+		{`weight <= 9.5`, false},
+		{`weight > -1`, true},
+		{`role > 0`, false},
+		{`missing < 1`, false},
+		{`role == "web" and dc == "east"`, true},
+		{`role == "web" and dc == "west"`, false},
+		{`role == "db" or dc == "east"`, true},
+		{`role == "db" or dc == "west"`, false},
+		{`role == "web" and (dc == "west" or not canary)`, true},
+		{`role == "web" and (dc == "west" or canary)`, false},
+		{`role == "db" and dc == "west" or weight == 10`, true},
+		{`role == "db" and (dc == "west" or weight == 10)`, false},
+		{`"not" == keyword`, true},
+		{`  role==web   and(dc==east)  `, true},
+	}
+
+	for _, tc := range cases {
+		expr, err := ParseTagExpr(tc.expr)
+		if err != nil {
+			t.Fatalf("%s: err: %v", tc.expr, err)
+		}
+		if match := expr.Match(tags); match != tc.match {
+			t.Fatalf("%s: expected %v", tc.expr, tc.match)
+		}
+		if expr.String() != tc.expr {
+			t.Fatalf("bad: %s", expr.String())
+		}
+	}
+}
+
+func TestParseTagExpr_Invalid(t *testing.T) {
+	cases := []string{
+		``,
+		`role ==`,
+		`role = web`,
+		`role == "web`,
+		`(role == web`,
+		`role == web)`,
+		`role == web and`,
+		`and role`,
+		`not`,
+		`role =~ "("`,
+		`weight > heavy`,
+		`role == web dc == east`,
+		`role == web; dc`,
+		strings.Repeat("(", 100) + "role" + strings.Repeat(")", 100),
+		strings.Repeat("not ", 100) + "role",
+	}
+
+	for _, expr := range cases {
+		if _, err := ParseTagExpr(expr); err == nil {
+			t.Fatalf("%s: expected error", expr)
+		}
+	}
+}